@@ -0,0 +1,221 @@
+package client
+
+import (
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "sort"
+    "sync"
+)
+
+const CLUSTER_VIRTUAL_NODE_COUNT = 160
+
+type ClusterNode struct {
+    hash uint32
+    host string
+    client *Client
+}
+
+type ClusterClient struct {
+    hosts []string
+    clients map[string]*Client
+    nodes []ClusterNode
+    dbs []*ClusterDatabase
+    empty_client *Client
+    glock *sync.Mutex
+    is_stop bool
+}
+
+func NewClusterClient(hosts []string) *ClusterClient {
+    cluster := &ClusterClient{make([]string, 0), make(map[string]*Client, len(hosts)), make([]ClusterNode, 0),
+        make([]*ClusterDatabase, 256), NewReplsetClient([]string{}), &sync.Mutex{}, false}
+    for _, host := range hosts {
+        cluster.AddClient(host, NewReplsetClient([]string{host}))
+    }
+    return cluster
+}
+
+func (self *ClusterClient) Open() error {
+    defer self.glock.Unlock()
+    self.glock.Lock()
+
+    if len(self.clients) == 0 {
+        return errors.New("Cluster Hosts Empty")
+    }
+
+    for _, host := range self.hosts {
+        err := self.clients[host].Open()
+        if err != nil {
+            return errors.New(fmt.Sprintf("open %s error: %v", host, err))
+        }
+    }
+    return nil
+}
+
+func (self *ClusterClient) Close() error {
+    defer self.glock.Unlock()
+    self.glock.Lock()
+
+    if self.is_stop {
+        return nil
+    }
+
+    for _, host := range self.hosts {
+        err := self.clients[host].Close()
+        if err != nil {
+            return err
+        }
+    }
+    self.is_stop = true
+    return nil
+}
+
+func (self *ClusterClient) AddHost(host string) error {
+    client := NewReplsetClient([]string{host})
+    err := client.Open()
+    if err != nil {
+        return err
+    }
+
+    defer self.glock.Unlock()
+    self.glock.Lock()
+
+    if _, ok := self.clients[host]; ok {
+        client.Close()
+        return errors.New("host is added")
+    }
+    self.AddClient(host, client)
+    return nil
+}
+
+func (self *ClusterClient) AddClient(host string, client *Client) {
+    self.hosts = append(self.hosts, host)
+    self.clients[host] = client
+
+    nodes := make([]ClusterNode, len(self.nodes), len(self.nodes) + CLUSTER_VIRTUAL_NODE_COUNT)
+    copy(nodes, self.nodes)
+    for i := 0; i < CLUSTER_VIRTUAL_NODE_COUNT; i++ {
+        nodes = append(nodes, ClusterNode{crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", host, i))), host, client})
+    }
+
+    sort.Slice(nodes, func(i, j int) bool {
+        if nodes[i].hash == nodes[j].hash {
+            return nodes[i].host < nodes[j].host
+        }
+        return nodes[i].hash < nodes[j].hash
+    })
+    self.nodes = nodes
+}
+
+func (self *ClusterClient) GetNode(lock_key [16]byte) *ClusterNode {
+    self.glock.Lock()
+    nodes := self.nodes
+    self.glock.Unlock()
+    if len(nodes) == 0 {
+        return nil
+    }
+
+    hash := crc32.ChecksumIEEE(lock_key[:])
+    index := sort.Search(len(nodes), func(i int) bool {
+        return nodes[i].hash >= hash
+    })
+    if index >= len(nodes) {
+        index = 0
+    }
+    return &nodes[index]
+}
+
+func (self *ClusterClient) GetClient(lock_key [16]byte) *Client {
+    node := self.GetNode(lock_key)
+    if node == nil {
+        return nil
+    }
+    return node.client
+}
+
+func (self *ClusterClient) SelectDB(db_id uint8) *ClusterDatabase {
+    db := self.dbs[db_id]
+    if db == nil {
+        self.glock.Lock()
+        db = self.dbs[db_id]
+        if db == nil {
+            db = &ClusterDatabase{db_id, self}
+            self.dbs[db_id] = db
+        }
+        self.glock.Unlock()
+    }
+    return db
+}
+
+func (self *ClusterClient) Lock(lock_key [16]byte, timeout uint32, expried uint32) *Lock {
+    return self.SelectDB(0).Lock(lock_key, timeout, expried)
+}
+
+func (self *ClusterClient) Event(event_key [16]byte, timeout uint32, expried uint32) *Event {
+    return self.SelectDB(0).Event(event_key, timeout, expried)
+}
+
+func (self *ClusterClient) CycleEvent(event_key [16]byte, timeout uint32, expried uint32) *CycleEvent {
+    return self.SelectDB(0).CycleEvent(event_key, timeout, expried)
+}
+
+func (self *ClusterClient) Semaphore(semaphore_key [16]byte, timeout uint32, expried uint32, count uint16) *Semaphore {
+    return self.SelectDB(0).Semaphore(semaphore_key, timeout, expried, count)
+}
+
+func (self *ClusterClient) RWLock(lock_key [16]byte, timeout uint32, expried uint32) *RWLock {
+    return self.SelectDB(0).RWLock(lock_key, timeout, expried)
+}
+
+func (self *ClusterClient) RLock(lock_key [16]byte, timeout uint32, expried uint32) *RLock {
+    return self.SelectDB(0).RLock(lock_key, timeout, expried)
+}
+
+type ClusterDatabase struct {
+    db_id uint8
+    cluster *ClusterClient
+}
+
+func (self *ClusterDatabase) GetDatabase(lock_key [16]byte) (*Database, error) {
+    client := self.cluster.GetClient(lock_key)
+    if client == nil {
+        return nil, errors.New("Cluster Hosts Empty")
+    }
+    return client.SelectDB(self.db_id), nil
+}
+
+func (self *ClusterDatabase) SelectDatabase(lock_key [16]byte) *Database {
+    db, err := self.GetDatabase(lock_key)
+    if err != nil {
+        return self.cluster.empty_client.SelectDB(self.db_id)
+    }
+    return db
+}
+
+func (self *ClusterDatabase) Lock(lock_key [16]byte, timeout uint32, expried uint32) *Lock {
+    return self.SelectDatabase(lock_key).Lock(lock_key, timeout, expried)
+}
+
+func (self *ClusterDatabase) Event(event_key [16]byte, timeout uint32, expried uint32) *Event {
+    return self.SelectDatabase(event_key).Event(event_key, timeout, expried)
+}
+
+func (self *ClusterDatabase) CycleEvent(event_key [16]byte, timeout uint32, expried uint32) *CycleEvent {
+    return self.SelectDatabase(event_key).CycleEvent(event_key, timeout, expried)
+}
+
+func (self *ClusterDatabase) Semaphore(semaphore_key [16]byte, timeout uint32, expried uint32, count uint16) *Semaphore {
+    return self.SelectDatabase(semaphore_key).Semaphore(semaphore_key, timeout, expried, count)
+}
+
+func (self *ClusterDatabase) RWLock(lock_key [16]byte, timeout uint32, expried uint32) *RWLock {
+    return self.SelectDatabase(lock_key).RWLock(lock_key, timeout, expried)
+}
+
+func (self *ClusterDatabase) RLock(lock_key [16]byte, timeout uint32, expried uint32) *RLock {
+    return self.SelectDatabase(lock_key).RLock(lock_key, timeout, expried)
+}
+
+func (self *ClusterDatabase) GenLockId() [16]byte {
+    return self.cluster.empty_client.SelectDB(self.db_id).GenLockId()
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestClusterClient_GetNode(t *testing.T) {
+    cluster := NewClusterClient([]string{"127.0.0.1:5658", "127.0.0.1:5659", "127.0.0.1:5660"})
+    lock_keys := make([][16]byte, 10000)
+    hosts := make([]string, len(lock_keys))
+    counts := make(map[string]int, 3)
+    for i := range lock_keys {
+        copy(lock_keys[i][:], fmt.Sprintf("key%d", i))
+        hosts[i] = cluster.GetNode(lock_keys[i]).host
+        counts[hosts[i]]++
+    }
+
+    for _, host := range cluster.hosts {
+        if counts[host] < len(lock_keys) / 6 {
+            t.Errorf("Cluster Node Balance Error %s %d", host, counts[host])
+        }
+    }
+
+    cluster.AddClient("127.0.0.1:5661", NewReplsetClient([]string{"127.0.0.1:5661"}))
+    moved := 0
+    for i := range lock_keys {
+        host := cluster.GetNode(lock_keys[i]).host
+        if host == hosts[i] {
+            continue
+        }
+
+        if host != "127.0.0.1:5661" {
+            t.Errorf("Cluster Node Moved Error %x %s %s", lock_keys[i], hosts[i], host)
+            return
+        }
+        moved++
+    }
+
+    if moved == 0 || moved > len(lock_keys) / 2 {
+        t.Errorf("Cluster Node Rebalance Error %d", moved)
+    }
+}
+
+func TestClusterClient_Empty(t *testing.T) {
+    cluster := NewClusterClient([]string{})
+    lock_key := [16]byte{}
+    copy(lock_key[:], "key")
+    if cluster.GetNode(lock_key) != nil {
+        t.Errorf("Cluster Empty Node Error")
+        return
+    }
+
+    _, err := cluster.SelectDB(0).GetDatabase(lock_key)
+    if err == nil {
+        t.Errorf("Cluster Empty Database Error")
+        return
+    }
+
+    lock := cluster.Lock(lock_key, 0, 5)
+    lerr := lock.Lock()
+    if lerr == nil {
+        t.Errorf("Cluster Empty Lock Error")
+    }
+}
@@ -1,9 +1,12 @@
 package client
 
 import (
+    "context"
     "errors"
+    "fmt"
     "github.com/snower/slock/protocol"
     "math/rand"
+    "strings"
     "sync"
     "sync/atomic"
     "time"
@@ -13,11 +16,14 @@ type Database struct {
     db_id uint8
     client *Client
     requests map[[16]byte]chan protocol.ICommand
+    commands map[[16]byte]protocol.CommandEncode
+    rejects map[[16]byte]bool
     glock *sync.Mutex
 }
 
 func NewDatabase(db_id uint8, client *Client) *Database {
-    return &Database{db_id, client, make(map[[16]byte]chan protocol.ICommand, 4096), &sync.Mutex{}}
+    return &Database{db_id, client, make(map[[16]byte]chan protocol.ICommand, 4096),
+        make(map[[16]byte]protocol.CommandEncode, 4096), make(map[[16]byte]bool, 64), &sync.Mutex{}}
 }
 
 func (self *Database) Close() error {
@@ -29,6 +35,8 @@ func (self *Database) Close() error {
     }
 
     self.requests = make(map[[16]byte]chan protocol.ICommand, 0)
+    self.commands = make(map[[16]byte]protocol.CommandEncode, 0)
+    self.rejects = make(map[[16]byte]bool, 0)
 
     self.client = nil
     return nil
@@ -38,7 +46,41 @@ func (self *Database) HandleLockCommandResult (command *protocol.LockResultComma
     self.glock.Lock()
 
     if request, ok := self.requests[command.RequestId]; ok {
+        if command.Result == protocol.RESULT_STATE_ERROR && self.client.IsReplset() {
+            // the follower rejected it without applying, so it is safe to send again to the new leader
+            self.rejects[command.RequestId] = true
+            self.glock.Unlock()
+            self.client.ChangeLeader(command)
+            return nil
+        }
+
         delete(self.requests, command.RequestId)
+        delete(self.commands, command.RequestId)
+        delete(self.rejects, command.RequestId)
+        self.glock.Unlock()
+
+        request <- command
+        return nil
+    }
+
+    self.glock.Unlock()
+    return nil
+}
+
+func (self *Database) HandleMultiLockCommandResult (command *protocol.MultiLockResultCommand) error {
+    self.glock.Lock()
+
+    if request, ok := self.requests[command.RequestId]; ok {
+        if command.Result == protocol.RESULT_STATE_ERROR && self.client.IsReplset() {
+            self.rejects[command.RequestId] = true
+            self.glock.Unlock()
+            self.client.ChangeLeader(&command.LockResultCommand)
+            return nil
+        }
+
+        delete(self.requests, command.RequestId)
+        delete(self.commands, command.RequestId)
+        delete(self.rejects, command.RequestId)
         self.glock.Unlock()
 
         request <- command
@@ -53,7 +95,17 @@ func (self *Database) HandleUnLockCommandResult (command *protocol.LockResultCom
     self.glock.Lock()
 
     if request, ok := self.requests[command.RequestId]; ok {
+        if command.Result == protocol.RESULT_STATE_ERROR && self.client.IsReplset() {
+            // the follower rejected it without applying, so it is safe to send again to the new leader
+            self.rejects[command.RequestId] = true
+            self.glock.Unlock()
+            self.client.ChangeLeader(command)
+            return nil
+        }
+
         delete(self.requests, command.RequestId)
+        delete(self.commands, command.RequestId)
+        delete(self.rejects, command.RequestId)
         self.glock.Unlock()
 
         request <- command
@@ -69,6 +121,39 @@ func (self *Database) HandleStateCommandResult (command *protocol.StateResultCom
 
     if request, ok := self.requests[command.RequestId]; ok {
         delete(self.requests, command.RequestId)
+        delete(self.commands, command.RequestId)
+        self.glock.Unlock()
+
+        request <- command
+        return nil
+    }
+
+    self.glock.Unlock()
+    return nil
+}
+
+func (self *Database) HandleQueryCommandResult (command *protocol.QueryResultCommand) error {
+    self.glock.Lock()
+
+    if request, ok := self.requests[command.RequestId]; ok {
+        delete(self.requests, command.RequestId)
+        delete(self.commands, command.RequestId)
+        self.glock.Unlock()
+
+        request <- command
+        return nil
+    }
+
+    self.glock.Unlock()
+    return nil
+}
+
+func (self *Database) HandleAdminCommandResult (command *protocol.AdminResultCommand) error {
+    self.glock.Lock()
+
+    if request, ok := self.requests[command.RequestId]; ok {
+        delete(self.requests, command.RequestId)
+        delete(self.commands, command.RequestId)
         self.glock.Unlock()
 
         request <- command
@@ -80,10 +165,26 @@ func (self *Database) HandleStateCommandResult (command *protocol.StateResultCom
 }
 
 func (self *Database) SendLockCommand(command *protocol.LockCommand) (*protocol.LockResultCommand, error) {
-    if self.client.protocol == nil {
+    return self.SendLockCommandContext(context.Background(), command)
+}
+
+func (self *Database) IsSupportedTime(timeout_flag uint16, expried_flag uint16) bool {
+    if timeout_flag & 0x8000 != 0 || expried_flag & 0x80ff != 0 {
+        return self.client.HasCapability(protocol.CAPABILITY_EXTENDED_TIME)
+    }
+    return true
+}
+
+func (self *Database) SendLockCommandContext(ctx context.Context, command *protocol.LockCommand) (*protocol.LockResultCommand, error) {
+    client_protocol := self.client.GetProtocol()
+    if client_protocol == nil {
         return nil, errors.New("client is not opened")
     }
 
+    if !self.IsSupportedTime(command.TimeoutFlag, command.ExpriedFlag) {
+        return nil, errors.New("server not support extended time")
+    }
+
     self.glock.Lock()
     if _, ok := self.requests[command.RequestId]; ok {
         self.glock.Unlock()
@@ -92,13 +193,90 @@ func (self *Database) SendLockCommand(command *protocol.LockCommand) (*protocol.
 
     waiter := make(chan protocol.ICommand, 1)
     self.requests[command.RequestId] = waiter
+    if self.client.IsReplset() {
+        self.commands[command.RequestId] = command
+    }
     self.glock.Unlock()
 
-    err := self.client.protocol.Write(command)
+    err := client_protocol.Write(command)
     if err != nil {
         self.glock.Lock()
         if _, ok := self.requests[command.RequestId]; ok {
             delete(self.requests, command.RequestId)
+            delete(self.commands, command.RequestId)
+        }
+        self.glock.Unlock()
+        return nil, err
+    }
+
+    select {
+    case result_command := <-waiter:
+        if result_command == nil {
+            return nil, errors.New("wait timeout")
+        }
+        return result_command.(*protocol.LockResultCommand), nil
+    case <-ctx.Done():
+        return self.CancelLockCommand(command, waiter, ctx.Err())
+    }
+}
+
+func (self *Database) CancelLockCommand(command *protocol.LockCommand, waiter chan protocol.ICommand, err error) (*protocol.LockResultCommand, error) {
+    if self.client.HasCapability(protocol.CAPABILITY_CANCEL) {
+        cancel_command := &protocol.LockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION, CommandType: protocol.COMMAND_CANCEL, RequestId: self.GetRequestId()},
+            Flag: 0, DbId: command.DbId, LockId: command.RequestId, LockKey: command.LockKey, TimeoutFlag: 0, Timeout: 0,
+            ExpriedFlag: 0, Expried: 0, Count: 0, Rcount: 0, LockName: ""}
+        _, cerr := self.SendCancelCommand(cancel_command)
+        if cerr == nil {
+            result_command := <-waiter
+            if result_command == nil {
+                return nil, err
+            }
+            return result_command.(*protocol.LockResultCommand), err
+        }
+    }
+
+    go self.ReleaseLockCommand(command, waiter)
+    return nil, err
+}
+
+func (self *Database) ReleaseLockCommand(command *protocol.LockCommand, waiter chan protocol.ICommand) {
+    // the lock command can not be canceled, keep waiting its result and unlock when it is still granted
+    result_command := <-waiter
+    if result_command == nil || result_command.(*protocol.LockResultCommand).Result != protocol.RESULT_SUCCED {
+        return
+    }
+
+    unlock_command := &protocol.LockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: command.Version, CommandType: protocol.COMMAND_UNLOCK, RequestId: self.GetRequestId()},
+        Flag: 0, DbId: command.DbId, LockId: command.LockId, LockKey: command.LockKey, TimeoutFlag: command.TimeoutFlag, Timeout: command.Timeout,
+        ExpriedFlag: command.ExpriedFlag, Expried: command.Expried, Count: command.Count, Rcount: 0, LockName: command.LockName}
+    self.SendUnLockCommand(unlock_command)
+}
+
+func (self *Database) SendUnLockCommand(command *protocol.LockCommand) (*protocol.LockResultCommand, error) {
+    client_protocol := self.client.GetProtocol()
+    if client_protocol == nil {
+        return nil, errors.New("client is not opened")
+    }
+
+    self.glock.Lock()
+    if _, ok := self.requests[command.RequestId]; ok {
+        self.glock.Unlock()
+        return nil, errors.New("request is used")
+    }
+
+    waiter := make(chan protocol.ICommand, 1)
+    self.requests[command.RequestId] = waiter
+    if self.client.IsReplset() {
+        self.commands[command.RequestId] = command
+    }
+    self.glock.Unlock()
+
+    err := client_protocol.Write(command)
+    if err != nil {
+        self.glock.Lock()
+        if _, ok := self.requests[command.RequestId]; ok {
+            delete(self.requests, command.RequestId)
+            delete(self.commands, command.RequestId)
         }
         self.glock.Unlock()
         return nil, err
@@ -111,11 +289,61 @@ func (self *Database) SendLockCommand(command *protocol.LockCommand) (*protocol.
     return result_command.(*protocol.LockResultCommand), nil
 }
 
-func (self *Database) SendUnLockCommand(command *protocol.LockCommand) (*protocol.LockResultCommand, error) {
-    if self.client.protocol == nil {
+func (self *Database) SendRenewCommand(command *protocol.LockCommand) (*protocol.LockResultCommand, error) {
+    client_protocol := self.client.GetProtocol()
+    if client_protocol == nil {
+        return nil, errors.New("client is not opened")
+    }
+
+    if !self.client.HasCapability(protocol.CAPABILITY_RENEW) {
+        return nil, errors.New("server not support renew")
+    }
+
+    if !self.IsSupportedTime(command.TimeoutFlag, command.ExpriedFlag) {
+        return nil, errors.New("server not support extended time")
+    }
+
+    self.glock.Lock()
+    if _, ok := self.requests[command.RequestId]; ok {
+        self.glock.Unlock()
+        return nil, errors.New("request is used")
+    }
+
+    waiter := make(chan protocol.ICommand, 1)
+    self.requests[command.RequestId] = waiter
+    if self.client.IsReplset() {
+        self.commands[command.RequestId] = command
+    }
+    self.glock.Unlock()
+
+    err := client_protocol.Write(command)
+    if err != nil {
+        self.glock.Lock()
+        if _, ok := self.requests[command.RequestId]; ok {
+            delete(self.requests, command.RequestId)
+            delete(self.commands, command.RequestId)
+        }
+        self.glock.Unlock()
+        return nil, err
+    }
+
+    result_command := <-waiter
+    if result_command == nil {
+        return nil, errors.New("wait timeout")
+    }
+    return result_command.(*protocol.LockResultCommand), nil
+}
+
+func (self *Database) SendCancelCommand(command *protocol.LockCommand) (*protocol.LockResultCommand, error) {
+    client_protocol := self.client.GetProtocol()
+    if client_protocol == nil {
         return nil, errors.New("client is not opened")
     }
 
+    if !self.client.HasCapability(protocol.CAPABILITY_CANCEL) {
+        return nil, errors.New("server not support cancel")
+    }
+
     self.glock.Lock()
     if _, ok := self.requests[command.RequestId]; ok {
         self.glock.Unlock()
@@ -124,13 +352,17 @@ func (self *Database) SendUnLockCommand(command *protocol.LockCommand) (*protoco
 
     waiter := make(chan protocol.ICommand, 1)
     self.requests[command.RequestId] = waiter
+    if self.client.IsReplset() {
+        self.commands[command.RequestId] = command
+    }
     self.glock.Unlock()
 
-    err := self.client.protocol.Write(command)
+    err := client_protocol.Write(command)
     if err != nil {
         self.glock.Lock()
         if _, ok := self.requests[command.RequestId]; ok {
             delete(self.requests, command.RequestId)
+            delete(self.commands, command.RequestId)
         }
         self.glock.Unlock()
         return nil, err
@@ -143,8 +375,54 @@ func (self *Database) SendUnLockCommand(command *protocol.LockCommand) (*protoco
     return result_command.(*protocol.LockResultCommand), nil
 }
 
+func (self *Database) SendMultiLockCommand(command *protocol.MultiLockCommand) (*protocol.MultiLockResultCommand, error) {
+    client_protocol := self.client.GetProtocol()
+    if client_protocol == nil {
+        return nil, errors.New("client is not opened")
+    }
+
+    if !self.client.HasCapability(protocol.CAPABILITY_MULTI_LOCK) {
+        return nil, errors.New("server not support multi lock")
+    }
+
+    if !self.IsSupportedTime(command.TimeoutFlag, command.ExpriedFlag) {
+        return nil, errors.New("server not support extended time")
+    }
+
+    self.glock.Lock()
+    if _, ok := self.requests[command.RequestId]; ok {
+        self.glock.Unlock()
+        return nil, errors.New("request is used")
+    }
+
+    waiter := make(chan protocol.ICommand, 1)
+    self.requests[command.RequestId] = waiter
+    if self.client.IsReplset() {
+        self.commands[command.RequestId] = command
+    }
+    self.glock.Unlock()
+
+    err := client_protocol.Write(command)
+    if err != nil {
+        self.glock.Lock()
+        if _, ok := self.requests[command.RequestId]; ok {
+            delete(self.requests, command.RequestId)
+            delete(self.commands, command.RequestId)
+        }
+        self.glock.Unlock()
+        return nil, err
+    }
+
+    result_command := <-waiter
+    if result_command == nil {
+        return nil, errors.New("wait timeout")
+    }
+    return result_command.(*protocol.MultiLockResultCommand), nil
+}
+
 func (self *Database) SendStateCommand(command *protocol.StateCommand) (*protocol.StateResultCommand, error) {
-    if self.client.protocol == nil {
+    client_protocol := self.client.GetProtocol()
+    if client_protocol == nil {
         return nil, errors.New("client not opened")
     }
 
@@ -156,13 +434,17 @@ func (self *Database) SendStateCommand(command *protocol.StateCommand) (*protoco
 
     waiter := make(chan protocol.ICommand, 1)
     self.requests[command.RequestId] = waiter
+    if self.client.IsReplset() {
+        self.commands[command.RequestId] = command
+    }
     self.glock.Unlock()
 
-    err := self.client.protocol.Write(command)
+    err := client_protocol.Write(command)
     if err != nil {
         self.glock.Lock()
         if _, ok := self.requests[command.RequestId]; ok {
             delete(self.requests, command.RequestId)
+            delete(self.commands, command.RequestId)
         }
         self.glock.Unlock()
         return nil, err
@@ -175,10 +457,141 @@ func (self *Database) SendStateCommand(command *protocol.StateCommand) (*protoco
     return result_command.(*protocol.StateResultCommand), nil
 }
 
+func (self *Database) SendQueryCommand(command *protocol.LockCommand) (*protocol.QueryResultCommand, error) {
+    client_protocol := self.client.GetProtocol()
+    if client_protocol == nil {
+        return nil, errors.New("client is not opened")
+    }
+
+    if !self.client.HasCapability(protocol.CAPABILITY_QUERY) {
+        return nil, errors.New("server not support query")
+    }
+
+    self.glock.Lock()
+    if _, ok := self.requests[command.RequestId]; ok {
+        self.glock.Unlock()
+        return nil, errors.New("request is used")
+    }
+
+    waiter := make(chan protocol.ICommand, 1)
+    self.requests[command.RequestId] = waiter
+    if self.client.IsReplset() {
+        self.commands[command.RequestId] = command
+    }
+    self.glock.Unlock()
+
+    err := client_protocol.Write(command)
+    if err != nil {
+        self.glock.Lock()
+        if _, ok := self.requests[command.RequestId]; ok {
+            delete(self.requests, command.RequestId)
+            delete(self.commands, command.RequestId)
+        }
+        self.glock.Unlock()
+        return nil, err
+    }
+
+    result_command := <-waiter
+    if result_command == nil {
+        return nil, errors.New("wait timeout")
+    }
+    return result_command.(*protocol.QueryResultCommand), nil
+}
+
+func (self *Database) SendAdminCommand(command *protocol.AdminCommand) (*protocol.AdminResultCommand, error) {
+    client_protocol := self.client.GetProtocol()
+    if client_protocol == nil {
+        return nil, errors.New("client is not opened")
+    }
+
+    if !self.client.HasCapability(protocol.CAPABILITY_ADMIN) {
+        return nil, errors.New("server not support admin command")
+    }
+
+    self.glock.Lock()
+    if _, ok := self.requests[command.RequestId]; ok {
+        self.glock.Unlock()
+        return nil, errors.New("request is used")
+    }
+
+    waiter := make(chan protocol.ICommand, 1)
+    self.requests[command.RequestId] = waiter
+    self.glock.Unlock()
+
+    err := client_protocol.Write(command)
+    if err != nil {
+        self.glock.Lock()
+        if _, ok := self.requests[command.RequestId]; ok {
+            delete(self.requests, command.RequestId)
+        }
+        self.glock.Unlock()
+        return nil, err
+    }
+
+    result_command := <-waiter
+    if result_command == nil {
+        return nil, errors.New("wait timeout")
+    }
+    return result_command.(*protocol.AdminResultCommand), nil
+}
+
+func (self *Database) ResendCommands(client_protocol ClientProtocol) error {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+
+    for request_id, command := range self.commands {
+        if _, ok := self.rejects[request_id]; ok || self.IsReadonlyCommand(command) {
+            err := client_protocol.Write(command)
+            if err != nil {
+                return err
+            }
+            delete(self.rejects, request_id)
+            continue
+        }
+
+        // the lost connection may have applied it, resending a lock or unlock could apply it twice,
+        // fail it with RESULT_STATE_ERROR and let the caller retry it on the new leader
+        if request, ok := self.requests[request_id]; ok {
+            request <- self.NewStateErrorResult(command)
+            delete(self.requests, request_id)
+        }
+        delete(self.commands, request_id)
+    }
+    return nil
+}
+
+func (self *Database) IsReadonlyCommand(command protocol.CommandEncode) bool {
+    switch command.(type) {
+    case *protocol.StateCommand:
+        return true
+    case *protocol.LockCommand:
+        return command.(*protocol.LockCommand).CommandType == protocol.COMMAND_QUERY
+    }
+    return false
+}
+
+func (self *Database) NewStateErrorResult(command protocol.CommandEncode) protocol.ICommand {
+    switch command.(type) {
+    case *protocol.LockCommand:
+        return protocol.NewLockResultCommand(command.(*protocol.LockCommand), protocol.RESULT_STATE_ERROR, 0, 0, 0, 0, 0)
+    case *protocol.MultiLockCommand:
+        return protocol.NewMultiLockResultCommand(command.(*protocol.MultiLockCommand), protocol.RESULT_STATE_ERROR, [16]byte{}, 0, nil)
+    }
+    return nil
+}
+
 func (self *Database) Lock(lock_key [16]byte, timeout uint32, expried uint32) *Lock {
     return NewLock(self, lock_key, timeout, expried, 0, 0)
 }
 
+func (self *Database) NamedLock(lock_name string, timeout uint32, expried uint32) *Lock {
+    return NewNamedLock(self, lock_name, timeout, expried, 0, 0)
+}
+
+func (self *Database) MultiLock(lock_keys [][16]byte, timeout uint32, expried uint32) *MultiLock {
+    return NewMultiLock(self, lock_keys, timeout, expried)
+}
+
 func (self *Database) Event(event_key [16]byte, timeout uint32, expried uint32) *Event {
     return NewEvent(self, event_key, timeout, expried)
 }
@@ -210,6 +623,101 @@ func (self *Database) State() *protocol.StateResultCommand {
     return result_command
 }
 
+func (self *Database) Inspect(lock_key [16]byte) (*protocol.QueryResultCommand, error) {
+    command := &protocol.LockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION, CommandType: protocol.COMMAND_QUERY, RequestId: self.GetRequestId()},
+        Flag: 0, DbId: self.db_id, LockId: [16]byte{}, LockKey: lock_key, TimeoutFlag: 0, Timeout: 0,
+        ExpriedFlag: 0, Expried: 0, Count: 0, Rcount: 0, LockName: ""}
+    return self.SendQueryCommand(command)
+}
+
+func (self *Database) Admin(admin_type uint8, args []string) ([]string, error) {
+    command := &protocol.AdminCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION, CommandType: protocol.COMMAND_ADMIN, RequestId: self.GetRequestId()},
+        AdminType: admin_type, DbId: self.db_id, ArgCount: uint8(len(args)), Blank: [42]byte{}, Args: args}
+    result_command, err := self.SendAdminCommand(command)
+    if err != nil {
+        return nil, err
+    }
+
+    if result_command.Result != protocol.RESULT_SUCCED {
+        if len(result_command.Values) > 0 {
+            return nil, errors.New(fmt.Sprintf("admin command error: %s", result_command.Values[0]))
+        }
+        return nil, errors.New(fmt.Sprintf("admin command error: %d", result_command.Result))
+    }
+    return result_command.Values, nil
+}
+
+func (self *Database) Info() (map[string]string, error) {
+    values, err := self.Admin(protocol.ADMIN_COMMAND_INFO, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    infos := make(map[string]string, len(values) / 2)
+    for i := 0; i + 1 < len(values); i += 2 {
+        infos[values[i]] = values[i + 1]
+    }
+    return infos, nil
+}
+
+func (self *Database) ConfigGet(name string) (map[string]string, error) {
+    args := []string{}
+    if name != "" {
+        args = append(args, name)
+    }
+
+    values, err := self.Admin(protocol.ADMIN_COMMAND_CONFIG_GET, args)
+    if err != nil {
+        return nil, err
+    }
+
+    configs := make(map[string]string, len(values) / 2)
+    for i := 0; i + 1 < len(values); i += 2 {
+        configs[values[i]] = values[i + 1]
+    }
+    return configs, nil
+}
+
+func (self *Database) ConfigSet(name string, value string) error {
+    _, err := self.Admin(protocol.ADMIN_COMMAND_CONFIG_SET, []string{name, value})
+    return err
+}
+
+func (self *Database) ClientList() ([]map[string]string, error) {
+    values, err := self.Admin(protocol.ADMIN_COMMAND_CLIENT_LIST, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    clients := make([]map[string]string, 0, len(values))
+    for _, value := range values {
+        client_info := make(map[string]string)
+        for _, field := range strings.Fields(value) {
+            index := strings.Index(field, "=")
+            if index > 0 {
+                client_info[field[:index]] = field[index + 1:]
+            }
+        }
+        clients = append(clients, client_info)
+    }
+    return clients, nil
+}
+
+func (self *Database) ClientKill(addr string) error {
+    _, err := self.Admin(protocol.ADMIN_COMMAND_CLIENT_KILL, []string{addr})
+    return err
+}
+
+func (self *Database) FlushDB() error {
+    _, err := self.Admin(protocol.ADMIN_COMMAND_FLUSHDB, nil)
+    return err
+}
+
+func (self *Database) RewriteAof() error {
+    _, err := self.Admin(protocol.ADMIN_COMMAND_REWRITEAOF, nil)
+    return err
+}
+
 func (self *Database) GetRequestId() [16]byte {
     now := uint32(time.Now().Unix())
     request_id_index := atomic.AddUint64(&request_id_index, 1)
@@ -1 +1,226 @@
 package client
+
+import (
+    "context"
+    "errors"
+    "github.com/snower/slock/protocol"
+    "net"
+    "testing"
+    "time"
+)
+
+type testCancelProtocol struct {
+    commands chan *protocol.LockCommand
+}
+
+func (self *testCancelProtocol) Close() error {
+    return nil
+}
+
+func (self *testCancelProtocol) Read() (protocol.CommandDecode, error) {
+    return nil, nil
+}
+
+func (self *testCancelProtocol) Write(command protocol.CommandEncode) error {
+    lock_command := command.(*protocol.LockCommand)
+    self.commands <- lock_command
+    if lock_command.CommandType == protocol.COMMAND_CANCEL {
+        return errors.New("write error")
+    }
+    return nil
+}
+
+func (self *testCancelProtocol) RemoteAddr() net.Addr {
+    return nil
+}
+
+func TestDatabase_CancelLockCommand(t *testing.T) {
+    for _, capabilities := range []uint32{0, protocol.CAPABILITY_CANCEL} {
+        client := NewReplsetClient([]string{"127.0.0.1:5658"})
+        client_protocol := &testCancelProtocol{make(chan *protocol.LockCommand, 4)}
+        client.protocol = client_protocol
+        client.server_capabilities = capabilities
+        db := client.SelectDB(0)
+
+        lock_key := [16]byte{}
+        copy(lock_key[:], "cancel_lock")
+        lock := db.Lock(lock_key, 5, 10)
+        ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+        start_time := time.Now()
+        err := lock.LockContext(ctx)
+        cancel()
+        if err == nil || err.Result != protocol.RESULT_CANCELED || time.Since(start_time) > time.Second {
+            t.Errorf("Database CancelLockCommand Lock Error %d %v %v", capabilities, err, time.Since(start_time))
+            return
+        }
+
+        lock_command := <- client_protocol.commands
+        if capabilities & protocol.CAPABILITY_CANCEL != 0 {
+            cancel_command := <- client_protocol.commands
+            if cancel_command.CommandType != protocol.COMMAND_CANCEL || cancel_command.LockId != lock_command.RequestId {
+                t.Errorf("Database CancelLockCommand Cancel Error %d", capabilities)
+                return
+            }
+        }
+
+        db.HandleLockCommandResult(protocol.NewLockResultCommand(lock_command, protocol.RESULT_SUCCED, 0, 0, 0, 0, 0))
+        select {
+        case unlock_command := <- client_protocol.commands:
+            if unlock_command.CommandType != protocol.COMMAND_UNLOCK || unlock_command.LockId != lock_command.LockId {
+                t.Errorf("Database CancelLockCommand Unlock Error %d %d", capabilities, unlock_command.CommandType)
+                return
+            }
+            db.HandleUnLockCommandResult(protocol.NewLockResultCommand(unlock_command, protocol.RESULT_SUCCED, 0, 0, 0, 0, 0))
+        case <- time.After(time.Second):
+            t.Errorf("Database CancelLockCommand Release Timeout %d", capabilities)
+            return
+        }
+    }
+}
+
+type testResendProtocol struct {
+    commands chan protocol.CommandEncode
+    err error
+}
+
+func (self *testResendProtocol) Close() error {
+    return nil
+}
+
+func (self *testResendProtocol) Read() (protocol.CommandDecode, error) {
+    return nil, nil
+}
+
+func (self *testResendProtocol) Write(command protocol.CommandEncode) error {
+    if self.err != nil {
+        return self.err
+    }
+    self.commands <- command
+    return nil
+}
+
+func (self *testResendProtocol) RemoteAddr() net.Addr {
+    return nil
+}
+
+func TestDatabase_ResendCommands(t *testing.T) {
+    client := NewReplsetClient([]string{"127.0.0.1:5658", "127.0.0.1:5659"})
+    client_protocol := &testResendProtocol{make(chan protocol.CommandEncode, 8), nil}
+    client.protocol = client_protocol
+    db := client.SelectDB(0)
+
+    lost_key, reject_key := [16]byte{}, [16]byte{}
+    copy(lost_key[:], "resend_lost")
+    copy(reject_key[:], "resend_reject")
+    lost_lock, reject_lock := db.Lock(lost_key, 5, 10), db.Lock(reject_key, 5, 10)
+    lost_result, reject_result := make(chan *LockError, 1), make(chan *LockError, 1)
+    go func() {
+        lost_result <- lost_lock.Lock()
+    }()
+    lost_command := (<- client_protocol.commands).(*protocol.LockCommand)
+    go func() {
+        reject_result <- reject_lock.Lock()
+    }()
+    reject_command := (<- client_protocol.commands).(*protocol.LockCommand)
+    state_result := make(chan *protocol.StateResultCommand, 1)
+    go func() {
+        state_result <- db.State()
+    }()
+    state_command := (<- client_protocol.commands).(*protocol.StateCommand)
+
+    db.HandleLockCommandResult(protocol.NewLockResultCommand(reject_command, protocol.RESULT_STATE_ERROR, 0, 0, 0, 0, 0))
+    if !client.leader_changed || client.host_index != 1 {
+        t.Errorf("Database ResendCommands Change Leader Error %v %d", client.leader_changed, client.host_index)
+        return
+    }
+
+    resend_protocol := &testResendProtocol{make(chan protocol.CommandEncode, 8), nil}
+    err := db.ResendCommands(resend_protocol)
+    if err != nil {
+        t.Errorf("Database ResendCommands Error %v", err)
+        return
+    }
+
+    select {
+    case lerr := <- lost_result:
+        if lerr == nil || lerr.Result != protocol.RESULT_STATE_ERROR {
+            t.Errorf("Database ResendCommands Lost Lock Result Error %v", lerr)
+            return
+        }
+    case <- time.After(time.Second):
+        t.Errorf("Database ResendCommands Lost Lock Timeout")
+        return
+    }
+
+    resend_count := len(resend_protocol.commands)
+    for i := 0; i < resend_count; i++ {
+        switch command := (<- resend_protocol.commands).(type) {
+        case *protocol.LockCommand:
+            if command.RequestId != reject_command.RequestId || command.RequestId == lost_command.RequestId {
+                t.Errorf("Database ResendCommands Resend Lock Error %v", command.LockKey)
+                return
+            }
+            db.HandleLockCommandResult(protocol.NewLockResultCommand(command, protocol.RESULT_SUCCED, 0, 0, 0, 0, 0))
+        case *protocol.StateCommand:
+            if command.RequestId != state_command.RequestId {
+                t.Errorf("Database ResendCommands Resend State Error")
+                return
+            }
+            db.HandleStateCommandResult(&protocol.StateResultCommand{ResultCommand: protocol.ResultCommand{Magic: protocol.MAGIC, Version: protocol.VERSION,
+                CommandType: protocol.COMMAND_STATE, RequestId: command.RequestId, Result: protocol.RESULT_SUCCED}, DbId: 0})
+        }
+    }
+    if resend_count != 2 {
+        t.Errorf("Database ResendCommands Resend Count Error %d", resend_count)
+        return
+    }
+
+    lerr := <- reject_result
+    if lerr != nil {
+        t.Errorf("Database ResendCommands Reject Lock Result Error %v", lerr)
+        return
+    }
+    state := <- state_result
+    if state == nil || state.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Database ResendCommands State Result Error %v", state)
+        return
+    }
+
+    if len(db.requests) != 0 || len(db.commands) != 0 || len(db.rejects) != 0 {
+        t.Errorf("Database ResendCommands Pending Error %d %d %d", len(db.requests), len(db.commands), len(db.rejects))
+    }
+}
+
+func TestDatabase_WriteError(t *testing.T) {
+    client := NewReplsetClient([]string{"127.0.0.1:5658", "127.0.0.1:5659"})
+    client.protocol = &testResendProtocol{make(chan protocol.CommandEncode, 8), errors.New("write error")}
+    db := client.SelectDB(0)
+
+    lock_key := [16]byte{}
+    copy(lock_key[:], "write_error")
+    lerr := db.Lock(lock_key, 5, 10).Lock()
+    if lerr == nil || lerr.Result != protocol.RESULT_ERROR {
+        t.Errorf("Database WriteError Lock Error %v", lerr)
+        return
+    }
+
+    if len(db.requests) != 0 || len(db.commands) != 0 {
+        t.Errorf("Database WriteError Pending Error %d %d", len(db.requests), len(db.commands))
+    }
+}
+
+func TestClient_ChangeLeader(t *testing.T) {
+    client := NewReplsetClient([]string{"127.0.0.1:5658", "localhost:5659", "127.0.0.1:5660"})
+    result_command := &protocol.LockResultCommand{Lcount: 5659, Blank: [4]byte{127, 0, 0, 1}}
+    client.ChangeLeader(result_command)
+    if client.host_index != 1 {
+        t.Errorf("Client ChangeLeader Resolve Host Error %d", client.host_index)
+    }
+
+    client.leader_changed = false
+    result_command = &protocol.LockResultCommand{Lcount: 5661, Blank: [4]byte{127, 0, 0, 1}}
+    client.ChangeLeader(result_command)
+    if client.host_index != 2 {
+        t.Errorf("Client ChangeLeader Next Host Error %d", client.host_index)
+    }
+}
@@ -25,7 +25,7 @@ func (self *Event) Clear() error{
     self.glock.Lock()
 
     if self.event_lock == nil {
-        self.event_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, self.timeout, self.expried, 0, 0}
+        self.event_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, self.timeout, self.expried, 0, 0, "", 0, false, nil, &sync.Mutex{}}
     }
     err := self.event_lock.Lock()
     if err != nil && err.Result != protocol.RESULT_LOCKED_ERROR {
@@ -40,7 +40,7 @@ func (self *Event) Set() error{
     self.glock.Lock()
 
     if self.event_lock == nil {
-        self.event_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, self.timeout, self.expried, 0, 0}
+        self.event_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, self.timeout, self.expried, 0, 0, "", 0, false, nil, &sync.Mutex{}}
     }
     err := self.event_lock.Unlock()
     if err != nil && err.Result != protocol.RESULT_UNLOCK_ERROR {
@@ -54,14 +54,24 @@ func (self *Event) IsSet() (bool, error){
     defer self.glock.Unlock()
     self.glock.Lock()
 
-    self.check_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, 0, 0, 0, 0}
+    if self.db.client != nil && self.db.client.HasCapability(protocol.CAPABILITY_QUERY) {
+        result_command, err := self.db.Inspect(self.event_key)
+        if err != nil {
+            return false, err
+        }
+        return result_command.Lcount == 0, nil
+    }
 
-    err := self.check_lock.Lock()
+    self.check_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, 0, 0, 0, 0, "", 0, false, nil, &sync.Mutex{}}
 
-    if err != nil && err.Result != protocol.RESULT_TIMEOUT {
+    err := self.check_lock.Lock()
+    if err == nil {
         return true, nil
     }
 
+    if err.Result == protocol.RESULT_TIMEOUT || err.Result == protocol.RESULT_LOCKED_ERROR {
+        return false, nil
+    }
     return false, err
 }
 
@@ -69,7 +79,7 @@ func (self *Event) Wait(timeout uint32) (bool, error) {
     defer self.glock.Unlock()
     self.glock.Lock()
 
-    self.wait_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, timeout, 0, 0, 0}
+    self.wait_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, timeout, 0, 0, 0, "", 0, false, nil, &sync.Mutex{}}
 
     err := self.wait_lock.Lock()
 
@@ -92,7 +102,7 @@ func (self *CycleEvent) Wait(timeout uint32) (bool, error) {
     defer self.glock.Unlock()
     self.glock.Lock()
 
-    self.wait_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, timeout, 0, 0, 0}
+    self.wait_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, timeout, 0, 0, 0, "", 0, false, nil, &sync.Mutex{}}
 
     err := self.wait_lock.Lock()
 
@@ -102,7 +112,7 @@ func (self *CycleEvent) Wait(timeout uint32) (bool, error) {
 
     if err.Result != protocol.RESULT_TIMEOUT {
         if self.event_lock == nil {
-            self.event_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, self.timeout, self.expried, 0, 0}
+            self.event_lock = &Lock{self.db, self.db.GetRequestId(), self.event_key, self.event_key, self.timeout, self.expried, 0, 0, "", 0, false, nil, &sync.Mutex{}}
         }
         _, err := self.event_lock.DoLock(0x02)
         if err != nil && err.Result != protocol.RESULT_LOCKED_ERROR {
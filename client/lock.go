@@ -1,9 +1,12 @@
 package client
 
 import (
+    "context"
     "errors"
     "fmt"
     "github.com/snower/slock/protocol"
+    "sync"
+    "time"
 )
 
 type LockError struct {
@@ -16,6 +19,27 @@ func (self LockError) Error() string {
     return fmt.Sprintf("%d %s", self.Result, self.Err.Error())
 }
 
+func TimeoutMinutes(minutes uint16) uint32 {
+    return 0x80000000 | uint32(minutes)
+}
+
+func ExpriedDeadline(deadline time.Time) uint32 {
+    return 0x80000000 | uint32(deadline.Unix()) & protocol.MAX_EXPRIED_TIME
+}
+
+func GetExpriedTime(expried uint32, now time.Time) time.Duration {
+    command := &protocol.LockCommand{}
+    command.Expried, command.ExpriedFlag = protocol.ResolveExpriedDeadline(uint16(expried), uint16(expried >> 16), now.Unix())
+    if command.ExpriedFlag & 0x4000 != 0 {
+        return time.Duration(1 << 62)
+    }
+
+    if command.ExpriedFlag & 0x0400 != 0 {
+        return time.Duration(command.GetExpried()) * time.Millisecond
+    }
+    return time.Duration(command.GetExpried()) * time.Second
+}
+
 type Lock struct {
     db *Database
     request_id [16]byte
@@ -25,32 +49,74 @@ type Lock struct {
     expried uint32
     count uint16
     rcount uint8
+    lock_name string
+    fencing_token uint64
+    auto_renew bool
+    renew_waiter chan bool
+    glock *sync.Mutex
 }
 
 func NewLock(db *Database, lock_key [16]byte, timeout uint32, expried uint32, count uint16, rcount uint8) *Lock {
-    return &Lock{db, [16]byte{}, db.GenLockId(), lock_key, timeout, expried, count, rcount}
+    return &Lock{db, [16]byte{}, db.GenLockId(), lock_key, timeout, expried, count, rcount, "", 0, false, nil, &sync.Mutex{}}
+}
+
+func NewNamedLock(db *Database, lock_name string, timeout uint32, expried uint32, count uint16, rcount uint8) *Lock {
+    lock_key := [16]byte{}
+    protocol.LockNameToKey(lock_name, &lock_key)
+    return &Lock{db, [16]byte{}, db.GenLockId(), lock_key, timeout, expried, count, rcount, lock_name, 0, false, nil, &sync.Mutex{}}
+}
+
+func (self *Lock) GetVersion() uint8 {
+    if self.db.client == nil {
+        return protocol.VERSION
+    }
+
+    if self.lock_name != "" && self.db.client.HasCapability(protocol.CAPABILITY_LOCK_NAME) {
+        return protocol.VERSION2
+    }
+
+    if self.db.client.HasCapability(protocol.CAPABILITY_FENCING_TOKEN) {
+        return protocol.VERSION2
+    }
+    return protocol.VERSION
+}
+
+func (self *Lock) GetFencingToken() uint64 {
+    return self.fencing_token
 }
 
 func (self *Lock) DoLock(flag uint8) (*protocol.LockResultCommand, *LockError){
+    return self.DoLockContext(context.Background(), flag)
+}
+
+func (self *Lock) DoLockContext(ctx context.Context, flag uint8) (*protocol.LockResultCommand, *LockError){
     self.request_id = self.db.GetRequestId()
-    command := &protocol.LockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION, CommandType: protocol.COMMAND_LOCK, RequestId: self.request_id},
+    command := &protocol.LockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: self.GetVersion(), CommandType: protocol.COMMAND_LOCK, RequestId: self.request_id},
         Flag: flag, DbId: self.db.db_id, LockId: self.lock_id, LockKey: self.lock_key, TimeoutFlag: uint16(self.timeout >> 16), Timeout: uint16(self.timeout),
-        ExpriedFlag: uint16(self.expried >> 16), Expried: uint16(self.expried), Count: self.count, Rcount: 0}
-    result_command, err := self.db.SendLockCommand(command)
+        ExpriedFlag: uint16(self.expried >> 16), Expried: uint16(self.expried), Count: self.count, Rcount: 0, LockName: self.lock_name}
+    result_command, err := self.db.SendLockCommandContext(ctx, command)
     if err != nil {
-        return result_command, &LockError{protocol.RESULT_ERROR, result_command, err}
+        if err != ctx.Err() {
+            return result_command, &LockError{protocol.RESULT_ERROR, result_command, err}
+        }
+
+        if result_command != nil && result_command.Result == protocol.RESULT_SUCCED {
+            self.DoUnlock(0)
+        }
+        return result_command, &LockError{protocol.RESULT_CANCELED, result_command, err}
     }
     if result_command.Result != protocol.RESULT_SUCCED {
         return result_command, &LockError{result_command.Result, result_command, errors.New("lock error")}
     }
+    self.fencing_token = result_command.Token
     return result_command, nil
 }
 
 func (self *Lock) DoUnlock(flag uint8) (*protocol.LockResultCommand, *LockError){
     self.request_id = self.db.GetRequestId()
-    command := &protocol.LockCommand{Command: protocol.Command{ Magic: protocol.MAGIC, Version: protocol.VERSION, CommandType: protocol.COMMAND_UNLOCK, RequestId: self.request_id},
+    command := &protocol.LockCommand{Command: protocol.Command{ Magic: protocol.MAGIC, Version: self.GetVersion(), CommandType: protocol.COMMAND_UNLOCK, RequestId: self.request_id},
         Flag: flag, DbId: self.db.db_id, LockId: self.lock_id, LockKey: self.lock_key, TimeoutFlag: uint16(self.timeout >> 16), Timeout: uint16(self.timeout),
-        ExpriedFlag: uint16(self.expried >> 16), Expried: uint16(self.expried), Count: self.count, Rcount: 0}
+        ExpriedFlag: uint16(self.expried >> 16), Expried: uint16(self.expried), Count: self.count, Rcount: 0, LockName: self.lock_name}
     result_command, err := self.db.SendUnLockCommand(command)
     if err != nil {
         return result_command, &LockError{protocol.RESULT_ERROR, result_command, err}
@@ -61,12 +127,115 @@ func (self *Lock) DoUnlock(flag uint8) (*protocol.LockResultCommand, *LockError)
     return result_command, nil
 }
 
+func (self *Lock) DoRenew(expried uint32) (*protocol.LockResultCommand, *LockError){
+    command := &protocol.LockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: self.GetVersion(), CommandType: protocol.COMMAND_RENEW, RequestId: self.db.GetRequestId()},
+        Flag: 0, DbId: self.db.db_id, LockId: self.lock_id, LockKey: self.lock_key, TimeoutFlag: 0, Timeout: 0,
+        ExpriedFlag: uint16(expried >> 16), Expried: uint16(expried), Count: 0, Rcount: 0, LockName: self.lock_name}
+    result_command, err := self.db.SendRenewCommand(command)
+    if err != nil {
+        return result_command, &LockError{protocol.RESULT_ERROR, result_command, err}
+    }
+    if result_command.Result != protocol.RESULT_SUCCED {
+        return result_command, &LockError{result_command.Result, result_command, errors.New("renew error")}
+    }
+    return result_command, nil
+}
+
 func (self *Lock) Lock() *LockError{
     _, err := self.DoLock(0)
+    if err == nil && self.auto_renew {
+        self.StartRenew()
+    }
+    return err
+}
+
+func (self *Lock) LockContext(ctx context.Context) *LockError{
+    _, err := self.DoLockContext(ctx, 0)
+    if err == nil && self.auto_renew {
+        self.StartRenew()
+    }
     return err
 }
 
 func (self *Lock) Unlock() *LockError{
+    self.StopRenew()
     _, err := self.DoUnlock(0)
     return err
+}
+
+func (self *Lock) Renew() *LockError{
+    _, err := self.DoRenew(0)
+    return err
+}
+
+func (self *Lock) SetAutoRenew(auto_renew bool) {
+    self.auto_renew = auto_renew
+}
+
+func (self *Lock) SetPriority(priority uint8) {
+    self.timeout = self.timeout & 0xff00ffff | uint32(priority) << 16
+}
+
+func (self *Lock) StartRenew() bool {
+    // unlimited and deadline locks need no renew, millisecond locks are answered with RESULT_NOT_SUPPORTED
+    if uint16(self.expried >> 16) & 0xc400 != 0 {
+        self.StopRenew()
+        return false
+    }
+
+    interval := GetExpriedTime(self.expried, time.Now()) / 3
+    if interval <= 0 {
+        self.StopRenew()
+        return false
+    }
+
+    self.glock.Lock()
+    if self.renew_waiter != nil {
+        close(self.renew_waiter)
+    }
+    self.renew_waiter = make(chan bool, 1)
+    go self.RenewLoop(self.renew_waiter, interval)
+    self.glock.Unlock()
+    return true
+}
+
+func (self *Lock) StopRenew() {
+    self.glock.Lock()
+    if self.renew_waiter != nil {
+        close(self.renew_waiter)
+        self.renew_waiter = nil
+    }
+    self.glock.Unlock()
+}
+
+func (self *Lock) IsRenewing() bool {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+    return self.renew_waiter != nil
+}
+
+func (self *Lock) RenewLoop(renew_waiter chan bool, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <- renew_waiter:
+            return
+        case <- ticker.C:
+            if self.db.client != nil {
+                _, err := self.DoRenew(0)
+                if err == nil {
+                    continue
+                }
+            }
+
+            self.glock.Lock()
+            if self.renew_waiter == renew_waiter {
+                self.renew_waiter = nil
+            }
+            self.glock.Unlock()
+            return
+        }
+    }
 }
\ No newline at end of file
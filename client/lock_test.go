@@ -1 +1,199 @@
 package client
+
+import (
+    "github.com/snower/slock/protocol"
+    "github.com/snower/slock/server"
+    "io/ioutil"
+    "net"
+    "os"
+    "testing"
+    "time"
+)
+
+func startTestLockServer(t *testing.T) (*server.Server, *Client, string) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("Lock Test Listen Error %v", err)
+    }
+    port := listener.Addr().(*net.TCPAddr).Port
+    listener.Close()
+
+    data_dir, err := ioutil.TempDir("", "slock_lock_test")
+    if err != nil {
+        t.Fatalf("Lock Test Create Data Dir Error %v", err)
+    }
+
+    config := &server.ServerConfig{Bind: "127.0.0.1", Port: uint(port), Log: "-", LogLevel: "ERROR", DataDir: data_dir,
+        DBFastKeyCount: 4096, DBConcurrentLock: 8, DBLockAofTime: 0, AofQueueSize: 4096, AofFsync: "no",
+        AofPersistence: "none", AofFileRewriteSize: 67174400, AofFileBufferSize: 4096}
+    slock := server.NewSLock(config)
+    slock_server := server.NewServer(slock)
+    err = slock_server.Listen()
+    if err != nil {
+        os.RemoveAll(data_dir)
+        t.Fatalf("Lock Test Server Listen Error %v", err)
+    }
+
+    err = slock.Init()
+    if err != nil {
+        os.RemoveAll(data_dir)
+        t.Fatalf("Lock Test SLock Init Error %v", err)
+    }
+    go slock_server.Loop()
+
+    client := NewClient("127.0.0.1", uint(port))
+    err = client.Open()
+    if err != nil {
+        slock_server.Close()
+        os.RemoveAll(data_dir)
+        t.Fatalf("Lock Test Client Open Error %v", err)
+    }
+    return slock_server, client, data_dir
+}
+
+func stopTestLockServer(slock_server *server.Server, client *Client, data_dir string) {
+    client.Close()
+    slock_server.Close()
+    os.RemoveAll(data_dir)
+}
+
+func newTestLockKey(name string) [16]byte {
+    lock_key := [16]byte{}
+    copy(lock_key[:], name)
+    return lock_key
+}
+
+func isTestLockHeld(client *Client, lock_key [16]byte) bool {
+    check_lock := client.Lock(lock_key, 0, 60)
+    err := check_lock.Lock()
+    if err == nil {
+        check_lock.Unlock()
+        return false
+    }
+    return true
+}
+
+func TestLock_Renew(t *testing.T) {
+    slock_server, client, data_dir := startTestLockServer(t)
+    defer stopTestLockServer(slock_server, client, data_dir)
+
+    lock_key := newTestLockKey("lock_renew")
+    lock := client.Lock(lock_key, 0, 2)
+    err := lock.Lock()
+    if err != nil {
+        t.Errorf("Lock Renew Lock Error %v", err)
+        return
+    }
+
+    time.Sleep(1500 * time.Millisecond)
+    result_command, err := lock.DoRenew(0)
+    if err != nil || result_command.Token != lock.GetFencingToken() {
+        t.Errorf("Lock Renew Renew Error %v", err)
+        return
+    }
+
+    time.Sleep(1500 * time.Millisecond)
+    if !isTestLockHeld(client, lock_key) {
+        t.Errorf("Lock Renew Expried Error")
+        return
+    }
+
+    _, err = lock.DoRenew(1)
+    if err != nil {
+        t.Errorf("Lock Renew Renew Expried Error %v", err)
+        return
+    }
+
+    time.Sleep(3 * time.Second)
+    if isTestLockHeld(client, lock_key) {
+        t.Errorf("Lock Renew Not Expried Error")
+        return
+    }
+
+    err = lock.Renew()
+    if err == nil || err.Result != protocol.RESULT_UNLOCK_ERROR {
+        t.Errorf("Lock Renew Not Held Error %v", err)
+        return
+    }
+
+    err = lock.Lock()
+    if err != nil {
+        t.Errorf("Lock Renew Relock Error %v", err)
+        return
+    }
+
+    other_lock := client.Lock(lock_key, 0, 2)
+    err = other_lock.Renew()
+    if err == nil || err.Result != protocol.RESULT_UNOWN_ERROR {
+        t.Errorf("Lock Renew Other Lock Error %v", err)
+        return
+    }
+    lock.Unlock()
+
+    ms_lock := client.Lock(newTestLockKey("lock_renew_ms"), 0, 0x04000000 | 5000)
+    err = ms_lock.Lock()
+    if err != nil {
+        t.Errorf("Lock Renew Millisecond Lock Error %v", err)
+        return
+    }
+
+    err = ms_lock.Renew()
+    if err == nil || err.Result != protocol.RESULT_NOT_SUPPORTED {
+        t.Errorf("Lock Renew Millisecond Error %v", err)
+        return
+    }
+
+    if ms_lock.StartRenew() || ms_lock.IsRenewing() {
+        t.Errorf("Lock Renew Millisecond StartRenew Error")
+        return
+    }
+    ms_lock.Unlock()
+}
+
+func TestLock_AutoRenew(t *testing.T) {
+    slock_server, client, data_dir := startTestLockServer(t)
+    defer stopTestLockServer(slock_server, client, data_dir)
+
+    lock_key := newTestLockKey("lock_auto_renew")
+    lock := client.Lock(lock_key, 0, 2)
+    lock.SetAutoRenew(true)
+    err := lock.Lock()
+    if err != nil || !lock.IsRenewing() {
+        t.Errorf("Lock AutoRenew Lock Error %v", err)
+        return
+    }
+
+    time.Sleep(4 * time.Second)
+    if !isTestLockHeld(client, lock_key) {
+        t.Errorf("Lock AutoRenew Expried Error")
+        return
+    }
+
+    err = lock.Unlock()
+    if err != nil || lock.IsRenewing() {
+        t.Errorf("Lock AutoRenew Unlock Error %v", err)
+        return
+    }
+
+    err = lock.Lock()
+    if err != nil || !lock.IsRenewing() {
+        t.Errorf("Lock AutoRenew Relock Error %v", err)
+        return
+    }
+
+    // the watchdog stops by itself once a renew fails
+    unlock := client.Lock(lock_key, 0, 2)
+    unlock.lock_id = lock.lock_id
+    err = unlock.Unlock()
+    if err != nil {
+        t.Errorf("Lock AutoRenew Other Unlock Error %v", err)
+        return
+    }
+
+    time.Sleep(1500 * time.Millisecond)
+    if lock.IsRenewing() || isTestLockHeld(client, lock_key) {
+        t.Errorf("Lock AutoRenew Stop Error")
+        return
+    }
+    lock.StopRenew()
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+    "errors"
+    "github.com/snower/slock/protocol"
+)
+
+type MultiLock struct {
+    db *Database
+    request_id [16]byte
+    lock_id [16]byte
+    lock_keys [][16]byte
+    timeout uint32
+    expried uint32
+    fencing_tokens []uint64
+}
+
+func NewMultiLock(db *Database, lock_keys [][16]byte, timeout uint32, expried uint32) *MultiLock {
+    return &MultiLock{db, [16]byte{}, db.GenLockId(), lock_keys, timeout, expried, nil}
+}
+
+func (self *MultiLock) GetVersion() uint8 {
+    if self.db.client != nil && self.db.client.HasCapability(protocol.CAPABILITY_FENCING_TOKEN) {
+        return protocol.VERSION2
+    }
+    return protocol.VERSION
+}
+
+func (self *MultiLock) GetFencingTokens() []uint64 {
+    return self.fencing_tokens
+}
+
+func (self *MultiLock) DoCommand(command_type uint8) (*protocol.MultiLockResultCommand, *LockError) {
+    if len(self.lock_keys) == 0 || len(self.lock_keys) > protocol.MAX_MULTI_LOCK_KEYS {
+        return nil, &LockError{protocol.RESULT_ERROR, nil, errors.New("lock keys count error")}
+    }
+
+    self.request_id = self.db.GetRequestId()
+    command := &protocol.MultiLockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: self.GetVersion(), CommandType: command_type, RequestId: self.request_id},
+        Flag: 0, DbId: self.db.db_id, LockId: self.lock_id, TimeoutFlag: uint16(self.timeout >> 16), Timeout: uint16(self.timeout),
+        ExpriedFlag: uint16(self.expried >> 16), Expried: uint16(self.expried), Count: 0, Rcount: 0, KeyCount: uint16(len(self.lock_keys)), LockKeys: self.lock_keys}
+    result_command, err := self.db.SendMultiLockCommand(command)
+    if err != nil {
+        if result_command != nil {
+            return result_command, &LockError{protocol.RESULT_ERROR, &result_command.LockResultCommand, err}
+        }
+        return result_command, &LockError{protocol.RESULT_ERROR, nil, err}
+    }
+    if result_command.Result != protocol.RESULT_SUCCED {
+        return result_command, &LockError{result_command.Result, &result_command.LockResultCommand, errors.New("lock error")}
+    }
+    return result_command, nil
+}
+
+func (self *MultiLock) Lock() *LockError {
+    result_command, err := self.DoCommand(protocol.COMMAND_MULTI_LOCK)
+    if err == nil {
+        self.fencing_tokens = result_command.Tokens
+    }
+    return err
+}
+
+func (self *MultiLock) Unlock() *LockError {
+    _, err := self.DoCommand(protocol.COMMAND_MULTI_UNLOCK)
+    return err
+}
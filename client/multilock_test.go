@@ -0,0 +1,180 @@
+package client
+
+import (
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestMultiLock_AllOrNothing(t *testing.T) {
+    slock_server, client, data_dir := startTestLockServer(t)
+    defer stopTestLockServer(slock_server, client, data_dir)
+
+    key_a, key_b := newTestLockKey("multi_all_a"), newTestLockKey("multi_all_b")
+    lock := client.Lock(key_b, 0, 60)
+    err := lock.Lock()
+    if err != nil {
+        t.Errorf("MultiLock AllOrNothing Lock Error %v", err)
+        return
+    }
+
+    multi_lock := client.MultiLock([][16]byte{key_a, key_b}, 0, 60)
+    err = multi_lock.Lock()
+    if err == nil || err.Result != protocol.RESULT_TIMEOUT || err.CommandResult == nil || err.CommandResult.LockKey != key_b {
+        t.Errorf("MultiLock AllOrNothing Blocked Error %v", err)
+        return
+    }
+
+    check_lock := client.Lock(key_a, 0, 60)
+    err = check_lock.Lock()
+    if err != nil {
+        t.Errorf("MultiLock AllOrNothing Key Held Error %v", err)
+        return
+    }
+    check_lock.Unlock()
+
+    err = lock.Unlock()
+    if err != nil {
+        t.Errorf("MultiLock AllOrNothing Unlock Error %v", err)
+        return
+    }
+
+    err = multi_lock.Lock()
+    if err != nil {
+        t.Errorf("MultiLock AllOrNothing Multi Lock Error %v", err)
+        return
+    }
+
+    tokens := multi_lock.GetFencingTokens()
+    if len(tokens) != 2 || tokens[0] == 0 || tokens[1] == 0 || tokens[0] == tokens[1] {
+        t.Errorf("MultiLock AllOrNothing Tokens Error %v", tokens)
+        return
+    }
+
+    for _, lock_key := range [][16]byte{key_a, key_b} {
+        check_lock = client.Lock(lock_key, 0, 60)
+        err = check_lock.Lock()
+        if err == nil || err.Result != protocol.RESULT_TIMEOUT {
+            t.Errorf("MultiLock AllOrNothing Key Not Held Error %x %v", lock_key, err)
+            return
+        }
+    }
+
+    err = multi_lock.Unlock()
+    if err != nil {
+        t.Errorf("MultiLock AllOrNothing Multi Unlock Error %v", err)
+        return
+    }
+
+    for _, lock_key := range [][16]byte{key_a, key_b} {
+        check_lock = client.Lock(lock_key, 0, 60)
+        err = check_lock.Lock()
+        if err != nil {
+            t.Errorf("MultiLock AllOrNothing Key Not Released Error %x %v", lock_key, err)
+            return
+        }
+        check_lock.Unlock()
+    }
+}
+
+func TestMultiLock_Timeout(t *testing.T) {
+    slock_server, client, data_dir := startTestLockServer(t)
+    defer stopTestLockServer(slock_server, client, data_dir)
+
+    key_a, key_b := newTestLockKey("multi_time_a"), newTestLockKey("multi_time_b")
+    lock := client.Lock(key_b, 0, 60)
+    err := lock.Lock()
+    if err != nil {
+        t.Errorf("MultiLock Timeout Lock Error %v", err)
+        return
+    }
+
+    start_time := time.Now()
+    multi_lock := client.MultiLock([][16]byte{key_a, key_b}, 1, 60)
+    err = multi_lock.Lock()
+    if err == nil || err.Result != protocol.RESULT_TIMEOUT {
+        t.Errorf("MultiLock Timeout Result Error %v", err)
+        return
+    }
+
+    if time.Since(start_time) < 900 * time.Millisecond || time.Since(start_time) > 3 * time.Second {
+        t.Errorf("MultiLock Timeout Time Error %v", time.Since(start_time))
+        return
+    }
+
+    waiter := make(chan *LockError, 1)
+    go func() {
+        waiter <- client.MultiLock([][16]byte{key_a, key_b}, 5, 60).Lock()
+    }()
+
+    time.Sleep(200 * time.Millisecond)
+    err = lock.Unlock()
+    if err != nil {
+        t.Errorf("MultiLock Timeout Unlock Error %v", err)
+        return
+    }
+
+    select {
+    case err = <- waiter:
+        if err != nil {
+            t.Errorf("MultiLock Timeout Wait Lock Error %v", err)
+        }
+    case <- time.After(5 * time.Second):
+        t.Errorf("MultiLock Timeout Wait Lock Timeout")
+    }
+}
+
+func TestMultiLock_ReverseOrder(t *testing.T) {
+    slock_server, client, data_dir := startTestLockServer(t)
+    defer stopTestLockServer(slock_server, client, data_dir)
+
+    key_a, key_b := newTestLockKey("multi_rev_a"), newTestLockKey("multi_rev_b")
+    var wait_group sync.WaitGroup
+    errs := make(chan error, 8)
+    for i := 0; i < 8; i++ {
+        lock_keys := [][16]byte{key_a, key_b}
+        if i % 2 == 1 {
+            lock_keys = [][16]byte{key_b, key_a}
+        }
+
+        wait_group.Add(1)
+        go func(lock_keys [][16]byte) {
+            defer wait_group.Done()
+            for j := 0; j < 20; j++ {
+                multi_lock := client.MultiLock(lock_keys, 5, 10)
+                err := multi_lock.Lock()
+                if err != nil {
+                    errs <- fmt.Errorf("lock %v", err)
+                    return
+                }
+
+                err = multi_lock.Unlock()
+                if err != nil {
+                    errs <- fmt.Errorf("unlock %v", err)
+                    return
+                }
+            }
+        }(lock_keys)
+    }
+
+    waiter := make(chan bool, 1)
+    go func() {
+        wait_group.Wait()
+        waiter <- true
+    }()
+
+    select {
+    case <- waiter:
+    case <- time.After(10 * time.Second):
+        t.Errorf("MultiLock ReverseOrder Deadlock Error")
+        return
+    }
+
+    select {
+    case err := <- errs:
+        t.Errorf("MultiLock ReverseOrder Error %v", err)
+    default:
+    }
+}
@@ -46,7 +46,7 @@ func (self *BinaryClientProtocol) Read() (protocol.CommandDecode, error) {
         return nil, errors.New("unknown magic")
     }
 
-    if uint8(self.rbuf[1]) != protocol.VERSION {
+    if uint8(self.rbuf[1]) != protocol.VERSION && uint8(self.rbuf[1]) != protocol.VERSION2 {
         return nil, errors.New("unknown version")
     }
 
@@ -57,6 +57,13 @@ func (self *BinaryClientProtocol) Read() (protocol.CommandDecode, error) {
         if err != nil {
             return nil, err
         }
+
+        if command.Version == protocol.VERSION2 {
+            err = self.ReadToken(&command)
+            if err != nil {
+                return nil, err
+            }
+        }
         return &command, nil
     case protocol.COMMAND_UNLOCK:
         command := protocol.LockResultCommand{}
@@ -64,6 +71,55 @@ func (self *BinaryClientProtocol) Read() (protocol.CommandDecode, error) {
         if err != nil {
             return nil, err
         }
+
+        if command.Version == protocol.VERSION2 {
+            err = self.ReadToken(&command)
+            if err != nil {
+                return nil, err
+            }
+        }
+        return &command, nil
+    case protocol.COMMAND_CANCEL:
+        command := protocol.LockResultCommand{}
+        err := command.Decode(self.rbuf)
+        if err != nil {
+            return nil, err
+        }
+        return &command, nil
+    case protocol.COMMAND_RENEW:
+        command := protocol.LockResultCommand{}
+        err := command.Decode(self.rbuf)
+        if err != nil {
+            return nil, err
+        }
+
+        if command.Version == protocol.VERSION2 {
+            err = self.ReadToken(&command)
+            if err != nil {
+                return nil, err
+            }
+        }
+        return &command, nil
+    case protocol.COMMAND_MULTI_LOCK, protocol.COMMAND_MULTI_UNLOCK:
+        command := protocol.MultiLockResultCommand{}
+        err := command.Decode(self.rbuf)
+        if err != nil {
+            return nil, err
+        }
+
+        if command.Version == protocol.VERSION2 {
+            err = self.ReadTokens(&command)
+            if err != nil {
+                return nil, err
+            }
+        }
+        return &command, nil
+    case protocol.COMMAND_QUERY:
+        command := protocol.QueryResultCommand{}
+        err := command.Decode(self.rbuf)
+        if err != nil {
+            return nil, err
+        }
         return &command, nil
     case protocol.COMMAND_STATE:
         command := protocol.StateResultCommand{}
@@ -85,6 +141,11 @@ func (self *BinaryClientProtocol) Read() (protocol.CommandDecode, error) {
         if err != nil {
             return nil, err
         }
+
+        err = self.ReadAdminValues(&command)
+        if err != nil {
+            return nil, err
+        }
         return &command, nil
     case protocol.COMMAND_PING:
         command := protocol.PingResultCommand{}
@@ -105,8 +166,58 @@ func (self *BinaryClientProtocol) Read() (protocol.CommandDecode, error) {
     }
 }
 
+func (self *BinaryClientProtocol) ReadToken(command *protocol.LockResultCommand) error {
+    buf := make([]byte, 8)
+    _, err := self.stream.ReadBytes(buf)
+    if err != nil {
+        return err
+    }
+    return command.DecodeToken(buf)
+}
+
+func (self *BinaryClientProtocol) ReadTokens(command *protocol.MultiLockResultCommand) error {
+    buf := make([]byte, int(command.Lcount) * 8)
+    if len(buf) > 0 {
+        _, err := self.stream.ReadBytes(buf)
+        if err != nil {
+            return err
+        }
+    }
+    return command.DecodeTokens(buf)
+}
+
+func (self *BinaryClientProtocol) ReadAdminValues(command *protocol.AdminResultCommand) error {
+    if command.ValueCount == 0 {
+        return command.DecodeValues(nil)
+    }
+
+    buf := make([]byte, 0, 64)
+    for i := 0; i < int(command.ValueCount); i++ {
+        len_buf := make([]byte, 4)
+        _, err := self.stream.ReadBytes(len_buf)
+        if err != nil {
+            return err
+        }
+
+        value_len := int(uint32(len_buf[0]) | uint32(len_buf[1])<<8 | uint32(len_buf[2])<<16 | uint32(len_buf[3])<<24)
+        value_buf := make([]byte, value_len)
+        if value_len > 0 {
+            _, err = self.stream.ReadBytes(value_buf)
+            if err != nil {
+                return err
+            }
+        }
+        buf = append(buf, len_buf...)
+        buf = append(buf, value_buf...)
+    }
+    return command.DecodeValues(buf)
+}
+
 func (self *BinaryClientProtocol) Write(result protocol.CommandEncode) error {
     wbuf := make([]byte, 64)
+    if command, ok := result.(protocol.CommandEncodeLength); ok {
+        wbuf = make([]byte, command.GetEncodeLength())
+    }
     err := result.Encode(wbuf)
     if err != nil {
         return err
@@ -394,6 +505,12 @@ func (self *TextClientProtocol) ArgsToLockComandResult(args []string) (*protocol
                 return nil, errors.New("Response Parse RCOUNT Error")
             }
             lock_command_result.Rcount = uint8(rcount)
+        case "TOKEN":
+            token, err := strconv.ParseUint(args[i+1], 10, 64)
+            if err != nil {
+                return nil, errors.New("Response Parse TOKEN Error")
+            }
+            lock_command_result.Token = token
         }
     }
     return &lock_command_result, nil
@@ -0,0 +1,132 @@
+package client
+
+import (
+    "errors"
+    "github.com/snower/slock/protocol"
+    "sync"
+    "time"
+)
+
+type QuorumLock struct {
+    locks []*Lock
+    lock_id [16]byte
+    lock_key [16]byte
+    timeout uint32
+    expried uint32
+    validity_time time.Time
+    glock *sync.Mutex
+}
+
+func NewQuorumLock(dbs []*Database, lock_key [16]byte, timeout uint32, expried uint32) *QuorumLock {
+    lock_id := [16]byte{}
+    if len(dbs) > 0 {
+        lock_id = dbs[0].GenLockId()
+    }
+
+    locks := make([]*Lock, len(dbs))
+    for i, db := range dbs {
+        locks[i] = &Lock{db, [16]byte{}, lock_id, lock_key, timeout, expried, 0, 0, "", 0, false, nil, &sync.Mutex{}}
+    }
+    return &QuorumLock{locks, lock_id, lock_key, timeout, expried, time.Time{}, &sync.Mutex{}}
+}
+
+func (self *QuorumLock) GetExpriedTime() time.Duration {
+    return GetExpriedTime(self.expried, time.Now())
+}
+
+func (self *QuorumLock) DoLocks(do_func func(*Lock) (*protocol.LockResultCommand, *LockError)) []*LockError {
+    errs := make([]*LockError, len(self.locks))
+    var waiter sync.WaitGroup
+    for i, lock := range self.locks {
+        waiter.Add(1)
+        go func(i int, lock *Lock) {
+            defer waiter.Done()
+            _, errs[i] = do_func(lock)
+        }(i, lock)
+    }
+    waiter.Wait()
+    return errs
+}
+
+func (self *QuorumLock) Lock() *LockError {
+    defer self.glock.Unlock()
+    self.glock.Lock()
+
+    if len(self.locks) == 0 {
+        return &LockError{protocol.RESULT_ERROR, nil, errors.New("quorum lock dbs empty")}
+    }
+
+    start_time := time.Now()
+    expried_time := GetExpriedTime(self.expried, start_time)
+    errs := self.DoLocks(func(lock *Lock) (*protocol.LockResultCommand, *LockError) {
+        return lock.DoLock(0)
+    })
+
+    succed_count := 0
+    var lock_err *LockError = nil
+    for _, err := range errs {
+        if err == nil {
+            succed_count++
+        } else if lock_err == nil {
+            lock_err = err
+        }
+    }
+
+    drift_time := expried_time / 100 + 2 * time.Millisecond
+    validity := expried_time - time.Since(start_time) - drift_time
+    if succed_count >= len(self.locks) / 2 + 1 && validity > 0 {
+        self.validity_time = start_time.Add(expried_time - drift_time)
+        return nil
+    }
+
+    self.DoLocks(func(lock *Lock) (*protocol.LockResultCommand, *LockError) {
+        return lock.DoUnlock(0)
+    })
+    self.validity_time = time.Time{}
+
+    if lock_err == nil {
+        return &LockError{protocol.RESULT_TIMEOUT, nil, errors.New("quorum lock validity timeout")}
+    }
+    return &LockError{lock_err.Result, lock_err.CommandResult, errors.New("quorum lock error")}
+}
+
+func (self *QuorumLock) Unlock() *LockError {
+    defer self.glock.Unlock()
+    self.glock.Lock()
+
+    errs := self.DoLocks(func(lock *Lock) (*protocol.LockResultCommand, *LockError) {
+        return lock.DoUnlock(0)
+    })
+    self.validity_time = time.Time{}
+
+    succed_count := 0
+    var lock_err *LockError = nil
+    for _, err := range errs {
+        if err == nil {
+            succed_count++
+        } else if lock_err == nil {
+            lock_err = err
+        }
+    }
+
+    if succed_count >= len(self.locks) / 2 + 1 {
+        return nil
+    }
+
+    if lock_err == nil {
+        return &LockError{protocol.RESULT_ERROR, nil, errors.New("quorum lock dbs empty")}
+    }
+    return &LockError{lock_err.Result, lock_err.CommandResult, errors.New("quorum unlock error")}
+}
+
+func (self *QuorumLock) GetValidity() time.Duration {
+    if self.validity_time.IsZero() {
+        return 0
+    }
+
+    validity := time.Until(self.validity_time)
+    if validity < 0 {
+        return 0
+    }
+    return validity
+}
@@ -0,0 +1,209 @@
+package client
+
+import (
+    "github.com/snower/slock/protocol"
+    "net"
+    "sync"
+    "testing"
+    "time"
+)
+
+type testQuorumProtocol struct {
+    db *Database
+    result uint8
+    locks map[[16]byte]bool
+    glock *sync.Mutex
+}
+
+func newTestQuorumDatabase(result uint8) (*Database, *testQuorumProtocol) {
+    client := NewReplsetClient([]string{"127.0.0.1:5658"})
+    client_protocol := &testQuorumProtocol{nil, result, make(map[[16]byte]bool, 4), &sync.Mutex{}}
+    client.protocol = client_protocol
+    client_protocol.db = client.SelectDB(0)
+    return client_protocol.db, client_protocol
+}
+
+func (self *testQuorumProtocol) Close() error {
+    return nil
+}
+
+func (self *testQuorumProtocol) Read() (protocol.CommandDecode, error) {
+    return nil, nil
+}
+
+func (self *testQuorumProtocol) Write(command protocol.CommandEncode) error {
+    lock_command := command.(*protocol.LockCommand)
+    self.glock.Lock()
+    result := self.result
+    switch lock_command.CommandType {
+    case protocol.COMMAND_LOCK:
+        if result == protocol.RESULT_SUCCED {
+            self.locks[lock_command.LockId] = true
+        }
+    case protocol.COMMAND_UNLOCK:
+        if self.locks[lock_command.LockId] {
+            delete(self.locks, lock_command.LockId)
+            result = protocol.RESULT_SUCCED
+        } else {
+            result = protocol.RESULT_UNLOCK_ERROR
+        }
+    }
+    self.glock.Unlock()
+
+    result_command := protocol.NewLockResultCommand(lock_command, result, 0, 0, 0, 0, 0)
+    go func() {
+        if lock_command.CommandType == protocol.COMMAND_UNLOCK {
+            self.db.HandleUnLockCommandResult(result_command)
+        } else {
+            self.db.HandleLockCommandResult(result_command)
+        }
+    }()
+    return nil
+}
+
+func (self *testQuorumProtocol) RemoteAddr() net.Addr {
+    return nil
+}
+
+func (self *testQuorumProtocol) LockedCount() int {
+    defer self.glock.Unlock()
+    self.glock.Lock()
+    return len(self.locks)
+}
+
+func TestQuorumLock_Majority(t *testing.T) {
+    dbs := make([]*Database, 3)
+    client_protocols := make([]*testQuorumProtocol, 3)
+    results := []uint8{protocol.RESULT_SUCCED, protocol.RESULT_SUCCED, protocol.RESULT_TIMEOUT}
+    for i, result := range results {
+        dbs[i], client_protocols[i] = newTestQuorumDatabase(result)
+    }
+
+    lock_key := [16]byte{}
+    copy(lock_key[:], "quorum_majority")
+    lock := NewQuorumLock(dbs, lock_key, 0, 5)
+    err := lock.Lock()
+    if err != nil {
+        t.Errorf("QuorumLock Majority Lock Error %v", err)
+        return
+    }
+
+    validity := lock.GetValidity()
+    if validity <= 0 || validity > 5 * time.Second {
+        t.Errorf("QuorumLock Majority Validity Error %v", validity)
+        return
+    }
+
+    err = lock.Unlock()
+    if err != nil {
+        t.Errorf("QuorumLock Majority Unlock Error %v", err)
+        return
+    }
+
+    for i, client_protocol := range client_protocols {
+        if client_protocol.LockedCount() != 0 {
+            t.Errorf("QuorumLock Majority Release Error %d", i)
+            return
+        }
+    }
+
+    if lock.GetValidity() != 0 {
+        t.Errorf("QuorumLock Majority Unlock Validity Error %v", lock.GetValidity())
+    }
+}
+
+func TestQuorumLock_Minority(t *testing.T) {
+    dbs := make([]*Database, 3)
+    client_protocols := make([]*testQuorumProtocol, 3)
+    results := []uint8{protocol.RESULT_SUCCED, protocol.RESULT_TIMEOUT, protocol.RESULT_TIMEOUT}
+    for i, result := range results {
+        dbs[i], client_protocols[i] = newTestQuorumDatabase(result)
+    }
+
+    lock_key := [16]byte{}
+    copy(lock_key[:], "quorum_minority")
+    lock := NewQuorumLock(dbs, lock_key, 0, 5)
+    err := lock.Lock()
+    if err == nil {
+        t.Errorf("QuorumLock Minority Lock Succed")
+        return
+    }
+
+    if err.Result != protocol.RESULT_TIMEOUT {
+        t.Errorf("QuorumLock Minority Lock Result Error %d", err.Result)
+        return
+    }
+
+    for i, client_protocol := range client_protocols {
+        if client_protocol.LockedCount() != 0 {
+            t.Errorf("QuorumLock Minority Release Error %d", i)
+            return
+        }
+    }
+
+    if lock.GetValidity() != 0 {
+        t.Errorf("QuorumLock Minority Validity Error %v", lock.GetValidity())
+    }
+}
+
+func TestQuorumLock_Validity(t *testing.T) {
+    dbs := make([]*Database, 3)
+    client_protocols := make([]*testQuorumProtocol, 3)
+    for i := range dbs {
+        dbs[i], client_protocols[i] = newTestQuorumDatabase(protocol.RESULT_SUCCED)
+    }
+
+    lock_key := [16]byte{}
+    copy(lock_key[:], "quorum_validity")
+    lock := NewQuorumLock(dbs, lock_key, 0, 0x04000000 | 1000)
+    if lock.GetExpriedTime() != time.Second {
+        t.Errorf("QuorumLock Millisecond Expried Time Error %v", lock.GetExpriedTime())
+        return
+    }
+
+    err := lock.Lock()
+    if err != nil {
+        t.Errorf("QuorumLock Validity Lock Error %v", err)
+        return
+    }
+
+    validity := lock.GetValidity()
+    if validity <= 0 || validity > time.Second - time.Second / 100 - 2 * time.Millisecond {
+        t.Errorf("QuorumLock Validity Error %v", validity)
+        return
+    }
+    lock.Unlock()
+
+    lock = NewQuorumLock(dbs, lock_key, 0, 0x04000000 | 1)
+    err = lock.Lock()
+    if err == nil {
+        t.Errorf("QuorumLock Validity Expried Lock Succed")
+        return
+    }
+
+    for i, client_protocol := range client_protocols {
+        if client_protocol.LockedCount() != 0 {
+            t.Errorf("QuorumLock Validity Release Error %d", i)
+            return
+        }
+    }
+}
+
+func TestQuorumLock_ExpriedTime(t *testing.T) {
+    dbs := make([]*Database, 1)
+    dbs[0], _ = newTestQuorumDatabase(protocol.RESULT_SUCCED)
+
+    lock_key := [16]byte{}
+    copy(lock_key[:], "quorum_expried")
+    lock := NewQuorumLock(dbs, lock_key, 0, 0x00010000 | 10)
+    if lock.GetExpriedTime() != time.Duration(0x10000 + 10) * time.Second {
+        t.Errorf("QuorumLock High Bits Expried Time Error %v", lock.GetExpriedTime())
+        return
+    }
+
+    lock = NewQuorumLock(dbs, lock_key, 0, ExpriedDeadline(time.Now().Add(100 * time.Second)))
+    expried_time := lock.GetExpriedTime()
+    if expried_time < 98 * time.Second || expried_time > 100 * time.Second {
+        t.Errorf("QuorumLock Deadline Expried Time Error %v", expried_time)
+    }
+}
@@ -3,6 +3,7 @@ package client
 import (
     "errors"
     "github.com/snower/slock/protocol"
+    "sync"
 )
 
 type RLock struct {
@@ -15,7 +16,7 @@ type RLock struct {
 }
 
 func NewRLock(db *Database, lock_key [16]byte, timeout uint32, expried uint32) *RLock {
-    lock := &Lock{db, [16]byte{}, db.GenLockId(), lock_key, timeout, expried, 0, 0xff}
+    lock := &Lock{db, [16]byte{}, db.GenLockId(), lock_key, timeout, expried, 0, 0xff, "", 0, false, nil, &sync.Mutex{}}
     return &RLock{db, lock_key, timeout, expried, lock, 0}
 }
 
@@ -1,6 +1,9 @@
 package client
 
-import "github.com/snower/slock/protocol"
+import (
+    "github.com/snower/slock/protocol"
+    "sync"
+)
 
 type Semaphore struct {
     db *Database
@@ -14,20 +17,24 @@ func NewSemaphore(db *Database, semaphore_key [16]byte, timeout uint32, expried
     return &Semaphore{db, semaphore_key, timeout, expried, count}
 }
 
+func (self *Semaphore) SetPriority(priority uint8) {
+    self.timeout = self.timeout & 0xff00ffff | uint32(priority) << 16
+}
+
 func (self *Semaphore) Acquire() error {
-    lock := &Lock{self.db, [16]byte{}, self.db.GenLockId(), self.semaphore_key, self.timeout, self.expried, self.count, 0}
+    lock := &Lock{self.db, [16]byte{}, self.db.GenLockId(), self.semaphore_key, self.timeout, self.expried, self.count, 0, "", 0, false, nil, &sync.Mutex{}}
     _, err := lock.DoLock(0)
     return err
 }
 
 func (self *Semaphore) Release() error {
-    lock := &Lock{self.db, [16]byte{}, [16]byte{}, self.semaphore_key, self.timeout, self.expried, self.count, 0}
+    lock := &Lock{self.db, [16]byte{}, [16]byte{}, self.semaphore_key, self.timeout, self.expried, self.count, 0, "", 0, false, nil, &sync.Mutex{}}
     _, err := lock.DoUnlock(0x01)
     return err
 }
 
 func (self *Semaphore) ReleaseN(n int) (int, error) {
-    lock := &Lock{self.db, [16]byte{}, [16]byte{}, self.semaphore_key, self.timeout, self.expried, self.count, 0}
+    lock := &Lock{self.db, [16]byte{}, [16]byte{}, self.semaphore_key, self.timeout, self.expried, self.count, 0, "", 0, false, nil, &sync.Mutex{}}
     for i := 0; i < n; i++{
         _, err := lock.DoUnlock(0x01)
         if err != nil {
@@ -41,7 +48,7 @@ func (self *Semaphore) ReleaseN(n int) (int, error) {
 }
 
 func (self *Semaphore) ReleaseAll() error {
-    lock := &Lock{self.db, [16]byte{}, [16]byte{}, self.semaphore_key, self.timeout, self.expried, self.count, 0}
+    lock := &Lock{self.db, [16]byte{}, [16]byte{}, self.semaphore_key, self.timeout, self.expried, self.count, 0, "", 0, false, nil, &sync.Mutex{}}
     for ;; {
         _, err := lock.DoUnlock(0x01)
         if err != nil {
@@ -54,7 +61,15 @@ func (self *Semaphore) ReleaseAll() error {
 }
 
 func (self *Semaphore) Count() (int, error) {
-    lock := &Lock{self.db, [16]byte{}, self.db.GenLockId(), self.semaphore_key, 0, 0, self.count, 0}
+    if self.db.client != nil && self.db.client.HasCapability(protocol.CAPABILITY_QUERY) {
+        result_command, err := self.db.Inspect(self.semaphore_key)
+        if err != nil {
+            return 0, err
+        }
+        return int(result_command.Lcount), nil
+    }
+
+    lock := &Lock{self.db, [16]byte{}, self.db.GenLockId(), self.semaphore_key, 0, 0, self.count, 0, "", 0, false, nil, &sync.Mutex{}}
     result_command, err := lock.DoLock(0x01)
     if err == nil {
         return 0, nil
@@ -15,8 +15,8 @@ var request_id_index uint64 = 0
 var lock_id_index uint64 = 0
 
 type Client struct {
-    host string
-    port uint
+    hosts []string
+    host_index int
     stream *Stream
     protocol ClientProtocol
     dbs []*Database
@@ -24,10 +24,18 @@ type Client struct {
     client_id [16]byte
     is_stop bool
     reconnect_count int
+    leader_changed bool
+    server_protocol_version uint8
+    server_version string
+    server_capabilities uint32
 }
 
 func NewClient(host string, port uint) *Client{
-    client := &Client{host, port, nil, nil,make([]*Database, 256), &sync.Mutex{}, [16]byte{}, false, 0}
+    return NewReplsetClient([]string{fmt.Sprintf("%s:%d", host, port)})
+}
+
+func NewReplsetClient(hosts []string) *Client{
+    client := &Client{hosts, 0, nil, nil,make([]*Database, 256), &sync.Mutex{}, [16]byte{}, false, 0, false, 0, "", 0}
     client.InitClientId()
     return client
 }
@@ -37,7 +45,18 @@ func (self *Client) Open() error {
         return errors.New("Client is Opened")
     }
 
-    addr := fmt.Sprintf("%s:%d", self.host, self.port)
+    var err error
+    for i := 0; i < len(self.hosts); i++ {
+        err = self.OpenHost(self.hosts[self.host_index])
+        if err == nil {
+            return nil
+        }
+        self.host_index = (self.host_index + 1) % len(self.hosts)
+    }
+    return err
+}
+
+func (self *Client) OpenHost(addr string) error {
     conn, err := net.Dial("tcp", addr)
     if err != nil {
         return err
@@ -76,6 +95,41 @@ func (self *Client) Reopen() {
     }
 }
 
+func (self *Client) IsReplset() bool {
+    return len(self.hosts) > 1
+}
+
+func (self *Client) GetProtocol() ClientProtocol {
+    client_protocol := self.protocol
+    if client_protocol == nil && !self.is_stop {
+        self.glock.Lock()
+        client_protocol = self.protocol
+        self.glock.Unlock()
+    }
+    return client_protocol
+}
+
+func (self *Client) ChangeLeader(command *protocol.LockResultCommand) {
+    if self.leader_changed {
+        return
+    }
+    self.leader_changed = true
+
+    next_index := (self.host_index + 1) % len(self.hosts)
+    if command.Lcount != 0 && (command.Blank[0] != 0 || command.Blank[1] != 0 || command.Blank[2] != 0 || command.Blank[3] != 0) {
+        // the hint is a resolved ipv4 address, the configured hosts may be names or written differently
+        leader_ip := net.IPv4(command.Blank[0], command.Blank[1], command.Blank[2], command.Blank[3])
+        for i, host := range self.hosts {
+            addr, err := net.ResolveTCPAddr("tcp", host)
+            if err == nil && addr.IP.Equal(leader_ip) && addr.Port == int(command.Lcount) {
+                next_index = i
+                break
+            }
+        }
+    }
+    self.host_index = next_index
+}
+
 func (self *Client) InitClientId() {
     now := uint32(time.Now().Unix())
     self.client_id = [16]byte{
@@ -100,6 +154,31 @@ func (self *Client) InitProtocol(client_protocol ClientProtocol) error {
         return errors.New(fmt.Sprintf("init stream error: %d", init_result_command.Result))
     }
 
+    self.server_protocol_version = init_result_command.ProtocolVersion
+    if self.server_protocol_version == 0 {
+        self.server_protocol_version = protocol.VERSION
+    }
+    self.server_version = init_result_command.GetServerVersion()
+    self.server_capabilities = init_result_command.Capabilities
+
+    if self.IsReplset() {
+        if init_result_command.InitType != 0 {
+            return nil
+        }
+
+        for _, db := range self.dbs {
+            if db == nil {
+                continue
+            }
+
+            err := db.ResendCommands(client_protocol)
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+
     if init_result_command.InitType == 0 {
         for _, db := range self.dbs {
             if db == nil {
@@ -117,6 +196,22 @@ func (self *Client) InitProtocol(client_protocol ClientProtocol) error {
     return nil
 }
 
+func (self *Client) GetServerProtocolVersion() uint8 {
+    return self.server_protocol_version
+}
+
+func (self *Client) GetServerVersion() string {
+    return self.server_version
+}
+
+func (self *Client) GetServerCapabilities() uint32 {
+    return self.server_capabilities
+}
+
+func (self *Client) HasCapability(capability uint32) bool {
+    return self.server_capabilities & capability == capability
+}
+
 func (self *Client) Handle(stream *Stream) {
     client_protocol := self.protocol
 
@@ -127,6 +222,12 @@ func (self *Client) Handle(stream *Stream) {
         self.stream = nil
         self.protocol = nil
         if !self.is_stop {
+            if self.leader_changed {
+                self.InitClientId()
+                self.leader_changed = false
+            } else if self.IsReplset() {
+                self.host_index = (self.host_index + 1) % len(self.hosts)
+            }
             self.Reopen()
         }
     }()
@@ -141,6 +242,9 @@ func (self *Client) Handle(stream *Stream) {
         }
 
         self.HandleCommand(command.(protocol.ICommand))
+        if self.leader_changed {
+            break
+        }
     }
 }
 
@@ -207,6 +311,22 @@ func (self *Client) HandleCommand(command protocol.ICommand) error{
         }
         return db.HandleUnLockCommandResult(lock_command)
 
+    case protocol.COMMAND_RENEW, protocol.COMMAND_CANCEL:
+        lock_command := command.(*protocol.LockResultCommand)
+        db := self.dbs[lock_command.DbId]
+        if db == nil {
+            db = self.GetDb(lock_command.DbId)
+        }
+        return db.HandleLockCommandResult(lock_command)
+
+    case protocol.COMMAND_MULTI_LOCK, protocol.COMMAND_MULTI_UNLOCK:
+        lock_command := command.(*protocol.MultiLockResultCommand)
+        db := self.dbs[lock_command.DbId]
+        if db == nil {
+            db = self.GetDb(lock_command.DbId)
+        }
+        return db.HandleMultiLockCommandResult(lock_command)
+
     case protocol.COMMAND_STATE:
         state_command := command.(*protocol.StateResultCommand)
         db := self.dbs[state_command.DbId]
@@ -214,6 +334,22 @@ func (self *Client) HandleCommand(command protocol.ICommand) error{
             db = self.GetDb(state_command.DbId)
         }
         return db.HandleStateCommandResult(state_command)
+
+    case protocol.COMMAND_QUERY:
+        query_command := command.(*protocol.QueryResultCommand)
+        db := self.dbs[query_command.DbId]
+        if db == nil {
+            db = self.GetDb(query_command.DbId)
+        }
+        return db.HandleQueryCommandResult(query_command)
+
+    case protocol.COMMAND_ADMIN:
+        admin_command := command.(*protocol.AdminResultCommand)
+        db := self.dbs[admin_command.DbId]
+        if db == nil {
+            db = self.GetDb(admin_command.DbId)
+        }
+        return db.HandleAdminCommandResult(admin_command)
     }
     return nil
 }
@@ -230,6 +366,14 @@ func (self *Client) Lock(lock_key [16]byte, timeout uint32, expried uint32) *Loc
     return self.SelectDB(0).Lock(lock_key, timeout, expried)
 }
 
+func (self *Client) NamedLock(lock_name string, timeout uint32, expried uint32) *Lock {
+    return self.SelectDB(0).NamedLock(lock_name, timeout, expried)
+}
+
+func (self *Client) MultiLock(lock_keys [][16]byte, timeout uint32, expried uint32) *MultiLock {
+    return self.SelectDB(0).MultiLock(lock_keys, timeout, expried)
+}
+
 func (self *Client) Event(event_key [16]byte, timeout uint32, expried uint32) *Event {
     return self.SelectDB(0).Event(event_key, timeout, expried)
 }
@@ -253,4 +397,32 @@ func (self *Client) RLock(lock_key [16]byte, timeout uint32, expried uint32) *RL
 
 func (self *Client) State(db_id uint8) *protocol.StateResultCommand {
     return self.SelectDB(db_id).State()
-}
\ No newline at end of file
+}
+
+func (self *Client) Info() (map[string]string, error) {
+    return self.SelectDB(0).Info()
+}
+
+func (self *Client) ConfigGet(name string) (map[string]string, error) {
+    return self.SelectDB(0).ConfigGet(name)
+}
+
+func (self *Client) ConfigSet(name string, value string) error {
+    return self.SelectDB(0).ConfigSet(name, value)
+}
+
+func (self *Client) ClientList() ([]map[string]string, error) {
+    return self.SelectDB(0).ClientList()
+}
+
+func (self *Client) ClientKill(addr string) error {
+    return self.SelectDB(0).ClientKill(addr)
+}
+
+func (self *Client) FlushDB(db_id uint8) error {
+    return self.SelectDB(db_id).FlushDB()
+}
+
+func (self *Client) RewriteAof() error {
+    return self.SelectDB(0).RewriteAof()
+}
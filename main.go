@@ -1,12 +1,21 @@
 package main
 
 import (
+    "bufio"
     "bytes"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
+    "io"
+    "io/ioutil"
+    "net"
     "os"
+    "path/filepath"
     "github.com/jessevdk/go-flags"
     "github.com/snower/slock/server"
     "github.com/snower/slock/client"
+    "strconv"
     "strings"
 )
 
@@ -54,18 +63,386 @@ func ShowDBStateInfo()  {
     }
 }
 
+func AofCommand()  {
+    type AofConfig struct{
+        DataDir string              `long:"data_dir" description:"data dir" default:"./data/"`
+        AofFileBufferSize uint      `long:"aof_file_buffer_size" description:"aof file buffer size" default:"4096"`
+        TargetDir string            `long:"target_dir" description:"restore target dir" default:""`
+        Time int64                  `long:"time" description:"restore up to unix timestamp" default:"0"`
+        AofIndex uint               `long:"aof_index" description:"restore up to aof index" default:"0"`
+        AofId uint                  `long:"aof_id" description:"restore up to aof id of aof index" default:"0"`
+    }
+
+    config := &AofConfig{}
+    parse := flags.NewParser(config, flags.Default)
+    parse.Usage = "aof dump|check|fix|restore\n\tdump command print aof locks as json lines\n\tcheck command check aof files\n\tfix command truncate aof files corrupted tail\n\trestore command write aof locks up to time or aof index and id as rewrite.aof to target dir"
+    args, err := parse.ParseArgs(os.Args)
+    if err != nil {
+        if strings.Contains(err.Error(), "unknown flag") {
+            var b bytes.Buffer
+            parse.WriteHelp(&b)
+            fmt.Println(b.String())
+        }
+        return
+    }
+
+    action := ""
+    for i, arg := range args {
+        if arg == "aof" && i + 1 < len(args) {
+            action = args[i + 1]
+            break
+        }
+    }
+
+    if action != "dump" && action != "check" && action != "fix" && action != "restore" {
+        var b bytes.Buffer
+        parse.WriteHelp(&b)
+        fmt.Println(b.String())
+        return
+    }
+
+    slock := server.NewSLock(&server.ServerConfig{Log: "-", LogLevel: "ERROR", DataDir: config.DataDir, AofFileBufferSize: config.AofFileBufferSize})
+    aof := slock.GetAof()
+    err = aof.SetDataDir(config.DataDir)
+    if err != nil {
+        fmt.Printf("Data Dir Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    if action == "restore" {
+        if config.TargetDir == "" {
+            fmt.Println("Restore Target Dir Empty")
+            os.Exit(1)
+        }
+
+        lock_count, err := aof.RestoreAofFiles(config.TargetDir, config.Time, uint32(config.AofIndex), uint32(config.AofId))
+        if err != nil {
+            fmt.Printf("Restore Error: %v\n", err)
+            os.Exit(1)
+        }
+        fmt.Printf("restore %d locks to %s\n", lock_count, filepath.Join(config.TargetDir, "rewrite.aof"))
+        return
+    }
+
+    append_files, rewrite_file, err := aof.FindAofFiles()
+    if err != nil {
+        fmt.Printf("Find Aof Files Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    aof_filenames := make([]string, 0)
+    if _, err := os.Stat(filepath.Join(aof.GetDataDir(), "snapshot.aof")); err == nil {
+        aof_filenames = append(aof_filenames, "snapshot.aof")
+    }
+    if rewrite_file != "" {
+        aof_filenames = append(aof_filenames, rewrite_file)
+    }
+    aof_filenames = append(aof_filenames, append_files...)
+
+    corrupted_count := 0
+    for _, aof_filename := range aof_filenames {
+        aof_file := server.NewAofFile(aof, filepath.Join(aof.GetDataDir(), aof_filename), os.O_RDONLY, int(config.AofFileBufferSize))
+        err := aof_file.Open()
+        if err != nil {
+            corrupted_count++
+            if action == "dump" {
+                fmt.Fprintf(os.Stderr, "%s header error: %v\n", aof_filename, err)
+                continue
+            }
+
+            fmt.Printf("%s header error: %v\n", aof_filename, err)
+            if action == "fix" && err == server.AOF_FILE_CORRUPTED_ERROR {
+                err = FixAofFileHeader(aof, aof_filename, int(config.AofFileBufferSize))
+                if err != nil {
+                    fmt.Printf("%s fix error: %v\n", aof_filename, err)
+                } else {
+                    fmt.Printf("%s fixed, rewrite empty file\n", aof_filename)
+                }
+            }
+            continue
+        }
+
+        lock := server.NewAofLock()
+        lock_count := 0
+        for {
+            err = aof_file.ReadLock(lock)
+            if err != nil {
+                break
+            }
+
+            err = lock.Decode()
+            if err != nil {
+                break
+            }
+
+            lock_count++
+            if action == "dump" {
+                lock_name, _ := json.Marshal(lock.LockName)
+                fmt.Printf("{\"file\": \"%s\", \"aof_index\": %d, \"aof_id\": %d, \"command_type\": %d, \"command_time\": %d, " +
+                    "\"flag\": %d, \"db_id\": %d, \"lock_id\": \"%s\", \"lock_key\": \"%s\", \"aof_flag\": %d, \"start_time\": %d, " +
+                    "\"expried_flag\": %d, \"expried_time\": %d, \"count\": %d, \"rcount\": %d, \"token\": %d, \"lock_name\": %s}\n",
+                    aof_filename, lock.AofIndex, lock.AofId, lock.CommandType, lock.CommandTime, lock.Flag, lock.DbId,
+                    hex.EncodeToString(lock.LockId[:]), hex.EncodeToString(lock.LockKey[:]), lock.AofFlag, lock.StartTime,
+                    lock.ExpriedFlag, lock.ExpriedTime, lock.Count, lock.Rcount, lock.Token, lock_name)
+            }
+        }
+
+        if err == io.EOF {
+            aof_file.Close()
+            if action != "dump" {
+                fmt.Printf("%s ok, version %d, %d locks\n", aof_filename, aof_file.GetVersion(), lock_count)
+            }
+            continue
+        }
+
+        corrupted_count++
+        if action == "dump" {
+            aof_file.Close()
+            fmt.Fprintf(os.Stderr, "%s corrupted at %d: %v\n", aof_filename, aof_file.GetSize(), err)
+            continue
+        }
+
+        fmt.Printf("%s corrupted at %d: %v, version %d, %d locks\n", aof_filename, aof_file.GetSize(), err, aof_file.GetVersion(), lock_count)
+        if action == "fix" {
+            err = aof.TruncateAofFile(aof_file)
+            if err != nil {
+                fmt.Printf("%s fix error: %v\n", aof_filename, err)
+            } else {
+                fmt.Printf("%s fixed, truncate to %d\n", aof_filename, aof_file.GetSize())
+            }
+        } else {
+            aof_file.Close()
+        }
+    }
+
+    if corrupted_count > 0 && action == "check" {
+        os.Exit(1)
+    }
+}
+
+func FixAofFileHeader(aof *server.Aof, aof_filename string, buf_size int) error {
+    filename := filepath.Join(aof.GetDataDir(), aof_filename)
+    err := os.Remove(filename)
+    if err != nil {
+        return err
+    }
+
+    aof_file := server.NewAofFile(aof, filename, os.O_WRONLY, buf_size)
+    err = aof_file.Open()
+    if err != nil {
+        return err
+    }
+    return aof_file.Close()
+}
+
+func ExportImportCommand(action string)  {
+    type ExportConfig struct{
+        Host string         `long:"host" description:"server host" default:"127.0.0.1"`
+        Port uint           `long:"port" description:"server port" default:"5658"`
+        Db string           `long:"db" description:"export db ids, comma separated" default:"0"`
+        File string         `long:"file" description:"export or import json filename, default is stdout or stdin" default:"-"`
+    }
+
+    config := &ExportConfig{}
+    parse := flags.NewParser(config, flags.Default)
+    parse.Usage = "export|import\n\texport command dump held locks of dbs as json\n\timport command lock the exported json locks"
+    _, err := parse.ParseArgs(os.Args)
+    if err != nil {
+        if strings.Contains(err.Error(), "unknown flag") {
+            var b bytes.Buffer
+            parse.WriteHelp(&b)
+            fmt.Println(b.String())
+        }
+        return
+    }
+
+    conn, err := net.Dial("tcp", net.JoinHostPort(config.Host, fmt.Sprintf("%d", config.Port)))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Connect Error: %v\n", err)
+        os.Exit(1)
+    }
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+
+    if action == "export" {
+        lock_infos := make([]*server.LockInfo, 0)
+        for _, db := range strings.Split(config.Db, ",") {
+            results, err := AdminCommand(conn, reader, []string{"DUMP", strings.TrimSpace(db)})
+            if err != nil || len(results) != 1 {
+                fmt.Fprintf(os.Stderr, "Dump DB %s Error: %v\n", db, err)
+                os.Exit(1)
+            }
+
+            db_lock_infos := make([]*server.LockInfo, 0)
+            err = json.Unmarshal([]byte(results[0]), &db_lock_infos)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Dump DB %s Error: %v\n", db, err)
+                os.Exit(1)
+            }
+            lock_infos = append(lock_infos, db_lock_infos...)
+        }
+
+        data, err := json.MarshalIndent(lock_infos, "", "  ")
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Export Error: %v\n", err)
+            os.Exit(1)
+        }
+
+        if config.File == "-" {
+            fmt.Println(string(data))
+        } else {
+            err = ioutil.WriteFile(config.File, data, 0644)
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Export Error: %v\n", err)
+                os.Exit(1)
+            }
+        }
+        fmt.Fprintf(os.Stderr, "export %d locks\n", len(lock_infos))
+        return
+    }
+
+    var data []byte
+    if config.File == "-" {
+        data, err = ioutil.ReadAll(os.Stdin)
+    } else {
+        data, err = ioutil.ReadFile(config.File)
+    }
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Import Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    lock_infos := make([]*server.LockInfo, 0)
+    err = json.Unmarshal(data, &lock_infos)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Import Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    db_ids := make([]uint8, 0)
+    db_lock_infos := make(map[uint8][]*server.LockInfo)
+    for _, lock_info := range lock_infos {
+        if _, ok := db_lock_infos[lock_info.DbId]; !ok {
+            db_ids = append(db_ids, lock_info.DbId)
+        }
+        db_lock_infos[lock_info.DbId] = append(db_lock_infos[lock_info.DbId], lock_info)
+    }
+
+    failed_count := 0
+    for _, db_id := range db_ids {
+        data, err := json.Marshal(db_lock_infos[db_id])
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Import DB %d Error: %v\n", db_id, err)
+            os.Exit(1)
+        }
+
+        results, err := AdminCommand(conn, reader, []string{"RESTORE", fmt.Sprintf("%d", db_id), string(data)})
+        if err != nil || len(results) != 2 {
+            fmt.Fprintf(os.Stderr, "Import DB %d Error: %v\n", db_id, err)
+            os.Exit(1)
+        }
+        fmt.Printf("import db %d %s locks, %s failed\n", db_id, results[0], results[1])
+        if results[1] != "0" {
+            failed_count++
+        }
+    }
+
+    if failed_count > 0 {
+        os.Exit(1)
+    }
+}
+
+func AdminCommand(conn net.Conn, reader *bufio.Reader, args []string) ([]string, error) {
+    var b bytes.Buffer
+    b.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+    for _, arg := range args {
+        b.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+    }
+
+    _, err := conn.Write(b.Bytes())
+    if err != nil {
+        return nil, err
+    }
+
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    line = strings.TrimRight(line, "\r\n")
+    if len(line) == 0 {
+        return nil, errors.New("Reply Empty")
+    }
+
+    switch line[0] {
+    case '+':
+        return []string{line[1:]}, nil
+    case '-':
+        return nil, errors.New(line[1:])
+    case '$':
+        result, err := AdminReadBulk(reader, line)
+        if err != nil {
+            return nil, err
+        }
+        return []string{result}, nil
+    case '*':
+        count, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+
+        results := make([]string, count)
+        for i := 0; i < count; i++ {
+            line, err := reader.ReadString('\n')
+            if err != nil {
+                return nil, err
+            }
+
+            results[i], err = AdminReadBulk(reader, strings.TrimRight(line, "\r\n"))
+            if err != nil {
+                return nil, err
+            }
+        }
+        return results, nil
+    }
+    return nil, errors.New("Reply Parse Error")
+}
+
+func AdminReadBulk(reader *bufio.Reader, line string) (string, error) {
+    if len(line) == 0 || line[0] != '$' {
+        return "", errors.New("Reply Parse Error")
+    }
+
+    size, err := strconv.Atoi(line[1:])
+    if err != nil {
+        return "", err
+    }
+
+    buf := make([]byte, size + 2)
+    _, err = io.ReadFull(reader, buf)
+    if err != nil {
+        return "", err
+    }
+    return string(buf[:size]), nil
+}
+
 func main() {
     for _, arg := range os.Args {
         switch arg {
         case "info":
             ShowDBStateInfo()
             return
+        case "aof":
+            AofCommand()
+            return
+        case "export", "import":
+            ExportImportCommand(arg)
+            return
         }
     }
 
     config := &server.ServerConfig{}
     parse := flags.NewParser(config, flags.Default)
-    parse.Usage = "[info]\n\tdefault start slock server\n\tinfo command show db state"
+    parse.Usage = "[info|aof|export|import]\n\tdefault start slock server\n\tinfo command show db state\n\taof command dump, check or fix aof files\n\texport command dump held locks as json\n\timport command lock exported json locks"
     _, err := parse.ParseArgs(os.Args)
     if err != nil {
         if strings.Contains(err.Error(), "unknown flag") {
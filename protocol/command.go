@@ -1,9 +1,15 @@
 package protocol
 
-import "errors"
+import (
+    "crypto/md5"
+    "encoding/hex"
+    "errors"
+)
 
 const MAGIC uint8 = 0x56
 const VERSION uint8 = 0x01
+const VERSION2 uint8 = 0x02
+const MAX_LOCK_NAME_LENGTH = 0xffff
 
 const (
     COMMAND_INIT    uint8 = 0
@@ -13,6 +19,45 @@ const (
     COMMAND_ADMIN   uint8 = 4
     COMMAND_PING    uint8 = 5
     COMMAND_QUIT    uint8 = 6
+    COMMAND_SYNC    uint8 = 7
+    COMMAND_RAFT_VOTE   uint8 = 8
+    COMMAND_RAFT_APPEND uint8 = 9
+    COMMAND_SNAPSHOT    uint8 = 10
+    COMMAND_MULTI_LOCK      uint8 = 11
+    COMMAND_MULTI_UNLOCK    uint8 = 12
+    COMMAND_RENEW           uint8 = 13
+    COMMAND_CANCEL          uint8 = 14
+    COMMAND_QUERY           uint8 = 15
+)
+
+const (
+    ADMIN_COMMAND_TEXT          uint8 = 0
+    ADMIN_COMMAND_INFO          uint8 = 1
+    ADMIN_COMMAND_CONFIG_GET    uint8 = 2
+    ADMIN_COMMAND_CONFIG_SET    uint8 = 3
+    ADMIN_COMMAND_CLIENT_LIST   uint8 = 4
+    ADMIN_COMMAND_CLIENT_KILL   uint8 = 5
+    ADMIN_COMMAND_FLUSHDB       uint8 = 6
+    ADMIN_COMMAND_REWRITEAOF    uint8 = 7
+)
+
+const MAX_MULTI_LOCK_KEYS = 256
+const MAX_ADMIN_ARGS = 16
+const MAX_EXPRIED_TIME = 0x00ffffff
+const MAX_EXPRIED_DEADLINE_TIME = 0x007fffff
+
+const (
+    CAPABILITY_MILLISECOND_TIME     uint32 = 0x00000001
+    CAPABILITY_UNLIMITED_EXPRIED    uint32 = 0x00000002
+    CAPABILITY_LOCK_NAME            uint32 = 0x00000004
+    CAPABILITY_MULTI_LOCK           uint32 = 0x00000008
+    CAPABILITY_FENCING_TOKEN        uint32 = 0x00000010
+    CAPABILITY_RENEW                uint32 = 0x00000020
+    CAPABILITY_CANCEL               uint32 = 0x00000040
+    CAPABILITY_PRIORITY             uint32 = 0x00000080
+    CAPABILITY_EXTENDED_TIME        uint32 = 0x00000100
+    CAPABILITY_QUERY                uint32 = 0x00000200
+    CAPABILITY_ADMIN                uint32 = 0x00000400
 )
 
 const (
@@ -28,6 +73,8 @@ const (
     RESULT_EXPRIED
     RESULT_STATE_ERROR
     RESULT_ERROR
+    RESULT_CANCELED
+    RESULT_NOT_SUPPORTED
 )
 
 var ERROR_MSG []string = []string{
@@ -43,6 +90,8 @@ var ERROR_MSG []string = []string{
     "EXPRIED",
     "RESULT_STATE_ERROR",
     "UNKNOWN_ERROR",
+    "CANCELED",
+    "NOT_SUPPORTED",
 }
 
 type ICommand interface {
@@ -60,6 +109,10 @@ type CommandEncode interface {
     Encode(buf []byte) error
 }
 
+type CommandEncodeLength interface {
+    GetEncodeLength() int
+}
+
 type Command struct {
     Magic     uint8
     Version   uint8
@@ -220,17 +273,22 @@ func (self *InitCommand) Encode(buf []byte) error {
     return nil
 }
 
-var INIT_COMMAND_BLANK_BYTERS = [43]byte{}
+var INIT_COMMAND_BLANK_BYTERS = [22]byte{}
 
 type InitResultCommand struct {
     ResultCommand
-    InitType  uint8
-    Blank     [43]byte
+    InitType        uint8
+    ProtocolVersion uint8
+    Capabilities    uint32
+    ServerVersion   [16]byte
+    Blank           [22]byte
 }
 
-func NewInitResultCommand(command *InitCommand, result uint8, init_type uint8) *InitResultCommand {
+func NewInitResultCommand(command *InitCommand, result uint8, init_type uint8, capabilities uint32, server_version string) *InitResultCommand {
     result_command := ResultCommand{ MAGIC, VERSION, command.CommandType, command.RequestId, result}
-    return &InitResultCommand{result_command,init_type, INIT_COMMAND_BLANK_BYTERS}
+    version := [16]byte{}
+    copy(version[:], server_version)
+    return &InitResultCommand{result_command,init_type, VERSION2, capabilities, version, INIT_COMMAND_BLANK_BYTERS}
 }
 
 func (self *InitResultCommand) Decode(buf []byte) error{
@@ -245,7 +303,9 @@ func (self *InitResultCommand) Decode(buf []byte) error{
         buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
         buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
 
-    self.Result, self.InitType = uint8(buf[19]), uint8(buf[20])
+    self.Result, self.InitType, self.ProtocolVersion = uint8(buf[19]), uint8(buf[20]), uint8(buf[21])
+    self.Capabilities = uint32(buf[22]) | uint32(buf[23])<<8 | uint32(buf[24])<<16 | uint32(buf[25])<<24
+    copy(self.ServerVersion[:], buf[26:42])
 
     return nil
 }
@@ -262,15 +322,26 @@ func (self *InitResultCommand) Encode(buf []byte) error {
         self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
         self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
         
-    buf[19], buf[20] = uint8(self.Result), byte(self.InitType)
+    buf[19], buf[20], buf[21] = uint8(self.Result), byte(self.InitType), byte(self.ProtocolVersion)
+    buf[22], buf[23], buf[24], buf[25] = byte(self.Capabilities), byte(self.Capabilities >> 8), byte(self.Capabilities >> 16), byte(self.Capabilities >> 24)
+    copy(buf[26:42], self.ServerVersion[:])
 
-    for i :=0; i<43; i++ {
-        buf[21 + i] = 0x00
+    for i :=0; i<22; i++ {
+        buf[42 + i] = 0x00
     }
 
     return nil
 }
 
+func (self *InitResultCommand) GetServerVersion() string {
+    for i, c := range self.ServerVersion {
+        if c == 0 {
+            return string(self.ServerVersion[:i])
+        }
+    }
+    return string(self.ServerVersion[:])
+}
+
 type LockCommand struct {
     Command
     Flag            uint8
@@ -279,20 +350,21 @@ type LockCommand struct {
     LockKey         [16]byte
     TimeoutFlag     uint16
     /*
-    |15      |                13                   |        11      |       10       |  8|7                                  0|
-    |--------|-------------------------------------|----------------|----------------|---|------------------------------------|
-    |        |update_no_reset_timeout_checked_count|timeout_is_error|millisecond_time|   |                                    |
+    |    15     |                13                   |        11      |       10       |  8|7                                  0|
+    |-----------|-------------------------------------|----------------|----------------|---|------------------------------------|
+    |minute_time|update_no_reset_timeout_checked_count|timeout_is_error|millisecond_time|   |           wait_priority            |
     */
     Timeout         uint16
     ExpriedFlag     uint16
     /*
-    |15      |          14          |                13                   |  12 |        11      |       10       |      9      |        8         |7                                  0|
-    |--------|----------------------|-------------------------------------|-----|----------------|----------------|-------------|------------------|------------------------------------|
-    |        |unlimited_expried_time|update_no_reset_expried_checked_count|aofed|expried_is_error|millisecond_time|zeor_aof_time|unlimited_aof_time|                                    |
+    |      15     |          14          |                13                   |  12 |        11      |       10       |      9      |        8         |7                                  0|
+    |-------------|----------------------|-------------------------------------|-----|----------------|----------------|-------------|------------------|------------------------------------|
+    |deadline_time|unlimited_expried_time|update_no_reset_expried_checked_count|aofed|expried_is_error|millisecond_time|zeor_aof_time|unlimited_aof_time|        expried bits 23-16          |
     */
     Expried         uint16
     Count           uint16
     Rcount          uint8
+    LockName        string
 }
 
 func NewLockCommand(buf []byte) *LockCommand {
@@ -329,6 +401,11 @@ func (self *LockCommand) Decode(buf []byte) error{
         
     self.Timeout, self.TimeoutFlag, self.Expried, self.ExpriedFlag = uint16(buf[53]) | uint16(buf[54])<<8, uint16(buf[55]) | uint16(buf[56])<<8, uint16(buf[57]) | uint16(buf[58])<<8, uint16(buf[59]) | uint16(buf[60])<<8
     self.Count, self.Rcount = uint16(buf[61]) | uint16(buf[62])<<8, uint8(buf[63])
+
+    self.LockName = ""
+    if self.Version == VERSION2 && len(buf) >= 66 {
+        return self.DecodeLockName(buf[64:])
+    }
     return nil
 }
 
@@ -360,9 +437,113 @@ func (self *LockCommand) Encode(buf []byte) error {
 
     buf[61], buf[62], buf[63] = byte(self.Count), byte(self.Count >> 8), byte(self.Rcount)
 
+    if self.Version == VERSION2 {
+        return self.EncodeLockName(buf[64:])
+    }
+    return nil
+}
+
+func (self *LockCommand) GetEncodeLength() int {
+    if self.Version == VERSION2 {
+        return 66 + len(self.LockName)
+    }
+    return 64
+}
+
+func (self *LockCommand) DecodeLockName(buf []byte) error {
+    if len(buf) < 2 {
+        return errors.New("buf too short")
+    }
+
+    name_len := int(uint16(buf[0]) | uint16(buf[1])<<8)
+    if len(buf) < 2 + name_len {
+        return errors.New("buf too short")
+    }
+
+    self.LockName = string(buf[2:2 + name_len])
+    if name_len > 0 {
+        LockNameToKey(self.LockName, &self.LockKey)
+    }
+    return nil
+}
+
+func (self *LockCommand) GetTimeout() uint32 {
+    if self.TimeoutFlag & 0x8400 == 0x8000 {
+        return uint32(self.Timeout) * 60
+    }
+    return uint32(self.Timeout)
+}
+
+func (self *LockCommand) GetExpried() uint32 {
+    return uint32(self.Expried) | uint32(self.ExpriedFlag & 0x00ff) << 16
+}
+
+func (self *LockCommand) SetExpried(expried uint32) {
+    if expried > MAX_EXPRIED_TIME {
+        expried = MAX_EXPRIED_TIME
+    }
+    self.Expried, self.ExpriedFlag = uint16(expried), self.ExpriedFlag & 0xff00 | uint16(expried >> 16)
+}
+
+func ResolveExpriedDeadline(expried uint16, expried_flag uint16, now int64) (uint16, uint16) {
+    if expried_flag & 0x8000 == 0 {
+        return expried, expried_flag
+    }
+
+    deadline := int64(expried) | int64(expried_flag & 0x00ff) << 16
+    expried_time := (deadline - now) & MAX_EXPRIED_TIME
+    if expried_time > MAX_EXPRIED_DEADLINE_TIME {
+        expried_time = 0
+    }
+    return uint16(expried_time), expried_flag & 0x7b00 | uint16(expried_time >> 16)
+}
+
+func (self *LockCommand) EncodeLockName(buf []byte) error {
+    name_len := len(self.LockName)
+    if name_len > MAX_LOCK_NAME_LENGTH {
+        return errors.New("lock name too long")
+    }
+
+    if len(buf) < 2 + name_len {
+        return errors.New("buf too short")
+    }
+
+    buf[0], buf[1] = byte(name_len), byte(name_len >> 8)
+    copy(buf[2:], self.LockName)
     return nil
 }
 
+func LockNameToKey(lock_name string, lock_key *[16]byte) {
+    name_len := len(lock_name)
+    if name_len == 16 {
+        copy(lock_key[:], lock_name)
+        return
+    }
+
+    if name_len > 16 {
+        if name_len == 32 {
+            v, err := hex.DecodeString(lock_name)
+            if err == nil {
+                copy(lock_key[:], v)
+                return
+            }
+        }
+
+        v := md5.Sum([]byte(lock_name))
+        copy(lock_key[:], v[:])
+        return
+    }
+
+    name_index := 16 - name_len
+    for i := 0; i < 16; i++ {
+        if i < name_index {
+            lock_key[i] = 0
+        } else {
+            lock_key[i] = lock_name[i - name_index]
+        }
+    }
+}
+
 var RESULT_LOCK_COMMAND_BLANK_BYTERS = [4]byte{}
 
 type LockResultCommand struct {
@@ -376,12 +557,19 @@ type LockResultCommand struct {
     Lrcount   uint8
     Rcount    uint8
     Blank     [4]byte
+    Token     uint64
 }
 
 func NewLockResultCommand(command *LockCommand, result uint8, flag uint8, lcount uint16, count uint16, lrcount uint8, rcount uint8) *LockResultCommand {
     result_command := ResultCommand{ MAGIC, VERSION, command.CommandType, command.RequestId, result}
     return &LockResultCommand{result_command, flag, command.DbId, command.LockId, command.LockKey,
-        lcount, count, lrcount, rcount, RESULT_LOCK_COMMAND_BLANK_BYTERS}
+        lcount, count, lrcount, rcount, RESULT_LOCK_COMMAND_BLANK_BYTERS, 0}
+}
+
+func NewTokenLockResultCommand(command *LockCommand, result uint8, flag uint8, lcount uint16, count uint16, lrcount uint8, rcount uint8, token uint64) *LockResultCommand {
+    result_command := ResultCommand{ MAGIC, command.Version, command.CommandType, command.RequestId, result}
+    return &LockResultCommand{result_command, flag, command.DbId, command.LockId, command.LockKey,
+        lcount, count, lrcount, rcount, RESULT_LOCK_COMMAND_BLANK_BYTERS, token}
 }
 
 func (self *LockResultCommand) Decode(buf []byte) error{
@@ -409,7 +597,21 @@ func (self *LockResultCommand) Decode(buf []byte) error{
         buf[46], buf[47], buf[48], buf[49], buf[50], buf[51], buf[52], buf[53]
 
     self.Lcount, self.Count, self.Lrcount, self.Rcount = uint16(buf[54]) | uint16(buf[55])<<8, uint16(buf[56]) | uint16(buf[57])<<8, uint8(buf[58]), uint8(buf[59])
+    self.Blank[0], self.Blank[1], self.Blank[2], self.Blank[3] = buf[60], buf[61], buf[62], buf[63]
+
+    self.Token = 0
+    if self.Version == VERSION2 && len(buf) >= 72 {
+        return self.DecodeToken(buf[64:])
+    }
+    return nil
+}
+
+func (self *LockResultCommand) DecodeToken(buf []byte) error {
+    if len(buf) < 8 {
+        return errors.New("buf too short")
+    }
 
+    self.Token = uint64(buf[0]) | uint64(buf[1])<<8 | uint64(buf[2])<<16 | uint64(buf[3])<<24 | uint64(buf[4])<<32 | uint64(buf[5])<<40 | uint64(buf[6])<<48 | uint64(buf[7])<<56
     return nil
 }
 
@@ -439,9 +641,25 @@ func (self *LockResultCommand) Encode(buf []byte) error {
 
     buf[54], buf[55], buf[56], buf[57], buf[58], buf[59], buf[60], buf[61] = byte(self.Lcount), byte(self.Lcount >> 8), byte(self.Count), byte(self.Count >> 8), byte(self.Lrcount), byte(self.Rcount), 0x00, 0x00
     buf[62], buf[63] = 0x00, 0x00
+
+    if self.Version == VERSION2 {
+        if len(buf) < 72 {
+            return errors.New("buf too short")
+        }
+
+        buf[64], buf[65], buf[66], buf[67], buf[68], buf[69], buf[70], buf[71] = byte(self.Token), byte(self.Token >> 8), byte(self.Token >> 16), byte(self.Token >> 24),
+            byte(self.Token >> 32), byte(self.Token >> 40), byte(self.Token >> 48), byte(self.Token >> 56)
+    }
     return nil
 }
 
+func (self *LockResultCommand) GetEncodeLength() int {
+    if self.Version == VERSION2 {
+        return 72
+    }
+    return 64
+}
+
 type StateCommand struct {
     Command
     Flag      uint8
@@ -609,7 +827,10 @@ func (self *StateResultCommand) Encode(buf []byte) error {
 type AdminCommand struct {
     Command
     AdminType   uint8
-    Blank       [44]byte
+    DbId        uint8
+    ArgCount    uint8
+    Blank       [42]byte
+    Args        []string
 }
 
 func NewAdminCommand(buf []byte) *AdminCommand {
@@ -621,6 +842,10 @@ func NewAdminCommand(buf []byte) *AdminCommand {
 }
 
 func (self *AdminCommand) Decode(buf []byte) error{
+    if len(buf) < 64 {
+        return errors.New("buf too short")
+    }
+
     self.Magic = uint8(buf[0])
     self.Version = uint8(buf[1])
     self.CommandType = uint8(buf[2])
@@ -630,12 +855,45 @@ func (self *AdminCommand) Decode(buf []byte) error{
         buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
         buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
 
-    self.AdminType = uint8(buf[19])
+    self.AdminType, self.DbId, self.ArgCount = uint8(buf[19]), uint8(buf[20]), uint8(buf[21])
+    if self.ArgCount > MAX_ADMIN_ARGS {
+        return errors.New("too many admin args")
+    }
+
+    self.Args = nil
+    if self.ArgCount > 0 && len(buf) > 64 {
+        return self.DecodeArgs(buf[64:])
+    }
+    return nil
+}
 
+func (self *AdminCommand) DecodeArgs(buf []byte) error {
+    self.Args = make([]string, 0, self.ArgCount)
+    index := 0
+    for i := 0; i < int(self.ArgCount); i++ {
+        if len(buf) < index + 2 {
+            return errors.New("buf too short")
+        }
+
+        arg_len := int(uint16(buf[index]) | uint16(buf[index + 1])<<8)
+        if len(buf) < index + 2 + arg_len {
+            return errors.New("buf too short")
+        }
+        self.Args = append(self.Args, string(buf[index + 2:index + 2 + arg_len]))
+        index += 2 + arg_len
+    }
     return nil
 }
 
 func (self *AdminCommand) Encode(buf []byte) error {
+    if len(buf) < self.GetEncodeLength() {
+        return errors.New("buf too short")
+    }
+
+    if len(self.Args) > MAX_ADMIN_ARGS {
+        return errors.New("too many admin args")
+    }
+
     buf[0] = byte(self.Magic)
     buf[1] = byte(self.Version)
     buf[2] = byte(self.CommandType)
@@ -645,26 +903,53 @@ func (self *AdminCommand) Encode(buf []byte) error {
         self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
         self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
 
-    buf[19] = byte(self.AdminType)
+    self.ArgCount = uint8(len(self.Args))
+    buf[19], buf[20], buf[21] = byte(self.AdminType), byte(self.DbId), byte(self.ArgCount)
 
-    for i :=0; i<44; i++ {
-        buf[20 + i] = 0x00
+    for i :=0; i<42; i++ {
+        buf[22 + i] = 0x00
     }
 
+    index := 64
+    for _, arg := range self.Args {
+        if len(arg) > 0xffff {
+            return errors.New("admin arg too long")
+        }
+
+        buf[index], buf[index + 1] = byte(len(arg)), byte(len(arg) >> 8)
+        copy(buf[index + 2:], arg)
+        index += 2 + len(arg)
+    }
     return nil
 }
 
+func (self *AdminCommand) GetEncodeLength() int {
+    length := 64
+    for _, arg := range self.Args {
+        length += 2 + len(arg)
+    }
+    return length
+}
+
 type AdminResultCommand struct {
     ResultCommand
-    Blank [44]byte
+    AdminType   uint8
+    DbId        uint8
+    ValueCount  uint16
+    Blank       [40]byte
+    Values      []string
 }
 
-func NewAdminResultCommand(command *AdminCommand, result uint8) *AdminResultCommand {
+func NewAdminResultCommand(command *AdminCommand, result uint8, values []string) *AdminResultCommand {
     result_command := ResultCommand{MAGIC, VERSION, command.CommandType, command.RequestId, result}
-    return &AdminResultCommand{result_command, [44]byte{}}
+    return &AdminResultCommand{result_command, command.AdminType, command.DbId, uint16(len(values)), [40]byte{}, values}
 }
 
 func (self *AdminResultCommand) Decode(buf []byte) error{
+    if len(buf) < 64 {
+        return errors.New("buf too short")
+    }
+
     self.Magic = uint8(buf[0])
     self.Version = uint8(buf[1])
     self.CommandType = uint8(buf[2])
@@ -675,11 +960,42 @@ func (self *AdminResultCommand) Decode(buf []byte) error{
         buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
 
     self.Result = uint8(buf[19])
+    self.AdminType, self.DbId, self.ValueCount = uint8(buf[20]), uint8(buf[21]), uint16(buf[22]) | uint16(buf[23])<<8
 
+    self.Values = nil
+    if self.ValueCount > 0 && len(buf) > 64 {
+        return self.DecodeValues(buf[64:])
+    }
+    return nil
+}
+
+func (self *AdminResultCommand) DecodeValues(buf []byte) error {
+    self.Values = make([]string, 0, self.ValueCount)
+    index := 0
+    for i := 0; i < int(self.ValueCount); i++ {
+        if len(buf) < index + 4 {
+            return errors.New("buf too short")
+        }
+
+        value_len := int(uint32(buf[index]) | uint32(buf[index + 1])<<8 | uint32(buf[index + 2])<<16 | uint32(buf[index + 3])<<24)
+        if len(buf) < index + 4 + value_len {
+            return errors.New("buf too short")
+        }
+        self.Values = append(self.Values, string(buf[index + 4:index + 4 + value_len]))
+        index += 4 + value_len
+    }
     return nil
 }
 
 func (self *AdminResultCommand) Encode(buf []byte) error {
+    if len(buf) < self.GetEncodeLength() {
+        return errors.New("buf too short")
+    }
+
+    if len(self.Values) > 0xffff {
+        return errors.New("too many admin values")
+    }
+
     buf[0] = byte(self.Magic)
     buf[1] = byte(self.Version)
     buf[2] = byte(self.CommandType)
@@ -691,13 +1007,30 @@ func (self *AdminResultCommand) Encode(buf []byte) error {
 
     buf[19] = uint8(self.Result)
 
-    for i :=0; i<44; i++ {
-        buf[20 + i] = 0x00
+    self.ValueCount = uint16(len(self.Values))
+    buf[20], buf[21], buf[22], buf[23] = byte(self.AdminType), byte(self.DbId), byte(self.ValueCount), byte(self.ValueCount >> 8)
+
+    for i :=0; i<40; i++ {
+        buf[24 + i] = 0x00
     }
 
+    index := 64
+    for _, value := range self.Values {
+        buf[index], buf[index + 1], buf[index + 2], buf[index + 3] = byte(len(value)), byte(len(value) >> 8), byte(len(value) >> 16), byte(len(value) >> 24)
+        copy(buf[index + 4:], value)
+        index += 4 + len(value)
+    }
     return nil
 }
 
+func (self *AdminResultCommand) GetEncodeLength() int {
+    length := 64
+    for _, value := range self.Values {
+        length += 4 + len(value)
+    }
+    return length
+}
+
 type PingCommand struct {
     Command
     Blank       [45]byte
@@ -870,4 +1203,716 @@ func (self *QuitResultCommand) Encode(buf []byte) error {
     }
 
     return nil
-}
\ No newline at end of file
+}
+
+type SyncCommand struct {
+    Command
+    AofIndex    uint32
+    AofId       uint32
+    Blank       [37]byte
+}
+
+func NewSyncCommand(buf []byte) *SyncCommand {
+    command := SyncCommand{}
+    if command.Decode(buf) != nil {
+        return nil
+    }
+    return &command
+}
+
+func (self *SyncCommand) Decode(buf []byte) error{
+    self.Magic = uint8(buf[0])
+    self.Version = uint8(buf[1])
+    self.CommandType = uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.AofIndex = uint32(buf[19]) | uint32(buf[20])<<8 | uint32(buf[21])<<16 | uint32(buf[22])<<24
+    self.AofId = uint32(buf[23]) | uint32(buf[24])<<8 | uint32(buf[25])<<16 | uint32(buf[26])<<24
+
+    return nil
+}
+
+func (self *SyncCommand) Encode(buf []byte) error {
+    buf[0] = byte(self.Magic)
+    buf[1] = byte(self.Version)
+    buf[2] = byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19], buf[20], buf[21], buf[22] = byte(self.AofIndex), byte(self.AofIndex >> 8), byte(self.AofIndex >> 16), byte(self.AofIndex >> 24)
+    buf[23], buf[24], buf[25], buf[26] = byte(self.AofId), byte(self.AofId >> 8), byte(self.AofId >> 16), byte(self.AofId >> 24)
+
+    for i :=0; i<37; i++ {
+        buf[27 + i] = 0x00
+    }
+
+    return nil
+}
+
+type SyncResultCommand struct {
+    ResultCommand
+    AofIndex    uint32
+    AofId       uint32
+    LockCount   uint64
+    Blank       [28]byte
+}
+
+func NewSyncResultCommand(command *SyncCommand, result uint8, aof_index uint32, aof_id uint32, lock_count uint64) *SyncResultCommand {
+    result_command := ResultCommand{MAGIC, VERSION, command.CommandType, command.RequestId, result}
+    return &SyncResultCommand{result_command, aof_index, aof_id, lock_count, [28]byte{}}
+}
+
+func (self *SyncResultCommand) Decode(buf []byte) error{
+    self.Magic = uint8(buf[0])
+    self.Version = uint8(buf[1])
+    self.CommandType = uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Result = uint8(buf[19])
+
+    self.AofIndex = uint32(buf[20]) | uint32(buf[21])<<8 | uint32(buf[22])<<16 | uint32(buf[23])<<24
+    self.AofId = uint32(buf[24]) | uint32(buf[25])<<8 | uint32(buf[26])<<16 | uint32(buf[27])<<24
+    self.LockCount = uint64(buf[28]) | uint64(buf[29])<<8 | uint64(buf[30])<<16 | uint64(buf[31])<<24 | uint64(buf[32])<<32 | uint64(buf[33])<<40 | uint64(buf[34])<<48 | uint64(buf[35])<<56
+
+    return nil
+}
+
+func (self *SyncResultCommand) Encode(buf []byte) error {
+    buf[0] = byte(self.Magic)
+    buf[1] = byte(self.Version)
+    buf[2] = byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19] = uint8(self.Result)
+
+    buf[20], buf[21], buf[22], buf[23] = byte(self.AofIndex), byte(self.AofIndex >> 8), byte(self.AofIndex >> 16), byte(self.AofIndex >> 24)
+    buf[24], buf[25], buf[26], buf[27] = byte(self.AofId), byte(self.AofId >> 8), byte(self.AofId >> 16), byte(self.AofId >> 24)
+    buf[28], buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35] = byte(self.LockCount), byte(self.LockCount >> 8), byte(self.LockCount >> 16), byte(self.LockCount >> 24), byte(self.LockCount >> 32), byte(self.LockCount >> 40), byte(self.LockCount >> 48), byte(self.LockCount >> 56)
+
+    for i :=0; i<28; i++ {
+        buf[36 + i] = 0x00
+    }
+
+    return nil
+}
+
+type RaftVoteCommand struct {
+    Command
+    Term            uint64
+    NodeId          uint8
+    LastLogIndex    uint64
+    LastLogTerm     uint64
+    Blank           [20]byte
+}
+
+func NewRaftVoteCommand(buf []byte) *RaftVoteCommand {
+    command := RaftVoteCommand{}
+    if command.Decode(buf) != nil {
+        return nil
+    }
+    return &command
+}
+
+func (self *RaftVoteCommand) Decode(buf []byte) error{
+    self.Magic = uint8(buf[0])
+    self.Version = uint8(buf[1])
+    self.CommandType = uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Term = uint64(buf[19]) | uint64(buf[20])<<8 | uint64(buf[21])<<16 | uint64(buf[22])<<24 | uint64(buf[23])<<32 | uint64(buf[24])<<40 | uint64(buf[25])<<48 | uint64(buf[26])<<56
+    self.NodeId = uint8(buf[27])
+    self.LastLogIndex = uint64(buf[28]) | uint64(buf[29])<<8 | uint64(buf[30])<<16 | uint64(buf[31])<<24 | uint64(buf[32])<<32 | uint64(buf[33])<<40 | uint64(buf[34])<<48 | uint64(buf[35])<<56
+    self.LastLogTerm = uint64(buf[36]) | uint64(buf[37])<<8 | uint64(buf[38])<<16 | uint64(buf[39])<<24 | uint64(buf[40])<<32 | uint64(buf[41])<<40 | uint64(buf[42])<<48 | uint64(buf[43])<<56
+
+    return nil
+}
+
+func (self *RaftVoteCommand) Encode(buf []byte) error {
+    buf[0] = byte(self.Magic)
+    buf[1] = byte(self.Version)
+    buf[2] = byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19], buf[20], buf[21], buf[22], buf[23], buf[24], buf[25], buf[26] = byte(self.Term), byte(self.Term >> 8), byte(self.Term >> 16), byte(self.Term >> 24), byte(self.Term >> 32), byte(self.Term >> 40), byte(self.Term >> 48), byte(self.Term >> 56)
+    buf[27] = byte(self.NodeId)
+    buf[28], buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35] = byte(self.LastLogIndex), byte(self.LastLogIndex >> 8), byte(self.LastLogIndex >> 16), byte(self.LastLogIndex >> 24), byte(self.LastLogIndex >> 32), byte(self.LastLogIndex >> 40), byte(self.LastLogIndex >> 48), byte(self.LastLogIndex >> 56)
+    buf[36], buf[37], buf[38], buf[39], buf[40], buf[41], buf[42], buf[43] = byte(self.LastLogTerm), byte(self.LastLogTerm >> 8), byte(self.LastLogTerm >> 16), byte(self.LastLogTerm >> 24), byte(self.LastLogTerm >> 32), byte(self.LastLogTerm >> 40), byte(self.LastLogTerm >> 48), byte(self.LastLogTerm >> 56)
+
+    for i :=0; i<20; i++ {
+        buf[44 + i] = 0x00
+    }
+
+    return nil
+}
+
+type RaftVoteResultCommand struct {
+    ResultCommand
+    Term            uint64
+    VoteGranted     uint8
+    Blank           [35]byte
+}
+
+func NewRaftVoteResultCommand(command *RaftVoteCommand, result uint8, term uint64, vote_granted uint8) *RaftVoteResultCommand {
+    result_command := ResultCommand{MAGIC, VERSION, command.CommandType, command.RequestId, result}
+    return &RaftVoteResultCommand{result_command, term, vote_granted, [35]byte{}}
+}
+
+func (self *RaftVoteResultCommand) Decode(buf []byte) error{
+    self.Magic = uint8(buf[0])
+    self.Version = uint8(buf[1])
+    self.CommandType = uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Result = uint8(buf[19])
+
+    self.Term = uint64(buf[20]) | uint64(buf[21])<<8 | uint64(buf[22])<<16 | uint64(buf[23])<<24 | uint64(buf[24])<<32 | uint64(buf[25])<<40 | uint64(buf[26])<<48 | uint64(buf[27])<<56
+    self.VoteGranted = uint8(buf[28])
+
+    return nil
+}
+
+func (self *RaftVoteResultCommand) Encode(buf []byte) error {
+    buf[0] = byte(self.Magic)
+    buf[1] = byte(self.Version)
+    buf[2] = byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19] = uint8(self.Result)
+
+    buf[20], buf[21], buf[22], buf[23], buf[24], buf[25], buf[26], buf[27] = byte(self.Term), byte(self.Term >> 8), byte(self.Term >> 16), byte(self.Term >> 24), byte(self.Term >> 32), byte(self.Term >> 40), byte(self.Term >> 48), byte(self.Term >> 56)
+    buf[28] = byte(self.VoteGranted)
+
+    for i :=0; i<35; i++ {
+        buf[29 + i] = 0x00
+    }
+
+    return nil
+}
+
+type RaftAppendCommand struct {
+    Command
+    Term            uint64
+    NodeId          uint8
+    PrevLogIndex    uint64
+    PrevLogTerm     uint64
+    LeaderCommit    uint64
+    EntryCount      uint16
+    Flag            uint8
+    Blank           [9]byte
+}
+
+func NewRaftAppendCommand(buf []byte) *RaftAppendCommand {
+    command := RaftAppendCommand{}
+    if command.Decode(buf) != nil {
+        return nil
+    }
+    return &command
+}
+
+func (self *RaftAppendCommand) Decode(buf []byte) error{
+    self.Magic = uint8(buf[0])
+    self.Version = uint8(buf[1])
+    self.CommandType = uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Term = uint64(buf[19]) | uint64(buf[20])<<8 | uint64(buf[21])<<16 | uint64(buf[22])<<24 | uint64(buf[23])<<32 | uint64(buf[24])<<40 | uint64(buf[25])<<48 | uint64(buf[26])<<56
+    self.NodeId = uint8(buf[27])
+    self.PrevLogIndex = uint64(buf[28]) | uint64(buf[29])<<8 | uint64(buf[30])<<16 | uint64(buf[31])<<24 | uint64(buf[32])<<32 | uint64(buf[33])<<40 | uint64(buf[34])<<48 | uint64(buf[35])<<56
+    self.PrevLogTerm = uint64(buf[36]) | uint64(buf[37])<<8 | uint64(buf[38])<<16 | uint64(buf[39])<<24 | uint64(buf[40])<<32 | uint64(buf[41])<<40 | uint64(buf[42])<<48 | uint64(buf[43])<<56
+    self.LeaderCommit = uint64(buf[44]) | uint64(buf[45])<<8 | uint64(buf[46])<<16 | uint64(buf[47])<<24 | uint64(buf[48])<<32 | uint64(buf[49])<<40 | uint64(buf[50])<<48 | uint64(buf[51])<<56
+    self.EntryCount = uint16(buf[52]) | uint16(buf[53])<<8
+    self.Flag = uint8(buf[54])
+
+    return nil
+}
+
+func (self *RaftAppendCommand) Encode(buf []byte) error {
+    buf[0] = byte(self.Magic)
+    buf[1] = byte(self.Version)
+    buf[2] = byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19], buf[20], buf[21], buf[22], buf[23], buf[24], buf[25], buf[26] = byte(self.Term), byte(self.Term >> 8), byte(self.Term >> 16), byte(self.Term >> 24), byte(self.Term >> 32), byte(self.Term >> 40), byte(self.Term >> 48), byte(self.Term >> 56)
+    buf[27] = byte(self.NodeId)
+    buf[28], buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35] = byte(self.PrevLogIndex), byte(self.PrevLogIndex >> 8), byte(self.PrevLogIndex >> 16), byte(self.PrevLogIndex >> 24), byte(self.PrevLogIndex >> 32), byte(self.PrevLogIndex >> 40), byte(self.PrevLogIndex >> 48), byte(self.PrevLogIndex >> 56)
+    buf[36], buf[37], buf[38], buf[39], buf[40], buf[41], buf[42], buf[43] = byte(self.PrevLogTerm), byte(self.PrevLogTerm >> 8), byte(self.PrevLogTerm >> 16), byte(self.PrevLogTerm >> 24), byte(self.PrevLogTerm >> 32), byte(self.PrevLogTerm >> 40), byte(self.PrevLogTerm >> 48), byte(self.PrevLogTerm >> 56)
+    buf[44], buf[45], buf[46], buf[47], buf[48], buf[49], buf[50], buf[51] = byte(self.LeaderCommit), byte(self.LeaderCommit >> 8), byte(self.LeaderCommit >> 16), byte(self.LeaderCommit >> 24), byte(self.LeaderCommit >> 32), byte(self.LeaderCommit >> 40), byte(self.LeaderCommit >> 48), byte(self.LeaderCommit >> 56)
+    buf[52], buf[53] = byte(self.EntryCount), byte(self.EntryCount >> 8)
+    buf[54] = byte(self.Flag)
+
+    for i :=0; i<9; i++ {
+        buf[55 + i] = 0x00
+    }
+
+    return nil
+}
+
+type RaftAppendResultCommand struct {
+    ResultCommand
+    Term            uint64
+    Success         uint8
+    MatchIndex      uint64
+    Blank           [27]byte
+}
+
+func NewRaftAppendResultCommand(command *RaftAppendCommand, result uint8, term uint64, success uint8, match_index uint64) *RaftAppendResultCommand {
+    result_command := ResultCommand{MAGIC, VERSION, command.CommandType, command.RequestId, result}
+    return &RaftAppendResultCommand{result_command, term, success, match_index, [27]byte{}}
+}
+
+func (self *RaftAppendResultCommand) Decode(buf []byte) error{
+    self.Magic = uint8(buf[0])
+    self.Version = uint8(buf[1])
+    self.CommandType = uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Result = uint8(buf[19])
+
+    self.Term = uint64(buf[20]) | uint64(buf[21])<<8 | uint64(buf[22])<<16 | uint64(buf[23])<<24 | uint64(buf[24])<<32 | uint64(buf[25])<<40 | uint64(buf[26])<<48 | uint64(buf[27])<<56
+    self.Success = uint8(buf[28])
+    self.MatchIndex = uint64(buf[29]) | uint64(buf[30])<<8 | uint64(buf[31])<<16 | uint64(buf[32])<<24 | uint64(buf[33])<<32 | uint64(buf[34])<<40 | uint64(buf[35])<<48 | uint64(buf[36])<<56
+
+    return nil
+}
+
+func (self *RaftAppendResultCommand) Encode(buf []byte) error {
+    buf[0] = byte(self.Magic)
+    buf[1] = byte(self.Version)
+    buf[2] = byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19] = uint8(self.Result)
+
+    buf[20], buf[21], buf[22], buf[23], buf[24], buf[25], buf[26], buf[27] = byte(self.Term), byte(self.Term >> 8), byte(self.Term >> 16), byte(self.Term >> 24), byte(self.Term >> 32), byte(self.Term >> 40), byte(self.Term >> 48), byte(self.Term >> 56)
+    buf[28] = byte(self.Success)
+    buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35], buf[36] = byte(self.MatchIndex), byte(self.MatchIndex >> 8), byte(self.MatchIndex >> 16), byte(self.MatchIndex >> 24), byte(self.MatchIndex >> 32), byte(self.MatchIndex >> 40), byte(self.MatchIndex >> 48), byte(self.MatchIndex >> 56)
+
+    for i :=0; i<27; i++ {
+        buf[37 + i] = 0x00
+    }
+
+    return nil
+}
+
+type SnapshotCommand struct {
+    Command
+    Flag        uint8
+    Blank       [44]byte
+}
+
+func NewSnapshotCommand(buf []byte) *SnapshotCommand {
+    command := SnapshotCommand{}
+    if command.Decode(buf) != nil {
+        return nil
+    }
+    return &command
+}
+
+func (self *SnapshotCommand) Decode(buf []byte) error{
+    self.Magic = uint8(buf[0])
+    self.Version = uint8(buf[1])
+    self.CommandType = uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Flag = uint8(buf[19])
+
+    return nil
+}
+
+func (self *SnapshotCommand) Encode(buf []byte) error {
+    buf[0] = byte(self.Magic)
+    buf[1] = byte(self.Version)
+    buf[2] = byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19] = byte(self.Flag)
+
+    for i :=0; i<44; i++ {
+        buf[20 + i] = 0x00
+    }
+
+    return nil
+}
+
+type SnapshotResultCommand struct {
+    ResultCommand
+    AofIndex    uint32
+    AofId       uint32
+    LockCount   uint64
+    Blank       [28]byte
+}
+
+func NewSnapshotResultCommand(command *SnapshotCommand, result uint8, aof_index uint32, aof_id uint32, lock_count uint64) *SnapshotResultCommand {
+    result_command := ResultCommand{MAGIC, VERSION, command.CommandType, command.RequestId, result}
+    return &SnapshotResultCommand{result_command, aof_index, aof_id, lock_count, [28]byte{}}
+}
+
+func (self *SnapshotResultCommand) Decode(buf []byte) error{
+    self.Magic = uint8(buf[0])
+    self.Version = uint8(buf[1])
+    self.CommandType = uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Result = uint8(buf[19])
+
+    self.AofIndex = uint32(buf[20]) | uint32(buf[21])<<8 | uint32(buf[22])<<16 | uint32(buf[23])<<24
+    self.AofId = uint32(buf[24]) | uint32(buf[25])<<8 | uint32(buf[26])<<16 | uint32(buf[27])<<24
+    self.LockCount = uint64(buf[28]) | uint64(buf[29])<<8 | uint64(buf[30])<<16 | uint64(buf[31])<<24 | uint64(buf[32])<<32 | uint64(buf[33])<<40 | uint64(buf[34])<<48 | uint64(buf[35])<<56
+
+    return nil
+}
+
+func (self *SnapshotResultCommand) Encode(buf []byte) error {
+    buf[0] = byte(self.Magic)
+    buf[1] = byte(self.Version)
+    buf[2] = byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19] = uint8(self.Result)
+
+    buf[20], buf[21], buf[22], buf[23] = byte(self.AofIndex), byte(self.AofIndex >> 8), byte(self.AofIndex >> 16), byte(self.AofIndex >> 24)
+    buf[24], buf[25], buf[26], buf[27] = byte(self.AofId), byte(self.AofId >> 8), byte(self.AofId >> 16), byte(self.AofId >> 24)
+    buf[28], buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35] = byte(self.LockCount), byte(self.LockCount >> 8), byte(self.LockCount >> 16), byte(self.LockCount >> 24), byte(self.LockCount >> 32), byte(self.LockCount >> 40), byte(self.LockCount >> 48), byte(self.LockCount >> 56)
+
+    for i :=0; i<28; i++ {
+        buf[36 + i] = 0x00
+    }
+
+    return nil
+}
+
+type MultiLockCommand struct {
+    Command
+    Flag            uint8
+    DbId            uint8
+    LockId          [16]byte
+    Timeout         uint16
+    TimeoutFlag     uint16
+    Expried         uint16
+    ExpriedFlag     uint16
+    Count           uint16
+    Rcount          uint8
+    KeyCount        uint16
+    LockKeys        [][16]byte
+}
+
+func NewMultiLockCommand(buf []byte) *MultiLockCommand {
+    command := MultiLockCommand{}
+    if command.Decode(buf) != nil {
+        return nil
+    }
+    return &command
+}
+
+func (self *MultiLockCommand) Decode(buf []byte) error{
+    if len(buf) < 64 {
+        return errors.New("buf too short")
+    }
+
+    self.Magic, self.Version, self.CommandType = uint8(buf[0]), uint8(buf[1]), uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Flag, self.DbId = uint8(buf[19]), uint8(buf[20])
+
+    self.LockId[0], self.LockId[1], self.LockId[2], self.LockId[3], self.LockId[4], self.LockId[5], self.LockId[6], self.LockId[7],
+        self.LockId[8], self.LockId[9], self.LockId[10], self.LockId[11], self.LockId[12], self.LockId[13], self.LockId[14], self.LockId[15] =
+        buf[21], buf[22], buf[23], buf[24], buf[25], buf[26], buf[27], buf[28],
+        buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35], buf[36]
+
+    self.Timeout, self.TimeoutFlag, self.Expried, self.ExpriedFlag = uint16(buf[37]) | uint16(buf[38])<<8, uint16(buf[39]) | uint16(buf[40])<<8, uint16(buf[41]) | uint16(buf[42])<<8, uint16(buf[43]) | uint16(buf[44])<<8
+    self.Count, self.Rcount, self.KeyCount = uint16(buf[45]) | uint16(buf[46])<<8, uint8(buf[47]), uint16(buf[48]) | uint16(buf[49])<<8
+
+    if self.KeyCount > MAX_MULTI_LOCK_KEYS {
+        return errors.New("too many lock keys")
+    }
+
+    self.LockKeys = nil
+    if len(buf) >= 64 + int(self.KeyCount) * 16 {
+        return self.DecodeLockKeys(buf[64:])
+    }
+    return nil
+}
+
+func (self *MultiLockCommand) DecodeLockKeys(buf []byte) error {
+    if len(buf) < int(self.KeyCount) * 16 {
+        return errors.New("buf too short")
+    }
+
+    self.LockKeys = make([][16]byte, self.KeyCount)
+    for i := 0; i < int(self.KeyCount); i++ {
+        copy(self.LockKeys[i][:], buf[i * 16:i * 16 + 16])
+    }
+    return nil
+}
+
+func (self *MultiLockCommand) Encode(buf []byte) error {
+    if len(buf) < self.GetEncodeLength() {
+        return errors.New("buf too short")
+    }
+
+    if len(self.LockKeys) > MAX_MULTI_LOCK_KEYS {
+        return errors.New("too many lock keys")
+    }
+
+    buf[0], buf[1], buf[2] = byte(self.Magic), byte(self.Version), byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19], buf[20] = byte(self.Flag), byte(self.DbId)
+
+    buf[21], buf[22], buf[23], buf[24], buf[25], buf[26], buf[27], buf[28],
+        buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35], buf[36] =
+        self.LockId[0], self.LockId[1], self.LockId[2], self.LockId[3], self.LockId[4], self.LockId[5], self.LockId[6], self.LockId[7],
+        self.LockId[8], self.LockId[9], self.LockId[10], self.LockId[11], self.LockId[12], self.LockId[13], self.LockId[14], self.LockId[15]
+
+    buf[37], buf[38], buf[39], buf[40], buf[41], buf[42], buf[43], buf[44] = byte(self.Timeout), byte(self.Timeout >> 8), byte(self.TimeoutFlag), byte(self.TimeoutFlag >> 8), byte(self.Expried), byte(self.Expried >> 8), byte(self.ExpriedFlag), byte(self.ExpriedFlag >> 8)
+
+    self.KeyCount = uint16(len(self.LockKeys))
+    buf[45], buf[46], buf[47], buf[48], buf[49] = byte(self.Count), byte(self.Count >> 8), byte(self.Rcount), byte(self.KeyCount), byte(self.KeyCount >> 8)
+
+    for i :=0; i<14; i++ {
+        buf[50 + i] = 0x00
+    }
+
+    for i, lock_key := range self.LockKeys {
+        copy(buf[64 + i * 16:], lock_key[:])
+    }
+    return nil
+}
+
+func (self *MultiLockCommand) GetEncodeLength() int {
+    return 64 + len(self.LockKeys) * 16
+}
+
+type MultiLockResultCommand struct {
+    LockResultCommand
+    Tokens          []uint64
+}
+
+func NewMultiLockResultCommand(command *MultiLockCommand, result uint8, lock_key [16]byte, lcount uint16, tokens []uint64) *MultiLockResultCommand {
+    result_command := ResultCommand{MAGIC, command.Version, command.CommandType, command.RequestId, result}
+    if command.Version != VERSION2 {
+        tokens = nil
+    } else if len(tokens) != int(lcount) {
+        tokens = make([]uint64, lcount)
+    }
+    return &MultiLockResultCommand{LockResultCommand{result_command, 0, command.DbId, command.LockId, lock_key,
+        lcount, command.Count, 0, command.Rcount, RESULT_LOCK_COMMAND_BLANK_BYTERS, 0}, tokens}
+}
+
+func (self *MultiLockResultCommand) Decode(buf []byte) error{
+    if len(buf) < 64 {
+        return errors.New("buf too short")
+    }
+
+    err := self.LockResultCommand.Decode(buf[:64])
+    if err != nil {
+        return err
+    }
+
+    self.Tokens = nil
+    if self.Version == VERSION2 && len(buf) >= 64 + int(self.Lcount) * 8 {
+        return self.DecodeTokens(buf[64:])
+    }
+    return nil
+}
+
+func (self *MultiLockResultCommand) DecodeTokens(buf []byte) error {
+    if len(buf) < int(self.Lcount) * 8 {
+        return errors.New("buf too short")
+    }
+
+    self.Tokens = make([]uint64, self.Lcount)
+    for i := 0; i < int(self.Lcount); i++ {
+        token_buf := buf[i * 8:i * 8 + 8]
+        self.Tokens[i] = uint64(token_buf[0]) | uint64(token_buf[1])<<8 | uint64(token_buf[2])<<16 | uint64(token_buf[3])<<24 |
+            uint64(token_buf[4])<<32 | uint64(token_buf[5])<<40 | uint64(token_buf[6])<<48 | uint64(token_buf[7])<<56
+    }
+    return nil
+}
+
+func (self *MultiLockResultCommand) Encode(buf []byte) error {
+    if len(buf) < self.GetEncodeLength() {
+        return errors.New("buf too short")
+    }
+
+    if self.Version == VERSION2 && len(self.Tokens) != int(self.Lcount) {
+        return errors.New("tokens count error")
+    }
+
+    // the token of the single lock result is replaced by the tokens of every key
+    result_command := self.LockResultCommand
+    result_command.Version = VERSION
+    err := result_command.Encode(buf[:64])
+    if err != nil {
+        return err
+    }
+    buf[1] = byte(self.Version)
+
+    if self.Version == VERSION2 {
+        for i, token := range self.Tokens {
+            token_buf := buf[64 + i * 8:64 + i * 8 + 8]
+            token_buf[0], token_buf[1], token_buf[2], token_buf[3], token_buf[4], token_buf[5], token_buf[6], token_buf[7] = byte(token), byte(token >> 8), byte(token >> 16), byte(token >> 24),
+                byte(token >> 32), byte(token >> 40), byte(token >> 48), byte(token >> 56)
+        }
+    }
+    return nil
+}
+
+func (self *MultiLockResultCommand) GetEncodeLength() int {
+    if self.Version == VERSION2 {
+        return 64 + int(self.Lcount) * 8
+    }
+    return 64
+}
+
+type QueryResultCommand struct {
+    ResultCommand
+    Flag            uint8
+    /*
+    |7                      1|        0       |
+    |------------------------|----------------|
+    |                        |lock_id_matched |
+    */
+    DbId            uint8
+    LockId          [16]byte
+    Lcount          uint16
+    Count           uint16
+    Lrcount         uint8
+    Rcount          uint8
+    Expried         uint32
+    WaitCount       uint32
+    Token           uint64
+    Blank           [4]byte
+}
+
+func NewQueryResultCommand(command *LockCommand, result uint8, flag uint8, lock_id [16]byte, lcount uint16, count uint16, lrcount uint8, rcount uint8,
+    expried uint32, wait_count uint32, token uint64) *QueryResultCommand {
+    result_command := ResultCommand{MAGIC, VERSION, command.CommandType, command.RequestId, result}
+    return &QueryResultCommand{result_command, flag, command.DbId, lock_id, lcount, count, lrcount, rcount, expried, wait_count, token, [4]byte{}}
+}
+
+func (self *QueryResultCommand) Decode(buf []byte) error{
+    if len(buf) < 64 {
+        return errors.New("buf too short")
+    }
+
+    self.Magic, self.Version, self.CommandType = uint8(buf[0]), uint8(buf[1]), uint8(buf[2])
+
+    self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15] =
+        buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18]
+
+    self.Result, self.Flag, self.DbId = uint8(buf[19]), uint8(buf[20]), uint8(buf[21])
+
+    self.LockId[0], self.LockId[1], self.LockId[2], self.LockId[3], self.LockId[4], self.LockId[5], self.LockId[6], self.LockId[7],
+        self.LockId[8], self.LockId[9], self.LockId[10], self.LockId[11], self.LockId[12], self.LockId[13], self.LockId[14], self.LockId[15] =
+        buf[22], buf[23], buf[24], buf[25], buf[26], buf[27], buf[28], buf[29],
+        buf[30], buf[31], buf[32], buf[33], buf[34], buf[35], buf[36], buf[37]
+
+    self.Lcount, self.Count, self.Lrcount, self.Rcount = uint16(buf[38]) | uint16(buf[39])<<8, uint16(buf[40]) | uint16(buf[41])<<8, uint8(buf[42]), uint8(buf[43])
+    self.Expried = uint32(buf[44]) | uint32(buf[45])<<8 | uint32(buf[46])<<16 | uint32(buf[47])<<24
+    self.WaitCount = uint32(buf[48]) | uint32(buf[49])<<8 | uint32(buf[50])<<16 | uint32(buf[51])<<24
+    self.Token = uint64(buf[52]) | uint64(buf[53])<<8 | uint64(buf[54])<<16 | uint64(buf[55])<<24 | uint64(buf[56])<<32 | uint64(buf[57])<<40 | uint64(buf[58])<<48 | uint64(buf[59])<<56
+    self.Blank[0], self.Blank[1], self.Blank[2], self.Blank[3] = buf[60], buf[61], buf[62], buf[63]
+    return nil
+}
+
+func (self *QueryResultCommand) Encode(buf []byte) error {
+    if len(buf) < 64 {
+        return errors.New("buf too short")
+    }
+
+    buf[0], buf[1], buf[2] = byte(self.Magic), byte(self.Version), byte(self.CommandType)
+
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
+        buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
+        self.RequestId[0], self.RequestId[1], self.RequestId[2], self.RequestId[3], self.RequestId[4], self.RequestId[5], self.RequestId[6], self.RequestId[7],
+        self.RequestId[8], self.RequestId[9], self.RequestId[10], self.RequestId[11], self.RequestId[12], self.RequestId[13], self.RequestId[14], self.RequestId[15]
+
+    buf[19], buf[20], buf[21] = uint8(self.Result), byte(self.Flag), byte(self.DbId)
+
+    buf[22], buf[23], buf[24], buf[25], buf[26], buf[27], buf[28], buf[29],
+        buf[30], buf[31], buf[32], buf[33], buf[34], buf[35], buf[36], buf[37] =
+        self.LockId[0], self.LockId[1], self.LockId[2], self.LockId[3], self.LockId[4], self.LockId[5], self.LockId[6], self.LockId[7],
+        self.LockId[8], self.LockId[9], self.LockId[10], self.LockId[11], self.LockId[12], self.LockId[13], self.LockId[14], self.LockId[15]
+
+    buf[38], buf[39], buf[40], buf[41], buf[42], buf[43] = byte(self.Lcount), byte(self.Lcount >> 8), byte(self.Count), byte(self.Count >> 8), byte(self.Lrcount), byte(self.Rcount)
+    buf[44], buf[45], buf[46], buf[47] = byte(self.Expried), byte(self.Expried >> 8), byte(self.Expried >> 16), byte(self.Expried >> 24)
+    buf[48], buf[49], buf[50], buf[51] = byte(self.WaitCount), byte(self.WaitCount >> 8), byte(self.WaitCount >> 16), byte(self.WaitCount >> 24)
+    buf[52], buf[53], buf[54], buf[55], buf[56], buf[57], buf[58], buf[59] = byte(self.Token), byte(self.Token >> 8), byte(self.Token >> 16), byte(self.Token >> 24),
+        byte(self.Token >> 32), byte(self.Token >> 40), byte(self.Token >> 48), byte(self.Token >> 56)
+    buf[60], buf[61], buf[62], buf[63] = 0x00, 0x00, 0x00, 0x00
+    return nil
+}
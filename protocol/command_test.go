@@ -8,7 +8,7 @@ import (
 func TestLockCommand_Encode(t *testing.T) {
     rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
     command := Command{MAGIC, VERSION, COMMAND_LOCK, rid}
-    lock_command := LockCommand{command, 0, 0, rid, rid, 0, 5, 0,5, 1, 0}
+    lock_command := LockCommand{command, 0, 0, rid, rid, 0, 5, 0,5, 1, 0, ""}
     buf := make([]byte,  64)
     if lock_command.Encode(buf) != nil {
         t.Error("TestLockCommand_Encode Test Return Nil Fail")
@@ -105,10 +105,55 @@ func TestLockCommand_Decode(t *testing.T) {
     }
 }
 
+func TestLockCommand_EncodeDecodeLockName(t *testing.T) {
+    rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
+    command := Command{MAGIC, VERSION2, COMMAND_LOCK, rid}
+    lock_command := LockCommand{command, 0, 0, rid, [16]byte{}, 0, 5, 0,5, 1, 0, "order:1001:payment"}
+    buf := make([]byte,  lock_command.GetEncodeLength())
+    if len(buf) != 84 {
+        t.Errorf("TestLockCommand_EncodeDecodeLockName Test Length Fail %d", len(buf))
+        return
+    }
+
+    if lock_command.Encode(buf) != nil {
+        t.Error("TestLockCommand_EncodeDecodeLockName Test Encode Fail")
+        return
+    }
+
+    if buf[1] != VERSION2 || buf[64] != 18 || buf[65] != 0 || string(buf[66:]) != "order:1001:payment" {
+        t.Errorf("TestLockCommand_EncodeDecodeLockName Test Encode Data Fail %v", buf)
+        return
+    }
+
+    decode_command := NewLockCommand(buf)
+    if decode_command == nil {
+        t.Error("TestLockCommand_EncodeDecodeLockName Test Decode Fail")
+        return
+    }
+
+    if decode_command.LockName != "order:1001:payment" {
+        t.Errorf("TestLockCommand_EncodeDecodeLockName Test LockName Fail %s", decode_command.LockName)
+        return
+    }
+
+    lock_key := [16]byte{}
+    LockNameToKey("order:1001:payment", &lock_key)
+    if decode_command.LockKey != lock_key {
+        t.Error("TestLockCommand_EncodeDecodeLockName Test LockKey Fail")
+        return
+    }
+
+    LockNameToKey("abc", &lock_key)
+    if lock_key != [16]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 'a', 'b', 'c'} {
+        t.Error("TestLockCommand_EncodeDecodeLockName Test Short LockKey Fail")
+        return
+    }
+}
+
 func TestLockResultCommand_Encode(t *testing.T) {
     rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
     command := ResultCommand{MAGIC, VERSION, COMMAND_LOCK, rid, 0}
-    lock_command := LockResultCommand{command, 0, 0, rid, rid, 0, 0,0, 0,[4]byte{0, 0, 0, 0}}
+    lock_command := LockResultCommand{command, 0, 0, rid, rid, 0, 0,0, 0,[4]byte{0, 0, 0, 0}, 0}
     buf := make([]byte,  64)
     if lock_command.Encode(buf) != nil {
         t.Error("TestLockResultCommand_Encode Test Return Nil Fail")
@@ -129,6 +174,33 @@ func TestLockResultCommand_Encode(t *testing.T) {
     }
 }
 
+func TestLockResultCommand_EncodeDecodeToken(t *testing.T) {
+    rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
+    command := ResultCommand{MAGIC, VERSION2, COMMAND_LOCK, rid, 0}
+    lock_command := LockResultCommand{command, 0, 0, rid, rid, 1, 0,1, 0,[4]byte{0, 0, 0, 0}, 0x0102030405060708}
+    buf := make([]byte, lock_command.GetEncodeLength())
+    if len(buf) != 72 || lock_command.Encode(buf) != nil {
+        t.Error("TestLockResultCommand_EncodeDecodeToken Test Encode Fail")
+        return
+    }
+
+    if lock_command.Encode(make([]byte, 64)) == nil {
+        t.Error("TestLockResultCommand_EncodeDecodeToken Test Encode Short Buf Fail")
+        return
+    }
+
+    result_command := LockResultCommand{}
+    if result_command.Decode(buf) != nil || result_command.Token != 0x0102030405060708 {
+        t.Errorf("TestLockResultCommand_EncodeDecodeToken Test Decode Fail %x", result_command.Token)
+        return
+    }
+
+    if result_command.Decode(buf[:64]) != nil || result_command.Token != 0 {
+        t.Error("TestLockResultCommand_EncodeDecodeToken Test Decode Without Token Fail")
+        return
+    }
+}
+
 func TestLockResultCommand_Decode(t *testing.T) {
     rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
     buf := []byte{MAGIC, VERSION, COMMAND_LOCK,
@@ -190,4 +262,197 @@ func TestLockResultCommand_Decode(t *testing.T) {
         t.Error("TestLockResultCommand_Decode Test LockKey Fail")
         return
     }
-}
\ No newline at end of file
+}
+func TestInitResultCommand_EncodeDecode(t *testing.T) {
+    rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
+    init_command := InitCommand{Command{MAGIC, VERSION, COMMAND_INIT, rid}, rid, [29]byte{}}
+    command := NewInitResultCommand(&init_command, RESULT_SUCCED, 1, CAPABILITY_MILLISECOND_TIME | CAPABILITY_LOCK_NAME, "1.0.1")
+    buf := make([]byte, 64)
+    if command.Encode(buf) != nil {
+        t.Error("TestInitResultCommand_EncodeDecode Test Encode Fail")
+        return
+    }
+
+    result_command := InitResultCommand{}
+    if result_command.Decode(buf) != nil {
+        t.Error("TestInitResultCommand_EncodeDecode Test Decode Fail")
+        return
+    }
+
+    if result_command.InitType != 1 || result_command.ProtocolVersion != VERSION2 {
+        t.Errorf("TestInitResultCommand_EncodeDecode Test InitType Fail %d %d", result_command.InitType, result_command.ProtocolVersion)
+        return
+    }
+
+    if result_command.Capabilities != CAPABILITY_MILLISECOND_TIME | CAPABILITY_LOCK_NAME {
+        t.Errorf("TestInitResultCommand_EncodeDecode Test Capabilities Fail %d", result_command.Capabilities)
+        return
+    }
+
+    if result_command.GetServerVersion() != "1.0.1" {
+        t.Errorf("TestInitResultCommand_EncodeDecode Test ServerVersion Fail %s", result_command.GetServerVersion())
+        return
+    }
+}
+
+func TestMultiLockCommand_EncodeDecode(t *testing.T) {
+    rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
+    lock_keys := [][16]byte{{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}}
+    command := MultiLockCommand{Command{MAGIC, VERSION, COMMAND_MULTI_LOCK, rid}, 0, 1, rid, 5, 0, 60, 0,
+        0, 0, 0, lock_keys}
+    buf := make([]byte, command.GetEncodeLength())
+    if len(buf) != 64 + 32 || command.Encode(buf) != nil {
+        t.Error("TestMultiLockCommand_EncodeDecode Test Encode Fail")
+        return
+    }
+
+    decode_command := MultiLockCommand{}
+    if decode_command.Decode(buf[:64]) != nil || decode_command.KeyCount != 2 || decode_command.LockKeys != nil {
+        t.Error("TestMultiLockCommand_EncodeDecode Test Decode Fail")
+        return
+    }
+
+    if decode_command.DecodeLockKeys(buf[64:]) != nil || len(decode_command.LockKeys) != 2 {
+        t.Error("TestMultiLockCommand_EncodeDecode Test DecodeLockKeys Fail")
+        return
+    }
+
+    if decode_command.LockId != rid || decode_command.Timeout != 5 || decode_command.Expried != 60 ||
+        decode_command.LockKeys[0] != lock_keys[0] || decode_command.LockKeys[1] != lock_keys[1] {
+        t.Error("TestMultiLockCommand_EncodeDecode Test Value Fail")
+        return
+    }
+}
+
+func TestMultiLockResultCommand_EncodeDecode(t *testing.T) {
+    rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
+    lock_keys := [][16]byte{{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}}
+    command := MultiLockCommand{Command{MAGIC, VERSION2, COMMAND_MULTI_LOCK, rid}, 0, 1, rid, 5, 0, 60, 0,
+        0, 0, 2, lock_keys}
+    result_command := NewMultiLockResultCommand(&command, RESULT_SUCCED, [16]byte{}, 2, []uint64{0x0102030405060708, 9})
+    buf := make([]byte, result_command.GetEncodeLength())
+    if len(buf) != 64 + 16 || result_command.Encode(buf) != nil || buf[1] != VERSION2 {
+        t.Error("TestMultiLockResultCommand_EncodeDecode Test Encode Fail")
+        return
+    }
+
+    decode_command := MultiLockResultCommand{}
+    if decode_command.Decode(buf[:64]) != nil || decode_command.Lcount != 2 || decode_command.Tokens != nil || decode_command.Token != 0 {
+        t.Error("TestMultiLockResultCommand_EncodeDecode Test Decode Fail")
+        return
+    }
+
+    if decode_command.DecodeTokens(buf[64:]) != nil || len(decode_command.Tokens) != 2 ||
+        decode_command.Tokens[0] != 0x0102030405060708 || decode_command.Tokens[1] != 9 {
+        t.Errorf("TestMultiLockResultCommand_EncodeDecode Test DecodeTokens Fail %v", decode_command.Tokens)
+        return
+    }
+
+    command.Version = VERSION
+    result_command = NewMultiLockResultCommand(&command, RESULT_SUCCED, [16]byte{}, 2, []uint64{1, 2})
+    if result_command.GetEncodeLength() != 64 || result_command.Tokens != nil || result_command.Encode(buf) != nil || buf[1] != VERSION {
+        t.Error("TestMultiLockResultCommand_EncodeDecode Test Version1 Fail")
+        return
+    }
+}
+
+func TestLockCommand_ExtendedTime(t *testing.T) {
+    command := LockCommand{}
+    command.ExpriedFlag = 0x0400
+    command.SetExpried(3 * 86400)
+    if command.Expried != uint16(3 * 86400 & 0xffff) || command.ExpriedFlag != 0x0400 | 0x0003 || command.GetExpried() != 3 * 86400 {
+        t.Errorf("TestLockCommand_ExtendedTime Test SetExpried Fail %d %d", command.Expried, command.ExpriedFlag)
+        return
+    }
+
+    command.TimeoutFlag, command.Timeout = 0x8000, 90
+    if command.GetTimeout() != 90 * 60 {
+        t.Errorf("TestLockCommand_ExtendedTime Test GetTimeout Fail %d", command.GetTimeout())
+        return
+    }
+
+    now := int64(1700000000)
+    deadline := now + 2 * 86400
+    expried, expried_flag := ResolveExpriedDeadline(uint16(deadline), 0x8000 | 0x0100 | uint16(deadline >> 16 & 0xff), now)
+    if expried != uint16(2 * 86400 & 0xffff) || expried_flag != 0x0100 | 0x0002 {
+        t.Errorf("TestLockCommand_ExtendedTime Test ResolveExpriedDeadline Fail %d %d", expried, expried_flag)
+        return
+    }
+
+    deadline = now - 10
+    expried, expried_flag = ResolveExpriedDeadline(uint16(deadline), 0x8000 | uint16(deadline >> 16 & 0xff), now)
+    if expried != 0 || expried_flag != 0 {
+        t.Errorf("TestLockCommand_ExtendedTime Test Past Deadline Fail %d %d", expried, expried_flag)
+        return
+    }
+}
+
+func TestQueryResultCommand_EncodeDecode(t *testing.T) {
+    rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
+    lid := [16]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 9}
+    command := LockCommand{Command: Command{MAGIC, VERSION, COMMAND_QUERY, rid}, DbId: 1}
+    result_command := NewQueryResultCommand(&command, RESULT_SUCCED, 0x01, lid, 2, 3, 1, 0, 3 * 86400, 5, 0x0102030405060708)
+    buf := make([]byte, 64)
+    if result_command.Encode(buf) != nil {
+        t.Error("TestQueryResultCommand_EncodeDecode Test Encode Fail")
+        return
+    }
+
+    decode_command := QueryResultCommand{}
+    if decode_command.Decode(buf) != nil {
+        t.Error("TestQueryResultCommand_EncodeDecode Test Decode Fail")
+        return
+    }
+
+    if decode_command.CommandType != COMMAND_QUERY || decode_command.RequestId != rid || decode_command.Flag != 0x01 || decode_command.DbId != 1 ||
+        decode_command.LockId != lid || decode_command.Lcount != 2 || decode_command.Count != 3 || decode_command.Lrcount != 1 ||
+        decode_command.Expried != 3 * 86400 || decode_command.WaitCount != 5 || decode_command.Token != 0x0102030405060708 {
+        t.Errorf("TestQueryResultCommand_EncodeDecode Test Value Fail %v", decode_command)
+        return
+    }
+}
+
+func TestAdminCommand_EncodeDecode(t *testing.T) {
+    rid := [16]byte{0, 0, 0, 0, 0, 0, 0, 2, 3, 0, 0, 0, 0, 0, 0, 0}
+    command := AdminCommand{Command: Command{MAGIC, VERSION, COMMAND_ADMIN, rid}, AdminType: ADMIN_COMMAND_CONFIG_SET, DbId: 2,
+        Args: []string{"LOG_LEVEL", "DEBUG"}}
+    buf := make([]byte, command.GetEncodeLength())
+    if command.Encode(buf) != nil {
+        t.Error("TestAdminCommand_EncodeDecode Test Encode Fail")
+        return
+    }
+
+    decode_command := AdminCommand{}
+    if decode_command.Decode(buf) != nil {
+        t.Error("TestAdminCommand_EncodeDecode Test Decode Fail")
+        return
+    }
+
+    if decode_command.CommandType != COMMAND_ADMIN || decode_command.RequestId != rid || decode_command.AdminType != ADMIN_COMMAND_CONFIG_SET ||
+        decode_command.DbId != 2 || decode_command.ArgCount != 2 || len(decode_command.Args) != 2 ||
+        decode_command.Args[0] != "LOG_LEVEL" || decode_command.Args[1] != "DEBUG" {
+        t.Errorf("TestAdminCommand_EncodeDecode Test Value Fail %v", decode_command)
+        return
+    }
+
+    result_command := NewAdminResultCommand(&decode_command, RESULT_SUCCED, []string{"version", "0.2.0", "", "uptime_in_seconds"})
+    buf = make([]byte, result_command.GetEncodeLength())
+    if result_command.Encode(buf) != nil {
+        t.Error("TestAdminCommand_EncodeDecode Test Result Encode Fail")
+        return
+    }
+
+    decode_result_command := AdminResultCommand{}
+    if decode_result_command.Decode(buf) != nil {
+        t.Error("TestAdminCommand_EncodeDecode Test Result Decode Fail")
+        return
+    }
+
+    if decode_result_command.CommandType != COMMAND_ADMIN || decode_result_command.RequestId != rid || decode_result_command.Result != RESULT_SUCCED ||
+        decode_result_command.AdminType != ADMIN_COMMAND_CONFIG_SET || decode_result_command.DbId != 2 || decode_result_command.ValueCount != 4 ||
+        len(decode_result_command.Values) != 4 || decode_result_command.Values[1] != "0.2.0" || decode_result_command.Values[2] != "" ||
+        decode_result_command.Values[3] != "uptime_in_seconds" {
+        t.Errorf("TestAdminCommand_EncodeDecode Test Result Value Fail %v", decode_result_command)
+        return
+    }
+}
@@ -1,8 +1,12 @@
 package server
 
 import (
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
     "github.com/hhkbp2/go-logging"
+    "github.com/snower/slock/protocol"
     "io"
     "net"
     "os"
@@ -29,11 +33,15 @@ func (self *Admin) GetHandlers() map[string]TextServerProtocolCommandHandler{
     handlers["SHUTDOWN"] = self.CommandHandleShutdownCommand
     handlers["BGREWRITEAOF"] = self.CommandHandleBgRewritAaofCommand
     handlers["REWRITEAOF"] = self.CommandHandleRewriteAofCommand
+    handlers["BGSAVE"] = self.CommandHandleBgSaveCommand
+    handlers["SAVE"] = self.CommandHandleSaveCommand
     handlers["ECHO"] = self.CommandHandleEchoCommand
     handlers["PING"] = self.CommandHandlePingCommand
     handlers["QUIT"] = self.CommandHandleQuitCommand
     handlers["INFO"] = self.CommandHandleInfoCommand
     handlers["SHOW"] = self.CommandHandleShowCommand
+    handlers["DUMP"] = self.CommandHandleDumpCommand
+    handlers["RESTORE"] = self.CommandHandleRestoreCommand
     handlers["CONFIG"] = self.CommandHandleConfigCommand
     handlers["CLIENT"] = self.CommandHandleClientCommand
     handlers["FLUSHDB"] = self.CommandHandleFlushDBCommand
@@ -46,7 +54,7 @@ func (self *Admin) Close() {
 }
 
 func (self *Admin) CommandHandleShutdownCommand(server_protocol *TextServerProtocol, args []string) error {
-    err := server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+    err := server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
     if err != nil {
         return err
     }
@@ -61,7 +69,7 @@ func (self *Admin) CommandHandleShutdownCommand(server_protocol *TextServerProto
 }
 
 func (self *Admin) CommandHandleBgRewritAaofCommand(server_protocol *TextServerProtocol, args []string) error {
-    err := server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+    err := server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
     if err != nil {
         return err
     }
@@ -75,34 +83,66 @@ func (self *Admin) CommandHandleBgRewritAaofCommand(server_protocol *TextServerP
 
 func (self *Admin) CommandHandleRewriteAofCommand(server_protocol *TextServerProtocol, args []string) error {
     self.slock.GetAof().RewriteAofFile()
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
 }
 
-func (self *Admin) CommandHandleFlushDBCommand(server_protocol *TextServerProtocol, args []string) error {
-    self.slock.glock.Lock()
-    defer self.slock.glock.Unlock()
+func (self *Admin) CommandHandleBgSaveCommand(server_protocol *TextServerProtocol, args []string) error {
+    err := server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+    if err != nil {
+        return err
+    }
+
+    go func() {
+        self.slock.Log().Infof("Aof Snapshot Save")
+        err := self.slock.GetAof().SaveSnapshot()
+        if err != nil {
+            self.slock.Log().Errorf("Aof Snapshot Save Error %v", err)
+        }
+    }()
+    return nil
+}
 
+func (self *Admin) CommandHandleSaveCommand(server_protocol *TextServerProtocol, args []string) error {
+    err := self.slock.GetAof().SaveSnapshot()
+    if err != nil {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, fmt.Sprintf("Snapshot Save Error %s", err.Error()), nil))
+    }
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+}
+
+func (self *Admin) CommandHandleFlushDBCommand(server_protocol *TextServerProtocol, args []string) error {
     if len(args) < 2 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Parse Len Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Parse Len Error", nil))
     }
 
     db_id, err := strconv.Atoi(args[1])
     if err != nil {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Parse DB_ID Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Parse DB_ID Error", nil))
     }
-    db := self.slock.dbs[uint8(db_id)]
+
+    err = self.FlushDB(uint8(db_id))
+    if err != nil {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, err.Error(), nil))
+    }
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+}
+
+func (self *Admin) FlushDB(db_id uint8) error {
+    self.slock.glock.Lock()
+    defer self.slock.glock.Unlock()
+
+    db := self.slock.dbs[db_id]
     if db == nil {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "No Such DB", nil))
+        return errors.New("No Such DB")
     }
 
-    self.slock.dbs[uint8(db_id)] = nil
-    err = db.FlushDB()
+    self.slock.dbs[db_id] = nil
+    err := db.FlushDB()
+    self.slock.dbs[db_id] = db
     if err != nil {
-        self.slock.dbs[uint8(db_id)] = db
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, fmt.Sprintf("Flush DB Error %s", err.Error()), nil))
+        return errors.New(fmt.Sprintf("Flush DB Error %s", err.Error()))
     }
-    self.slock.dbs[uint8(db_id)] = db
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+    return nil
 }
 
 func (self *Admin) CommandHandleFlushAllCommand(server_protocol *TextServerProtocol, args []string) error {
@@ -124,35 +164,35 @@ func (self *Admin) CommandHandleFlushAllCommand(server_protocol *TextServerProto
             for db_id, db := range self.slock.dbs {
                 self.slock.dbs[db_id] = db
             }
-            return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, fmt.Sprintf("Flush DB %d Error %s", db_id, err.Error()), nil))
+            return server_protocol.WriteBytes(server_protocol.parser.Build(false, fmt.Sprintf("Flush DB %d Error %s", db_id, err.Error()), nil))
         }
     }
 
     for db_id, db := range self.slock.dbs {
         self.slock.dbs[db_id] = db
     }
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
 }
 
 func (self *Admin) CommandHandleEchoCommand(server_protocol *TextServerProtocol, args []string) error {
     if len(args) != 2 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
     }
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "", args[1:]))
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", args[1:]))
 }
 
 func (self *Admin) CommandHandlePingCommand(server_protocol *TextServerProtocol, args []string) error {
     if len(args) > 1 {
         if len(args) != 2 {
-            return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+            return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
         }
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "", args[1:]))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", args[1:]))
     }
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "PONG", nil))
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "PONG", nil))
 }
 
 func (self *Admin) CommandHandleQuitCommand(server_protocol *TextServerProtocol, args []string) error {
-    err := server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+    err := server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
     if err != nil {
         return err
     }
@@ -160,6 +200,12 @@ func (self *Admin) CommandHandleQuitCommand(server_protocol *TextServerProtocol,
 }
 
 func (self *Admin) CommandHandleInfoCommand(server_protocol *TextServerProtocol, args []string) error {
+    infos := self.GetInfos()
+    infos = append(infos, "\r\n")
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", []string{strings.Join(infos, "\r\n")}))
+}
+
+func (self *Admin) GetInfos() []string {
     infos := make([]string, 0)
 
     infos = append(infos, "# Server")
@@ -247,8 +293,42 @@ func (self *Admin) CommandHandleInfoCommand(server_protocol *TextServerProtocol,
     infos = append(infos, fmt.Sprintf("aof_channel_count:%d", aof.channel_count))
     infos = append(infos, fmt.Sprintf("aof_channel_active:%d", aof.actived_channel_count))
     infos = append(infos, fmt.Sprintf("aof_count:%d", aof.aof_lock_count))
-    infos = append(infos, fmt.Sprintf("aof_file_name:%s", aof.aof_file.filename))
-    infos = append(infos, fmt.Sprintf("aof_file_size:%d", aof.aof_file.size))
+    aof_file_name, aof_file_size := "", 0
+    if aof.persistence != nil {
+        infos = append(infos, fmt.Sprintf("aof_persistence:%s", aof.persistence.GetName()))
+        if file_persistence, ok := aof.persistence.(*FileAofPersistence); ok {
+            aof_file_name = file_persistence.GetFilename()
+        }
+        aof_file_size = aof.persistence.GetSize()
+    }
+    infos = append(infos, fmt.Sprintf("aof_file_name:%s", aof_file_name))
+    infos = append(infos, fmt.Sprintf("aof_file_size:%d", aof_file_size))
+
+    aof.glock.Lock()
+    aof_rewrite_in_progress, aof_current_rewrite_time := 0, int64(-1)
+    if !aof.rewrite_start_time.IsZero() {
+        aof_rewrite_in_progress, aof_current_rewrite_time = 1, time.Since(aof.rewrite_start_time).Nanoseconds() / 1e6
+    }
+    aof_last_rewrite_status := "ok"
+    if aof.rewrite_last_error != nil {
+        aof_last_rewrite_status = "err"
+    }
+    aof_rewrite_count, aof_last_rewrite_time, aof_base_size := aof.rewrite_count, aof.rewrite_last_duration.Nanoseconds() / 1e6, aof.rewrite_base_size
+    aof.glock.Unlock()
+    aof_rewrite_scheduled := 0
+    if aof.rewrite_scheduled {
+        aof_rewrite_scheduled = 1
+    }
+    infos = append(infos, fmt.Sprintf("aof_rewrite_in_progress:%d", aof_rewrite_in_progress))
+    infos = append(infos, fmt.Sprintf("aof_rewrite_scheduled:%d", aof_rewrite_scheduled))
+    infos = append(infos, fmt.Sprintf("aof_rewrite_count:%d", aof_rewrite_count))
+    infos = append(infos, fmt.Sprintf("aof_last_rewrite_time_ms:%d", aof_last_rewrite_time))
+    infos = append(infos, fmt.Sprintf("aof_current_rewrite_time_ms:%d", aof_current_rewrite_time))
+    infos = append(infos, fmt.Sprintf("aof_last_rewrite_status:%s", aof_last_rewrite_status))
+    infos = append(infos, fmt.Sprintf("aof_base_size:%d", aof_base_size))
+    infos = append(infos, fmt.Sprintf("aof_rewrite_min_size:%d", aof.rewrite_size))
+    infos = append(infos, fmt.Sprintf("aof_rewrite_percentage:%d", aof.rewrite_percentage))
+    infos = append(infos, fmt.Sprintf("aof_rewrite_quiet_hours:%s", Config.AofFileRewriteQuietHours))
 
     infos = append(infos, "\r\n# Keyspace")
     for db_id, db := range self.slock.dbs {
@@ -266,25 +346,22 @@ func (self *Admin) CommandHandleInfoCommand(server_protocol *TextServerProtocol,
             infos = append(infos, fmt.Sprintf("db%d:%s", db_id, strings.Join(db_infos, ",")))
         }
     }
-
-    infos = append(infos, "\r\n")
-
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "", []string{strings.Join(infos, "\r\n")}))
+    return infos
 }
 
 func (self *Admin) CommandHandleShowCommand(server_protocol *TextServerProtocol, args []string) error {
     if len(args) < 2 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
     }
 
     db_id, err := strconv.Atoi(args[1])
     if err != nil {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "DB Id Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "DB Id Error", nil))
     }
 
     db := self.slock.dbs[uint8(db_id)]
     if db == nil {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "DB Uninit Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "DB Uninit Error", nil))
     }
 
     if len(args) == 2 {
@@ -294,101 +371,201 @@ func (self *Admin) CommandHandleShowCommand(server_protocol *TextServerProtocol,
 }
 
 func (self *Admin) CommandHandleShowDBCommand(server_protocol *TextServerProtocol, args []string, db *LockDB) error {
-    db.glock.Lock()
-    lock_managers := make([]*LockManager, 0)
-    for _, lock_manager := range db.locks {
-        if lock_manager.locked > 0 {
-            lock_managers = append(lock_managers, lock_manager)
-        }
-    }
-    db.glock.Unlock()
-
+    lock_managers := db.GetLockManagers()
     db_infos := make([]string, 0)
     for _, lock_manager := range lock_managers {
-        db_infos = append(db_infos, fmt.Sprintf("%x", lock_manager.lock_key))
+        if lock_manager.lock_name != "" {
+            db_infos = append(db_infos, lock_manager.lock_name)
+        } else {
+            db_infos = append(db_infos, fmt.Sprintf("%x", lock_manager.lock_key))
+        }
         db_infos = append(db_infos, fmt.Sprintf("%d", lock_manager.locked))
     }
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "", db_infos))
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", db_infos))
 }
 
 func (self *Admin) CommandHandleShowLockCommand(server_protocol *TextServerProtocol, args []string, db *LockDB) error {
-    lock_key := [16]byte{}
-    server_protocol.ArgsToLockComandParseId(args[2], &lock_key)
+    command := protocol.LockCommand{}
+    server_protocol.ArgsToLockComandParseId(args[2], &command.LockKey)
 
-    db.glock.Lock()
-    lock_manager, ok := db.locks[lock_key]
-    db.glock.Unlock()
-
-    if !ok || lock_manager.locked <= 0 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Unknown Lock Manager Error", nil))
+    lock_manager := db.GetLockManager(&command)
+    if lock_manager == nil || lock_manager.locked <= 0 {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Unknown Lock Manager Error", nil))
     }
 
-    lock_infos := make([]string, 0)
     lock_manager.glock.Lock()
-    if lock_manager.current_lock != nil {
-        lock := lock_manager.current_lock
+    lock_infos := lock_manager.GetLockInfos(lock_manager.lock_db.current_time)
+    lock_manager.glock.Unlock()
+
+    results := make([]string, 0)
+    for _, lock_info := range lock_infos {
+        results = append(results, lock_info.LockId)
+        results = append(results, fmt.Sprintf("%d", lock_info.StartTime))
+        results = append(results, fmt.Sprintf("%d", lock_info.TimeoutTime))
+        results = append(results, fmt.Sprintf("%d", lock_info.ExpriedTime))
+        results = append(results, fmt.Sprintf("%d", lock_info.Locked))
+        results = append(results, fmt.Sprintf("%d", lock_info.AofTime))
+        results = append(results, fmt.Sprintf("%d", lock_info.State))
+    }
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", results))
+}
 
-        state := uint8(0)
-        if lock.timeouted {
-            state |= 0x01
+func (self *Admin) CommandHandleDumpCommand(server_protocol *TextServerProtocol, args []string) error {
+    if len(args) < 2 {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+    }
+
+    db_id, err := strconv.Atoi(args[1])
+    if err != nil || db_id < 0 || db_id >= 0xff {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "DB Id Error", nil))
+    }
+
+    lock_infos := make([]*LockInfo, 0)
+    db := self.slock.dbs[uint8(db_id)]
+    if db != nil {
+        lock_keys := make(map[[16]byte]bool, len(args) - 2)
+        for _, arg := range args[2:] {
+            lock_key := [16]byte{}
+            server_protocol.ArgsToLockComandParseId(arg, &lock_key)
+            lock_keys[lock_key] = true
         }
 
-        if lock.expried {
-            state |= 0x02
+        lock_managers := make([]*LockManager, 0)
+        for _, lock_manager := range db.GetLockManagers() {
+            if len(lock_keys) > 0 {
+                if _, ok := lock_keys[lock_manager.lock_key]; !ok {
+                    continue
+                }
+            }
+            lock_managers = append(lock_managers, lock_manager)
         }
 
-        if lock.long_wait_index > 0 {
-            state |= 0x04
+        for _, lock_manager := range lock_managers {
+            lock_manager.glock.Lock()
+            if lock_manager.locked > 0 {
+                for _, lock_info := range lock_manager.GetLockInfos(db.current_time) {
+                    if lock_info.Locked > 0 && lock_info.State & 0x02 == 0 {
+                        lock_infos = append(lock_infos, lock_info)
+                    }
+                }
+            }
+            lock_manager.glock.Unlock()
         }
+    }
+
+    data, err := json.Marshal(lock_infos)
+    if err != nil {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, fmt.Sprintf("Dump Error %s", err.Error()), nil))
+    }
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", []string{string(data)}))
+}
+
+func (self *Admin) CommandHandleRestoreCommand(server_protocol *TextServerProtocol, args []string) error {
+    if len(args) != 3 {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+    }
+
+    db_id, err := strconv.Atoi(args[1])
+    if err != nil || db_id < 0 || db_id >= 0xff {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "DB Id Error", nil))
+    }
+
+    if self.slock.state != STATE_LEADER {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Restore Only Leader", nil))
+    }
+
+    lock_infos := make([]*LockInfo, 0)
+    err = json.Unmarshal([]byte(args[2]), &lock_infos)
+    if err != nil {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, fmt.Sprintf("Restore Data Error %s", err.Error()), nil))
+    }
 
-        if lock.is_aof {
-            state |= 0x08
+    db := self.slock.dbs[uint8(db_id)]
+    if db == nil {
+        db = self.slock.GetOrNewDB(uint8(db_id))
+    }
+
+    restore_protocol := NewMemWaiterServerProtocol(self.slock)
+    restored_count, failed_count := 0, 0
+    for _, lock_info := range lock_infos {
+        if self.RestoreLockInfo(restore_protocol, db, lock_info) {
+            restored_count++
+        } else {
+            failed_count++
         }
+    }
+    restore_protocol.Close()
+
+    self.slock.Log().Infof("Admin Restore DB %d %d Locks %d Failed", db_id, restored_count, failed_count)
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", []string{fmt.Sprintf("%d", restored_count), fmt.Sprintf("%d", failed_count)}))
+}
 
-        lock_infos = append(lock_infos, fmt.Sprintf("%x", lock.command.LockId))
-        lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.start_time))
-        lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.timeout_time))
-        lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.expried_time))
-        lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.locked))
-        lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.aof_time))
-        lock_infos = append(lock_infos, fmt.Sprintf("%d", state))
+func (self *Admin) RestoreLockInfo(restore_protocol *MemWaiterServerProtocol, db *LockDB, lock_info *LockInfo) bool {
+    lock_key, err := hex.DecodeString(lock_info.LockKey)
+    if err != nil || len(lock_key) != 16 {
+        return false
     }
 
-    if lock_manager.lock_maps != nil {
-        for _, lock := range lock_manager.lock_maps {
-            state := uint8(0)
-            if lock.timeouted {
-                state |= 0x01
-            }
+    lock_id, err := hex.DecodeString(lock_info.LockId)
+    if err != nil || len(lock_id) != 16 {
+        return false
+    }
 
-            if lock.expried {
-                state |= 0x02
-            }
+    if lock_info.ExpriedFlag & 0x4000 == 0 && lock_info.Expried == 0 {
+        return false
+    }
 
-            if lock.long_wait_index > 0 {
-                state |= 0x04
-            }
+    locked := int(lock_info.Locked)
+    if locked == 0 {
+        locked = 1
+    }
+    if self.slock.raft == nil {
+        db.UpdateFencingToken(lock_info.FencingToken)
+    }
 
-            if lock.is_aof {
-                state |= 0x08
-            }
+    for i := 0; i < locked; i++ {
+        restore_protocol.Lock()
+        lock_command := restore_protocol.GetLockCommand()
+        restore_protocol.Unlock()
+
+        lock_command.CommandType = protocol.COMMAND_LOCK
+        lock_command.RequestId = self.slock.GetAof().GetRequestId()
+        lock_command.Flag = 0
+        lock_command.DbId = db.db_id
+        copy(lock_command.LockId[:], lock_id)
+        copy(lock_command.LockKey[:], lock_key)
+        lock_command.LockName = lock_info.LockName
+        lock_command.TimeoutFlag = 0
+        lock_command.Timeout = 0
+        lock_command.ExpriedFlag = lock_info.ExpriedFlag & 0x4f00
+        lock_command.SetExpried(lock_info.Expried)
+        lock_command.Count = lock_info.Count
+        lock_command.Rcount = lock_info.Rcount
 
-            lock_infos = append(lock_infos, fmt.Sprintf("%x", lock.command.LockId))
-            lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.start_time))
-            lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.timeout_time))
-            lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.expried_time))
-            lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.locked))
-            lock_infos = append(lock_infos, fmt.Sprintf("%d", lock.aof_time))
-            lock_infos = append(lock_infos, fmt.Sprintf("%d", state))
+        waiter := make(chan *protocol.LockResultCommand, 1)
+        restore_protocol.AddWaiter(lock_command, waiter)
+        err := self.slock.DoLockComamnd(db, restore_protocol, lock_command)
+        if err != nil {
+            restore_protocol.RemoveWaiter(lock_command)
+            return false
+        }
+
+        select {
+        case result := <- waiter:
+            if result == nil || result.Result != protocol.RESULT_SUCCED {
+                return false
+            }
+        case <- time.After(5 * time.Second):
+            restore_protocol.RemoveWaiter(lock_command)
+            return false
         }
     }
-    lock_manager.glock.Unlock()
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "", lock_infos))
+    return true
 }
 
 func (self *Admin) CommandHandleConfigCommand(server_protocol *TextServerProtocol, args []string) error {
     if len(args) < 2 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
     }
 
     if strings.ToUpper(args[1]) == "SET" {
@@ -398,12 +575,25 @@ func (self *Admin) CommandHandleConfigCommand(server_protocol *TextServerProtoco
 }
 
 func (self *Admin) CommandHandleConfigGetCommand(server_protocol *TextServerProtocol, args []string) error {
+    config_name := ""
+    if len(args) >= 3 {
+        config_name = args[2]
+    }
+
+    infos := self.GetConfigs(config_name)
+    if len(infos) <= 0 {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Unknown Config Parameter", nil))
+    }
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", infos))
+}
+
+func (self *Admin) GetConfigs(name string) []string {
     ConfigValue := reflect.ValueOf(Config).Elem()
     ConfigType := ConfigValue.Type()
     infos := []string{}
     for i := 0; i < ConfigType.NumField(); i++ {
         config_name := strings.ToUpper(ConfigType.Field(i).Tag.Get("long"))
-        if len(args) >= 3 && config_name != strings.ToUpper(args[2]) {
+        if name != "" && config_name != strings.ToUpper(name) {
             continue
         }
 
@@ -418,23 +608,27 @@ func (self *Admin) CommandHandleConfigGetCommand(server_protocol *TextServerProt
             infos = append(infos, fmt.Sprintf("%v", value))
         }
     }
-
-    if len(infos) <= 0 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Unknown Config Parameter", nil))
-    }
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "", infos))
+    return infos
 }
 
 func (self *Admin) CommandHandleConfigSetCommand(server_protocol *TextServerProtocol, args []string) error {
     if len(args) < 4 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
     }
 
-    switch strings.ToUpper(args[2]) {
+    err := self.SetConfig(args[2], args[3])
+    if err != nil {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, err.Error(), nil))
+    }
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+}
+
+func (self *Admin) SetConfig(name string, value string) error {
+    switch strings.ToUpper(name) {
     case "DB_LOCK_AOF_TIME":
-        db_lock_aof_time, err := strconv.Atoi(args[3])
+        db_lock_aof_time, err := strconv.Atoi(value)
         if err != nil {
-            return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Parameter Value Error", nil))
+            return errors.New("Parameter Value Error")
         }
 
         Config.DBLockAofTime = uint(db_lock_aof_time)
@@ -443,17 +637,43 @@ func (self *Admin) CommandHandleConfigSetCommand(server_protocol *TextServerProt
                 db.aof_time = uint8(db_lock_aof_time)
             }
         }
+    case "DB_LOCK_PRIORITY_AGING_TIME":
+        db_lock_priority_aging_time, err := strconv.Atoi(value)
+        if err != nil || db_lock_priority_aging_time < 0 {
+            return errors.New("Parameter Value Error")
+        }
+
+        Config.DBLockPriorityAgingTime = uint(db_lock_priority_aging_time)
+        for _, db := range self.slock.dbs {
+            if db != nil {
+                db.priority_aging_time = int64(db_lock_priority_aging_time)
+            }
+        }
     case "AOF_FILE_REWRITE_SIZE":
-        aof_file_rewrite_size, err := strconv.Atoi(args[3])
+        aof_file_rewrite_size, err := strconv.Atoi(value)
         if err != nil {
-            return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Parameter Value Error", nil))
+            return errors.New("Parameter Value Error")
         }
-        Config.DBLockAofTime = uint(aof_file_rewrite_size)
+        Config.AofFileRewriteSize = uint(aof_file_rewrite_size)
         self.slock.GetAof().rewrite_size = uint32(aof_file_rewrite_size)
+    case "AOF_FILE_REWRITE_PERCENTAGE":
+        aof_file_rewrite_percentage, err := strconv.Atoi(value)
+        if err != nil || aof_file_rewrite_percentage < 0 {
+            return errors.New("Parameter Value Error")
+        }
+        Config.AofFileRewritePercentage = uint(aof_file_rewrite_percentage)
+        self.slock.GetAof().rewrite_percentage = uint32(aof_file_rewrite_percentage)
+    case "AOF_FILE_REWRITE_QUIET_HOURS":
+        aof := self.slock.GetAof()
+        err := aof.SetRewritePolicy(aof.rewrite_size, aof.rewrite_percentage, value)
+        if err != nil {
+            return errors.New("Parameter Value Error")
+        }
+        Config.AofFileRewriteQuietHours = value
     case "LOG_LEVEL":
         logger := self.slock.Log()
         logging_level := logging.LevelInfo
-        switch args[3] {
+        switch value {
         case "DEBUG":
             logging_level = logging.LevelDebug
         case "INFO":
@@ -463,22 +683,22 @@ func (self *Admin) CommandHandleConfigSetCommand(server_protocol *TextServerProt
         case "ERROR":
             logging_level = logging.LevelError
         default:
-            return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Unknown Log Level", nil))
+            return errors.New("Unknown Log Level")
         }
-        Config.LogLevel = args[2]
+        Config.LogLevel = value
         for _, handler := range logger.GetHandlers() {
             handler.SetLevel(logging_level)
         }
         logger.SetLevel(logging_level)
     default:
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "UnSupport Config Set Parameter", nil))
+        return errors.New("UnSupport Config Set Parameter")
     }
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+    return nil
 }
 
 func (self *Admin) CommandHandleClientCommand(server_protocol *TextServerProtocol, args []string) error {
     if len(args) < 2 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
     }
 
     if strings.ToUpper(args[1]) == "KILL" {
@@ -488,6 +708,12 @@ func (self *Admin) CommandHandleClientCommand(server_protocol *TextServerProtoco
 }
 
 func (self *Admin) CommandHandleClientListCommand(server_protocol *TextServerProtocol, args []string) error {
+    infos := self.GetClients()
+    infos = append(infos, "\r\n")
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "", []string{strings.Join(infos, "\r\n")}))
+}
+
+func (self *Admin) GetClients() []string {
     infos := []string{}
     for _, stream := range self.server.streams {
         protocol_name, client_id, command_count := "", [16]byte{}, uint64(0)
@@ -515,24 +741,81 @@ func (self *Admin) CommandHandleClientListCommand(server_protocol *TextServerPro
         infos = append(infos, fmt.Sprintf("id=%d addr=%s fd=%s protocol=%s age=%d client_id=%x command_count=%d", stream.stream_id, stream.RemoteAddr().String(),
             fd, protocol_name, time.Now().Unix() - stream.start_time.Unix(), client_id, command_count))
     }
-    infos = append(infos, "\r\n")
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "", []string{strings.Join(infos, "\r\n")}))
+    return infos
 }
 
 func (self *Admin) CommandHandleClientKillCommand(server_protocol *TextServerProtocol, args []string) error {
     if len(args) < 3 {
-        return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, "Command Arguments Error", nil))
+    }
+
+    err := self.KillClient(args[2])
+    if err != nil {
+        return server_protocol.WriteBytes(server_protocol.parser.Build(false, err.Error(), nil))
     }
+    return server_protocol.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+}
 
+func (self *Admin) KillClient(addr string) error {
     for _, stream := range self.server.streams {
-        if stream.RemoteAddr().String() == args[2] {
+        if stream.RemoteAddr().String() == addr {
             err := stream.Close()
             if err != nil {
-                return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "Client Close Error", nil))
+                return errors.New("Client Close Error")
             }
-            return server_protocol.stream.WriteBytes(server_protocol.parser.Build(true, "OK", nil))
+            return nil
         }
     }
+    return errors.New("No such client")
+}
 
-    return server_protocol.stream.WriteBytes(server_protocol.parser.Build(false, "No such client", nil))
-}
\ No newline at end of file
+func (self *Admin) ProcessBinaryCommand(server_protocol *BinaryServerProtocol, command *protocol.AdminCommand) error {
+    var values []string
+    var err error
+
+    switch command.AdminType {
+    case protocol.ADMIN_COMMAND_INFO:
+        values = make([]string, 0)
+        for _, info := range self.GetInfos() {
+            index := strings.Index(info, ":")
+            if index > 0 {
+                values = append(values, info[:index], info[index + 1:])
+            }
+        }
+    case protocol.ADMIN_COMMAND_CONFIG_GET:
+        config_name := ""
+        if len(command.Args) >= 1 {
+            config_name = command.Args[0]
+        }
+
+        values = self.GetConfigs(config_name)
+        if len(values) <= 0 {
+            err = errors.New("Unknown Config Parameter")
+        }
+    case protocol.ADMIN_COMMAND_CONFIG_SET:
+        if len(command.Args) < 2 {
+            err = errors.New("Command Arguments Error")
+        } else {
+            err = self.SetConfig(command.Args[0], command.Args[1])
+        }
+    case protocol.ADMIN_COMMAND_CLIENT_LIST:
+        values = self.GetClients()
+    case protocol.ADMIN_COMMAND_CLIENT_KILL:
+        if len(command.Args) < 1 {
+            err = errors.New("Command Arguments Error")
+        } else {
+            err = self.KillClient(command.Args[0])
+        }
+    case protocol.ADMIN_COMMAND_FLUSHDB:
+        err = self.FlushDB(command.DbId)
+    case protocol.ADMIN_COMMAND_REWRITEAOF:
+        self.slock.GetAof().RewriteAofFile()
+    default:
+        return server_protocol.Write(protocol.NewAdminResultCommand(command, protocol.RESULT_UNKNOWN_COMMAND, []string{"Unknown Admin Command"}))
+    }
+
+    if err != nil {
+        return server_protocol.Write(protocol.NewAdminResultCommand(command, protocol.RESULT_ERROR, []string{err.Error()}))
+    }
+    return server_protocol.Write(protocol.NewAdminResultCommand(command, protocol.RESULT_SUCCED, values))
+}
@@ -1,2 +1,351 @@
 package server
 
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func readTestAdminBulk(reader *bufio.Reader, line string) (string, error) {
+    size, err := strconv.Atoi(line[1:])
+    if err != nil {
+        return "", err
+    }
+
+    buf := make([]byte, size + 2)
+    _, err = io.ReadFull(reader, buf)
+    if err != nil {
+        return "", err
+    }
+    return string(buf[:size]), nil
+}
+
+func readTestAdminLine(reader *bufio.Reader) (string, error) {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+    return line[:len(line) - 2], nil
+}
+
+func doTestAdminCommand(slock *SLock, args ...string) ([]string, error) {
+    server_conn, client_conn := net.Pipe()
+    defer server_conn.Close()
+    defer client_conn.Close()
+
+    server_protocol := NewTextServerProtocol(slock, NewStream(NewServer(slock), server_conn))
+    go server_protocol.ProcessArgs(args)
+
+    client_conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    reader := bufio.NewReader(client_conn)
+    line, err := readTestAdminLine(reader)
+    if err != nil {
+        return nil, err
+    }
+
+    switch line[0] {
+    case '+':
+        return []string{line[1:]}, nil
+    case '-':
+        return nil, errors.New(line[1:])
+    case '$':
+        value, err := readTestAdminBulk(reader, line)
+        if err != nil {
+            return nil, err
+        }
+        return []string{value}, nil
+    case '*':
+        count, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+
+        values := make([]string, count)
+        for i := 0; i < count; i++ {
+            line, err = readTestAdminLine(reader)
+            if err != nil {
+                return nil, err
+            }
+
+            values[i], err = readTestAdminBulk(reader, line)
+            if err != nil {
+                return nil, err
+            }
+        }
+        return values, nil
+    }
+    return nil, errors.New("unknown reply " + line)
+}
+
+func TestAdmin_SaveSnapshot(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "file")
+    defer os.RemoveAll(data_dir)
+
+    lock_keys, lock_id := make([][16]byte, 4), [16]byte{}
+    for i, name := range []string{"save_locked", "save_reentrant", "save_unlocked", "save_after"} {
+        copy(lock_keys[i][:], name)
+    }
+    copy(lock_id[:], "save_lock_id")
+
+    max_token := uint64(0)
+    for i, rcount := range []uint8{0, 1, 0, 0} {
+        for j := uint8(0); j <= rcount; j++ {
+            result := doTestAofRcountLockCommand(slock, protocol.COMMAND_LOCK, lock_keys[i], lock_id, rcount)
+            if result == nil || result.Result != protocol.RESULT_SUCCED {
+                t.Errorf("Admin SaveSnapshot Lock Error %d %v", i, result)
+                slock.Close()
+                return
+            }
+            if result.Token > max_token {
+                max_token = result.Token
+            }
+        }
+
+        if i == 2 {
+            result := doTestAofLockCommand(slock, protocol.COMMAND_UNLOCK, lock_keys[i], lock_id)
+            if result == nil || result.Result != protocol.RESULT_SUCCED {
+                t.Errorf("Admin SaveSnapshot Unlock Error %v", result)
+                slock.Close()
+                return
+            }
+
+            values, err := doTestAdminCommand(slock, "SAVE")
+            if err != nil || len(values) != 1 || values[0] != "OK" {
+                t.Errorf("Admin SaveSnapshot Save Error %v %v", values, err)
+                slock.Close()
+                return
+            }
+        }
+    }
+    slock.Close()
+
+    append_files, _ := filepath.Glob(filepath.Join(data_dir, "append.aof.*"))
+    rewrite_files, _ := filepath.Glob(filepath.Join(data_dir, "rewrite.aof*"))
+    if _, err := os.Stat(filepath.Join(data_dir, "snapshot.aof")); err != nil || len(append_files) != 1 || len(rewrite_files) != 0 {
+        t.Errorf("Admin SaveSnapshot Files Error %v %v", append_files, err)
+        return
+    }
+
+    // the snapshot is loaded into the lock dbs directly, the append file after it is replayed through the aof channels
+    slock = openTestAofSLock(t, "file", data_dir)
+    for i, locked_count := range []uint32{1, 2, 0} {
+        if getTestLockedCount(slock, lock_keys[i]) != locked_count {
+            t.Errorf("Admin SaveSnapshot Load Lock Error %d %d", i, getTestLockedCount(slock, lock_keys[i]))
+            slock.Close()
+            return
+        }
+    }
+
+    if !waitTestLockedCount(slock, lock_keys[3], 1) {
+        t.Errorf("Admin SaveSnapshot Load Append Lock Error %d", getTestLockedCount(slock, lock_keys[3]))
+        slock.Close()
+        return
+    }
+
+    result := doTestAofLockCommand(slock, protocol.COMMAND_LOCK, lock_keys[2], lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED || result.Token <= max_token {
+        t.Errorf("Admin SaveSnapshot Load Fencing Token Error %v %d", result, max_token)
+        slock.Close()
+        return
+    }
+
+    result = doTestAofLockCommand(slock, protocol.COMMAND_UNLOCK, lock_keys[0], lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Admin SaveSnapshot Load Unlock Error %v", result)
+        slock.Close()
+        return
+    }
+
+    snapshot_info, _ := os.Stat(filepath.Join(data_dir, "snapshot.aof"))
+    values, err := doTestAdminCommand(slock, "BGSAVE")
+    if err != nil || len(values) != 1 || values[0] != "OK" {
+        t.Errorf("Admin SaveSnapshot BgSave Error %v %v", values, err)
+        slock.Close()
+        return
+    }
+
+    for i := 0; i < 500; i++ {
+        info, err := os.Stat(filepath.Join(data_dir, "snapshot.aof"))
+        append_files, _ = filepath.Glob(filepath.Join(data_dir, "append.aof.*"))
+        if err == nil && !os.SameFile(info, snapshot_info) && len(append_files) == 1 {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    slock.Close()
+
+    slock = openTestAofSLock(t, "file", data_dir)
+    defer slock.Close()
+    for i, locked_count := range []uint32{0, 2, 1, 1} {
+        if !waitTestLockedCount(slock, lock_keys[i], locked_count) {
+            t.Errorf("Admin SaveSnapshot BgSave Load Lock Error %d %d", i, getTestLockedCount(slock, lock_keys[i]))
+            return
+        }
+    }
+}
+
+func TestAdmin_DumpRestore(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_keys, lock_ids := make([][16]byte, 3), make([][16]byte, 3)
+    for i := range lock_keys {
+        copy(lock_keys[i][:], fmt.Sprintf("dump_lock_%d", i))
+        copy(lock_ids[i][:], fmt.Sprintf("dump_lock_id_%d", i))
+    }
+
+    max_token := uint64(0)
+    for i, rcount := range []uint8{0, 2, 0} {
+        for j := uint8(0); j <= rcount; j++ {
+            result := doTestAofRcountLockCommand(slock, protocol.COMMAND_LOCK, lock_keys[i], lock_ids[i], rcount)
+            if result == nil || result.Result != protocol.RESULT_SUCCED {
+                t.Errorf("Admin DumpRestore Lock Error %d %v", i, result)
+                return
+            }
+            if result.Token > max_token {
+                max_token = result.Token
+            }
+        }
+    }
+
+    result := doTestAofLockCommand(slock, protocol.COMMAND_UNLOCK, lock_keys[2], lock_ids[2])
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Admin DumpRestore Unlock Error %v", result)
+        return
+    }
+
+    values, err := doTestAdminCommand(slock, "DUMP", "0", fmt.Sprintf("%x", lock_keys[1]))
+    lock_infos := make([]*LockInfo, 0)
+    if err != nil || len(values) != 1 || json.Unmarshal([]byte(values[0]), &lock_infos) != nil || len(lock_infos) != 1 ||
+        lock_infos[0].LockKey != fmt.Sprintf("%x", lock_keys[1]) || lock_infos[0].Locked != 3 {
+        t.Errorf("Admin DumpRestore Dump Key Error %v %v", values, err)
+        return
+    }
+
+    values, err = doTestAdminCommand(slock, "DUMP", "0")
+    lock_infos = make([]*LockInfo, 0)
+    if err != nil || len(values) != 1 || json.Unmarshal([]byte(values[0]), &lock_infos) != nil || len(lock_infos) != 2 {
+        t.Errorf("Admin DumpRestore Dump Error %v %v", values, err)
+        return
+    }
+
+    for _, lock_info := range lock_infos {
+        if lock_info.LockId != fmt.Sprintf("%x", lock_ids[0]) && lock_info.LockId != fmt.Sprintf("%x", lock_ids[1]) {
+            t.Errorf("Admin DumpRestore Dump Lock Id Error %s", lock_info.LockId)
+            return
+        }
+
+        if lock_info.Expried == 0 || lock_info.Expried > 61 || lock_info.FencingToken == 0 {
+            t.Errorf("Admin DumpRestore Dump Expried Error %d %d", lock_info.Expried, lock_info.FencingToken)
+            return
+        }
+    }
+
+    // the dump json is what export writes and import sends, restore it on a fresh server
+    restore_slock, restore_data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(restore_data_dir)
+    defer restore_slock.Close()
+
+    values, err = doTestAdminCommand(restore_slock, "RESTORE", "0", values[0])
+    if err != nil || len(values) != 2 || values[0] != "2" || values[1] != "0" {
+        t.Errorf("Admin DumpRestore Restore Error %v %v", values, err)
+        return
+    }
+
+    for i, locked_count := range []uint32{1, 3, 0} {
+        if getTestLockedCount(restore_slock, lock_keys[i]) != locked_count {
+            t.Errorf("Admin DumpRestore Restore Lock Error %d %d", i, getTestLockedCount(restore_slock, lock_keys[i]))
+            return
+        }
+    }
+
+    result = doTestAofLockCommand(restore_slock, protocol.COMMAND_LOCK, lock_keys[2], lock_ids[2])
+    if result == nil || result.Result != protocol.RESULT_SUCCED || result.Token <= max_token {
+        t.Errorf("Admin DumpRestore Restore Fencing Token Error %v %d", result, max_token)
+        return
+    }
+
+    result = doTestAofLockCommand(restore_slock, protocol.COMMAND_UNLOCK, lock_keys[0], lock_ids[0])
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Admin DumpRestore Restore Unlock Error %v", result)
+        return
+    }
+
+    released_lock_info := lock_infos[0]
+    if released_lock_info.LockKey != fmt.Sprintf("%x", lock_keys[0]) {
+        released_lock_info = lock_infos[1]
+    }
+    values, err = doTestAdminCommand(restore_slock, "RESTORE", "0", fmt.Sprintf("[%s]", mustTestJson(released_lock_info)))
+    if err != nil || len(values) != 2 || values[0] != "1" || values[1] != "0" {
+        t.Errorf("Admin DumpRestore Restore Released Lock Error %v %v", values, err)
+        return
+    }
+
+    values, err = doTestAdminCommand(restore_slock, "RESTORE", "0", mustTestJson(lock_infos))
+    if err != nil || len(values) != 2 || values[0] != "0" || values[1] != "2" {
+        t.Errorf("Admin DumpRestore Restore Held Lock Error %v %v", values, err)
+        return
+    }
+
+    values, err = doTestAdminCommand(restore_slock, "RESTORE", "0", "[{")
+    if err == nil {
+        t.Errorf("Admin DumpRestore Restore Bad Json Error %v", values)
+    }
+}
+
+func mustTestJson(value interface{}) string {
+    data, _ := json.Marshal(value)
+    return string(data)
+}
+
+func TestAdmin_ConfigSetRewritePolicy(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof, db_lock_aof_time := slock.GetAof(), Config.DBLockAofTime
+    for _, args := range [][]string{{"AOF_FILE_REWRITE_SIZE", "1024"}, {"AOF_FILE_REWRITE_PERCENTAGE", "150"}, {"AOF_FILE_REWRITE_QUIET_HOURS", "22-6"}} {
+        values, err := doTestAdminCommand(slock, "CONFIG", "SET", args[0], args[1])
+        if err != nil || len(values) != 1 || values[0] != "OK" {
+            t.Errorf("Admin ConfigSetRewritePolicy Set Error %s %v %v", args[0], values, err)
+            return
+        }
+    }
+
+    if Config.AofFileRewriteSize != 1024 || aof.rewrite_size != 1024 || Config.DBLockAofTime != db_lock_aof_time {
+        t.Errorf("Admin ConfigSetRewritePolicy Rewrite Size Error %d %d %d", Config.AofFileRewriteSize, aof.rewrite_size, Config.DBLockAofTime)
+        return
+    }
+
+    if Config.AofFileRewritePercentage != 150 || aof.rewrite_percentage != 150 {
+        t.Errorf("Admin ConfigSetRewritePolicy Rewrite Percentage Error %d %d", Config.AofFileRewritePercentage, aof.rewrite_percentage)
+        return
+    }
+
+    if Config.AofFileRewriteQuietHours != "22-6" || aof.rewrite_quiet_start != 22 || aof.rewrite_quiet_end != 6 || aof.rewrite_size != 1024 {
+        t.Errorf("Admin ConfigSetRewritePolicy Quiet Hours Error %s %d %d", Config.AofFileRewriteQuietHours, aof.rewrite_quiet_start, aof.rewrite_quiet_end)
+        return
+    }
+
+    for _, args := range [][]string{{"AOF_FILE_REWRITE_SIZE", "a"}, {"AOF_FILE_REWRITE_PERCENTAGE", "-1"}, {"AOF_FILE_REWRITE_QUIET_HOURS", "6-6"}} {
+        values, err := doTestAdminCommand(slock, "CONFIG", "SET", args[0], args[1])
+        if err == nil {
+            t.Errorf("Admin ConfigSetRewritePolicy Set Invalid Error %s %v", args[0], values)
+            return
+        }
+    }
+
+    if aof.rewrite_size != 1024 || aof.rewrite_percentage != 150 || aof.rewrite_quiet_start != 22 {
+        t.Errorf("Admin ConfigSetRewritePolicy Invalid Changed Error %d %d %d", aof.rewrite_size, aof.rewrite_percentage, aof.rewrite_quiet_start)
+    }
+}
@@ -4,12 +4,15 @@ import (
     "bufio"
     "errors"
     "fmt"
+    "github.com/snower/slock/protocol"
+    "hash/crc32"
     "io"
     "math/rand"
     "os"
     "path/filepath"
     "sort"
     "strconv"
+    "strings"
     "sync"
     "sync/atomic"
     "time"
@@ -17,6 +20,9 @@ import (
 
 var LETTERS = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 var request_id_index uint64 = 0
+var AOF_FILE_CORRUPTED_ERROR = errors.New("Aof File Corrupted")
+
+const AOF_FILE_VERSION = 0x0004
 
 type AofLock struct {
     CommandType     uint8
@@ -34,13 +40,66 @@ type AofLock struct {
     Count           uint16
     Rcount          uint8
     LockType        uint8
+    Token           uint64
+    LockName        string
     buf             []byte
+    waiter          chan bool
+}
+
+func NewAofLock() *AofLock {
+    return &AofLock{0, 0, 0, 0, 0, 0,  [16]byte{},
+        [16]byte{}, 0, 0, 0, 0, 0, 0, 0, 0, "", make([]byte, 64), nil}
 }
 
 func (self *AofLock) GetBuf() []byte {
     return self.buf
 }
 
+func (self *AofLock) GetLockNameLen() int {
+    if len(self.LockName) > AOF_LOCK_NAME_MAX_LEN {
+        return AOF_LOCK_NAME_MAX_LEN
+    }
+    return len(self.LockName)
+}
+
+func (self *AofLock) EncodeReplication(extend bool) []byte {
+    if !extend {
+        buf := make([]byte, 64)
+        copy(buf, self.buf[:64])
+        buf[0], buf[1] = 62, 0
+        return buf
+    }
+
+    name_len := self.GetLockNameLen()
+    buf := make([]byte, 74 + name_len)
+    copy(buf, self.buf[:64])
+    buf[0], buf[1] = byte(72 + name_len), byte((72 + name_len) >> 8)
+    buf[64], buf[65], buf[66], buf[67], buf[68], buf[69], buf[70], buf[71] = byte(self.Token), byte(self.Token >> 8), byte(self.Token >> 16), byte(self.Token >> 24),
+        byte(self.Token >> 32), byte(self.Token >> 40), byte(self.Token >> 48), byte(self.Token >> 56)
+    buf[72], buf[73] = byte(name_len), byte(name_len >> 8)
+    copy(buf[74:], self.LockName[:name_len])
+    return buf
+}
+
+func (self *AofLock) DecodeReplication(extend_buf []byte) error {
+    self.Token, self.LockName = 0, ""
+    if len(extend_buf) == 0 {
+        return nil
+    }
+
+    if len(extend_buf) < 10 {
+        return errors.New("Buffer Len error")
+    }
+
+    name_len := int(extend_buf[8]) | int(extend_buf[9])<<8
+    if len(extend_buf) < 10 + name_len {
+        return errors.New("Buffer Len error")
+    }
+    self.Token = uint64(extend_buf[0]) | uint64(extend_buf[1])<<8 | uint64(extend_buf[2])<<16 | uint64(extend_buf[3])<<24 | uint64(extend_buf[4])<<32 | uint64(extend_buf[5])<<40 | uint64(extend_buf[6])<<48 | uint64(extend_buf[7])<<56
+    self.LockName = string(extend_buf[10:10 + name_len])
+    return nil
+}
+
 func (self *AofLock) Decode() error {
     buf := self.buf
     if len(buf) < 64 {
@@ -104,6 +163,10 @@ func (self *AofLock) Encode() error {
     return nil
 }
 
+func (self *AofLock) GetExpriedTime() uint32 {
+    return uint32(self.ExpriedTime) | uint32(self.ExpriedFlag & 0x00ff) << 16
+}
+
 func (self *AofLock) UpdateAofIndexId(aof_index uint32, aof_id uint32) error {
     self.AofIndex = aof_index
     self.AofId = aof_id
@@ -128,10 +191,12 @@ type AofFile struct {
     rbuf        *bufio.Reader
     wbuf        *bufio.Writer
     size        int
+    lock_count  uint64
+    version     uint16
 }
 
 func NewAofFile(aof *Aof, filename string, mode int, buf_size int) *AofFile{
-    return &AofFile{aof.slock, aof, filename, nil, mode, buf_size, make([]byte, 64), nil, nil, 0}
+    return &AofFile{aof.slock, aof, filename, nil, mode, buf_size, make([]byte, 64), nil, nil, 0, 0, AOF_FILE_VERSION}
 }
 
 func (self *AofFile) Open() error {
@@ -165,8 +230,11 @@ func (self *AofFile) Open() error {
 }
 
 func (self *AofFile) ReadHeader() error {
-    n, err := self.rbuf.Read(self.buf[:12])
+    n, err := io.ReadFull(self.rbuf, self.buf[:12])
     if err != nil {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return AOF_FILE_CORRUPTED_ERROR
+        }
         return err
     }
 
@@ -174,12 +242,15 @@ func (self *AofFile) ReadHeader() error {
         return errors.New("File is not AOF FIle")
     }
 
-    if string(self.buf[:8]) == "SLOCKAOF" {
-        return errors.New("File is not AOF File")
+    version := uint16(self.buf[8]) | uint16(self.buf[9])<<8
+    if string(self.buf[:8]) != "SLOCKAOF" {
+        // version 0x0001 wrote the last magic byte over the seventh, only its files may carry the short magic
+        if string(self.buf[:7]) != "SLOCKAO" || version != 0x0001 {
+            return errors.New("File is not AOF File")
+        }
     }
 
-    version := uint16(self.buf[8]) | uint16(self.buf[9])<<8
-    if version != 0x0001 {
+    if version != 0x0001 && version != 0x0002 && version != 0x0003 && version != 0x0004 {
         return errors.New("AOF File Unknown Version")
     }
 
@@ -199,13 +270,14 @@ func (self *AofFile) ReadHeader() error {
         }
     }
 
+    self.version = version
     self.size += 12 + int(header_len)
     return nil
 }
 
 func (self *AofFile) WriteHeader() error {
-    self.buf[0], self.buf[1], self.buf[2], self.buf[3], self.buf[4], self.buf[5], self.buf[6], self.buf[6] = 'S', 'L', 'O', 'C', 'K', 'A', 'O', 'F'
-    self.buf[8], self.buf[9], self.buf[10], self.buf[11] = 0x01, 0x00, 0x00, 0x00
+    self.buf[0], self.buf[1], self.buf[2], self.buf[3], self.buf[4], self.buf[5], self.buf[6], self.buf[7] = 'S', 'L', 'O', 'C', 'K', 'A', 'O', 'F'
+    self.buf[8], self.buf[9], self.buf[10], self.buf[11] = byte(self.version), byte(self.version >> 8), 0x00, 0x00
     n, err := self.wbuf.Write(self.buf[:12])
     if n != 12 {
         return err
@@ -215,30 +287,93 @@ func (self *AofFile) WriteHeader() error {
     return self.wbuf.Flush()
 }
 
+func (self *AofFile) GetVersion() uint16 {
+    return self.version
+}
+
+func (self *AofFile) GetLockCount() uint64 {
+    return self.lock_count
+}
+
 func (self *AofFile) ReadLock(lock *AofLock) error {
     buf := lock.GetBuf()
     if len(buf) < 64 {
         return errors.New("Buffer Len error")
     }
 
-    n, err := self.rbuf.Read(buf)
+    n, err := io.ReadFull(self.rbuf, buf[:64])
     if err != nil {
+        if err == io.ErrUnexpectedEOF {
+            return AOF_FILE_CORRUPTED_ERROR
+        }
         return err
     }
-    
+
     lock_len := uint16(buf[0]) | uint16(buf[1])<<8
     if n != int(lock_len) + 2 {
-        nn, nerr := self.rbuf.Read(buf[n:64])
-        if nerr != nil {
+        return AOF_FILE_CORRUPTED_ERROR
+    }
+
+    lock.Token, lock.LockName = 0, ""
+    if self.version == 0x0002 {
+        _, err := io.ReadFull(self.rbuf, self.buf[:4])
+        if err != nil {
+            if err == io.EOF || err == io.ErrUnexpectedEOF {
+                return AOF_FILE_CORRUPTED_ERROR
+            }
+            return err
+        }
+
+        checksum := uint32(self.buf[0]) | uint32(self.buf[1])<<8 | uint32(self.buf[2])<<16 | uint32(self.buf[3])<<24
+        if checksum != crc32.ChecksumIEEE(buf[:64]) {
+            return AOF_FILE_CORRUPTED_ERROR
+        }
+        self.size += 4
+    } else if self.version == 0x0003 {
+        _, err := io.ReadFull(self.rbuf, self.buf[:12])
+        if err != nil {
+            if err == io.EOF || err == io.ErrUnexpectedEOF {
+                return AOF_FILE_CORRUPTED_ERROR
+            }
+            return err
+        }
+
+        checksum := uint32(self.buf[8]) | uint32(self.buf[9])<<8 | uint32(self.buf[10])<<16 | uint32(self.buf[11])<<24
+        if checksum != crc32.Update(crc32.ChecksumIEEE(buf[:64]), crc32.IEEETable, self.buf[:8]) {
+            return AOF_FILE_CORRUPTED_ERROR
+        }
+        lock.Token = uint64(self.buf[0]) | uint64(self.buf[1])<<8 | uint64(self.buf[2])<<16 | uint64(self.buf[3])<<24 | uint64(self.buf[4])<<32 | uint64(self.buf[5])<<40 | uint64(self.buf[6])<<48 | uint64(self.buf[7])<<56
+        self.size += 12
+    } else if self.version != 0x0001 {
+        _, err := io.ReadFull(self.rbuf, self.buf[:10])
+        if err != nil {
+            if err == io.EOF || err == io.ErrUnexpectedEOF {
+                return AOF_FILE_CORRUPTED_ERROR
+            }
             return err
         }
-        n += nn
-        if n != int(lock_len) + 2 {
-            return errors.New("Lock Len error")
+
+        name_len := int(self.buf[8]) | int(self.buf[9])<<8
+        name_buf := make([]byte, name_len + 4)
+        _, err = io.ReadFull(self.rbuf, name_buf)
+        if err != nil {
+            if err == io.EOF || err == io.ErrUnexpectedEOF {
+                return AOF_FILE_CORRUPTED_ERROR
+            }
+            return err
         }
+
+        checksum := uint32(name_buf[name_len]) | uint32(name_buf[name_len + 1])<<8 | uint32(name_buf[name_len + 2])<<16 | uint32(name_buf[name_len + 3])<<24
+        if checksum != crc32.Update(crc32.Update(crc32.ChecksumIEEE(buf[:64]), crc32.IEEETable, self.buf[:10]), crc32.IEEETable, name_buf[:name_len]) {
+            return AOF_FILE_CORRUPTED_ERROR
+        }
+        lock.Token = uint64(self.buf[0]) | uint64(self.buf[1])<<8 | uint64(self.buf[2])<<16 | uint64(self.buf[3])<<24 | uint64(self.buf[4])<<32 | uint64(self.buf[5])<<40 | uint64(self.buf[6])<<48 | uint64(self.buf[7])<<56
+        lock.LockName = string(name_buf[:name_len])
+        self.size += 14 + name_len
     }
 
-    self.size += 2 + int(lock_len)
+    self.size += 64
+    self.lock_count++
     return nil
 }
 
@@ -258,10 +393,80 @@ func (self *AofFile) WriteLock(lock *AofLock) error {
         return errors.New("Write buf error")
     }
 
+    if self.version == 0x0002 {
+        checksum := crc32.ChecksumIEEE(buf[:64])
+        self.buf[0], self.buf[1], self.buf[2], self.buf[3] = byte(checksum), byte(checksum >> 8), byte(checksum >> 16), byte(checksum >> 24)
+        n, err = self.wbuf.Write(self.buf[:4])
+        if err != nil {
+            return err
+        }
+
+        if n != 4 {
+            return errors.New("Write buf error")
+        }
+        self.size += 4
+    } else if self.version == 0x0003 {
+        self.buf[0], self.buf[1], self.buf[2], self.buf[3], self.buf[4], self.buf[5], self.buf[6], self.buf[7] = byte(lock.Token), byte(lock.Token >> 8), byte(lock.Token >> 16), byte(lock.Token >> 24),
+            byte(lock.Token >> 32), byte(lock.Token >> 40), byte(lock.Token >> 48), byte(lock.Token >> 56)
+        checksum := crc32.Update(crc32.ChecksumIEEE(buf[:64]), crc32.IEEETable, self.buf[:8])
+        self.buf[8], self.buf[9], self.buf[10], self.buf[11] = byte(checksum), byte(checksum >> 8), byte(checksum >> 16), byte(checksum >> 24)
+        n, err = self.wbuf.Write(self.buf[:12])
+        if err != nil {
+            return err
+        }
+
+        if n != 12 {
+            return errors.New("Write buf error")
+        }
+        self.size += 12
+    } else if self.version != 0x0001 {
+        name_len := lock.GetLockNameLen()
+        self.buf[0], self.buf[1], self.buf[2], self.buf[3], self.buf[4], self.buf[5], self.buf[6], self.buf[7] = byte(lock.Token), byte(lock.Token >> 8), byte(lock.Token >> 16), byte(lock.Token >> 24),
+            byte(lock.Token >> 32), byte(lock.Token >> 40), byte(lock.Token >> 48), byte(lock.Token >> 56)
+        self.buf[8], self.buf[9] = byte(name_len), byte(name_len >> 8)
+        n, err = self.wbuf.Write(self.buf[:10])
+        if err != nil {
+            return err
+        }
+
+        if n != 10 {
+            return errors.New("Write buf error")
+        }
+
+        n, err = self.wbuf.WriteString(lock.LockName[:name_len])
+        if err != nil {
+            return err
+        }
+
+        if n != name_len {
+            return errors.New("Write buf error")
+        }
+
+        checksum := crc32.Update(crc32.Update(crc32.ChecksumIEEE(buf[:64]), crc32.IEEETable, self.buf[:10]), crc32.IEEETable, []byte(lock.LockName[:name_len]))
+        self.buf[0], self.buf[1], self.buf[2], self.buf[3] = byte(checksum), byte(checksum >> 8), byte(checksum >> 16), byte(checksum >> 24)
+        n, err = self.wbuf.Write(self.buf[:4])
+        if err != nil {
+            return err
+        }
+
+        if n != 4 {
+            return errors.New("Write buf error")
+        }
+        self.size += 14 + name_len
+    }
+
     self.size += 64
+    self.lock_count++
     return nil
 }
 
+func (self *AofFile) FlushBuffer() error {
+    if self.file == nil {
+        return nil
+    }
+    return self.wbuf.Flush()
+}
+
 func (self *AofFile) Flush() error {
     if self.file == nil {
         return nil
@@ -304,6 +509,7 @@ type AofChannel struct {
     free_lock_index int32
     free_lock_max   int32
     buf             []byte
+    fsync_waiters   []chan bool
     closed          bool
     is_stop         bool
 }
@@ -343,12 +549,19 @@ func (self *AofChannel) Push(lock *Lock, command_type uint8) error {
         }
         aof_lock.ExpriedFlag = lock.command.ExpriedFlag & 0x4800
         if lock.command.ExpriedFlag & 0x4000 == 0 {
-            aof_lock.ExpriedTime = uint16(uint64(lock.expried_time) - aof_lock.CommandTime)
+            expried_time := uint64(lock.expried_time) - aof_lock.CommandTime
+            if expried_time > protocol.MAX_EXPRIED_TIME {
+                expried_time = protocol.MAX_EXPRIED_TIME
+            }
+            aof_lock.ExpriedFlag |= uint16(expried_time >> 16)
+            aof_lock.ExpriedTime = uint16(expried_time)
         } else {
             aof_lock.ExpriedTime = 0
         }
         aof_lock.Count = lock.command.Count
         aof_lock.Rcount = lock.command.Rcount
+        aof_lock.Token = lock.fencing_token
+        aof_lock.LockName = lock.manager.lock_name
     } else {
         command_time := self.lock_db.current_time
         if lock.expried_time <= command_time {
@@ -358,15 +571,28 @@ func (self *AofChannel) Push(lock *Lock, command_type uint8) error {
         if command_time - lock.start_time <= 0xffff {
             start_time = uint16(command_time - lock.start_time)
         }
-        expried_time := uint16(0)
+        expried_time := uint32(0)
         if lock.command.ExpriedFlag & 0x4000 == 0 {
-            expried_time = uint16(lock.expried_time - command_time)
+            if lock.expried_time - command_time > protocol.MAX_EXPRIED_TIME {
+                expried_time = protocol.MAX_EXPRIED_TIME
+            } else {
+                expried_time = uint32(lock.expried_time - command_time)
+            }
         }
         aof_lock = &AofLock{command_type, 0, 0, uint64(command_time), lock.command.Flag, lock.manager.db_id,  lock.command.LockId,
-            lock.command.LockKey, lock.command.ExpriedFlag & 0x4800, 0, start_time, expried_time, lock.command.Count, lock.command.Rcount, 0, self.buf}
+            lock.command.LockKey, 0, start_time, lock.command.ExpriedFlag & 0x4800 | uint16(expried_time >> 16), uint16(expried_time), lock.command.Count, lock.command.Rcount, 0, lock.fencing_token, lock.manager.lock_name, self.buf, nil}
     }
 
     aof_lock.LockType = 0
+    aof_lock.waiter = nil
+    if command_type == protocol.COMMAND_UNLOCK {
+        // an unlock record always releases the whole reentrant lock, the same way the rewrite reads it
+        aof_lock.Rcount = 0
+    }
+    if command_type == protocol.COMMAND_LOCK && lock.aof_time == 0 && self.aof.fsync_policy == AOF_FSYNC_ALWAYS {
+        aof_lock.waiter = make(chan bool, 1)
+        lock.aof_waiter = aof_lock.waiter
+    }
     self.channel <- aof_lock
     return nil
 }
@@ -399,12 +625,15 @@ func (self *AofChannel) Load(lock *AofLock) error {
         aof_lock.ExpriedTime = lock.ExpriedTime
         aof_lock.Count = lock.Count
         aof_lock.Rcount = lock.Rcount
+        aof_lock.Token = lock.Token
+        aof_lock.LockName = lock.LockName
     } else {
         aof_lock = &AofLock{lock.CommandType, lock.AofIndex, lock.AofId, lock.CommandTime, lock.Flag, lock.DbId,  lock.LockId,
-            lock.LockKey, lock.AofFlag, lock.StartTime, lock.ExpriedFlag, lock.ExpriedTime, lock.Count, lock.Rcount, 0, self.buf}
+            lock.LockKey, lock.AofFlag, lock.StartTime, lock.ExpriedFlag, lock.ExpriedTime, lock.Count, lock.Rcount, 0, lock.Token, lock.LockName, self.buf, nil}
     }
 
     aof_lock.LockType = 1
+    aof_lock.waiter = nil
     self.channel <- aof_lock
     return nil
 }
@@ -443,25 +672,54 @@ func (self *AofChannel) Handle() {
     }
 }
 
+func (self *AofChannel) Drain() {
+    aof_lock := NewAofLock()
+    aof_lock.LockType = 2
+    aof_lock.waiter = make(chan bool, 1)
+    self.channel <- aof_lock
+    <- aof_lock.waiter
+}
+
 func (self *AofChannel) HandleLock(aof_lock *AofLock)  {
+    if aof_lock.LockType == 2 {
+        if len(self.fsync_waiters) > 0 {
+            self.WakeUpFsyncWaiters()
+        }
+        aof_lock.waiter <- true
+        return
+    }
+
     if aof_lock.LockType == 0 {
         err := aof_lock.Encode()
         if err != nil {
             self.slock.Log().Errorf("Aof Push Encode Error %v", err)
         }
         self.aof.PushLock(aof_lock)
-        self.glock.Lock()
-        if self.free_lock_index < self.free_lock_max {
-            self.free_locks[self.free_lock_index] = aof_lock
-            self.free_lock_index++
+        if aof_lock.waiter != nil {
+            self.fsync_waiters = append(self.fsync_waiters, aof_lock.waiter)
+            aof_lock.waiter = nil
         }
-        self.glock.Unlock()
+        if len(self.fsync_waiters) > 0 && (len(self.channel) == 0 || len(self.fsync_waiters) >= AOF_FSYNC_MAX_WAITERS) {
+            self.WakeUpFsyncWaiters()
+        }
+        self.FreeAofLock(aof_lock)
         return
     }
 
-    expried_time := uint16(0)
+    expried_time := uint32(0)
     if aof_lock.ExpriedFlag & 0x4000 == 0 {
-        expried_time = uint16(int64(aof_lock.CommandTime + uint64(aof_lock.ExpriedTime)) - self.lock_db.current_time)
+        remaining_time := int64(aof_lock.CommandTime + uint64(aof_lock.GetExpriedTime())) - self.lock_db.current_time
+        if remaining_time > 0 {
+            expried_time = uint32(remaining_time)
+        }
+    }
+
+    if aof_lock.CommandType == protocol.COMMAND_LOCK {
+        self.lock_db.UpdateFencingToken(aof_lock.Token)
+        if aof_lock.ExpriedFlag & 0x4000 == 0 && expried_time == 0 {
+            self.FreeAofLock(aof_lock)
+            return
+        }
     }
 
     lock_command := self.server_protocol.GetLockCommand()
@@ -471,16 +729,23 @@ func (self *AofChannel) HandleLock(aof_lock *AofLock)  {
     lock_command.DbId = aof_lock.DbId
     lock_command.LockId = aof_lock.LockId
     lock_command.LockKey = aof_lock.LockKey
+    lock_command.LockName = aof_lock.LockName
     lock_command.TimeoutFlag = 0
     lock_command.Timeout = 5
     lock_command.ExpriedFlag = aof_lock.ExpriedFlag | 0x1200
-    lock_command.Expried = expried_time
+    lock_command.SetExpried(expried_time)
     lock_command.Count = aof_lock.Count
     lock_command.Rcount = aof_lock.Rcount
     err := self.server_protocol.ProcessLockCommand(lock_command)
     if err != nil {
         self.slock.Log().Errorf("Aof Load ProcessLockCommand Error %v", err)
+    } else if aof_lock.CommandType == protocol.COMMAND_LOCK && aof_lock.Token > 0 {
+        self.lock_db.UpdateLockFencingToken(lock_command, aof_lock.Token)
     }
+    self.FreeAofLock(aof_lock)
+}
+
+func (self *AofChannel) FreeAofLock(aof_lock *AofLock) {
     self.glock.Lock()
     if self.free_lock_index < self.free_lock_max {
         self.free_locks[self.free_lock_index] = aof_lock
@@ -489,7 +754,21 @@ func (self *AofChannel) HandleLock(aof_lock *AofLock)  {
     self.glock.Unlock()
 }
 
+func (self *AofChannel) WakeUpFsyncWaiters()  {
+    self.aof.aof_file_glock.Lock()
+    err := self.aof.Flush()
+    self.aof.aof_file_glock.Unlock()
+
+    for _, waiter := range self.fsync_waiters {
+        waiter <- err == nil
+    }
+    self.fsync_waiters = self.fsync_waiters[:0]
+}
+
 func (self *AofChannel) DoStop()  {
+    if len(self.fsync_waiters) > 0 {
+        self.WakeUpFsyncWaiters()
+    }
     self.is_stop = true
     self.server_protocol.Close()
     self.lock_db = nil
@@ -501,7 +780,7 @@ type Aof struct {
     glock                       *sync.Mutex
     data_dir                    string
     aof_file_index              uint32
-    aof_file                    *AofFile
+    persistence                 AofPersistence
     aof_file_glock              *sync.Mutex
     channels                    []*AofChannel
     channel_count               uint32
@@ -510,162 +789,534 @@ type Aof struct {
     unactived_channel_waiter    chan bool
     rewrited_waiter             chan bool
     rewrite_size                uint32
+    rewrite_percentage          uint32
+    rewrite_quiet_start         int
+    rewrite_quiet_end           int
+    rewrite_base_size           uint32
+    rewrite_count               uint64
+    rewrite_start_time          time.Time
+    rewrite_last_duration       time.Duration
+    rewrite_last_error          error
+    rewrite_scheduled           bool
+    fsync_policy                uint8
     aof_lock_count              uint64
     aof_id                      uint32
+    replications                []*ReplicationServer
     is_rewriting                bool
     is_stop                     bool
 }
 
 func NewAof() *Aof {
     return &Aof{nil, &sync.Mutex{}, "",0, nil, &sync.Mutex{}, make([]*AofChannel, 0),
-        0, 0, nil, nil, nil, 0, 0, 0, false, false}
+        0, 0, nil, nil, nil, 0, 0, -1, -1, 0, 0, time.Time{}, 0, nil, false,
+        AOF_FSYNC_EVERYSEC, 0, 0, make([]*ReplicationServer, 0), false, false}
 }
 
-func (self *Aof) LoadAndInit() error {
-    self.rewrite_size = uint32(Config.AofFileRewriteSize)
-    data_dir, err := filepath.Abs(Config.DataDir)
+func (self *Aof) SetDataDir(data_dir string) error {
+    data_dir, err := filepath.Abs(data_dir)
     if err != nil {
         return err
     }
 
-    self.data_dir = data_dir
-    if _, err := os.Stat(self.data_dir); os.IsNotExist(err) {
+    if _, err := os.Stat(data_dir); os.IsNotExist(err) {
         return err
     }
+    self.data_dir = data_dir
     self.slock.Log().Infof("Aof Data Dir %s", self.data_dir)
+    return nil
+}
 
-    append_files, rewrite_file, err := self.FindAofFiles()
+func (self *Aof) GetDataDir() string {
+    return self.data_dir
+}
+
+func (self *Aof) SetFsyncPolicy(fsync string) error {
+    switch fsync {
+    case "always":
+        self.fsync_policy = AOF_FSYNC_ALWAYS
+    case "everysec", "":
+        self.fsync_policy = AOF_FSYNC_EVERYSEC
+    case "no":
+        self.fsync_policy = AOF_FSYNC_NO
+    default:
+        return errors.New("Unknown Aof Fsync Policy")
+    }
+    return nil
+}
+
+func (self *Aof) SetRewritePolicy(rewrite_size uint32, rewrite_percentage uint32, quiet_hours string) error {
+    quiet_start, quiet_end, err := ParseAofRewriteQuietHours(quiet_hours)
     if err != nil {
         return err
     }
 
-    if len(append_files) > 0 {
-        aof_file_index, err := strconv.Atoi(append_files[len(append_files) -1][11:])
+    self.rewrite_size = rewrite_size
+    self.rewrite_percentage = rewrite_percentage
+    self.rewrite_quiet_start = quiet_start
+    self.rewrite_quiet_end = quiet_end
+    return nil
+}
+
+func ParseAofRewriteQuietHours(quiet_hours string) (int, int, error) {
+    if quiet_hours == "" {
+        return -1, -1, nil
+    }
+
+    hours := strings.Split(quiet_hours, "-")
+    if len(hours) != 2 {
+        return -1, -1, errors.New("Aof Rewrite Quiet Hours Error")
+    }
+
+    quiet_start, err := strconv.Atoi(strings.TrimSpace(hours[0]))
+    if err != nil || quiet_start < 0 || quiet_start > 23 {
+        return -1, -1, errors.New("Aof Rewrite Quiet Hours Error")
+    }
+
+    quiet_end, err := strconv.Atoi(strings.TrimSpace(hours[1]))
+    if err != nil || quiet_end < 0 || quiet_end > 23 || quiet_end == quiet_start {
+        return -1, -1, errors.New("Aof Rewrite Quiet Hours Error")
+    }
+    return quiet_start, quiet_end, nil
+}
+
+func (self *Aof) IsRewriteQuietHours(now time.Time) bool {
+    if self.rewrite_quiet_start < 0 {
+        return true
+    }
+
+    hour := now.Hour()
+    if self.rewrite_quiet_start < self.rewrite_quiet_end {
+        return hour >= self.rewrite_quiet_start && hour < self.rewrite_quiet_end
+    }
+    return hour >= self.rewrite_quiet_start || hour < self.rewrite_quiet_end
+}
+
+func (self *Aof) CheckRewrite() bool {
+    aof_size := uint32(self.persistence.GetSize())
+    if aof_size < self.rewrite_size {
+        return false
+    }
+
+    if self.rewrite_percentage > 0 && uint64(aof_size) * 100 < uint64(self.rewrite_base_size) * uint64(self.rewrite_percentage) {
+        return false
+    }
+
+    if !self.IsRewriteQuietHours(time.Now()) {
+        self.rewrite_scheduled = true
+        return false
+    }
+    self.rewrite_scheduled = false
+    return true
+}
+
+func (self *Aof) RewriteRun() {
+    for ; !self.is_stop; {
+        time.Sleep(time.Minute)
+        self.aof_file_glock.Lock()
+        if self.rewrite_scheduled && !self.is_stop && self.IsRewriteQuietHours(time.Now()) {
+            self.rewrite_scheduled = false
+            self.slock.Log().Infof("Aof Scheduled Rewrite Size %d", self.persistence.GetSize())
+            self.RewriteAofFile()
+        }
+        self.aof_file_glock.Unlock()
+    }
+}
+
+func (self *Aof) SetPersistence(persistence AofPersistence) {
+    self.persistence = persistence
+}
+
+func (self *Aof) GetPersistence() AofPersistence {
+    return self.persistence
+}
+
+func (self *Aof) InitPersistence() error {
+    if self.persistence == nil {
+        persistence, err := NewAofPersistence(self, Config.AofPersistence)
         if err != nil {
             return err
         }
-        self.aof_file_index = uint32(aof_file_index)
+        self.persistence = persistence
     }
+    self.slock.Log().Infof("Aof Persistence %s", self.persistence.GetName())
+    return self.persistence.Init()
+}
 
-    self.aof_file = NewAofFile(self, filepath.Join(self.data_dir, fmt.Sprintf("%s.%d", "append.aof", self.aof_file_index + 1)), os.O_WRONLY, int(Config.AofFileBufferSize))
-    err = self.aof_file.Open()
+func (self *Aof) Init() error {
+    err := self.SetRewritePolicy(uint32(Config.AofFileRewriteSize), uint32(Config.AofFileRewritePercentage), Config.AofFileRewriteQuietHours)
     if err != nil {
         return err
     }
-    self.aof_file_index++
-    self.slock.Log().Infof("Aof File Create %s.%d", "append.aof", self.aof_file_index)
 
-    aof_filenames := make([]string, 0)
-    if rewrite_file != "" {
-        aof_filenames = append(aof_filenames, rewrite_file)
-    }
-    aof_filenames = append(aof_filenames, append_files...)
-    err = self.LoadAofFiles(aof_filenames, func (filename string, aof_file *AofFile, lock *AofLock, first_lock bool) (bool, error) {
-        err := self.LoadLock(lock)
-        if err != nil {
-            return true, err
-        }
-        return true, nil
-    })
+    err = self.SetFsyncPolicy(Config.AofFsync)
     if err != nil {
         return err
     }
-    self.slock.Log().Infof("Aof File Load %v", aof_filenames)
 
-    if self.actived_channel_count > 0 {
-        self.unactived_channel_waiter = make(chan bool, 1)
-        <- self.unactived_channel_waiter
+    err = self.InitPersistence()
+    if err != nil {
+        return err
     }
-    if len(append_files) > 0 {
-        go self.RewriteAofFiles()
+
+    err = self.Reset()
+    if err != nil {
+        return err
     }
+    go self.FsyncRun()
+    go self.RewriteRun()
     return nil
 }
 
-func (self *Aof) FindAofFiles() ([]string, string, error) {
-    append_files := make([]string, 0)
-    rewrite_file := ""
-
-    err := filepath.Walk(self.data_dir, func(path string, info os.FileInfo, err error) error {
-        if err != nil {
-            return err
-        }
+func (self *Aof) LoadAndInit() error {
+    err := self.SetRewritePolicy(uint32(Config.AofFileRewriteSize), uint32(Config.AofFileRewritePercentage), Config.AofFileRewriteQuietHours)
+    if err != nil {
+        return err
+    }
 
-        if info.IsDir() {
-            return nil
-        }
+    err = self.SetFsyncPolicy(Config.AofFsync)
+    if err != nil {
+        return err
+    }
 
-        file_name := info.Name()
-        if len(file_name) >= 11 && file_name[:10] == "append.aof" {
-            _, err := strconv.Atoi(file_name[11:])
-            if err == nil {
-                append_files = append(append_files, file_name)
-            }
-        } else if file_name == "rewrite.aof" {
-            rewrite_file = file_name
-        }
-        return nil
-    })
+    err = self.InitPersistence()
     if err != nil {
-        return nil, "", err
+        return err
     }
 
-    sort.Strings(append_files)
-    return append_files, rewrite_file, nil
-}
+    err = self.persistence.Load()
+    if err != nil {
+        return err
+    }
 
-func (self *Aof) LoadAofFiles(filenames []string, iter_func func(string, *AofFile, *AofLock, bool) (bool, error)) error {
-    lock := &AofLock{0, 0, 0, 0, 0, 0,  [16]byte{},
-        [16]byte{}, 0, 0, 0, 0, 0, 0, 0, make([]byte, 64)}
-    now := time.Now().Unix()
+    err = self.persistence.Open(self.aof_file_index + 1)
+    if err != nil {
+        return err
+    }
+    self.aof_file_index++
 
-    for _, filename := range filenames {
-        err := self.LoadAofFile(filename, lock, now, iter_func)
-        if err != nil {
-            if err == io.EOF {
-                return nil
-            }
-            return err
-        }
+    if self.actived_channel_count > 0 {
+        self.unactived_channel_waiter = make(chan bool, 1)
+        <- self.unactived_channel_waiter
     }
+    go self.RewriteAofFiles()
+    go self.FsyncRun()
+    go self.RewriteRun()
     return nil
 }
 
-func (self *Aof) LoadAofFile(filename string, lock *AofLock, now int64, iter_func func(string, *AofFile, *AofLock, bool) (bool, error)) error {
-    aof_file := NewAofFile(self, filepath.Join(self.data_dir, filename), os.O_RDONLY, int(Config.AofFileBufferSize))
-    err := aof_file.Open()
+func (self *Aof) LoadSnapshot() (uint32, error) {
+    filename := filepath.Join(self.data_dir, "snapshot.aof")
+    if _, err := os.Stat(filename); os.IsNotExist(err) {
+        return 0, nil
+    }
+
+    snapshot_file := NewAofFile(self, filename, os.O_RDONLY, int(Config.AofFileBufferSize))
+    err := snapshot_file.Open()
     if err != nil {
-        return err
+        if err == AOF_FILE_CORRUPTED_ERROR {
+            self.slock.Log().Warningf("Aof Snapshot Header Corrupted Skip %s", filename)
+            return 0, nil
+        }
+        return 0, err
     }
+    defer snapshot_file.Close()
 
-    first_lock := true
+    lock := NewAofLock()
+    now := time.Now().Unix()
+    aof_index, lock_count := uint32(0), 0
     for {
-        err := aof_file.ReadLock(lock)
+        err := snapshot_file.ReadLock(lock)
         if err == io.EOF {
-            err := aof_file.Close()
-            if err != nil {
-                return err
-            }
-            return nil
+            break
+        }
+
+        if err == AOF_FILE_CORRUPTED_ERROR {
+            self.slock.Log().Warningf("Aof Snapshot Corrupted At %d", snapshot_file.GetSize())
+            break
         }
 
         if err != nil {
-            return err
+            return 0, err
         }
 
         err = lock.Decode()
         if err != nil {
-            return err
+            return 0, err
         }
 
+        aof_index = lock.AofIndex
         if lock.ExpriedFlag & 0x4000 == 0 {
-            if int64(lock.CommandTime + uint64(lock.ExpriedTime)) <= now {
+            if int64(lock.CommandTime + uint64(lock.GetExpriedTime())) <= now {
+                self.slock.GetOrNewDB(lock.DbId).UpdateFencingToken(lock.Token)
                 continue
             }
         }
 
-        is_stop, iter_err := iter_func(filename, aof_file, lock, first_lock)
-        if iter_err != nil {
+        err = self.RestoreLock(lock, now)
+        if err != nil {
+            return 0, err
+        }
+        lock_count++
+    }
+
+    self.slock.Log().Infof("Aof Snapshot Load %d Locks Aof Index %d", lock_count, aof_index)
+    return aof_index, nil
+}
+
+func (self *Aof) RestoreLock(lock *AofLock, now int64) error {
+    expried_time := uint32(0)
+    if lock.ExpriedFlag & 0x4000 == 0 {
+        remaining_time := int64(lock.CommandTime + uint64(lock.GetExpriedTime())) - now
+        if remaining_time <= 0 {
+            return nil
+        }
+        expried_time = uint32(remaining_time)
+    }
+
+    db := self.slock.dbs[lock.DbId]
+    if db == nil {
+        db = self.slock.GetOrNewDB(lock.DbId)
+    }
+
+    server_protocol := db.aof_channels[uint8(lock.LockKey[3] ^ lock.LockKey[15]) % uint8(db.manager_max_glocks)].server_protocol
+    server_protocol.Lock()
+    lock_command := server_protocol.GetLockCommand()
+    server_protocol.Unlock()
+
+    lock_command.CommandType = lock.CommandType
+    lock_command.RequestId = self.GetRequestId()
+    lock_command.Flag = lock.Flag
+    lock_command.DbId = lock.DbId
+    lock_command.LockId = lock.LockId
+    lock_command.LockKey = lock.LockKey
+    lock_command.LockName = lock.LockName
+    lock_command.TimeoutFlag = 0
+    lock_command.Timeout = 5
+    lock_command.ExpriedFlag = lock.ExpriedFlag | 0x1200
+    lock_command.SetExpried(expried_time)
+    lock_command.Count = lock.Count
+    lock_command.Rcount = lock.Rcount
+    return db.RestoreLock(server_protocol, lock_command, lock.Token)
+}
+
+func (self *Aof) SaveSnapshot() error {
+    if Config.Cluster != "" || self.slock.state != STATE_LEADER {
+        return errors.New("Snapshot Only Leader")
+    }
+
+    if _, ok := self.persistence.(*FileAofPersistence); !ok {
+        return errors.New("Snapshot Only File Persistence")
+    }
+
+    self.LockRewriting()
+    defer self.UnLockRewriting()
+
+    self.aof_file_glock.Lock()
+    if self.is_stop {
+        self.aof_file_glock.Unlock()
+        return errors.New("Aof Closed")
+    }
+    aof_file_index := self.aof_file_index
+    self.RewriteAofFile()
+    self.aof_file_glock.Unlock()
+
+    os.Remove(filepath.Join(self.data_dir, "snapshot.aof.tmp"))
+    snapshot_file := NewAofFile(self, filepath.Join(self.data_dir, "snapshot.aof.tmp"), os.O_WRONLY, int(Config.AofFileBufferSize))
+    err := snapshot_file.Open()
+    if err != nil {
+        return err
+    }
+
+    lock_count, err := self.DumpSnapshotLocks(snapshot_file, aof_file_index)
+    if err == nil {
+        err = snapshot_file.Flush()
+    }
+    if err != nil {
+        snapshot_file.Close()
+        os.Remove(filepath.Join(self.data_dir, "snapshot.aof.tmp"))
+        self.slock.Log().Errorf("Aof Snapshot Write Error %v", err)
+        return err
+    }
+
+    err = snapshot_file.Close()
+    if err != nil {
+        return err
+    }
+
+    err = os.Rename(filepath.Join(self.data_dir, "snapshot.aof.tmp"), filepath.Join(self.data_dir, "snapshot.aof"))
+    if err != nil {
+        self.slock.Log().Errorf("Aof Snapshot Rename Error %v", err)
+        return err
+    }
+    self.slock.Log().Infof("Aof Snapshot Save %d Locks Aof Index %d", lock_count, aof_file_index)
+    self.ClearSnapshotAofFiles(aof_file_index)
+    return nil
+}
+
+func (self *Aof) DumpSnapshotLocks(snapshot_file *AofFile, aof_file_index uint32) (uint32, error) {
+    now := time.Now().Unix()
+    aof_id := uint32(0)
+    for _, db := range self.slock.dbs {
+        if db == nil {
+            continue
+        }
+
+        for _, lock_manager := range db.GetLockManagers() {
+            aof_locks := make([]*AofLock, 0)
+            lock_manager.glock.Lock()
+            if lock_manager.locked > 0 {
+                if lock_manager.current_lock != nil && lock_manager.current_lock.is_aof {
+                    for i := uint8(0); i < lock_manager.current_lock.locked; i++ {
+                        aof_locks = append(aof_locks, lock_manager.DumpAofLock(lock_manager.current_lock, aof_file_index, 0, now))
+                    }
+                }
+
+                for _, lock := range lock_manager.lock_maps {
+                    if lock.is_aof {
+                        for i := uint8(0); i < lock.locked; i++ {
+                            aof_locks = append(aof_locks, lock_manager.DumpAofLock(lock, aof_file_index, 0, now))
+                        }
+                    }
+                }
+            }
+            lock_manager.glock.Unlock()
+
+            for _, aof_lock := range aof_locks {
+                if aof_lock == nil {
+                    continue
+                }
+
+                aof_id++
+                aof_lock.UpdateAofIndexId(aof_file_index, aof_id)
+                err := snapshot_file.WriteLock(aof_lock)
+                if err != nil {
+                    return aof_id, err
+                }
+            }
+        }
+    }
+    return aof_id, nil
+}
+
+func (self *Aof) ClearSnapshotAofFiles(aof_file_index uint32) {
+    append_files, rewrite_file, err := self.FindAofFiles()
+    if err != nil {
+        self.slock.Log().Errorf("Aof Snapshot Find Files Error %v", err)
+        return
+    }
+
+    aof_filenames := make([]string, 0)
+    if rewrite_file != "" {
+        aof_filenames = append(aof_filenames, rewrite_file)
+    }
+    for _, append_file := range append_files {
+        append_file_index, err := strconv.Atoi(append_file[11:])
+        if err == nil && uint32(append_file_index) <= aof_file_index {
+            aof_filenames = append(aof_filenames, append_file)
+        }
+    }
+
+    for _, aof_filename := range aof_filenames {
+        err := os.Remove(filepath.Join(self.data_dir, aof_filename))
+        if err != nil {
+            self.slock.Log().Errorf("Aof Snapshot Remove File Error %s %v", aof_filename, err)
+            continue
+        }
+        self.slock.Log().Infof("Aof Snapshot Remove File %s", aof_filename)
+    }
+}
+
+func (self *Aof) FindAofFiles() ([]string, string, error) {
+    append_files := make([]string, 0)
+    rewrite_file := ""
+
+    err := filepath.Walk(self.data_dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+
+        if info.IsDir() {
+            return nil
+        }
+
+        file_name := info.Name()
+        if len(file_name) >= 11 && file_name[:10] == "append.aof" {
+            _, err := strconv.Atoi(file_name[11:])
+            if err == nil {
+                append_files = append(append_files, file_name)
+            }
+        } else if file_name == "rewrite.aof" {
+            rewrite_file = file_name
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, "", err
+    }
+
+    sort.Strings(append_files)
+    return append_files, rewrite_file, nil
+}
+
+func (self *Aof) LoadAofFiles(filenames []string, iter_func func(string, *AofFile, *AofLock, bool) (bool, error)) error {
+    lock := NewAofLock()
+    now := time.Now().Unix()
+
+    for _, filename := range filenames {
+        err := self.LoadAofFile(filename, lock, now, iter_func)
+        if err != nil {
+            if err == io.EOF {
+                return nil
+            }
+            return err
+        }
+    }
+    return nil
+}
+
+func (self *Aof) LoadAofFile(filename string, lock *AofLock, now int64, iter_func func(string, *AofFile, *AofLock, bool) (bool, error)) error {
+    aof_file := NewAofFile(self, filepath.Join(self.data_dir, filename), os.O_RDONLY, int(Config.AofFileBufferSize))
+    err := aof_file.Open()
+    if err != nil {
+        if err == AOF_FILE_CORRUPTED_ERROR {
+            self.slock.Log().Warningf("Aof File Header Corrupted Skip %s", filename)
+            return nil
+        }
+        return err
+    }
+
+    first_lock := true
+    for {
+        err := aof_file.ReadLock(lock)
+        if err == io.EOF {
+            err := aof_file.Close()
+            if err != nil {
+                return err
+            }
+            return nil
+        }
+
+        if err == AOF_FILE_CORRUPTED_ERROR {
+            return self.TruncateAofFile(aof_file)
+        }
+
+        if err != nil {
+            return err
+        }
+
+        err = lock.Decode()
+        if err != nil {
+            return err
+        }
+
+        if lock.ExpriedFlag & 0x4000 == 0 {
+            if int64(lock.CommandTime + uint64(lock.GetExpriedTime())) <= now {
+                continue
+            }
+        }
+
+        is_stop, iter_err := iter_func(filename, aof_file, lock, first_lock)
+        if iter_err != nil {
             return iter_err
         }
 
@@ -676,6 +1327,185 @@ func (self *Aof) LoadAofFile(filename string, lock *AofLock, now int64, iter_fun
     }
 }
 
+func (self *Aof) RestoreAofFiles(target_dir string, restore_time int64, aof_index uint32, aof_id uint32) (uint32, error) {
+    target_dir, err := filepath.Abs(target_dir)
+    if err != nil {
+        return 0, err
+    }
+
+    if target_dir == self.data_dir {
+        return 0, errors.New("Target Dir Is Data Dir")
+    }
+
+    err = os.MkdirAll(target_dir, 0755)
+    if err != nil {
+        return 0, err
+    }
+
+    target_aof_files, err := filepath.Glob(filepath.Join(target_dir, "*.aof*"))
+    if err != nil {
+        return 0, err
+    }
+
+    if len(target_aof_files) > 0 {
+        return 0, errors.New("Target Dir Has Aof Files")
+    }
+
+    append_files, rewrite_file, err := self.FindAofFiles()
+    if err != nil {
+        return 0, err
+    }
+
+    append_file_indexes := make(map[string]uint32, len(append_files))
+    for _, append_file := range append_files {
+        append_file_index, err := strconv.Atoi(append_file[11:])
+        if err != nil {
+            return 0, err
+        }
+        append_file_indexes[append_file] = uint32(append_file_index)
+    }
+    sort.Slice(append_files, func(i, j int) bool {
+        return append_file_indexes[append_files[i]] < append_file_indexes[append_files[j]]
+    })
+
+    if aof_index > 0 || aof_id > 0 {
+        if len(append_files) == 0 || aof_index < append_file_indexes[append_files[0]] {
+            return 0, errors.New("Aof Position Compacted")
+        }
+    }
+
+    aof_filenames := make([]string, 0)
+    if _, err := os.Stat(filepath.Join(self.data_dir, "snapshot.aof")); err == nil {
+        aof_filenames = append(aof_filenames, "snapshot.aof")
+    }
+    if rewrite_file != "" {
+        aof_filenames = append(aof_filenames, rewrite_file)
+    }
+    aof_filenames = append(aof_filenames, append_files...)
+
+    rewrite_aof_file := NewAofFile(self, filepath.Join(target_dir, "rewrite.aof.tmp"), os.O_WRONLY, int(Config.AofFileBufferSize))
+    err = rewrite_aof_file.Open()
+    if err != nil {
+        return 0, err
+    }
+
+    lock := NewAofLock()
+    now := time.Now().Unix()
+    rewrite_aof_id := uint32(0)
+    for _, aof_filename := range aof_filenames {
+        append_file_index, is_append_file := append_file_indexes[aof_filename]
+        if is_append_file && (aof_index > 0 || aof_id > 0) && append_file_index > aof_index {
+            break
+        }
+
+        _, rerr := self.RestoreAofFile(aof_filename, lock, func(lock *AofLock) (bool, error) {
+            if is_append_file && append_file_index == aof_index && aof_id > 0 && lock.AofId > aof_id {
+                return false, nil
+            }
+
+            if restore_time > 0 && int64(lock.CommandTime) > restore_time {
+                return true, nil
+            }
+
+            if lock.ExpriedFlag & 0x4000 == 0 {
+                if int64(lock.CommandTime + uint64(lock.GetExpriedTime())) <= now {
+                    return true, nil
+                }
+            }
+
+            rewrite_aof_id++
+            lock.UpdateAofIndexId(0, rewrite_aof_id)
+            return true, rewrite_aof_file.WriteLock(lock)
+        })
+        if rerr != nil {
+            rewrite_aof_file.Close()
+            os.Remove(filepath.Join(target_dir, "rewrite.aof.tmp"))
+            return 0, rerr
+        }
+    }
+
+    err = rewrite_aof_file.Flush()
+    if err != nil {
+        rewrite_aof_file.Close()
+        return 0, err
+    }
+
+    err = rewrite_aof_file.Close()
+    if err != nil {
+        return 0, err
+    }
+
+    err = os.Rename(filepath.Join(target_dir, "rewrite.aof.tmp"), filepath.Join(target_dir, "rewrite.aof"))
+    if err != nil {
+        return 0, err
+    }
+    self.slock.Log().Infof("Aof Restore %d Locks To %s", rewrite_aof_id, target_dir)
+    return rewrite_aof_id, nil
+}
+
+func (self *Aof) RestoreAofFile(filename string, lock *AofLock, iter_func func(*AofLock) (bool, error)) (bool, error) {
+    aof_file := NewAofFile(self, filepath.Join(self.data_dir, filename), os.O_RDONLY, int(Config.AofFileBufferSize))
+    err := aof_file.Open()
+    if err != nil {
+        if err == AOF_FILE_CORRUPTED_ERROR {
+            self.slock.Log().Warningf("Aof Restore File Header Corrupted Skip %s", filename)
+            return false, nil
+        }
+        return false, err
+    }
+    defer aof_file.Close()
+
+    for {
+        err := aof_file.ReadLock(lock)
+        if err == io.EOF {
+            return false, nil
+        }
+
+        if err == AOF_FILE_CORRUPTED_ERROR {
+            self.slock.Log().Warningf("Aof Restore File Corrupted %s At %d", filename, aof_file.GetSize())
+            return false, nil
+        }
+
+        if err != nil {
+            return false, err
+        }
+
+        err = lock.Decode()
+        if err != nil {
+            return false, err
+        }
+
+        is_continue, iter_err := iter_func(lock)
+        if iter_err != nil {
+            return false, iter_err
+        }
+
+        if !is_continue {
+            return true, nil
+        }
+    }
+}
+
+func (self *Aof) TruncateAofFile(aof_file *AofFile) error {
+    err := aof_file.Close()
+    if err != nil {
+        return err
+    }
+
+    info, err := os.Stat(aof_file.filename)
+    if err != nil {
+        return err
+    }
+
+    err = os.Truncate(aof_file.filename, int64(aof_file.GetSize()))
+    if err != nil {
+        self.slock.Log().Errorf("Aof File Truncate Error %s %v", aof_file.filename, err)
+        return err
+    }
+    self.slock.Log().Warningf("Aof File Corrupted Truncate %s At %d Drop %d Bytes", aof_file.filename, aof_file.GetSize(), info.Size() - int64(aof_file.GetSize()))
+    return nil
+}
+
 func (self *Aof) Close()  {
     self.glock.Lock()
     if self.is_stop {
@@ -694,8 +1524,16 @@ func (self *Aof) Close()  {
     self.glock.Unlock()
 
     self.aof_file_glock.Lock()
-    self.aof_file.Close()
-    self.aof_file = nil
+    for _, replication_server := range self.replications {
+        replication_server.Close()
+    }
+    self.replications = self.replications[:0]
+    if self.persistence != nil {
+        err := self.persistence.Close()
+        if err != nil {
+            self.slock.Log().Errorf("Aof Persistence Close Error %v", err)
+        }
+    }
     self.aof_file_glock.Unlock()
 }
 
@@ -703,7 +1541,7 @@ func (self *Aof) NewAofChannel(lock_db *LockDB) *AofChannel {
     self.glock.Lock()
     aof_channel := &AofChannel{self.slock, &sync.Mutex{}, self, lock_db, make(chan *AofLock, Config.AofQueueSize),
         NewMemWaiterServerProtocol(self.slock), make([]*AofLock, Config.AofQueueSize), 0, int32(Config.AofQueueSize),
-        make([]byte, 64), false, false}
+        make([]byte, 64), make([]chan bool, 0), false, false}
     self.channel_count++
     go aof_channel.Handle()
     self.glock.Unlock()
@@ -736,7 +1574,13 @@ func (self *Aof) ChannelUnActive(channel *AofChannel) {
     }
 
     self.aof_file_glock.Lock()
-    self.Flush()
+    if self.persistence != nil {
+        if self.fsync_policy == AOF_FSYNC_ALWAYS {
+            self.Flush()
+        } else {
+            self.FlushBuffer()
+        }
+    }
     if self.unactived_channel_waiter != nil {
         self.unactived_channel_waiter <- true
         self.unactived_channel_waiter = nil
@@ -770,13 +1614,13 @@ func (self *Aof) PushLock(lock *AofLock) {
     self.aof_file_glock.Lock()
     self.aof_id++
     lock.UpdateAofIndexId(self.aof_file_index, self.aof_id)
-    err := self.aof_file.WriteLock(lock)
+    err := self.persistence.WriteLock(lock)
     if err != nil {
         for ; !self.is_stop; {
             self.slock.Log().Errorf("Aof File Write Error %v", err)
             time.Sleep(1e10)
 
-            err := self.aof_file.WriteLock(lock)
+            err := self.persistence.WriteLock(lock)
             if err == nil {
                 break
             }
@@ -784,7 +1628,11 @@ func (self *Aof) PushLock(lock *AofLock) {
     }
     self.aof_lock_count++
 
-    if uint32(self.aof_file.GetSize()) >= self.rewrite_size {
+    for _, replication_server := range self.replications {
+        replication_server.PushLock(lock)
+    }
+
+    if self.CheckRewrite() {
         self.RewriteAofFile()
     }
     self.aof_file_glock.Unlock()
@@ -792,31 +1640,42 @@ func (self *Aof) PushLock(lock *AofLock) {
 
 func (self *Aof) AppendLock(lock *AofLock) {
     self.aof_file_glock.Lock()
-    if lock.AofIndex != self.aof_file_index || self.aof_file == nil {
-        self.aof_file_index = lock.AofIndex
-        self.aof_id = lock.AofId
-        self.RewriteAofFile()
+    if lock.AofIndex != self.aof_file_index {
+        self.AppendAofFile(lock.AofIndex)
     }
 
-    err := self.aof_file.WriteLock(lock)
+    err := self.persistence.WriteLock(lock)
     if err != nil {
         for ; !self.is_stop; {
             self.slock.Log().Errorf("Aof File Write Error %v", err)
             time.Sleep(1e10)
 
-            err := self.aof_file.WriteLock(lock)
+            err := self.persistence.WriteLock(lock)
             if err == nil {
                 break
             }
         }
     }
+    self.aof_id = lock.AofId
     self.aof_lock_count++
+
+    for _, replication_server := range self.replications {
+        replication_server.PushLock(lock)
+    }
     self.aof_file_glock.Unlock()
 }
 
-func (self *Aof) Flush() {
+func (self *Aof) Flush() error {
+    err := self.persistence.Flush()
+    if err != nil {
+        self.slock.Log().Errorf("Aof File Flush Error %v", err)
+    }
+    return err
+}
+
+func (self *Aof) FlushBuffer() {
     for ; !self.is_stop; {
-        err := self.aof_file.Flush()
+        err := self.persistence.FlushBuffer()
         if err != nil {
             self.slock.Log().Errorf("Aof File Flush Error %v", err)
             time.Sleep(1e10)
@@ -825,6 +1684,19 @@ func (self *Aof) Flush() {
     }
 }
 
+func (self *Aof) FsyncRun() {
+    if self.fsync_policy != AOF_FSYNC_EVERYSEC {
+        return
+    }
+
+    for ; !self.is_stop; {
+        time.Sleep(time.Second)
+        self.aof_file_glock.Lock()
+        self.Flush()
+        self.aof_file_glock.Unlock()
+    }
+}
+
 func (self *Aof) Reset() error {
     self.aof_file_glock.Lock()
     defer self.aof_file_glock.Unlock()
@@ -832,71 +1704,37 @@ func (self *Aof) Reset() error {
         return errors.New("Aof Rewriting")
     }
 
-    if self.aof_file != nil {
-        self.Flush()
-
-        err := self.aof_file.Close()
-        if err != nil {
-            self.slock.Log().Errorf("Aof File Close Error %s.%d %v", "append.aof", self.aof_file_index, err)
-            return err
-        }
-        self.aof_file = nil
-    }
-
-    append_files, rewrite_file, err := self.FindAofFiles()
+    err := self.persistence.Reset()
     if err != nil {
         return err
     }
 
-    prefix := "backup-" + time.Now().Format("20060102150405") + "-"
-    if rewrite_file != "" {
-        err := os.Rename(filepath.Join(self.data_dir, rewrite_file), filepath.Join(self.data_dir, prefix + rewrite_file))
-        if err != nil {
-            self.slock.Log().Errorf("Aof Reset Rename Error %v", err)
-            return err
-        }
-    }
-
-    for _, append_file := range append_files {
-        err := os.Rename(filepath.Join(self.data_dir, append_file), filepath.Join(self.data_dir, prefix + append_file))
-        if err != nil {
-            self.slock.Log().Errorf("Aof Reset Rename Error %v", err)
-            return err
-        }
-    }
-
     self.aof_file_index = 0
     self.aof_id = 0
     self.aof_lock_count = 0
+
+    err = self.persistence.Open(self.aof_file_index + 1)
+    if err != nil {
+        return err
+    }
+    self.aof_file_index++
     return nil
 }
 
 func (self *Aof) RewriteAofFile() {
-    if self.aof_file != nil {
-        self.Flush()
-
-        err := self.aof_file.Close()
-        if err != nil {
-            self.slock.Log().Errorf("Aof File Close Error %s.%d %v", "append.aof", self.aof_file_index, err)
-        }
-        self.aof_file = nil
-    }
+    self.AppendAofFile(self.aof_file_index + 1)
+}
 
+func (self *Aof) AppendAofFile(aof_file_index uint32) {
     for ; !self.is_stop; {
-        aof_filename := "rewrite.aof"
-        if self.aof_file_index > 0 {
-            aof_filename = fmt.Sprintf("%s.%d", "append.aof", self.aof_file_index + 1)
-        }
-        aof_file := NewAofFile(self, filepath.Join(self.data_dir, aof_filename), os.O_WRONLY, int(Config.AofFileBufferSize))
-        err := aof_file.Open()
+        err := self.persistence.Open(aof_file_index)
         if err != nil {
+            self.slock.Log().Errorf("Aof File Open Error %s.%d %v", "append.aof", aof_file_index, err)
             time.Sleep(1e10)
             continue
         }
-        self.aof_file = aof_file
-        self.aof_file_index++
+        self.aof_file_index = aof_file_index
         self.aof_id = 0
-        self.slock.Log().Infof("Aof File Create %s.%d", "append.aof", self.aof_file_index)
 
         go self.RewriteAofFiles()
         break
@@ -910,33 +1748,56 @@ func (self *Aof) RewriteAofFiles() {
         return
     }
     self.is_rewriting = true
+    self.rewrite_start_time = time.Now()
     self.glock.Unlock()
 
     defer func() {
         self.glock.Lock()
         self.is_rewriting = false
         if self.rewrited_waiter != nil {
-            self.rewrited_waiter <- true
+            close(self.rewrited_waiter)
+            self.rewrited_waiter = nil
         }
         self.glock.Unlock()
     }()
 
-    aof_filenames, err := self.FindRewriteAofFiles()
-    if err != nil || len(aof_filenames) == 0 {
-        return
+    rewrite_size, err := self.persistence.Rewrite()
+    self.glock.Lock()
+    if err != nil {
+        self.slock.Log().Errorf("Aof Rewrite Error %v", err)
+    } else {
+        self.rewrite_base_size = uint32(rewrite_size)
     }
+    self.rewrite_count++
+    self.rewrite_last_duration = time.Since(self.rewrite_start_time)
+    self.rewrite_last_error = err
+    self.rewrite_start_time = time.Time{}
+    self.glock.Unlock()
+}
 
-    rewrite_aof_file, aof_files, err := self.LoadRewriteAofFiles(aof_filenames)
-    if err != nil {
-        return
+func (self *Aof) LockRewriting() {
+    self.glock.Lock()
+    for self.is_rewriting {
+        if self.rewrited_waiter == nil {
+            self.rewrited_waiter = make(chan bool, 1)
+        }
+        rewrited_waiter := self.rewrited_waiter
+        self.glock.Unlock()
+        <- rewrited_waiter
+        self.glock.Lock()
     }
+    self.is_rewriting = true
+    self.glock.Unlock()
+}
 
-    self.ClearRewriteAofFiles(aof_filenames)
-    total_aof_size := len(aof_filenames) * 12 - len(aof_files) * 12
-    for _, aof_file := range aof_files {
-        total_aof_size += aof_file.GetSize()
+func (self *Aof) UnLockRewriting() {
+    self.glock.Lock()
+    self.is_rewriting = false
+    if self.rewrited_waiter != nil {
+        close(self.rewrited_waiter)
+        self.rewrited_waiter = nil
     }
-    self.slock.Log().Infof("Aof Rewrite %d to %d", total_aof_size, rewrite_aof_file.GetSize())
+    self.glock.Unlock()
 }
 
 func (self *Aof) FindRewriteAofFiles() ([]string, error) {
@@ -1052,6 +1913,142 @@ func (self *Aof) ClearAofFiles() error {
     return err
 }
 
+func (self *Aof) AddReplication(replication_server *ReplicationServer) ([]string, []uint64, error) {
+    self.aof_file_glock.Lock()
+    defer self.aof_file_glock.Unlock()
+
+    if self.is_stop {
+        return nil, nil, errors.New("Aof Closed")
+    }
+
+    file_persistence, ok := self.persistence.(*FileAofPersistence)
+    if !ok {
+        return nil, nil, errors.New("Replication Sync Only File Persistence")
+    }
+
+    self.Flush()
+    append_files, rewrite_file, err := self.FindAofFiles()
+    if err != nil {
+        return nil, nil, err
+    }
+
+    aof_filenames := make([]string, 0)
+    if rewrite_file != "" {
+        aof_filenames = append(aof_filenames, rewrite_file)
+    }
+    aof_filenames = append(aof_filenames, append_files...)
+
+    current_filename := fmt.Sprintf("%s.%d", "append.aof", self.aof_file_index)
+    lock_counts := make([]uint64, len(aof_filenames))
+    for i, aof_filename := range aof_filenames {
+        if aof_filename == current_filename {
+            if file_persistence.aof_file != nil {
+                lock_counts[i] = file_persistence.aof_file.GetLockCount()
+            }
+            continue
+        }
+
+        lock_count, err := self.GetAofFileLockCount(aof_filename)
+        if err != nil {
+            return nil, nil, err
+        }
+        lock_counts[i] = lock_count
+    }
+
+    replication_server.aof_index = self.aof_file_index
+    replication_server.aof_id = self.aof_id
+    self.replications = append(self.replications, replication_server)
+    return aof_filenames, lock_counts, nil
+}
+
+func (self *Aof) GetAofFileLockCount(aof_filename string) (uint64, error) {
+    aof_file := NewAofFile(self, filepath.Join(self.data_dir, aof_filename), os.O_RDONLY, 4096)
+    err := aof_file.Open()
+    if err != nil {
+        if err == AOF_FILE_CORRUPTED_ERROR {
+            return 0, nil
+        }
+        return 0, err
+    }
+
+    aof_lock := NewAofLock()
+    for {
+        err := aof_file.ReadLock(aof_lock)
+        if err != nil {
+            if err == io.EOF || err == AOF_FILE_CORRUPTED_ERROR {
+                break
+            }
+            aof_file.Close()
+            return 0, err
+        }
+    }
+
+    err = aof_file.Close()
+    if err != nil {
+        return 0, err
+    }
+    return aof_file.GetLockCount(), nil
+}
+
+func (self *Aof) AddSnapshotReplication(replication_server *ReplicationServer) ([][]byte, error) {
+    // no lock changes while every queued aof record is written, the dump and the aof position are then the same point
+    self.slock.glock.Lock()
+    defer self.slock.glock.Unlock()
+
+    dbs := make([]*LockDB, 0)
+    for _, db := range self.slock.dbs {
+        if db != nil && !db.is_stop {
+            dbs = append(dbs, db)
+        }
+    }
+
+    for _, db := range dbs {
+        for i := int8(0); i < db.manager_max_glocks; i++ {
+            db.manager_glocks[i].Lock()
+        }
+    }
+    defer func() {
+        for _, db := range dbs {
+            for i := int8(0); i < db.manager_max_glocks; i++ {
+                db.manager_glocks[i].Unlock()
+            }
+        }
+    }()
+
+    for _, db := range dbs {
+        for _, aof_channel := range db.aof_channels {
+            aof_channel.Drain()
+        }
+    }
+
+    self.aof_file_glock.Lock()
+    defer self.aof_file_glock.Unlock()
+
+    if self.is_stop || self.persistence == nil {
+        return nil, errors.New("Aof Closed")
+    }
+
+    replication_server.aof_index = self.aof_file_index
+    replication_server.aof_id = self.aof_id
+    lock_bufs := replication_server.DumpLocks(dbs)
+    self.replications = append(self.replications, replication_server)
+    return lock_bufs, nil
+}
+
+func (self *Aof) RemoveReplication(replication_server *ReplicationServer) {
+    self.aof_file_glock.Lock()
+    defer self.aof_file_glock.Unlock()
+
+    replications := make([]*ReplicationServer, 0)
+    for _, r := range self.replications {
+        if r != replication_server {
+            replications = append(replications, r)
+        }
+    }
+    self.replications = replications
+    replication_server.Close()
+}
+
 func (self *Aof) GetRequestId() [16]byte {
     now := uint32(time.Now().Unix())
     request_id_index := atomic.AddUint64(&request_id_index, 1)
@@ -0,0 +1,515 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "time"
+)
+
+type AofPersistence interface {
+    GetName() string
+    Init() error
+    Load() error
+    Reset() error
+    Open(aof_file_index uint32) error
+    WriteLock(lock *AofLock) error
+    FlushBuffer() error
+    Flush() error
+    Rewrite() (int, error)
+    Iterate(iter_func func(*AofLock) (bool, error)) error
+    GetSize() int
+    Close() error
+}
+
+func NewAofPersistence(aof *Aof, name string) (AofPersistence, error) {
+    switch name {
+    case "file", "":
+        return NewFileAofPersistence(aof), nil
+    case "memory":
+        return NewMemoryAofPersistence(aof), nil
+    case "none":
+        return NewNoneAofPersistence(aof), nil
+    }
+    return nil, errors.New("Unknown Aof Persistence")
+}
+
+type FileAofPersistence struct {
+    aof         *Aof
+    aof_file    *AofFile
+}
+
+func NewFileAofPersistence(aof *Aof) *FileAofPersistence {
+    return &FileAofPersistence{aof, nil}
+}
+
+func (self *FileAofPersistence) GetName() string {
+    return "file"
+}
+
+func (self *FileAofPersistence) Init() error {
+    return self.aof.SetDataDir(Config.DataDir)
+}
+
+func (self *FileAofPersistence) Load() error {
+    append_files, rewrite_file, err := self.aof.FindAofFiles()
+    if err != nil {
+        return err
+    }
+
+    if len(append_files) > 0 {
+        aof_file_index, err := strconv.Atoi(append_files[len(append_files) -1][11:])
+        if err != nil {
+            return err
+        }
+        self.aof.aof_file_index = uint32(aof_file_index)
+    }
+
+    snapshot_aof_index, err := self.aof.LoadSnapshot()
+    if err != nil {
+        return err
+    }
+
+    if snapshot_aof_index > 0 {
+        snapshot_append_files := make([]string, 0)
+        for _, append_file := range append_files {
+            aof_file_index, err := strconv.Atoi(append_file[11:])
+            if err == nil && uint32(aof_file_index) > snapshot_aof_index {
+                snapshot_append_files = append(snapshot_append_files, append_file)
+            }
+        }
+        append_files = snapshot_append_files
+
+        if self.aof.aof_file_index < snapshot_aof_index {
+            self.aof.aof_file_index = snapshot_aof_index
+        }
+    }
+
+    aof_filenames := make([]string, 0)
+    if rewrite_file != "" {
+        aof_filenames = append(aof_filenames, rewrite_file)
+    }
+    aof_filenames = append(aof_filenames, append_files...)
+    err = self.aof.LoadAofFiles(aof_filenames, func (filename string, aof_file *AofFile, lock *AofLock, first_lock bool) (bool, error) {
+        err := self.aof.LoadLock(lock)
+        if err != nil {
+            return true, err
+        }
+        return true, nil
+    })
+    if err != nil {
+        return err
+    }
+    self.aof.slock.Log().Infof("Aof File Load %v", aof_filenames)
+    return nil
+}
+
+func (self *FileAofPersistence) Reset() error {
+    if self.aof_file != nil {
+        err := self.aof_file.Flush()
+        if err != nil {
+            self.aof.slock.Log().Errorf("Aof File Flush Error %v", err)
+        }
+
+        err = self.aof_file.Close()
+        if err != nil {
+            self.aof.slock.Log().Errorf("Aof File Close Error %s.%d %v", "append.aof", self.aof.aof_file_index, err)
+            return err
+        }
+        self.aof_file = nil
+    }
+
+    append_files, rewrite_file, err := self.aof.FindAofFiles()
+    if err != nil {
+        return err
+    }
+
+    data_dir := self.aof.data_dir
+    prefix := "backup-" + time.Now().Format("20060102150405") + "-"
+    if _, err := os.Stat(filepath.Join(data_dir, "snapshot.aof")); err == nil {
+        err := os.Rename(filepath.Join(data_dir, "snapshot.aof"), filepath.Join(data_dir, prefix + "snapshot.aof"))
+        if err != nil {
+            self.aof.slock.Log().Errorf("Aof Reset Rename Error %v", err)
+            return err
+        }
+    }
+
+    if rewrite_file != "" {
+        err := os.Rename(filepath.Join(data_dir, rewrite_file), filepath.Join(data_dir, prefix + rewrite_file))
+        if err != nil {
+            self.aof.slock.Log().Errorf("Aof Reset Rename Error %v", err)
+            return err
+        }
+    }
+
+    for _, append_file := range append_files {
+        err := os.Rename(filepath.Join(data_dir, append_file), filepath.Join(data_dir, prefix + append_file))
+        if err != nil {
+            self.aof.slock.Log().Errorf("Aof Reset Rename Error %v", err)
+            return err
+        }
+    }
+    return nil
+}
+
+func (self *FileAofPersistence) Open(aof_file_index uint32) error {
+    if self.aof_file != nil {
+        err := self.aof_file.Flush()
+        if err != nil {
+            self.aof.slock.Log().Errorf("Aof File Flush Error %v", err)
+        }
+
+        err = self.aof_file.Close()
+        if err != nil {
+            self.aof.slock.Log().Errorf("Aof File Close Error %s.%d %v", "append.aof", self.aof.aof_file_index, err)
+        }
+        self.aof_file = nil
+    }
+
+    aof_file := NewAofFile(self.aof, filepath.Join(self.aof.data_dir, fmt.Sprintf("%s.%d", "append.aof", aof_file_index)), os.O_WRONLY, int(Config.AofFileBufferSize))
+    err := aof_file.Open()
+    if err != nil {
+        return err
+    }
+    self.aof_file = aof_file
+    self.aof.slock.Log().Infof("Aof File Create %s.%d", "append.aof", aof_file_index)
+    return nil
+}
+
+func (self *FileAofPersistence) WriteLock(lock *AofLock) error {
+    if self.aof_file == nil {
+        return errors.New("Aof File Closed")
+    }
+    return self.aof_file.WriteLock(lock)
+}
+
+func (self *FileAofPersistence) FlushBuffer() error {
+    if self.aof_file == nil {
+        return nil
+    }
+    return self.aof_file.FlushBuffer()
+}
+
+func (self *FileAofPersistence) Flush() error {
+    if self.aof_file == nil {
+        return nil
+    }
+    return self.aof_file.Flush()
+}
+
+func (self *FileAofPersistence) Rewrite() (int, error) {
+    aof_filenames, err := self.aof.FindRewriteAofFiles()
+    if err != nil {
+        return 0, err
+    }
+
+    if len(aof_filenames) == 0 || (len(aof_filenames) == 1 && aof_filenames[0] == "rewrite.aof") {
+        info, err := os.Stat(filepath.Join(self.aof.data_dir, "rewrite.aof"))
+        if err != nil {
+            return 0, nil
+        }
+        return int(info.Size()), nil
+    }
+
+    rewrite_aof_file, aof_files, err := self.aof.LoadRewriteAofFiles(aof_filenames)
+    if err != nil {
+        return 0, err
+    }
+
+    self.aof.ClearRewriteAofFiles(aof_filenames)
+    total_aof_size := len(aof_filenames) * 12 - len(aof_files) * 12
+    for _, aof_file := range aof_files {
+        total_aof_size += aof_file.GetSize()
+    }
+    self.aof.slock.Log().Infof("Aof Rewrite %d to %d", total_aof_size, rewrite_aof_file.GetSize())
+    return rewrite_aof_file.GetSize(), nil
+}
+
+func (self *FileAofPersistence) Iterate(iter_func func(*AofLock) (bool, error)) error {
+    append_files, rewrite_file, err := self.aof.FindAofFiles()
+    if err != nil {
+        return err
+    }
+
+    aof_filenames := make([]string, 0)
+    if rewrite_file != "" {
+        aof_filenames = append(aof_filenames, rewrite_file)
+    }
+    aof_filenames = append(aof_filenames, append_files...)
+    return self.aof.LoadAofFiles(aof_filenames, func (filename string, aof_file *AofFile, lock *AofLock, first_lock bool) (bool, error) {
+        return iter_func(lock)
+    })
+}
+
+func (self *FileAofPersistence) GetSize() int {
+    if self.aof_file == nil {
+        return 0
+    }
+    return self.aof_file.GetSize()
+}
+
+func (self *FileAofPersistence) GetFilename() string {
+    if self.aof_file == nil {
+        return ""
+    }
+    return self.aof_file.filename
+}
+
+func (self *FileAofPersistence) Close() error {
+    if self.aof_file == nil {
+        return nil
+    }
+
+    err := self.aof_file.Close()
+    self.aof_file = nil
+    return err
+}
+
+type MemoryAofPersistence struct {
+    aof         *Aof
+    glock       *sync.Mutex
+    locks       []*AofLock
+    size        int
+}
+
+func NewMemoryAofPersistence(aof *Aof) *MemoryAofPersistence {
+    return &MemoryAofPersistence{aof, &sync.Mutex{}, make([]*AofLock, 0), 0}
+}
+
+func (self *MemoryAofPersistence) GetName() string {
+    return "memory"
+}
+
+func (self *MemoryAofPersistence) Init() error {
+    return nil
+}
+
+func (self *MemoryAofPersistence) Load() error {
+    lock_count := 0
+    err := self.Iterate(func(lock *AofLock) (bool, error) {
+        if lock.AofIndex > self.aof.aof_file_index {
+            self.aof.aof_file_index = lock.AofIndex
+        }
+
+        err := self.aof.LoadLock(lock)
+        if err != nil {
+            return true, err
+        }
+        lock_count++
+        return true, nil
+    })
+    if err != nil {
+        return err
+    }
+    self.aof.slock.Log().Infof("Aof Memory Load %d Locks", lock_count)
+    return nil
+}
+
+func (self *MemoryAofPersistence) Reset() error {
+    self.glock.Lock()
+    self.locks = make([]*AofLock, 0)
+    self.size = 0
+    self.glock.Unlock()
+    return nil
+}
+
+func (self *MemoryAofPersistence) Open(aof_file_index uint32) error {
+    self.glock.Lock()
+    self.size = 0
+    self.glock.Unlock()
+    return nil
+}
+
+func (self *MemoryAofPersistence) CopyLock(lock *AofLock) (*AofLock, error) {
+    aof_lock := NewAofLock()
+    copy(aof_lock.GetBuf(), lock.GetBuf())
+    err := aof_lock.Decode()
+    if err != nil {
+        return nil, err
+    }
+    aof_lock.Token = lock.Token
+    aof_lock.LockName = lock.LockName
+    return aof_lock, nil
+}
+
+func (self *MemoryAofPersistence) WriteLock(lock *AofLock) error {
+    buf := lock.GetBuf()
+    if len(buf) < 64 {
+        return errors.New("Buffer Len error")
+    }
+    buf[0], buf[1] = 62, 0
+
+    aof_lock, err := self.CopyLock(lock)
+    if err != nil {
+        return err
+    }
+
+    self.glock.Lock()
+    self.locks = append(self.locks, aof_lock)
+    self.size += 64
+    self.glock.Unlock()
+    return nil
+}
+
+func (self *MemoryAofPersistence) FlushBuffer() error {
+    return nil
+}
+
+func (self *MemoryAofPersistence) Flush() error {
+    return nil
+}
+
+func (self *MemoryAofPersistence) Rewrite() (int, error) {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+
+    now := time.Now().Unix()
+    rewrite_locks := make([]*AofLock, 0, len(self.locks))
+    append_locks := make([]*AofLock, 0)
+    locked_indexes := make(map[[33]byte][]int, len(self.locks))
+    for _, lock := range self.locks {
+        if lock.AofIndex >= self.aof.aof_file_index {
+            append_locks = append(append_locks, lock)
+            continue
+        }
+
+        lock_key := [33]byte{lock.DbId}
+        copy(lock_key[1:], lock.LockKey[:])
+        copy(lock_key[17:], lock.LockId[:])
+        if lock.CommandType == protocol.COMMAND_UNLOCK {
+            for _, index := range locked_indexes[lock_key] {
+                rewrite_locks[index] = nil
+            }
+            delete(locked_indexes, lock_key)
+            continue
+        }
+
+        if lock.ExpriedFlag & 0x4000 == 0 && int64(lock.CommandTime + uint64(lock.GetExpriedTime())) <= now {
+            continue
+        }
+        locked_indexes[lock_key] = append(locked_indexes[lock_key], len(rewrite_locks))
+        rewrite_locks = append(rewrite_locks, lock)
+    }
+
+    aof_id := uint32(0)
+    locks := make([]*AofLock, 0, len(rewrite_locks) + len(append_locks))
+    for _, lock := range rewrite_locks {
+        if lock == nil {
+            continue
+        }
+
+        aof_lock, err := self.CopyLock(lock)
+        if err != nil {
+            return 0, err
+        }
+        aof_id++
+        aof_lock.UpdateAofIndexId(0, aof_id)
+        locks = append(locks, aof_lock)
+    }
+    locks = append(locks, append_locks...)
+    self.aof.slock.Log().Infof("Aof Memory Rewrite %d to %d", len(self.locks), len(locks))
+    self.locks = locks
+    return int(aof_id) * 64, nil
+}
+
+func (self *MemoryAofPersistence) Iterate(iter_func func(*AofLock) (bool, error)) error {
+    self.glock.Lock()
+    locks := self.locks
+    self.glock.Unlock()
+
+    now := time.Now().Unix()
+    for _, lock := range locks {
+        if lock.ExpriedFlag & 0x4000 == 0 && int64(lock.CommandTime + uint64(lock.GetExpriedTime())) <= now {
+            continue
+        }
+
+        is_stop, err := iter_func(lock)
+        if err != nil {
+            return err
+        }
+
+        if !is_stop {
+            return nil
+        }
+    }
+    return nil
+}
+
+func (self *MemoryAofPersistence) GetSize() int {
+    return self.size
+}
+
+func (self *MemoryAofPersistence) GetLocks() []*AofLock {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+    return self.locks
+}
+
+func (self *MemoryAofPersistence) Close() error {
+    return nil
+}
+
+type NoneAofPersistence struct {
+    aof         *Aof
+}
+
+func NewNoneAofPersistence(aof *Aof) *NoneAofPersistence {
+    return &NoneAofPersistence{aof}
+}
+
+func (self *NoneAofPersistence) GetName() string {
+    return "none"
+}
+
+func (self *NoneAofPersistence) Init() error {
+    return nil
+}
+
+func (self *NoneAofPersistence) Load() error {
+    return nil
+}
+
+func (self *NoneAofPersistence) Reset() error {
+    return nil
+}
+
+func (self *NoneAofPersistence) Open(aof_file_index uint32) error {
+    return nil
+}
+
+func (self *NoneAofPersistence) WriteLock(lock *AofLock) error {
+    buf := lock.GetBuf()
+    if len(buf) < 64 {
+        return errors.New("Buffer Len error")
+    }
+    buf[0], buf[1] = 62, 0
+    return nil
+}
+
+func (self *NoneAofPersistence) FlushBuffer() error {
+    return nil
+}
+
+func (self *NoneAofPersistence) Flush() error {
+    return nil
+}
+
+func (self *NoneAofPersistence) Rewrite() (int, error) {
+    return 0, nil
+}
+
+func (self *NoneAofPersistence) Iterate(iter_func func(*AofLock) (bool, error)) error {
+    return nil
+}
+
+func (self *NoneAofPersistence) GetSize() int {
+    return 0
+}
+
+func (self *NoneAofPersistence) Close() error {
+    return nil
+}
@@ -1 +1,708 @@
 package server
+
+import (
+    "errors"
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
+
+func newTestAofSLock(t *testing.T, persistence string) (*SLock, string) {
+    data_dir, err := ioutil.TempDir("", "slock_aof_test")
+    if err != nil {
+        t.Fatalf("Aof Test Create Data Dir Error %v", err)
+    }
+    return openTestAofSLock(t, persistence, data_dir), data_dir
+}
+
+func openTestAofSLock(t *testing.T, persistence string, data_dir string) *SLock {
+    config := &ServerConfig{Bind: "127.0.0.1", Port: 5658, Log: "-", LogLevel: "ERROR", DataDir: data_dir,
+        DBFastKeyCount: 4096, DBConcurrentLock: 8, DBLockAofTime: 0, AofQueueSize: 4096, AofFsync: "always",
+        AofPersistence: persistence, AofFileRewriteSize: 67174400, AofFileBufferSize: 4096}
+    slock := NewSLock(config)
+    err := slock.Init()
+    if err != nil {
+        os.RemoveAll(data_dir)
+        t.Fatalf("Aof Test SLock Init Error %v", err)
+    }
+    return slock
+}
+
+func doTestAofLockCommand(slock *SLock, command_type uint8, lock_key [16]byte, lock_id [16]byte) *protocol.LockResultCommand {
+    return doTestAofRcountLockCommand(slock, command_type, lock_key, lock_id, 0)
+}
+
+func doTestAofRcountLockCommand(slock *SLock, command_type uint8, lock_key [16]byte, lock_id [16]byte, rcount uint8) *protocol.LockResultCommand {
+    server_protocol := slock.multi_lock_protocol
+    server_protocol.Lock()
+    lock_command := server_protocol.GetLockCommand()
+    server_protocol.Unlock()
+
+    lock_command.Magic = protocol.MAGIC
+    lock_command.Version = protocol.VERSION
+    lock_command.CommandType = command_type
+    lock_command.RequestId = slock.GetAof().GetRequestId()
+    lock_command.Flag = 0
+    lock_command.DbId = 0
+    lock_command.LockId = lock_id
+    lock_command.LockKey = lock_key
+    lock_command.LockName = ""
+    lock_command.TimeoutFlag = 0
+    lock_command.Timeout = 0
+    lock_command.ExpriedFlag = 0
+    lock_command.Expried = 60
+    lock_command.Count = 0
+    lock_command.Rcount = rcount
+
+    waiter := make(chan *protocol.LockResultCommand, 1)
+    server_protocol.AddWaiter(lock_command, waiter)
+    err := server_protocol.ProcessLockCommand(lock_command)
+    if err != nil {
+        server_protocol.RemoveWaiter(lock_command)
+        return nil
+    }
+
+    select {
+    case result := <- waiter:
+        return result
+    case <- time.After(5 * time.Second):
+        server_protocol.RemoveWaiter(lock_command)
+        return nil
+    }
+}
+
+func newTestAofLock(command_type uint8, aof_index uint32, aof_id uint32, lock_key byte, lock_id byte) *AofLock {
+    lock := NewAofLock()
+    lock.CommandType = command_type
+    lock.AofIndex = aof_index
+    lock.AofId = aof_id
+    lock.CommandTime = uint64(time.Now().Unix())
+    lock.LockKey[15] = lock_key
+    lock.LockId[15] = lock_id
+    lock.ExpriedTime = 60
+    lock.Token = uint64(aof_id)
+    lock.Encode()
+    return lock
+}
+
+func TestAofChannel_Memory(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    copy(lock_key[:], "aof_memory")
+    copy(lock_id[:], "aof_memory_id")
+    result := doTestAofLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("AofChannel Memory Lock Error %v", result)
+        return
+    }
+
+    persistence := slock.GetAof().GetPersistence().(*MemoryAofPersistence)
+    locks := persistence.GetLocks()
+    if len(locks) != 1 || locks[0].CommandType != protocol.COMMAND_LOCK || locks[0].LockKey != lock_key || locks[0].Token != result.Token {
+        t.Errorf("AofChannel Memory Lock Record Error %d", len(locks))
+        return
+    }
+
+    result = doTestAofLockCommand(slock, protocol.COMMAND_UNLOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("AofChannel Memory Unlock Error %v", result)
+        return
+    }
+
+    for i := 0; i < 100 && len(persistence.GetLocks()) < 2; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    locks = persistence.GetLocks()
+    if len(locks) != 2 || locks[1].CommandType != protocol.COMMAND_UNLOCK || locks[1].LockId != lock_id {
+        t.Errorf("AofChannel Memory Unlock Record Error %d", len(locks))
+    }
+}
+
+func TestAofChannel_None(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "none")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    copy(lock_key[:], "aof_none")
+    copy(lock_id[:], "aof_none_id")
+    result := doTestAofLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("AofChannel None Lock Error %v", result)
+        return
+    }
+
+    result = doTestAofLockCommand(slock, protocol.COMMAND_UNLOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("AofChannel None Unlock Error %v", result)
+        return
+    }
+
+    if slock.GetAof().GetPersistence().GetSize() != 0 {
+        t.Errorf("AofChannel None Size Error %d", slock.GetAof().GetPersistence().GetSize())
+    }
+}
+
+func TestMemoryAofPersistence_Rewrite(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof := slock.GetAof()
+    persistence := aof.GetPersistence().(*MemoryAofPersistence)
+    aof_index := aof.aof_file_index
+    old_locks := []*AofLock{
+        newTestAofLock(protocol.COMMAND_LOCK, aof_index, 1, 1, 1),
+        newTestAofLock(protocol.COMMAND_LOCK, aof_index, 2, 2, 2),
+        newTestAofLock(protocol.COMMAND_LOCK, aof_index, 3, 1, 1),
+        newTestAofLock(protocol.COMMAND_UNLOCK, aof_index, 4, 1, 1),
+    }
+    for _, lock := range old_locks {
+        persistence.WriteLock(lock)
+    }
+    records := persistence.GetLocks()
+
+    aof.aof_file_glock.Lock()
+    aof.aof_file_index++
+    persistence.WriteLock(newTestAofLock(protocol.COMMAND_LOCK, aof.aof_file_index, 1, 3, 3))
+    _, err := persistence.Rewrite()
+    aof.aof_file_glock.Unlock()
+    if err != nil {
+        t.Errorf("MemoryAofPersistence Rewrite Error %v", err)
+        return
+    }
+
+    locks := persistence.GetLocks()
+    if len(locks) != 2 {
+        t.Errorf("MemoryAofPersistence Rewrite Count Error %d", len(locks))
+        return
+    }
+
+    if locks[0].LockKey[15] != 2 || locks[0].AofIndex != 0 || locks[0].AofId != 1 || locks[0].Token != 2 {
+        t.Errorf("MemoryAofPersistence Rewrite Lock Error %x %d %d", locks[0].LockKey, locks[0].AofIndex, locks[0].AofId)
+        return
+    }
+
+    if locks[1].LockKey[15] != 3 || locks[1].AofIndex != aof.aof_file_index {
+        t.Errorf("MemoryAofPersistence Rewrite Append Lock Error %x %d", locks[1].LockKey, locks[1].AofIndex)
+        return
+    }
+
+    for i, lock := range records {
+        if lock.AofIndex != aof_index || lock.AofId != uint32(i + 1) {
+            t.Errorf("MemoryAofPersistence Rewrite Modified Record Error %d %d %d", i, lock.AofIndex, lock.AofId)
+            return
+        }
+    }
+}
+
+func writeTestAofFile(aof *Aof, filename string, version uint16, locks []*AofLock) error {
+    aof_file := NewAofFile(aof, filepath.Join(aof.data_dir, filename), os.O_WRONLY, 4096)
+    aof_file.version = version
+    err := aof_file.Open()
+    if err != nil {
+        return err
+    }
+
+    for _, lock := range locks {
+        err = aof_file.WriteLock(lock)
+        if err != nil {
+            aof_file.Close()
+            return err
+        }
+    }
+
+    err = aof_file.Flush()
+    if err != nil {
+        aof_file.Close()
+        return err
+    }
+    return aof_file.Close()
+}
+
+func loadTestAofFile(aof *Aof, filename string) ([]*AofLock, error) {
+    locks := make([]*AofLock, 0)
+    err := aof.LoadAofFile(filename, NewAofLock(), time.Now().Unix(), func(filename string, aof_file *AofFile, lock *AofLock, first_lock bool) (bool, error) {
+        load_lock := NewAofLock()
+        copy(load_lock.buf, lock.buf)
+        err := load_lock.Decode()
+        if err != nil {
+            return true, err
+        }
+        load_lock.Token, load_lock.LockName = lock.Token, lock.LockName
+        locks = append(locks, load_lock)
+        return true, nil
+    })
+    return locks, err
+}
+
+func newTestAofFileLocks(count int) []*AofLock {
+    locks := make([]*AofLock, count)
+    for i := range locks {
+        locks[i] = newTestAofLock(protocol.COMMAND_LOCK, 1, uint32(i + 1), byte(i + 1), byte(i + 1))
+        locks[i].LockName = fmt.Sprintf("aof_file_%d", i + 1)
+    }
+    return locks
+}
+
+func TestAofFile_Versions(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof := slock.GetAof()
+    aof.SetDataDir(data_dir)
+    filenames := make([]string, 0)
+    for _, version := range []uint16{0x0001, 0x0002, 0x0003, 0x0004} {
+        filename := fmt.Sprintf("versions.aof.%d", version)
+        err := writeTestAofFile(aof, filename, version, newTestAofFileLocks(3))
+        if err != nil {
+            t.Errorf("AofFile Versions Write Error %d %v", version, err)
+            return
+        }
+        filenames = append(filenames, filename)
+    }
+
+    // version 0x0001 files were written with the short "SLOCKAO" magic
+    file, err := os.OpenFile(filepath.Join(aof.data_dir, filenames[0]), os.O_WRONLY, 0644)
+    if err != nil {
+        t.Errorf("AofFile Versions Open Error %v", err)
+        return
+    }
+    file.WriteAt([]byte{0}, 7)
+    file.Close()
+
+    lock_count := 0
+    err = aof.LoadAofFiles(filenames, func(filename string, aof_file *AofFile, lock *AofLock, first_lock bool) (bool, error) {
+        version, index := aof_file.GetVersion(), lock_count % 3 + 1
+        if int(version) != lock_count / 3 + 1 || lock.LockKey[15] != byte(index) || lock.AofId != uint32(index) {
+            return false, errors.New(fmt.Sprintf("lock error %s %d %d", filename, version, lock.AofId))
+        }
+
+        if (version < 0x0003 && lock.Token != 0) || (version >= 0x0003 && lock.Token != uint64(index)) {
+            return false, errors.New(fmt.Sprintf("token error %s %d %d", filename, version, lock.Token))
+        }
+
+        if (version < 0x0004 && lock.LockName != "") || (version >= 0x0004 && lock.LockName != fmt.Sprintf("aof_file_%d", index)) {
+            return false, errors.New(fmt.Sprintf("lock name error %s %d %s", filename, version, lock.LockName))
+        }
+        lock_count++
+        return true, nil
+    })
+    if err != nil || lock_count != 12 {
+        t.Errorf("AofFile Versions Load Error %d %v", lock_count, err)
+    }
+}
+
+func TestAofFile_TornRecord(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof := slock.GetAof()
+    aof.SetDataDir(data_dir)
+    err := writeTestAofFile(aof, "torn.aof", AOF_FILE_VERSION, newTestAofFileLocks(3))
+    if err != nil {
+        t.Errorf("AofFile TornRecord Write Error %v", err)
+        return
+    }
+
+    filename := filepath.Join(aof.data_dir, "torn.aof")
+    info, _ := os.Stat(filename)
+    os.Truncate(filename, info.Size() - 10)
+    locks, err := loadTestAofFile(aof, "torn.aof")
+    if err != nil || len(locks) != 2 || locks[1].LockKey[15] != 2 {
+        t.Errorf("AofFile TornRecord Load Error %d %v", len(locks), err)
+        return
+    }
+
+    // the torn record is dropped and the next load reads the complete records only
+    info, _ = os.Stat(filename)
+    record_size := int64(78 + len("aof_file_1"))
+    if info.Size() != 12 + record_size * 2 {
+        t.Errorf("AofFile TornRecord Truncate Size Error %d", info.Size())
+        return
+    }
+
+    locks, err = loadTestAofFile(aof, "torn.aof")
+    if err != nil || len(locks) != 2 {
+        t.Errorf("AofFile TornRecord Reload Error %d %v", len(locks), err)
+    }
+}
+
+func TestAofFile_ChecksumMismatch(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof := slock.GetAof()
+    aof.SetDataDir(data_dir)
+    for _, version := range []uint16{0x0002, 0x0003, 0x0004} {
+        filename := fmt.Sprintf("checksum.aof.%d", version)
+        err := writeTestAofFile(aof, filename, version, newTestAofFileLocks(3))
+        if err != nil {
+            t.Errorf("AofFile ChecksumMismatch Write Error %d %v", version, err)
+            return
+        }
+
+        record_size := int64(map[uint16]int{0x0002: 68, 0x0003: 76, 0x0004: 78 + len("aof_file_1")}[version])
+        file, err := os.OpenFile(filepath.Join(aof.data_dir, filename), os.O_RDWR, 0644)
+        if err != nil {
+            t.Errorf("AofFile ChecksumMismatch Open Error %d %v", version, err)
+            return
+        }
+        buf := make([]byte, 1)
+        file.ReadAt(buf, 12 + record_size + 40)
+        buf[0] ^= 0xff
+        file.WriteAt(buf, 12 + record_size + 40)
+        file.Close()
+
+        locks, err := loadTestAofFile(aof, filename)
+        if err != nil || len(locks) != 1 || locks[0].LockKey[15] != 1 {
+            t.Errorf("AofFile ChecksumMismatch Load Error %d %d %v", version, len(locks), err)
+            return
+        }
+
+        info, _ := os.Stat(filepath.Join(aof.data_dir, filename))
+        if info.Size() != 12 + record_size {
+            t.Errorf("AofFile ChecksumMismatch Truncate Size Error %d %d", version, info.Size())
+            return
+        }
+    }
+}
+
+func TestAofFile_CorruptHeader(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof := slock.GetAof()
+    aof.SetDataDir(data_dir)
+    ioutil.WriteFile(filepath.Join(aof.data_dir, "header.aof.torn"), []byte("SLOCK"), 0644)
+    locks, err := loadTestAofFile(aof, "header.aof.torn")
+    if err != nil || len(locks) != 0 {
+        t.Errorf("AofFile CorruptHeader Torn Error %d %v", len(locks), err)
+        return
+    }
+
+    for _, header := range [][]byte{[]byte("SLOCKXOF\x04\x00\x00\x00"), []byte("SLOCKAO\x00\x04\x00\x00\x00"),
+        []byte("SLOCKAOF\x09\x00\x00\x00"), []byte("SLOCKAOF\x04\x00\x01\x00")} {
+        ioutil.WriteFile(filepath.Join(aof.data_dir, "header.aof"), header, 0644)
+        aof_file := NewAofFile(aof, filepath.Join(aof.data_dir, "header.aof"), os.O_RDONLY, 4096)
+        err = aof_file.Open()
+        if err == nil || err == AOF_FILE_CORRUPTED_ERROR {
+            t.Errorf("AofFile CorruptHeader Open Error %q %v", header, err)
+            return
+        }
+    }
+
+    ioutil.WriteFile(filepath.Join(aof.data_dir, "header.aof"), []byte("SLOCKAOF\x04\x00\x00\x00"), 0644)
+    aof_file := NewAofFile(aof, filepath.Join(aof.data_dir, "header.aof"), os.O_RDONLY, 4096)
+    err = aof_file.Open()
+    if err != nil {
+        t.Errorf("AofFile CorruptHeader Empty File Error %v", err)
+        return
+    }
+    err = aof_file.ReadLock(NewAofLock())
+    aof_file.Close()
+    if err != io.EOF {
+        t.Errorf("AofFile CorruptHeader Empty File Read Error %v", err)
+    }
+}
+
+type testFsyncAofPersistence struct {
+    AofPersistence
+    glock           *sync.Mutex
+    flush_waiter    chan bool
+    flush_err       error
+    write_count     int
+    flushed_count   int
+}
+
+func (self *testFsyncAofPersistence) WriteLock(lock *AofLock) error {
+    self.glock.Lock()
+    self.write_count++
+    self.glock.Unlock()
+    return self.AofPersistence.WriteLock(lock)
+}
+
+func (self *testFsyncAofPersistence) Flush() error {
+    if self.flush_waiter != nil {
+        <- self.flush_waiter
+    }
+
+    self.glock.Lock()
+    self.flushed_count = self.write_count
+    self.glock.Unlock()
+    if self.flush_err != nil {
+        return self.flush_err
+    }
+    return self.AofPersistence.Flush()
+}
+
+func (self *testFsyncAofPersistence) GetFlushedCount() int {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+    return self.flushed_count
+}
+
+func newTestFsyncAofPersistence(aof *Aof, flush_waiter chan bool, flush_err error) *testFsyncAofPersistence {
+    aof.aof_file_glock.Lock()
+    persistence := &testFsyncAofPersistence{aof.persistence, &sync.Mutex{}, flush_waiter, flush_err, 0, 0}
+    aof.persistence = persistence
+    aof.aof_file_glock.Unlock()
+    return persistence
+}
+
+func TestAofChannel_FsyncAlways(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    flush_waiter := make(chan bool, 16)
+    persistence := newTestFsyncAofPersistence(slock.GetAof(), flush_waiter, nil)
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    copy(lock_key[:], "aof_fsync")
+    copy(lock_id[:], "aof_fsync_id")
+    results := make(chan *protocol.LockResultCommand, 1)
+    go func() {
+        results <- doTestAofLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+    }()
+
+    select {
+    case result := <- results:
+        t.Errorf("AofChannel FsyncAlways Answer Before Fsync Error %v", result)
+        return
+    case <- time.After(200 * time.Millisecond):
+    }
+
+    for i := 0; i < cap(flush_waiter); i++ {
+        flush_waiter <- true
+    }
+    result := <- results
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("AofChannel FsyncAlways Lock Error %v", result)
+        return
+    }
+
+    if persistence.GetFlushedCount() < 1 {
+        t.Errorf("AofChannel FsyncAlways Record Not Durable Error %d", persistence.GetFlushedCount())
+    }
+}
+
+func TestAofChannel_FsyncError(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    newTestFsyncAofPersistence(slock.GetAof(), nil, errors.New("fsync error"))
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    copy(lock_key[:], "aof_fsync_err")
+    copy(lock_id[:], "aof_fsync_id")
+    result := doTestAofLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_ERROR {
+        t.Errorf("AofChannel FsyncError Lock Result Error %v", result)
+        return
+    }
+
+    if getTestLockedCount(slock, lock_key) != 0 {
+        t.Errorf("AofChannel FsyncError Lock Released Error %d", getTestLockedCount(slock, lock_key))
+    }
+}
+
+func readTestAofFileKeys(aof *Aof, filename string) ([]byte, error) {
+    aof_file := NewAofFile(aof, filename, os.O_RDONLY, 4096)
+    err := aof_file.Open()
+    if err != nil {
+        return nil, err
+    }
+    defer aof_file.Close()
+
+    lock, lock_keys := NewAofLock(), make([]byte, 0)
+    for {
+        err := aof_file.ReadLock(lock)
+        if err == io.EOF {
+            return lock_keys, nil
+        }
+        if err != nil {
+            return lock_keys, err
+        }
+
+        err = lock.Decode()
+        if err != nil {
+            return lock_keys, err
+        }
+        lock_keys = append(lock_keys, lock.LockKey[15])
+    }
+}
+
+func TestAof_RestoreAofFiles(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof := slock.GetAof()
+    aof.SetDataDir(data_dir)
+    now := time.Now().Unix()
+    append_locks := [][]*AofLock{
+        {newTestAofLock(protocol.COMMAND_LOCK, 1, 1, 1, 1), newTestAofLock(protocol.COMMAND_LOCK, 1, 2, 2, 2), newTestAofLock(protocol.COMMAND_LOCK, 1, 3, 3, 3)},
+        {newTestAofLock(protocol.COMMAND_LOCK, 2, 1, 4, 4), newTestAofLock(protocol.COMMAND_LOCK, 2, 2, 5, 5)},
+    }
+    command_times := []int64{now - 30, now - 20, now - 10, now - 5, now}
+    for i, locks := range append_locks {
+        for _, lock := range locks {
+            lock.CommandTime = uint64(command_times[int(lock.LockKey[15]) - 1])
+            lock.Encode()
+        }
+
+        err := writeTestAofFile(aof, fmt.Sprintf("append.aof.%d", i + 1), AOF_FILE_VERSION, locks)
+        if err != nil {
+            t.Errorf("Aof RestoreAofFiles Write Error %v", err)
+            return
+        }
+    }
+
+    restore_dir, err := ioutil.TempDir("", "slock_aof_restore_test")
+    if err != nil {
+        t.Errorf("Aof RestoreAofFiles Create Dir Error %v", err)
+        return
+    }
+    defer os.RemoveAll(restore_dir)
+
+    for i, restore := range []struct {
+        restore_time    int64
+        aof_index       uint32
+        aof_id          uint32
+        lock_keys       []byte
+    }{{0, 0, 0, []byte{1, 2, 3, 4, 5}}, {now - 15, 0, 0, []byte{1, 2}}, {0, 1, 2, []byte{1, 2}}, {0, 2, 1, []byte{1, 2, 3, 4}},
+        {now - 25, 2, 1, []byte{1}}} {
+        target_dir := filepath.Join(restore_dir, fmt.Sprintf("%d", i))
+        lock_count, err := aof.RestoreAofFiles(target_dir, restore.restore_time, restore.aof_index, restore.aof_id)
+        if err != nil || int(lock_count) != len(restore.lock_keys) {
+            t.Errorf("Aof RestoreAofFiles Restore Error %d %d %v", i, lock_count, err)
+            return
+        }
+
+        lock_keys, err := readTestAofFileKeys(aof, filepath.Join(target_dir, "rewrite.aof"))
+        if err != nil || string(lock_keys) != string(restore.lock_keys) {
+            t.Errorf("Aof RestoreAofFiles Restore Locks Error %d %v %v", i, lock_keys, err)
+            return
+        }
+    }
+
+    _, err = aof.RestoreAofFiles(filepath.Join(restore_dir, "0"), 0, 0, 0)
+    if err == nil {
+        t.Errorf("Aof RestoreAofFiles Target Has Aof Files Error")
+        return
+    }
+
+    _, err = aof.RestoreAofFiles(aof.data_dir, 0, 0, 0)
+    if err == nil {
+        t.Errorf("Aof RestoreAofFiles Target Is Data Dir Error")
+        return
+    }
+
+    os.Remove(filepath.Join(aof.data_dir, "append.aof.1"))
+    _, err = aof.RestoreAofFiles(filepath.Join(restore_dir, "compacted"), 0, 1, 3)
+    if err == nil {
+        t.Errorf("Aof RestoreAofFiles Compacted Position Error")
+    }
+}
+
+type testSizeAofPersistence struct {
+    AofPersistence
+    size    int
+}
+
+func (self *testSizeAofPersistence) GetSize() int {
+    return self.size
+}
+
+func TestAof_CheckRewrite(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof := slock.GetAof()
+    aof.aof_file_glock.Lock()
+    persistence := &testSizeAofPersistence{aof.persistence, 0}
+    aof.persistence = persistence
+    defer func() {
+        aof.aof_file_glock.Lock()
+        aof.persistence = persistence.AofPersistence
+        aof.aof_file_glock.Unlock()
+    }()
+    aof.aof_file_glock.Unlock()
+
+    now := time.Now()
+    for i, check := range []struct {
+        rewrite_size        uint32
+        rewrite_percentage  uint32
+        base_size           uint32
+        quiet_hours         string
+        size                int
+        rewrite             bool
+        scheduled           bool
+    }{{1024, 0, 0, "", 1023, false, false}, {1024, 0, 0, "", 1024, true, false},
+        {1024, 150, 2048, "", 3071, false, false}, {1024, 150, 2048, "", 3072, true, false}, {1024, 100, 0, "", 1024, true, false},
+        {1024, 0, 0, fmt.Sprintf("%d-%d", (now.Hour() + 1) % 24, (now.Hour() + 2) % 24), 4096, false, true},
+        {1024, 0, 0, fmt.Sprintf("%d-%d", now.Hour(), (now.Hour() + 1) % 24), 4096, true, false}} {
+        err := aof.SetRewritePolicy(check.rewrite_size, check.rewrite_percentage, check.quiet_hours)
+        if err != nil {
+            t.Errorf("Aof CheckRewrite SetRewritePolicy Error %d %v", i, err)
+            return
+        }
+
+        aof.aof_file_glock.Lock()
+        aof.rewrite_base_size, aof.rewrite_scheduled = check.base_size, false
+        persistence.size = check.size
+        rewrite, scheduled := aof.CheckRewrite(), aof.rewrite_scheduled
+        aof.aof_file_glock.Unlock()
+        if rewrite != check.rewrite || scheduled != check.scheduled {
+            t.Errorf("Aof CheckRewrite Error %d %v %v", i, rewrite, scheduled)
+            return
+        }
+    }
+}
+
+func TestAof_RewriteQuietHours(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    aof := slock.GetAof()
+    for _, quiet_hours := range []string{"1", "1-1", "24-2", "a-2", "1-b", "1-2-3"} {
+        if aof.SetRewritePolicy(aof.rewrite_size, aof.rewrite_percentage, quiet_hours) == nil {
+            t.Errorf("Aof RewriteQuietHours Parse Error %s", quiet_hours)
+            return
+        }
+    }
+
+    for _, check := range []struct {
+        quiet_hours string
+        hour        int
+        quiet       bool
+    }{{"", 12, true}, {"1-3", 1, true}, {"1-3", 2, true}, {"1-3", 3, false}, {"1-3", 0, false},
+        {"22-6", 23, true}, {"22-6", 0, true}, {"22-6", 5, true}, {"22-6", 6, false}, {"22-6", 12, false}} {
+        err := aof.SetRewritePolicy(aof.rewrite_size, aof.rewrite_percentage, check.quiet_hours)
+        if err != nil {
+            t.Errorf("Aof RewriteQuietHours SetRewritePolicy Error %s %v", check.quiet_hours, err)
+            return
+        }
+
+        now := time.Date(2020, 1, 1, check.hour, 30, 0, 0, time.Local)
+        if aof.IsRewriteQuietHours(now) != check.quiet {
+            t.Errorf("Aof RewriteQuietHours Error %s %d", check.quiet_hours, check.hour)
+            return
+        }
+    }
+}
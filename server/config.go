@@ -1,5 +1,7 @@
 package server
 
+import "time"
+
 const VERSION  = "1.0.1"
 
 const QUEUE_MAX_MALLOC_SIZE = 0x3fffff
@@ -24,6 +26,25 @@ const FREE_MILLISECOND_WAIT_QUEUE_INIT_SIZE  = 8096
 const FREE_COMMAND_QUEUE_INIT_SIZE  = 256
 const STREAMS_INIT_COUNT  = 65536
 
+const RAFT_HEARTBEAT_TIME = 100 * time.Millisecond
+const RAFT_ELECTION_TIMEOUT = 1000 * time.Millisecond
+const RAFT_RPC_TIMEOUT = 2000 * time.Millisecond
+const RAFT_APPEND_MAX_ENTRIES = 1024
+const RAFT_LOG_COMPACT_COUNT = 4096
+const RAFT_ENTRY_TIMEOUT uint8 = 0x81
+const RAFT_ENTRY_EXPRIED uint8 = 0x82
+const RAFT_ENTRY_WAKEUP uint8 = 0x83
+const RAFT_ENTRY_SNAPSHOT_DB uint8 = 0x84
+const RAFT_ENTRY_SNAPSHOT_WAIT uint8 = 0x85
+
+const REPLICATION_QUEUE_SIZE = 0x10000
+
+const AOF_FSYNC_ALWAYS uint8 = 0
+const AOF_FSYNC_EVERYSEC uint8 = 1
+const AOF_FSYNC_NO uint8 = 2
+const AOF_FSYNC_MAX_WAITERS = 64
+const AOF_LOCK_NAME_MAX_LEN = 0xff00
+
 type ServerConfig struct{
     Bind string                 `long:"bind" description:"bind address" default:"127.0.0.1"`
     Port uint                   `long:"port" description:"bind port" default:"5658"`
@@ -37,9 +58,17 @@ type ServerConfig struct{
     DBFastKeyCount uint         `long:"db_fast_key_count" description:"db fast key count" default:"4194304"`
     DBConcurrentLock uint       `long:"db_concurrent_lock" description:"db concurrent lock count" default:"8"`
     DBLockAofTime uint          `long:"db_lock_aof_time" description:"db lock aof time" default:"1"`
+    DBLockPriorityAgingTime uint    `long:"db_lock_priority_aging_time" description:"waiting locks gain one priority level every this seconds, 0 is disabled" default:"5"`
     AofQueueSize uint           `long:"aof_queue_size" description:"aof channel queue size" default:"4096"`
-    AofFileRewriteSize uint     `long:"aof_file_rewrite_size" description:"aof file rewrite size" default:"67174400"`
+    AofFileRewriteSize uint     `long:"aof_file_rewrite_size" description:"aof file rewrite min size" default:"67174400"`
+    AofFileRewritePercentage uint   `long:"aof_file_rewrite_percentage" description:"aof file rewrite when it grows this percentage of the last rewrite size, 0 is disabled" default:"100"`
+    AofFileRewriteQuietHours string `long:"aof_file_rewrite_quiet_hours" description:"automatic aof file rewrite only runs in these local hours, start-end like 2-6, default is any time" default:""`
     AofFileBufferSize uint      `long:"aof_file_buffer_size" description:"aof file buffer size" default:"4096"`
+    AofPersistence string       `long:"aof_persistence" description:"aof persistence backend, memory keeps aof locks only in process, none disables persistence" default:"file" choice:"file" choice:"memory" choice:"none"`
+    AofFsync string             `long:"aof_fsync" description:"aof fsync policy, always fsync before persistent lock result" default:"everysec" choice:"always" choice:"everysec" choice:"no"`
+    SlaveOf string              `long:"slaveof" description:"slave of to master sync, host:port" default:""`
+    Cluster string              `long:"cluster" description:"cluster node addresses, host:port,host:port,host:port" default:""`
+    ClusterAddress string       `long:"cluster_address" description:"this node address in cluster, default is bind:port" default:""`
 }
 
 var Config *ServerConfig = nil
@@ -2,6 +2,7 @@ package server
 
 import (
     "github.com/snower/slock/protocol"
+    "sort"
     "sync"
     "sync/atomic"
     "time"
@@ -43,6 +44,7 @@ type LockDB struct {
     millisecond_timeout_locks       [][]*LockQueue
     millisecond_expried_locks       [][]*LockQueue
     current_time                    int64
+    fencing_token                   uint64
     check_timeout_time              int64
     check_expried_time              int64
     glock                           *sync.Mutex
@@ -52,6 +54,7 @@ type LockDB struct {
     free_long_wait_queues           []*LongWaitLockFreeQueue
     free_millisecond_wait_queues    []*MillisecondWaitLockFreeQueue
     aof_channels                    []*AofChannel
+    priority_aging_time             int64
     fast_key_count                  uint32
     free_lock_manager_head          uint32
     free_lock_manager_tail          uint32
@@ -101,6 +104,7 @@ func NewLockDB(slock *SLock, db_id uint8) *LockDB {
         free_long_wait_queues: free_long_wait_queues,
         free_millisecond_wait_queues: free_millisecond_wait_queues,
         aof_channels: aof_channels,
+        priority_aging_time: int64(Config.DBLockPriorityAgingTime),
         fast_key_count: uint32(Config.DBFastKeyCount),
         free_lock_manager_head: 0,
         free_lock_manager_tail: 0,
@@ -657,7 +661,7 @@ func (self *LockDB) CheckMillisecondExpried(ms int64, glock_index int8){
             node_queues := lock_queue.IterNodeQueues(int32(i))
             for j, lock := range node_queues {
                 if !lock.expried {
-                    expried_seconds := int64(lock.command.Expried / 1000)
+                    expried_seconds := int64(lock.command.GetExpried() / 1000)
                     lock.expried_time = self.current_time + expried_seconds + 1
                     if expried_seconds > 0 {
                         self.AddExpried(lock)
@@ -898,6 +902,54 @@ func (self *LockDB) InitNewLockManager(db_id uint8) {
     }
 }
 
+func (self *LockDB) GetLockManagers() []*LockManager {
+    lock_managers := make([]*LockManager, 0)
+    for i := uint32(0); i < self.fast_key_count; i++ {
+        fast_value := &self.fast_locks[i]
+        if atomic.LoadUint32(&fast_value.count) == 0 {
+            continue
+        }
+
+        lock_manager := fast_value.manager
+        if lock_manager != nil && lock_manager.locked > 0 {
+            lock_managers = append(lock_managers, lock_manager)
+        }
+    }
+
+    self.glock.Lock()
+    for _, lock_manager := range self.locks {
+        if lock_manager.locked > 0 {
+            lock_managers = append(lock_managers, lock_manager)
+        }
+    }
+    self.glock.Unlock()
+    return lock_managers
+}
+
+func (self *LockDB) GetActiveLockManagers() []*LockManager {
+    lock_managers := make([]*LockManager, 0)
+    for i := uint32(0); i < self.fast_key_count; i++ {
+        fast_value := &self.fast_locks[i]
+        if atomic.LoadUint32(&fast_value.count) == 0 {
+            continue
+        }
+
+        lock_manager := fast_value.manager
+        if lock_manager != nil && (lock_manager.locked > 0 || lock_manager.waited) {
+            lock_managers = append(lock_managers, lock_manager)
+        }
+    }
+
+    self.glock.Lock()
+    for _, lock_manager := range self.locks {
+        if lock_manager.locked > 0 || lock_manager.waited {
+            lock_managers = append(lock_managers, lock_manager)
+        }
+    }
+    self.glock.Unlock()
+    return lock_managers
+}
+
 func (self *LockDB) GetOrNewLockManager(command *protocol.LockCommand) *LockManager{
     fash_hash := (uint32(command.LockKey[0]) << 24 | uint32(command.LockKey[1]) << 16 | uint32(command.LockKey[2]) << 8 | uint32(command.LockKey[3])) ^ (
         uint32(command.LockKey[4]) << 24 | uint32(command.LockKey[5]) << 16 | uint32(command.LockKey[6]) << 8 | uint32(command.LockKey[7])) ^ (
@@ -1020,6 +1072,9 @@ func (self *LockDB) RemoveLockManager(lock_manager *LockManager) {
         }
 
         lock_manager.freed = true
+        lock_manager.lock_name = ""
+        lock_manager.priority_waited = false
+        lock_manager.priority_wait_locks = nil
         lock_manager.fast_key_value = nil
         fast_value.manager = nil
         atomic.AddUint32(&fast_value.count, 0xffffffff)
@@ -1064,6 +1119,9 @@ func (self *LockDB) RemoveLockManager(lock_manager *LockManager) {
 
     delete(self.locks, lock_manager.lock_key)
     lock_manager.freed = true
+    lock_manager.lock_name = ""
+    lock_manager.priority_waited = false
+    lock_manager.priority_wait_locks = nil
     self.glock.Unlock()
     lock_manager.fast_key_value = nil
     atomic.AddUint32(&fast_value.count, 0xffffffff)
@@ -1165,8 +1223,23 @@ func (self *LockDB) DoTimeOut(lock *Lock){
         return
     }
 
+    if self.slock.raft != nil && !self.is_stop {
+        var entry *RaftEntry = nil
+        if self.slock.state == STATE_LEADER {
+            entry = NewRaftEntry(0, lock.command)
+            entry.CommandType = RAFT_ENTRY_TIMEOUT
+        }
+        self.AddTimeOut(lock)
+        lock_manager.glock.Unlock()
+
+        if entry != nil {
+            self.slock.raft.ProposeEntry(entry)
+        }
+        return
+    }
+
     lock.timeouted = true
-    lock_protocol, lock_command := lock.protocol, lock.command
+    lock_protocol, lock_command, lock_name := lock.protocol, lock.command, lock_manager.lock_name
     if lock_manager.GetWaitLock() == nil {
         lock_manager.waited = false
     }
@@ -1180,17 +1253,17 @@ func (self *LockDB) DoTimeOut(lock *Lock){
     lock_manager.glock.Unlock()
 
     timeout_flag := lock_command.TimeoutFlag
-    lock_protocol.ProcessLockResultCommandLocked(lock_command, protocol.RESULT_TIMEOUT, uint16(lock_manager.locked), lock.locked)
+    lock_protocol.ProcessLockResultCommandLocked(lock_command, protocol.RESULT_TIMEOUT, uint16(lock_manager.locked), lock.locked, 0)
     lock_protocol.FreeLockCommandLocked(lock_command)
     atomic.AddUint32(&self.state.WaitCount, 0xffffffff)
     atomic.AddUint32(&self.state.TimeoutedCount, 1)
 
     if timeout_flag & 0x0800 != 0 {
-        self.slock.Log().Errorf("LockTimeout DbId:%d LockKey:%x LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
-            lock_command.LockKey, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
+        self.slock.Log().Errorf("LockTimeout DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
+            lock_command.LockKey, lock_name, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
     } else {
-        self.slock.Log().Debugf("LockTimeout DbId:%d LockKey:%x LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
-            lock_command.LockKey, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
+        self.slock.Log().Debugf("LockTimeout DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
+            lock_command.LockKey, lock_name, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
     }
 }
 
@@ -1286,10 +1359,25 @@ func (self *LockDB) DoExpried(lock *Lock){
         return
     }
 
+    if self.slock.raft != nil && !self.is_stop {
+        var entry *RaftEntry = nil
+        if self.slock.state == STATE_LEADER {
+            entry = NewRaftEntry(0, lock.command)
+            entry.CommandType, entry.Token = RAFT_ENTRY_EXPRIED, lock.fencing_token
+        }
+        self.AddExpried(lock)
+        lock_manager.glock.Unlock()
+
+        if entry != nil {
+            self.slock.raft.ProposeEntry(entry)
+        }
+        return
+    }
+
     lock_locked := lock.locked
     lock.expried = true
     lock_manager.locked -= uint32(lock_locked)
-    lock_protocol, lock_command := lock.protocol, lock.command
+    lock_protocol, lock_command, lock_name := lock.protocol, lock.command, lock_manager.lock_name
     lock_manager.RemoveLock(lock)
     if lock.is_aof {
         lock_manager.PushUnLockAof(lock)
@@ -1305,17 +1393,17 @@ func (self *LockDB) DoExpried(lock *Lock){
     lock_manager.glock.Unlock()
 
     expried_flag := lock_command.ExpriedFlag
-    lock_protocol.ProcessLockResultCommandLocked(lock_command, protocol.RESULT_EXPRIED, uint16(lock_manager.locked), lock.locked)
+    lock_protocol.ProcessLockResultCommandLocked(lock_command, protocol.RESULT_EXPRIED, uint16(lock_manager.locked), lock.locked, 0)
     lock_protocol.FreeLockCommandLocked(lock_command)
     atomic.AddUint32(&self.state.LockedCount, 0xffffffff - uint32(lock_locked) + 1)
     atomic.AddUint32(&self.state.ExpriedCount, uint32(lock_locked))
 
     if expried_flag & 0x0800 != 0 {
-        self.slock.Log().Errorf("LockExpried DbId:%d LockKey:%x LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
-            lock_command.LockKey, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
+        self.slock.Log().Errorf("LockExpried DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
+            lock_command.LockKey, lock_name, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
     }else{
-        self.slock.Log().Debugf("LockExpried DbId:%d LockKey:%x LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
-            lock_command.LockKey, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
+        self.slock.Log().Debugf("LockExpried DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
+            lock_command.LockKey, lock_name, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
     }
 
     self.WakeUpWaitLocks(lock_manager, nil)
@@ -1323,7 +1411,7 @@ func (self *LockDB) DoExpried(lock *Lock){
 
 func (self *LockDB) AddMillisecondExpried(lock *Lock) {
     lock.expried = false
-    ms := time.Now().UnixNano() / 1e6 + int64(lock.command.Expried % 1000)
+    ms := time.Now().UnixNano() / 1e6 + int64(lock.command.GetExpried() % 1000)
 
     lock_queue := self.millisecond_expried_locks[lock.manager.glock_index][ms % 1000]
     if lock_queue == nil {
@@ -1345,6 +1433,158 @@ func (self *LockDB) AddMillisecondExpried(lock *Lock) {
     }
 }
 
+func (self *LockDB) DoAofFsyncError(lock_manager *LockManager, lock *Lock) {
+    lock_manager.glock.Lock()
+    if lock.manager != lock_manager || lock.expried || lock_manager.GetLockedLock(lock.command) != lock {
+        lock_manager.glock.Unlock()
+        return
+    }
+
+    lock_command := lock.command
+    lock.expried = true
+    lock_manager.locked -= uint32(lock.locked)
+    if lock.long_wait_index > 0 {
+        self.RemoveLongExpried(lock)
+        lock_manager.RemoveLock(lock)
+        if lock.is_aof {
+            lock_manager.PushUnLockAof(lock)
+        }
+
+        if lock.ref_count == 0 {
+            lock_manager.FreeLock(lock)
+            if lock_manager.ref_count == 0 {
+                self.RemoveLockManager(lock_manager)
+            }
+        }
+    } else {
+        lock_manager.RemoveLock(lock)
+        if lock.is_aof {
+            lock_manager.PushUnLockAof(lock)
+        }
+    }
+    lock_manager.glock.Unlock()
+
+    self.slock.Log().Errorf("Lock Aof Fsync Error DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x", lock_command.DbId,
+        lock_command.LockKey, lock_manager.lock_name, lock_command.LockId, lock_command.RequestId)
+    self.WakeUpWaitLocks(lock_manager, nil)
+}
+
+func (self *LockDB) DoRaftTimeOut(command *protocol.LockCommand) {
+    lock_manager := self.GetLockManager(command)
+    if lock_manager == nil {
+        return
+    }
+
+    lock_manager.glock.Lock()
+    wait_lock := lock_manager.GetWaitLockByRequestId(command.RequestId)
+    if wait_lock == nil {
+        lock_manager.glock.Unlock()
+        return
+    }
+
+    wait_lock.timeouted = true
+    if wait_lock.long_wait_index > 0 {
+        self.RemoveLongTimeOut(wait_lock)
+    }
+    if lock_manager.GetWaitLock() == nil {
+        lock_manager.waited = false
+    }
+    lock_protocol, lock_command, lock_name := wait_lock.protocol, wait_lock.command, lock_manager.lock_name
+    lock_manager.glock.Unlock()
+
+    timeout_flag := lock_command.TimeoutFlag
+    lock_protocol.ProcessLockResultCommandLocked(lock_command, protocol.RESULT_TIMEOUT, uint16(lock_manager.locked), wait_lock.locked, 0)
+    lock_protocol.FreeLockCommandLocked(lock_command)
+    atomic.AddUint32(&self.state.WaitCount, 0xffffffff)
+    atomic.AddUint32(&self.state.TimeoutedCount, 1)
+
+    if timeout_flag & 0x0800 != 0 {
+        self.slock.Log().Errorf("LockTimeout DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
+            lock_command.LockKey, lock_name, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
+    } else {
+        self.slock.Log().Debugf("LockTimeout DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
+            lock_command.LockKey, lock_name, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
+    }
+}
+
+func (self *LockDB) DoRaftExpried(command *protocol.LockCommand, fencing_token uint64) {
+    lock_manager := self.GetLockManager(command)
+    if lock_manager == nil {
+        return
+    }
+
+    lock_manager.glock.Lock()
+    if lock_manager.locked == 0 {
+        lock_manager.glock.Unlock()
+        return
+    }
+
+    lock := lock_manager.GetLockedLock(command)
+    if lock == nil || lock.fencing_token != fencing_token {
+        lock_manager.glock.Unlock()
+        return
+    }
+
+    lock_locked := lock.locked
+    lock.expried = true
+    lock_manager.locked -= uint32(lock_locked)
+    lock_protocol, lock_command, lock_name := lock.protocol, lock.command, lock_manager.lock_name
+    if lock.long_wait_index > 0 {
+        self.RemoveLongExpried(lock)
+        lock_manager.RemoveLock(lock)
+        if lock.is_aof {
+            lock_manager.PushUnLockAof(lock)
+        }
+
+        if lock.ref_count == 0 {
+            lock_manager.FreeLock(lock)
+            if lock_manager.ref_count == 0 {
+                self.RemoveLockManager(lock_manager)
+            }
+        }
+    } else {
+        lock_manager.RemoveLock(lock)
+        if lock.is_aof {
+            lock_manager.PushUnLockAof(lock)
+        }
+    }
+    lock_manager.glock.Unlock()
+
+    expried_flag := lock_command.ExpriedFlag
+    lock_protocol.ProcessLockResultCommandLocked(lock_command, protocol.RESULT_EXPRIED, uint16(lock_manager.locked), 0, 0)
+    lock_protocol.FreeLockCommandLocked(lock_command)
+    atomic.AddUint32(&self.state.LockedCount, 0xffffffff - uint32(lock_locked) + 1)
+    atomic.AddUint32(&self.state.ExpriedCount, uint32(lock_locked))
+
+    if expried_flag & 0x0800 != 0 {
+        self.slock.Log().Errorf("LockExpried DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
+            lock_command.LockKey, lock_name, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
+    }else{
+        self.slock.Log().Debugf("LockExpried DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", lock_command.DbId,
+            lock_command.LockKey, lock_name, lock_command.LockId, lock_command.RequestId, lock_protocol.RemoteAddr().String())
+    }
+
+    self.WakeUpWaitLocks(lock_manager, nil)
+}
+
+func (self *LockDB) DoRaftWakeUp(command *protocol.LockCommand) {
+    lock_manager := self.GetLockManager(command)
+    if lock_manager == nil {
+        return
+    }
+
+    lock_manager.glock.Lock()
+    wait_lock := lock_manager.GetWaitLockByRequestId(command.RequestId)
+    if wait_lock == nil || !self.DoLock(lock_manager, wait_lock) {
+        lock_manager.glock.Unlock()
+        self.WakeUpWaitLocks(lock_manager, nil)
+        return
+    }
+
+    self.WakeUpWaitLock(lock_manager, wait_lock, nil)
+    self.WakeUpWaitLocks(lock_manager, nil)
+}
+
 func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockCommand) error {
     /*
     protocol.LockCommand.Flag
@@ -1361,9 +1601,13 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
         return self.Lock(server_protocol, command)
     }
 
+    if command.LockName != "" && lock_manager.lock_name != command.LockName {
+        lock_manager.lock_name = command.LockName
+    }
+
     if self.is_stop {
         lock_manager.glock.Unlock()
-        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_LOCKED_ERROR, uint16(lock_manager.locked), 0)
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_LOCKED_ERROR, uint16(lock_manager.locked), 0, 0)
         server_protocol.FreeLockCommand(command)
         return nil
     }
@@ -1374,12 +1618,12 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
 
             current_lock := lock_manager.current_lock
             command.LockId = current_lock.command.LockId
-            command.Expried = uint16(current_lock.expried_time - current_lock.start_time)
+            command.SetExpried(uint32(current_lock.expried_time - current_lock.start_time))
             command.Timeout = current_lock.command.Timeout
             command.Count = current_lock.command.Count
             command.Rcount = current_lock.command.Rcount
 
-            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, uint16(lock_manager.locked), current_lock.locked)
+            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, uint16(lock_manager.locked), current_lock.locked, current_lock.fencing_token)
             server_protocol.FreeLockCommand(command)
             return nil
         }
@@ -1400,28 +1644,36 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
                 } else {
                     lock_manager.UpdateLockedLock(current_lock, command.TimeoutFlag, command.Timeout, command.Expried, command.ExpriedFlag, command.Count, command.Rcount)
                 }
+                aof_waiter := current_lock.aof_waiter
+                current_lock.aof_waiter = nil
                 lock_manager.glock.Unlock()
 
-                command.Expried = uint16(current_lock.expried_time - current_lock.start_time)
+                command.SetExpried(uint32(current_lock.expried_time - current_lock.start_time))
                 command.Timeout = current_lock.command.Timeout
                 command.Count = current_lock.command.Count
                 command.Rcount = current_lock.command.Rcount
+                if aof_waiter != nil && !<- aof_waiter {
+                    server_protocol.ProcessLockResultCommand(command, protocol.RESULT_ERROR, uint16(lock_manager.locked), current_lock.locked, 0)
+                    server_protocol.FreeLockCommand(command)
+                    return nil
+                }
             } else if(current_lock.locked < 0xff && current_lock.locked <= command.Rcount){
-                if(command.Expried == 0) {
+                if(command.GetExpried() == 0) {
                     lock_manager.glock.Unlock()
 
-                    command.Expried = uint16(current_lock.expried_time - current_lock.start_time)
+                    command.SetExpried(uint32(current_lock.expried_time - current_lock.start_time))
                     command.Timeout = current_lock.command.Timeout
                     command.Count = current_lock.command.Count
                     command.Rcount = current_lock.command.Rcount
 
-                    server_protocol.ProcessLockResultCommand(command, protocol.RESULT_EXPRIED, uint16(lock_manager.locked), current_lock.locked)
+                    server_protocol.ProcessLockResultCommand(command, protocol.RESULT_EXPRIED, uint16(lock_manager.locked), current_lock.locked, 0)
                     server_protocol.FreeLockCommand(command)
                     return nil
                 }
 
                 lock_manager.locked++
                 current_lock.locked++
+                current_lock.fencing_token = self.GetFencingToken()
                 if current_lock.long_wait_index > 0 {
                     self.RemoveLongExpried(current_lock)
                     lock_manager.UpdateLockedLock(current_lock, command.Timeout,command.TimeoutFlag,  command.Expried, command.ExpriedFlag, command.Count, command.Rcount)
@@ -1434,9 +1686,24 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
                 } else {
                     lock_manager.UpdateLockedLock(current_lock, command.Timeout, command.TimeoutFlag, command.Expried, command.ExpriedFlag, command.Count, command.Rcount)
                 }
+                aof_waiter, fencing_token := current_lock.aof_waiter, current_lock.fencing_token
+                current_lock.aof_waiter = nil
                 lock_manager.glock.Unlock()
 
-                server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), current_lock.locked)
+                if aof_waiter != nil && !<- aof_waiter {
+                    lock_manager.glock.Lock()
+                    if current_lock.manager == lock_manager && !current_lock.expried && current_lock.locked > 1 {
+                        lock_manager.locked--
+                        current_lock.locked--
+                    }
+                    lock_manager.glock.Unlock()
+
+                    server_protocol.ProcessLockResultCommand(command, protocol.RESULT_ERROR, uint16(lock_manager.locked), 0, 0)
+                    server_protocol.FreeLockCommand(command)
+                    return nil
+                }
+
+                server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), current_lock.locked, fencing_token)
                 server_protocol.FreeLockCommand(command)
                 atomic.AddUint64(&self.state.LockCount, 1)
                 atomic.AddUint32(&self.state.LockedCount, 1)
@@ -1445,7 +1712,7 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
                 lock_manager.glock.Unlock()
             }
 
-            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_LOCKED_ERROR, uint16(lock_manager.locked), current_lock.locked)
+            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_LOCKED_ERROR, uint16(lock_manager.locked), current_lock.locked, 0)
             server_protocol.FreeLockCommand(command)
             return nil
         }
@@ -1453,7 +1720,7 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
 
     lock := lock_manager.GetOrNewLock(server_protocol, command)
     if !lock_manager.waited && self.DoLock(lock_manager, lock) {
-        if command.Expried > 0 {
+        if command.GetExpried() > 0 {
             lock_manager.AddLock(lock)
             lock_manager.locked++
             if command.ExpriedFlag & 0x0400 == 0 {
@@ -1462,9 +1729,16 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
                 self.AddMillisecondExpried(lock)
             }
             lock.ref_count++
+            aof_waiter, fencing_token := lock.aof_waiter, lock.fencing_token
+            lock.aof_waiter = nil
             lock_manager.glock.Unlock()
 
-            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), lock.locked)
+            if aof_waiter != nil && !<- aof_waiter {
+                self.DoAofFsyncError(lock_manager, lock)
+                server_protocol.ProcessLockResultCommand(command, protocol.RESULT_ERROR, uint16(lock_manager.locked), 0, 0)
+                return nil
+            }
+            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), lock.locked, fencing_token)
             atomic.AddUint64(&self.state.LockCount, 1)
             atomic.AddUint32(&self.state.LockedCount, 1)
             return nil
@@ -1476,7 +1750,7 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
         }
         lock_manager.glock.Unlock()
 
-        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), lock.locked)
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), lock.locked, 0)
         server_protocol.FreeLockCommand(command)
         atomic.AddUint64(&self.state.LockCount, 1)
         return nil
@@ -1502,11 +1776,369 @@ func (self *LockDB) Lock(server_protocol ServerProtocol, command *protocol.LockC
     }
     lock_manager.glock.Unlock()
 
-    server_protocol.ProcessLockResultCommand(command, protocol.RESULT_TIMEOUT, uint16(lock_manager.locked), lock.locked)
+    server_protocol.ProcessLockResultCommand(command, protocol.RESULT_TIMEOUT, uint16(lock_manager.locked), lock.locked, 0)
     server_protocol.FreeLockCommand(command)
     return nil
 }
 
+func (self *LockDB) MultiLock(server_protocol *MemWaiterServerProtocol, command *protocol.MultiLockCommand) (uint8, [16]byte, []uint64) {
+    lock_keys := self.GetMultiLockKeys(command)
+    if len(lock_keys) == 0 {
+        return protocol.RESULT_ERROR, [16]byte{}, nil
+    }
+
+    timeout := time.Duration(command.Timeout) * time.Second
+    if command.TimeoutFlag & 0x0400 != 0 {
+        timeout = time.Duration(command.Timeout) * time.Millisecond
+    } else if command.TimeoutFlag & 0x8000 != 0 {
+        timeout = time.Duration(command.Timeout) * time.Minute
+    }
+    timeout_time := time.Now().Add(timeout)
+
+    for ;; {
+        waiter := make(chan *protocol.LockResultCommand, 1)
+        result, lock_key, tokens, waited := self.DoMultiLock(server_protocol, command, lock_keys, timeout_time, waiter)
+        if !waited {
+            return result, lock_key, self.GetMultiLockTokens(command, lock_keys, tokens)
+        }
+
+        // queued on the blocking key, woken up when it is free and then try the whole set again
+        wait_result := <- waiter
+        if wait_result.Result == protocol.RESULT_SUCCED {
+            continue
+        }
+
+        if wait_result.Result == protocol.RESULT_TIMEOUT && !self.is_stop && time.Now().Before(timeout_time) {
+            continue
+        }
+        return wait_result.Result, lock_key, nil
+    }
+}
+
+func (self *LockDB) GetMultiLockTokens(command *protocol.MultiLockCommand, lock_keys [][16]byte, tokens []uint64) []uint64 {
+    if tokens == nil {
+        return nil
+    }
+
+    // one token for every key of the command, repeated keys get the token of the same lock
+    key_tokens := make([]uint64, len(command.LockKeys))
+    for i, lock_key := range command.LockKeys {
+        for j, ulock_key := range lock_keys {
+            if ulock_key == lock_key {
+                key_tokens[i] = tokens[j]
+                break
+            }
+        }
+    }
+    return key_tokens
+}
+
+func (self *LockDB) DoMultiLock(server_protocol *MemWaiterServerProtocol, command *protocol.MultiLockCommand, lock_keys [][16]byte,
+    timeout_time time.Time, waiter chan *protocol.LockResultCommand) (uint8, [16]byte, []uint64, bool) {
+    timeout_flag, timeout := command.TimeoutFlag & 0x7bff | 0x0400, uint16(0)
+    wait_time := time.Until(timeout_time) / time.Millisecond
+    if wait_time > 0xffff {
+        timeout_flag, timeout = command.TimeoutFlag & 0x7bff, 0xffff
+        if wait_time / 1000 < 0xffff {
+            timeout = uint16(wait_time / 1000)
+        }
+    } else if wait_time > 0 {
+        timeout = uint16(wait_time)
+    }
+
+    lock_commands := make([]*protocol.LockCommand, len(lock_keys))
+    lock_managers := make([]*LockManager, len(lock_keys))
+    server_protocol.Lock()
+    for i, lock_key := range lock_keys {
+        lock_command := server_protocol.GetLockCommand()
+        lock_command.Magic = protocol.MAGIC
+        lock_command.Version = protocol.VERSION
+        lock_command.CommandType = protocol.COMMAND_LOCK
+        lock_command.RequestId = command.RequestId
+        lock_command.Flag = 0
+        lock_command.DbId = command.DbId
+        lock_command.LockId = command.LockId
+        lock_command.LockKey = lock_key
+        lock_command.LockName = ""
+        lock_command.TimeoutFlag = timeout_flag
+        lock_command.Timeout = timeout
+        lock_command.ExpriedFlag = command.ExpriedFlag
+        lock_command.Expried = command.Expried
+        lock_command.Count = command.Count
+        lock_command.Rcount = command.Rcount
+        lock_commands[i] = lock_command
+    }
+    server_protocol.Unlock()
+
+    for i, lock_command := range lock_commands {
+        lock_managers[i] = self.GetOrNewLockManager(lock_command)
+    }
+
+    glock_indexes := self.LockManagerGlocks(lock_managers)
+    for _, lock_manager := range lock_managers {
+        if lock_manager.freed {
+            self.UnLockManagerGlocks(glock_indexes)
+            for _, lock_command := range lock_commands {
+                server_protocol.FreeLockCommand(lock_command)
+            }
+            return self.DoMultiLock(server_protocol, command, lock_keys, timeout_time, waiter)
+        }
+    }
+
+    locks := make([]*Lock, len(lock_managers))
+    lock_index := -1
+    for i, lock_manager := range lock_managers {
+        locks[i] = lock_manager.GetOrNewLock(server_protocol, lock_commands[i])
+        if lock_index < 0 && (self.is_stop || lock_manager.waited || !self.DoLock(lock_manager, locks[i])) {
+            lock_index = i
+        }
+    }
+
+    if lock_index >= 0 || (command.Expried == 0 && command.ExpriedFlag & 0x00ff == 0) {
+        waited := lock_index >= 0 && !self.is_stop && timeout > 0
+        for i, lock_manager := range lock_managers {
+            if waited && i == lock_index {
+                server_protocol.AddWaiter(lock_commands[i], waiter)
+                locks[i].multi_waited = true
+                lock_manager.AddWaitLock(locks[i])
+                if timeout_flag & 0x0400 == 0 {
+                    self.AddTimeOut(locks[i])
+                } else {
+                    self.AddMillisecondTimeOut(locks[i])
+                }
+                locks[i].ref_count++
+                continue
+            }
+
+            lock_manager.FreeLock(locks[i])
+            if lock_manager.ref_count == 0 {
+                self.RemoveLockManager(lock_manager)
+            }
+        }
+        self.UnLockManagerGlocks(glock_indexes)
+
+        for i, lock_command := range lock_commands {
+            if !waited || i != lock_index {
+                server_protocol.FreeLockCommand(lock_command)
+            }
+        }
+
+        if lock_index < 0 {
+            atomic.AddUint64(&self.state.LockCount, uint64(len(locks)))
+            return protocol.RESULT_SUCCED, [16]byte{}, make([]uint64, len(locks)), false
+        }
+
+        if self.is_stop {
+            return protocol.RESULT_LOCKED_ERROR, lock_keys[lock_index], nil, false
+        }
+
+        if waited {
+            atomic.AddUint32(&self.state.WaitCount, 1)
+        }
+        return protocol.RESULT_TIMEOUT, lock_keys[lock_index], nil, waited
+    }
+
+    aof_waiters, tokens := make([]chan bool, 0), make([]uint64, len(locks))
+    for i, lock_manager := range lock_managers {
+        lock := locks[i]
+        lock_manager.AddLock(lock)
+        lock_manager.locked++
+        tokens[i] = lock.fencing_token
+        if command.ExpriedFlag & 0x0400 == 0 {
+            self.AddExpried(lock)
+        } else {
+            self.AddMillisecondExpried(lock)
+        }
+        lock.ref_count++
+        if lock.aof_waiter != nil {
+            aof_waiters = append(aof_waiters, lock.aof_waiter)
+            lock.aof_waiter = nil
+        }
+    }
+    self.UnLockManagerGlocks(glock_indexes)
+
+    succed := true
+    for _, aof_waiter := range aof_waiters {
+        if !<- aof_waiter {
+            succed = false
+        }
+    }
+
+    if !succed {
+        for i, lock_manager := range lock_managers {
+            self.DoAofFsyncError(lock_manager, locks[i])
+        }
+        return protocol.RESULT_ERROR, lock_keys[0], nil, false
+    }
+    atomic.AddUint64(&self.state.LockCount, uint64(len(locks)))
+    atomic.AddUint32(&self.state.LockedCount, uint32(len(locks)))
+    return protocol.RESULT_SUCCED, [16]byte{}, tokens, false
+}
+
+func (self *LockDB) MultiUnLock(server_protocol *MemWaiterServerProtocol, command *protocol.MultiLockCommand) (uint8, [16]byte) {
+    lock_keys := self.GetMultiLockKeys(command)
+    if len(lock_keys) == 0 {
+        return protocol.RESULT_ERROR, [16]byte{}
+    }
+
+    result, result_lock_key := uint8(protocol.RESULT_SUCCED), [16]byte{}
+    for _, lock_key := range lock_keys {
+        server_protocol.Lock()
+        lock_command := server_protocol.GetLockCommand()
+        server_protocol.Unlock()
+
+        lock_command.Magic = protocol.MAGIC
+        lock_command.Version = protocol.VERSION
+        lock_command.CommandType = protocol.COMMAND_UNLOCK
+        lock_command.RequestId = self.slock.GetAof().GetRequestId()
+        lock_command.Flag = 0
+        lock_command.DbId = command.DbId
+        lock_command.LockId = command.LockId
+        lock_command.LockKey = lock_key
+        lock_command.LockName = ""
+        lock_command.TimeoutFlag = 0
+        lock_command.Timeout = 0
+        lock_command.ExpriedFlag = 0
+        lock_command.Expried = 0
+        lock_command.Count = 0
+        lock_command.Rcount = command.Rcount
+
+        waiter := make(chan *protocol.LockResultCommand, 1)
+        server_protocol.AddWaiter(lock_command, waiter)
+        err := self.UnLock(server_protocol, lock_command)
+        if err != nil {
+            server_protocol.RemoveWaiter(lock_command)
+            if result == protocol.RESULT_SUCCED {
+                result, result_lock_key = protocol.RESULT_ERROR, lock_key
+            }
+            continue
+        }
+
+        lock_result_command := <- waiter
+        if lock_result_command == nil || lock_result_command.Result != protocol.RESULT_SUCCED {
+            if result == protocol.RESULT_SUCCED {
+                result, result_lock_key = protocol.RESULT_UNLOCK_ERROR, lock_key
+                if lock_result_command != nil {
+                    result = lock_result_command.Result
+                }
+            }
+        }
+    }
+    return result, result_lock_key
+}
+
+func (self *LockDB) GetMultiLockKeys(command *protocol.MultiLockCommand) [][16]byte {
+    lock_keys := make([][16]byte, 0, len(command.LockKeys))
+    for _, lock_key := range command.LockKeys {
+        has_lock_key := false
+        for _, ulock_key := range lock_keys {
+            if ulock_key == lock_key {
+                has_lock_key = true
+                break
+            }
+        }
+
+        if !has_lock_key {
+            lock_keys = append(lock_keys, lock_key)
+        }
+    }
+    return lock_keys
+}
+
+func (self *LockDB) LockManagerGlocks(lock_managers []*LockManager) []int8 {
+    glock_indexes := make([]int8, 0, len(lock_managers))
+    for _, lock_manager := range lock_managers {
+        has_glock_index := false
+        for _, glock_index := range glock_indexes {
+            if glock_index == lock_manager.glock_index {
+                has_glock_index = true
+                break
+            }
+        }
+
+        if !has_glock_index {
+            glock_indexes = append(glock_indexes, lock_manager.glock_index)
+        }
+    }
+
+    sort.Slice(glock_indexes, func(i, j int) bool { return glock_indexes[i] < glock_indexes[j] })
+    for _, glock_index := range glock_indexes {
+        self.manager_glocks[glock_index].Lock()
+    }
+    return glock_indexes
+}
+
+func (self *LockDB) UnLockManagerGlocks(glock_indexes []int8) {
+    for i := len(glock_indexes) - 1; i >= 0; i-- {
+        self.manager_glocks[glock_indexes[i]].Unlock()
+    }
+}
+
+func (self *LockDB) RestoreLock(server_protocol ServerProtocol, command *protocol.LockCommand, fencing_token uint64) error {
+    self.UpdateFencingToken(fencing_token)
+    lock_manager := self.GetOrNewLockManager(command)
+    lock_manager.glock.Lock()
+
+    if lock_manager.freed {
+        lock_manager.glock.Unlock()
+        return self.RestoreLock(server_protocol, command, fencing_token)
+    }
+
+    if command.LockName != "" && lock_manager.lock_name != command.LockName {
+        lock_manager.lock_name = command.LockName
+    }
+
+    if lock_manager.locked > 0 {
+        current_lock := lock_manager.GetLockedLock(command)
+        if current_lock != nil {
+            if current_lock.locked < 0xff {
+                lock_manager.locked++
+                current_lock.locked++
+                atomic.AddUint32(&self.state.LockedCount, 1)
+            }
+            lock_manager.glock.Unlock()
+
+            server_protocol.FreeLockCommand(command)
+            return nil
+        }
+    }
+
+    lock := lock_manager.GetOrNewLock(server_protocol, command)
+    lock.fencing_token = fencing_token
+    lock_manager.AddLock(lock)
+    lock_manager.locked++
+    self.AddExpried(lock)
+    lock.ref_count++
+    lock_manager.glock.Unlock()
+
+    atomic.AddUint64(&self.state.LockCount, 1)
+    atomic.AddUint32(&self.state.LockedCount, 1)
+    return nil
+}
+
+func (self *LockDB) RestoreWaitLock(server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    lock_manager := self.GetOrNewLockManager(command)
+    lock_manager.glock.Lock()
+
+    if lock_manager.freed {
+        lock_manager.glock.Unlock()
+        return self.RestoreWaitLock(server_protocol, command)
+    }
+
+    if command.LockName != "" && lock_manager.lock_name != command.LockName {
+        lock_manager.lock_name = command.LockName
+    }
+
+    lock := lock_manager.GetOrNewLock(server_protocol, command)
+    lock_manager.AddWaitLock(lock)
+    self.AddTimeOut(lock)
+    lock.ref_count++
+    lock_manager.glock.Unlock()
+
+    atomic.AddUint32(&self.state.WaitCount, 1)
+    return nil
+}
+
 func (self *LockDB) UnLock(server_protocol ServerProtocol, command *protocol.LockCommand) error {
     /*
     protocol.LockCommand.Flag
@@ -1517,7 +2149,7 @@ func (self *LockDB) UnLock(server_protocol ServerProtocol, command *protocol.Loc
 
     lock_manager := self.GetLockManager(command)
     if lock_manager == nil {
-        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNLOCK_ERROR, 0, 0)
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNLOCK_ERROR, 0, 0, 0)
         server_protocol.FreeLockCommand(command)
         atomic.AddUint32(&self.state.UnlockErrorCount, 1)
         return nil
@@ -1528,7 +2160,7 @@ func (self *LockDB) UnLock(server_protocol ServerProtocol, command *protocol.Loc
     if self.is_stop || lock_manager.locked == 0 {
         lock_manager.glock.Unlock()
 
-        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNLOCK_ERROR, uint16(lock_manager.locked), 0)
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNLOCK_ERROR, uint16(lock_manager.locked), 0, 0)
         server_protocol.FreeLockCommand(command)
         atomic.AddUint32(&self.state.UnlockErrorCount, 1)
         return nil
@@ -1542,21 +2174,21 @@ func (self *LockDB) UnLock(server_protocol ServerProtocol, command *protocol.Loc
             if current_lock == nil {
                 lock_manager.glock.Unlock()
 
-                server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, uint16(lock_manager.locked), 0)
+                server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, uint16(lock_manager.locked), 0, 0)
                 server_protocol.FreeLockCommand(command)
                 atomic.AddUint32(&self.state.UnlockErrorCount, 1)
                 return nil
             }
 
             command.LockId = current_lock.command.LockId
-            command.Expried = current_lock.command.Expried
+            command.SetExpried(current_lock.command.GetExpried())
             command.Timeout = current_lock.command.Timeout
             command.Count = current_lock.command.Count
             command.Rcount = current_lock.command.Rcount
         } else {
             lock_manager.glock.Unlock()
 
-            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, uint16(lock_manager.locked), 0)
+            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, uint16(lock_manager.locked), 0, 0)
             server_protocol.FreeLockCommand(command)
             atomic.AddUint32(&self.state.UnlockErrorCount, 1)
             return nil
@@ -1600,7 +2232,7 @@ func (self *LockDB) UnLock(server_protocol ServerProtocol, command *protocol.Loc
             }
             lock_manager.glock.Unlock()
 
-            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), current_lock.locked)
+            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), current_lock.locked, 0)
             server_protocol.FreeLockCommand(command)
             server_protocol.FreeLockCommand(current_lock_command)
 
@@ -1611,7 +2243,7 @@ func (self *LockDB) UnLock(server_protocol ServerProtocol, command *protocol.Loc
             current_lock.locked--
             lock_manager.glock.Unlock()
 
-            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), current_lock.locked)
+            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), current_lock.locked, 0)
             server_protocol.FreeLockCommand(command)
 
             atomic.AddUint64(&self.state.UnLockCount, 1)
@@ -1652,7 +2284,7 @@ func (self *LockDB) UnLock(server_protocol ServerProtocol, command *protocol.Loc
         }
         lock_manager.glock.Unlock()
 
-        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), current_lock.locked)
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), current_lock.locked, 0)
         server_protocol.FreeLockCommand(command)
         server_protocol.FreeLockCommand(current_lock_command)
 
@@ -1664,6 +2296,144 @@ func (self *LockDB) UnLock(server_protocol ServerProtocol, command *protocol.Loc
     return nil
 }
 
+func (self *LockDB) Renew(server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    /*
+    protocol.LockCommand.Expried
+    0 keeps the expried seconds of the locked lock, others reset it from now.
+    */
+
+    lock_manager := self.GetLockManager(command)
+    if lock_manager == nil {
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNLOCK_ERROR, 0, 0, 0)
+        server_protocol.FreeLockCommand(command)
+        return nil
+    }
+
+    lock_manager.glock.Lock()
+
+    if self.is_stop || lock_manager.locked == 0 {
+        lock_manager.glock.Unlock()
+
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNLOCK_ERROR, uint16(lock_manager.locked), 0, 0)
+        server_protocol.FreeLockCommand(command)
+        return nil
+    }
+
+    current_lock := lock_manager.GetLockedLock(command)
+    if current_lock == nil {
+        lock_manager.glock.Unlock()
+
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, uint16(lock_manager.locked), 0, 0)
+        server_protocol.FreeLockCommand(command)
+        return nil
+    }
+
+    // a millisecond lock may still be queued on its millisecond timer, which can not be moved
+    if (current_lock.command.ExpriedFlag | command.ExpriedFlag) & 0x0400 != 0 {
+        lock_manager.glock.Unlock()
+
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_NOT_SUPPORTED, uint16(lock_manager.locked), current_lock.locked, 0)
+        server_protocol.FreeLockCommand(command)
+        return nil
+    }
+
+    if current_lock.command.ExpriedFlag & 0x4000 == 0 {
+        expried, expried_flag := current_lock.command.Expried, current_lock.command.ExpriedFlag
+        if command.GetExpried() > 0 {
+            expried, expried_flag = command.Expried, expried_flag & 0xff00 | command.ExpriedFlag & 0x00ff
+        }
+
+        if current_lock.long_wait_index > 0 {
+            self.RemoveLongExpried(current_lock)
+            lock_manager.UpdateLockedLock(current_lock, current_lock.command.Timeout, current_lock.command.TimeoutFlag, expried, expried_flag,
+                current_lock.command.Count, current_lock.command.Rcount)
+            self.AddExpried(current_lock)
+            current_lock.ref_count++
+        } else {
+            lock_manager.UpdateLockedLock(current_lock, current_lock.command.Timeout, current_lock.command.TimeoutFlag, expried, expried_flag,
+                current_lock.command.Count, current_lock.command.Rcount)
+        }
+    }
+
+    command.SetExpried(current_lock.command.GetExpried())
+    command.Count = current_lock.command.Count
+    command.Rcount = current_lock.command.Rcount
+    lcount, lrcount, fencing_token := uint16(lock_manager.locked), current_lock.locked, current_lock.fencing_token
+    aof_waiter := current_lock.aof_waiter
+    current_lock.aof_waiter = nil
+    lock_manager.glock.Unlock()
+
+    if aof_waiter != nil && !<- aof_waiter {
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_ERROR, lcount, lrcount, 0)
+        server_protocol.FreeLockCommand(command)
+        return nil
+    }
+    server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, lcount, lrcount, fencing_token)
+    server_protocol.FreeLockCommand(command)
+    return nil
+}
+
+func (self *LockDB) Cancel(server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    /*
+    protocol.LockCommand.LockId
+    the request id of the waiting lock command to cancel, only the session that sent it can cancel it.
+    */
+
+    lock_manager := self.GetLockManager(command)
+    if lock_manager == nil {
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, 0, 0, 0)
+        server_protocol.FreeLockCommand(command)
+        return nil
+    }
+
+    lock_manager.glock.Lock()
+
+    wait_lock := lock_manager.GetWaitLockByRequestId(command.LockId)
+    if wait_lock == nil || wait_lock.protocol != server_protocol {
+        locked := uint16(lock_manager.locked)
+        lock_manager.glock.Unlock()
+
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, locked, 0, 0)
+        server_protocol.FreeLockCommand(command)
+        return nil
+    }
+
+    wait_lock.timeouted = true
+    if wait_lock.long_wait_index > 0 {
+        self.RemoveLongTimeOut(wait_lock)
+    }
+    if lock_manager.GetWaitLock() == nil {
+        lock_manager.waited = false
+    }
+    wait_lock_protocol, wait_lock_command, lock_name, locked := wait_lock.protocol, wait_lock.command, lock_manager.lock_name, uint16(lock_manager.locked)
+    lock_manager.glock.Unlock()
+
+    self.slock.Log().Debugf("LockCancel DbId:%d LockKey:%x LockName:%s LockId:%x RequestId:%x RemoteAddr:%s", wait_lock_command.DbId,
+        wait_lock_command.LockKey, lock_name, wait_lock_command.LockId, command.LockId, wait_lock_protocol.RemoteAddr().String())
+
+    wait_lock_protocol.ProcessLockResultCommand(wait_lock_command, protocol.RESULT_CANCELED, locked, 0, 0)
+    wait_lock_protocol.FreeLockCommand(wait_lock_command)
+    atomic.AddUint32(&self.state.WaitCount, 0xffffffff)
+
+    server_protocol.ProcessLockResultCommand(command, protocol.RESULT_SUCCED, locked, 0, 0)
+    server_protocol.FreeLockCommand(command)
+    self.WakeUpWaitLocks(lock_manager, server_protocol)
+    return nil
+}
+
+func (self *LockDB) HasWaitLock(server_protocol ServerProtocol, command *protocol.LockCommand) bool {
+    lock_manager := self.GetLockManager(command)
+    if lock_manager == nil {
+        return false
+    }
+
+    lock_manager.glock.Lock()
+    wait_lock := lock_manager.GetWaitLockByRequestId(command.LockId)
+    has_wait_lock := wait_lock != nil && wait_lock.protocol == server_protocol
+    lock_manager.glock.Unlock()
+    return has_wait_lock
+}
+
 func (self *LockDB) DoLock(lock_manager *LockManager, lock *Lock) bool{
     if lock_manager.locked == 0 {
         return true
@@ -1682,10 +2452,60 @@ func (self *LockDB) DoLock(lock_manager *LockManager, lock *Lock) bool{
     return false
 }
 
+func (self *LockDB) Query(command *protocol.LockCommand) *protocol.QueryResultCommand {
+    lock_manager := self.GetLockManager(command)
+    if lock_manager == nil {
+        return protocol.NewQueryResultCommand(command, protocol.RESULT_SUCCED, 0, [16]byte{}, 0, 0, 0, 0, 0, 0, 0)
+    }
+
+    lock_manager.glock.Lock()
+    if lock_manager.freed || lock_manager.lock_key != command.LockKey {
+        lock_manager.glock.Unlock()
+        return protocol.NewQueryResultCommand(command, protocol.RESULT_SUCCED, 0, [16]byte{}, 0, 0, 0, 0, 0, 0, 0)
+    }
+
+    wait_count := lock_manager.GetWaitLockCount()
+    if lock_manager.locked == 0 || lock_manager.current_lock == nil {
+        lock_manager.glock.Unlock()
+        return protocol.NewQueryResultCommand(command, protocol.RESULT_SUCCED, 0, [16]byte{}, 0, 0, 0, 0, 0, wait_count, 0)
+    }
+
+    flag, current_lock := uint8(0x01), lock_manager.GetLockedLock(command)
+    if current_lock == nil {
+        flag, current_lock = 0, lock_manager.current_lock
+    }
+
+    expried := uint32(0)
+    if current_lock.command.ExpriedFlag & 0x4000 != 0 {
+        expried = 0xffffffff
+    } else if current_lock.expried_time > self.current_time {
+        expried = uint32(current_lock.expried_time - self.current_time)
+    }
+
+    result_command := protocol.NewQueryResultCommand(command, protocol.RESULT_SUCCED, flag, current_lock.command.LockId, uint16(lock_manager.locked),
+        current_lock.command.Count, current_lock.locked, current_lock.command.Rcount, expried, wait_count, current_lock.fencing_token)
+    lock_manager.glock.Unlock()
+    return result_command
+}
+
 func (self *LockDB) WakeUpWaitLocks(lock_manager *LockManager, server_protocol ServerProtocol) {
     if lock_manager.waited {
         lock_manager.glock.Lock()
         wait_lock := lock_manager.GetWaitLock()
+        if wait_lock != nil && self.slock.raft != nil && !self.is_stop {
+            var entry *RaftEntry = nil
+            if self.slock.state == STATE_LEADER && self.DoLock(lock_manager, wait_lock) {
+                entry = NewRaftEntry(0, wait_lock.command)
+                entry.CommandType = RAFT_ENTRY_WAKEUP
+            }
+            lock_manager.glock.Unlock()
+
+            if entry != nil {
+                self.slock.raft.ProposeEntry(entry)
+            }
+            return
+        }
+
         for ; wait_lock != nil; {
             if !self.DoLock(lock_manager, wait_lock) {
                 lock_manager.glock.Unlock()
@@ -1714,7 +2534,7 @@ func (self *LockDB) WakeUpWaitLock(lock_manager *LockManager, wait_lock *Lock, s
         self.RemoveLongTimeOut(wait_lock)
     }
 
-    if wait_lock.command.Expried > 0 {
+    if wait_lock.command.GetExpried() > 0 && !wait_lock.multi_waited {
         lock_manager.AddLock(wait_lock)
         lock_manager.locked++
         if wait_lock.command.ExpriedFlag & 0x0400 == 0 {
@@ -1724,12 +2544,25 @@ func (self *LockDB) WakeUpWaitLock(lock_manager *LockManager, wait_lock *Lock, s
         }
         wait_lock.ref_count++
         wait_lock_protocol, wait_lock_command := wait_lock.protocol, wait_lock.command
+        aof_waiter, fencing_token := wait_lock.aof_waiter, wait_lock.fencing_token
+        wait_lock.aof_waiter = nil
         lock_manager.glock.Unlock()
 
+        if aof_waiter != nil && !<- aof_waiter {
+            self.DoAofFsyncError(lock_manager, wait_lock)
+            if wait_lock_protocol == server_protocol {
+                wait_lock_protocol.ProcessLockResultCommand(wait_lock_command, protocol.RESULT_ERROR, uint16(lock_manager.locked), 0, 0)
+            } else {
+                wait_lock_protocol.ProcessLockResultCommandLocked(wait_lock_command, protocol.RESULT_ERROR, uint16(lock_manager.locked), 0, 0)
+            }
+            atomic.AddUint32(&self.state.WaitCount, 0xffffffff)
+            return
+        }
+
         if wait_lock_protocol == server_protocol {
-            wait_lock_protocol.ProcessLockResultCommand(wait_lock_command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), wait_lock.locked)
+            wait_lock_protocol.ProcessLockResultCommand(wait_lock_command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), wait_lock.locked, fencing_token)
         } else {
-            wait_lock_protocol.ProcessLockResultCommandLocked(wait_lock_command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), wait_lock.locked)
+            wait_lock_protocol.ProcessLockResultCommandLocked(wait_lock_command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), wait_lock.locked, fencing_token)
         }
         atomic.AddUint64(&self.state.LockCount, 1)
         atomic.AddUint32(&self.state.LockedCount, 1)
@@ -1737,21 +2570,73 @@ func (self *LockDB) WakeUpWaitLock(lock_manager *LockManager, wait_lock *Lock, s
         return
     }
 
-    wait_lock_protocol, wait_lock_command := wait_lock.protocol, wait_lock.command
+    wait_lock_protocol, wait_lock_command, multi_waited := wait_lock.protocol, wait_lock.command, wait_lock.multi_waited
     lock_manager.glock.Unlock()
 
     if wait_lock_protocol == server_protocol {
-        wait_lock_protocol.ProcessLockResultCommand(wait_lock_command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), wait_lock.locked)
+        wait_lock_protocol.ProcessLockResultCommand(wait_lock_command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), wait_lock.locked, 0)
         server_protocol.FreeLockCommand(wait_lock_command)
     } else {
-        wait_lock_protocol.ProcessLockResultCommandLocked(wait_lock_command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), wait_lock.locked)
+        wait_lock_protocol.ProcessLockResultCommandLocked(wait_lock_command, protocol.RESULT_SUCCED, uint16(lock_manager.locked), wait_lock.locked, 0)
         wait_lock_protocol.FreeLockCommandLocked(wait_lock_command)
     }
 
-    atomic.AddUint64(&self.state.LockCount, 1)
+    if !multi_waited {
+        atomic.AddUint64(&self.state.LockCount, 1)
+    }
     atomic.AddUint32(&self.state.WaitCount, 0xffffffff)
 }
 
+func (self *LockDB) GetFencingToken() uint64 {
+    if self.slock.raft != nil {
+        return atomic.AddUint64(&self.fencing_token, 1)
+    }
+
+    for ;; {
+        fencing_token := atomic.LoadUint64(&self.fencing_token)
+        next_fencing_token := uint64(self.current_time) << 32
+        if next_fencing_token <= fencing_token {
+            next_fencing_token = fencing_token + 1
+        }
+
+        if atomic.CompareAndSwapUint64(&self.fencing_token, fencing_token, next_fencing_token) {
+            return next_fencing_token
+        }
+    }
+}
+
+func (self *LockDB) UpdateFencingToken(fencing_token uint64) {
+    for ;; {
+        current_fencing_token := atomic.LoadUint64(&self.fencing_token)
+        if fencing_token <= current_fencing_token {
+            return
+        }
+
+        if atomic.CompareAndSwapUint64(&self.fencing_token, current_fencing_token, fencing_token) {
+            return
+        }
+    }
+}
+
+func (self *LockDB) UpdateLockFencingToken(command *protocol.LockCommand, fencing_token uint64) {
+    lock_manager := self.GetLockManager(command)
+    if lock_manager == nil {
+        return
+    }
+
+    lock_manager.glock.Lock()
+    if lock_manager.freed || lock_manager.locked == 0 || lock_manager.lock_key != command.LockKey {
+        lock_manager.glock.Unlock()
+        return
+    }
+
+    lock := lock_manager.GetLockedLock(command)
+    if lock != nil {
+        lock.fencing_token = fencing_token
+    }
+    lock_manager.glock.Unlock()
+}
+
 func (self *LockDB) GetState() *protocol.LockDBState {
     return self.state
 }
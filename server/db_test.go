@@ -1 +1,444 @@
 package server
+
+import (
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "os"
+    "testing"
+    "time"
+)
+
+func TestLockDB_MultiLockWait(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "none")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    copy(lock_key[:], "multi_wait_b")
+    copy(lock_id[:], "multi_wait_id")
+    result := doTestAofLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("LockDB MultiLock Wait Lock Error %v", result)
+        return
+    }
+
+    multi_lock_key, multi_lock_id := [16]byte{}, [16]byte{}
+    copy(multi_lock_key[:], "multi_wait_a")
+    copy(multi_lock_id[:], "multi_wait_multi_id")
+    command := &protocol.MultiLockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION,
+        CommandType: protocol.COMMAND_MULTI_LOCK, RequestId: slock.GetAof().GetRequestId()}, DbId: 0, LockId: multi_lock_id,
+        Timeout: 5, Expried: 60, KeyCount: 2, LockKeys: [][16]byte{multi_lock_key, lock_key}}
+
+    db := slock.GetOrNewDB(0)
+    waiter := make(chan uint8, 1)
+    start_time := time.Now()
+    go func() {
+        multi_result, _, _ := slock.DoMultiLockComamnd(db, command)
+        waiter <- multi_result
+    }()
+
+    time.Sleep(100 * time.Millisecond)
+    if db.GetState().WaitCount != 1 {
+        t.Errorf("LockDB MultiLock Wait Count Error %d", db.GetState().WaitCount)
+        return
+    }
+
+    result = doTestAofLockCommand(slock, protocol.COMMAND_UNLOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("LockDB MultiLock Wait Unlock Error %v", result)
+        return
+    }
+
+    select {
+    case multi_result := <- waiter:
+        if multi_result != protocol.RESULT_SUCCED {
+            t.Errorf("LockDB MultiLock Wait Result Error %d", multi_result)
+            return
+        }
+    case <- time.After(5 * time.Second):
+        t.Errorf("LockDB MultiLock Wait Timeout")
+        return
+    }
+
+    if time.Since(start_time) > time.Second {
+        t.Errorf("LockDB MultiLock Wait Wakeup Error %v", time.Since(start_time))
+        return
+    }
+
+    if db.GetState().WaitCount != 0 || db.GetState().LockedCount != 2 {
+        t.Errorf("LockDB MultiLock Wait State Error %d %d", db.GetState().WaitCount, db.GetState().LockedCount)
+    }
+}
+
+func TestLockDB_MultiLockTokens(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "none")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_keys, lock_id := make([][16]byte, 2), [16]byte{}
+    copy(lock_keys[0][:], "multi_token_a")
+    copy(lock_keys[1][:], "multi_token_b")
+    copy(lock_id[:], "multi_token_id")
+    command := &protocol.MultiLockCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION2,
+        CommandType: protocol.COMMAND_MULTI_LOCK, RequestId: slock.GetAof().GetRequestId()}, DbId: 0, LockId: lock_id,
+        Timeout: 0, Expried: 60, KeyCount: 3, LockKeys: [][16]byte{lock_keys[0], lock_keys[1], lock_keys[0]}}
+
+    db := slock.GetOrNewDB(0)
+    result, _, tokens := slock.DoMultiLockComamnd(db, command)
+    if result != protocol.RESULT_SUCCED || len(tokens) != 3 {
+        t.Errorf("LockDB MultiLock Tokens Lock Error %d %v", result, tokens)
+        return
+    }
+
+    if tokens[0] == 0 || tokens[1] == 0 || tokens[0] == tokens[1] || tokens[2] != tokens[0] {
+        t.Errorf("LockDB MultiLock Tokens Value Error %v", tokens)
+        return
+    }
+
+    for i, lock_key := range lock_keys {
+        lock_manager := db.GetLockManager(&protocol.LockCommand{DbId: 0, LockKey: lock_key})
+        if lock_manager == nil || lock_manager.current_lock == nil || lock_manager.current_lock.fencing_token != tokens[i] {
+            t.Errorf("LockDB MultiLock Tokens Lock Token Error %d", i)
+            return
+        }
+    }
+
+    result_command := protocol.NewMultiLockResultCommand(command, result, [16]byte{}, command.KeyCount, tokens)
+    if result_command.GetEncodeLength() != 64 + 3 * 8 || len(result_command.Tokens) != 3 {
+        t.Errorf("LockDB MultiLock Tokens Result Error %d", result_command.GetEncodeLength())
+        return
+    }
+
+    command.CommandType, command.RequestId = protocol.COMMAND_MULTI_UNLOCK, slock.GetAof().GetRequestId()
+    result, _, tokens = slock.DoMultiLockComamnd(db, command)
+    if result != protocol.RESULT_SUCCED || tokens != nil {
+        t.Errorf("LockDB MultiLock Tokens Unlock Error %d %v", result, tokens)
+        return
+    }
+
+    command.CommandType, command.RequestId, command.Expried = protocol.COMMAND_MULTI_LOCK, slock.GetAof().GetRequestId(), 0
+    result, _, tokens = slock.DoMultiLockComamnd(db, command)
+    if result != protocol.RESULT_SUCCED || len(tokens) != 3 || tokens[0] != 0 || tokens[1] != 0 {
+        t.Errorf("LockDB MultiLock Tokens Zero Expried Error %d %v", result, tokens)
+    }
+}
+
+func newTestDBLockCommand(server_protocol *MemWaiterServerProtocol, command_type uint8, lock_key [16]byte, lock_id [16]byte, timeout uint16,
+    expried_flag uint16, expried uint16) *protocol.LockCommand {
+    server_protocol.Lock()
+    lock_command := server_protocol.GetLockCommand()
+    server_protocol.Unlock()
+
+    lock_command.Magic = protocol.MAGIC
+    lock_command.Version = protocol.VERSION
+    lock_command.CommandType = command_type
+    lock_command.RequestId = server_protocol.slock.GetAof().GetRequestId()
+    lock_command.Flag = 0
+    lock_command.DbId = 0
+    lock_command.LockId = lock_id
+    lock_command.LockKey = lock_key
+    lock_command.LockName = ""
+    lock_command.TimeoutFlag = 0
+    lock_command.Timeout = timeout
+    lock_command.ExpriedFlag = expried_flag
+    lock_command.Expried = expried
+    lock_command.Count = 0
+    lock_command.Rcount = 0
+    return lock_command
+}
+
+func waitTestDBLockCommand(server_protocol *MemWaiterServerProtocol, lock_command *protocol.LockCommand) *protocol.LockResultCommand {
+    waiter := make(chan *protocol.LockResultCommand, 1)
+    server_protocol.AddWaiter(lock_command, waiter)
+    err := server_protocol.ProcessLockCommand(lock_command)
+    if err != nil {
+        server_protocol.RemoveWaiter(lock_command)
+        return nil
+    }
+
+    select {
+    case result := <- waiter:
+        return result
+    case <- time.After(5 * time.Second):
+        server_protocol.RemoveWaiter(lock_command)
+        return nil
+    }
+}
+
+func doTestDBLockCommand(slock *SLock, command_type uint8, lock_key [16]byte, lock_id [16]byte, expried_flag uint16, expried uint16) *protocol.LockResultCommand {
+    server_protocol := slock.multi_lock_protocol
+    return waitTestDBLockCommand(server_protocol, newTestDBLockCommand(server_protocol, command_type, lock_key, lock_id, 0, expried_flag, expried))
+}
+
+func TestLockDB_Renew(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "none")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_key, lock_id, other_lock_id := [16]byte{}, [16]byte{}, [16]byte{}
+    copy(lock_key[:], "renew_key")
+    copy(lock_id[:], "renew_id")
+    copy(other_lock_id[:], "renew_other_id")
+    result := doTestDBLockCommand(slock, protocol.COMMAND_RENEW, lock_key, lock_id, 0, 0)
+    if result == nil || result.Result != protocol.RESULT_UNKNOWN_DB {
+        t.Errorf("LockDB Renew Unknown DB Error %v", result)
+        return
+    }
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id, 0, 2)
+    if result == nil || result.Result != protocol.RESULT_SUCCED || result.Token == 0 {
+        t.Errorf("LockDB Renew Lock Error %v", result)
+        return
+    }
+    token := result.Token
+
+    db := slock.GetOrNewDB(0)
+    lock_manager := db.GetLockManager(&protocol.LockCommand{DbId: 0, LockKey: lock_key})
+    lock_manager.glock.Lock()
+    expried_time := lock_manager.current_lock.expried_time
+    lock_manager.glock.Unlock()
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_RENEW, lock_key, lock_id, 0, 0)
+    if result == nil || result.Result != protocol.RESULT_SUCCED || result.Token != token {
+        t.Errorf("LockDB Renew Keep Expried Error %v", result)
+        return
+    }
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_RENEW, lock_key, lock_id, 0, 60)
+    if result == nil || result.Result != protocol.RESULT_SUCCED || result.Token != token {
+        t.Errorf("LockDB Renew Expried Error %v", result)
+        return
+    }
+
+    lock_manager.glock.Lock()
+    renew_expried, renew_expried_time := lock_manager.current_lock.command.Expried, lock_manager.current_lock.expried_time
+    lock_manager.glock.Unlock()
+    if renew_expried != 60 || renew_expried_time < expried_time + 58 {
+        t.Errorf("LockDB Renew Expried Time Error %d %d %d", renew_expried, expried_time, renew_expried_time)
+        return
+    }
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_RENEW, lock_key, other_lock_id, 0, 0)
+    if result == nil || result.Result != protocol.RESULT_UNOWN_ERROR {
+        t.Errorf("LockDB Renew Other Lock Error %v", result)
+        return
+    }
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_RENEW, lock_key, lock_id, 0x0400, 500)
+    if result == nil || result.Result != protocol.RESULT_NOT_SUPPORTED {
+        t.Errorf("LockDB Renew Millisecond Error %v", result)
+        return
+    }
+
+    state := db.GetState()
+    if state.LockCount != 1 || state.LockedCount != 1 {
+        t.Errorf("LockDB Renew State Error %d %d", state.LockCount, state.LockedCount)
+        return
+    }
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_UNLOCK, lock_key, lock_id, 0, 0)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("LockDB Renew Unlock Error %v", result)
+        return
+    }
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_RENEW, lock_key, lock_id, 0, 0)
+    if result == nil || result.Result != protocol.RESULT_UNLOCK_ERROR {
+        t.Errorf("LockDB Renew Unlocked Error %v", result)
+    }
+}
+
+func TestLockDB_Cancel(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "none")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_key, lock_id, wait_lock_id := [16]byte{}, [16]byte{}, [16]byte{}
+    copy(lock_key[:], "cancel_key")
+    copy(lock_id[:], "cancel_id")
+    copy(wait_lock_id[:], "cancel_wait_id")
+    result := doTestDBLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id, 0, 60)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("LockDB Cancel Lock Error %v", result)
+        return
+    }
+
+    wait_protocol, other_protocol := NewMemWaiterServerProtocol(slock), NewMemWaiterServerProtocol(slock)
+    defer wait_protocol.Close()
+    defer other_protocol.Close()
+    wait_command := newTestDBLockCommand(wait_protocol, protocol.COMMAND_LOCK, lock_key, wait_lock_id, 5, 0, 60)
+    wait_request_id := wait_command.RequestId
+    waiter := make(chan *protocol.LockResultCommand, 1)
+    go func() {
+        waiter <- waitTestDBLockCommand(wait_protocol, wait_command)
+    }()
+
+    db := slock.GetOrNewDB(0)
+    for i := 0; i < 100 && db.GetState().WaitCount != 1; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if db.GetState().WaitCount != 1 {
+        t.Errorf("LockDB Cancel Wait Error %d", db.GetState().WaitCount)
+        return
+    }
+
+    unknown_key := [16]byte{}
+    copy(unknown_key[:], "cancel_unknown")
+    for _, cancel_protocol := range []*MemWaiterServerProtocol{slock.multi_lock_protocol, other_protocol} {
+        result = waitTestDBLockCommand(cancel_protocol, newTestDBLockCommand(cancel_protocol, protocol.COMMAND_CANCEL, lock_key, wait_request_id, 0, 0, 0))
+        if result == nil || result.Result != protocol.RESULT_UNOWN_ERROR || result.Lcount != 1 {
+            t.Errorf("LockDB Cancel Other Session Error %v", result)
+            return
+        }
+    }
+
+    for _, cancel_key := range [][16]byte{lock_key, unknown_key} {
+        result = waitTestDBLockCommand(wait_protocol, newTestDBLockCommand(wait_protocol, protocol.COMMAND_CANCEL, cancel_key, lock_id, 0, 0, 0))
+        if result == nil || result.Result != protocol.RESULT_UNOWN_ERROR {
+            t.Errorf("LockDB Cancel Unknown Wait Error %v", result)
+            return
+        }
+    }
+
+    if db.GetState().WaitCount != 1 || len(waiter) != 0 {
+        t.Errorf("LockDB Cancel Still Wait Error %d", db.GetState().WaitCount)
+        return
+    }
+
+    result = waitTestDBLockCommand(wait_protocol, newTestDBLockCommand(wait_protocol, protocol.COMMAND_CANCEL, lock_key, wait_request_id, 0, 0, 0))
+    if result == nil || result.Result != protocol.RESULT_SUCCED || result.Lcount != 1 {
+        t.Errorf("LockDB Cancel Error %v", result)
+        return
+    }
+
+    select {
+    case result = <- waiter:
+        if result == nil || result.Result != protocol.RESULT_CANCELED || result.LockId != wait_lock_id {
+            t.Errorf("LockDB Cancel Wait Result Error %v", result)
+            return
+        }
+    case <- time.After(time.Second):
+        t.Errorf("LockDB Cancel Wait Result Timeout")
+        return
+    }
+
+    if db.GetState().WaitCount != 0 || db.GetState().LockedCount != 1 {
+        t.Errorf("LockDB Cancel State Error %d %d", db.GetState().WaitCount, db.GetState().LockedCount)
+        return
+    }
+
+    result = waitTestDBLockCommand(wait_protocol, newTestDBLockCommand(wait_protocol, protocol.COMMAND_CANCEL, lock_key, wait_request_id, 0, 0, 0))
+    if result == nil || result.Result != protocol.RESULT_UNOWN_ERROR {
+        t.Errorf("LockDB Cancel Again Error %v", result)
+    }
+}
+
+func TestLockDB_Query(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "none")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_key, unlimited_key, lock_id, other_lock_id := [16]byte{}, [16]byte{}, [16]byte{}, [16]byte{}
+    copy(lock_key[:], "query_key")
+    copy(unlimited_key[:], "query_unlimited")
+    copy(lock_id[:], "query_id")
+    copy(other_lock_id[:], "query_other_id")
+    result := doTestDBLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id, 0, 60)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("LockDB Query Lock Error %v", result)
+        return
+    }
+    token := result.Token
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_LOCK, unlimited_key, lock_id, 0x4000, 1)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("LockDB Query Unlimited Lock Error %v", result)
+        return
+    }
+
+    wait_protocol := NewMemWaiterServerProtocol(slock)
+    defer wait_protocol.Close()
+    waiter := make(chan *protocol.LockResultCommand, 2)
+    for i := 0; i < 2; i++ {
+        wait_lock_id := [16]byte{}
+        copy(wait_lock_id[:], fmt.Sprintf("query_wait_%d", i))
+        wait_command := newTestDBLockCommand(wait_protocol, protocol.COMMAND_LOCK, lock_key, wait_lock_id, 2, 0, 60)
+        go func() {
+            waiter <- waitTestDBLockCommand(wait_protocol, wait_command)
+        }()
+    }
+
+    db := slock.GetOrNewDB(0)
+    for i := 0; i < 100 && db.GetState().WaitCount != 2; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    state := *db.GetState()
+    if state.WaitCount != 2 || state.LockCount != 2 || state.LockedCount != 2 {
+        t.Errorf("LockDB Query Wait Error %d %d %d", state.WaitCount, state.LockCount, state.LockedCount)
+        return
+    }
+
+    unknown_key := [16]byte{}
+    copy(unknown_key[:], "query_unknown")
+    query_result := db.Query(&protocol.LockCommand{CommandType: protocol.COMMAND_QUERY, DbId: 0, LockId: lock_id, LockKey: unknown_key})
+    if query_result.Result != protocol.RESULT_SUCCED || query_result.Flag != 0 || query_result.LockId != [16]byte{} || query_result.Lcount != 0 || query_result.WaitCount != 0 {
+        t.Errorf("LockDB Query Unknown Key Error %v", query_result)
+        return
+    }
+
+    query_result = db.Query(&protocol.LockCommand{CommandType: protocol.COMMAND_QUERY, DbId: 0, LockId: lock_id, LockKey: lock_key})
+    if query_result.Result != protocol.RESULT_SUCCED || query_result.Flag != 0x01 || query_result.LockId != lock_id || query_result.Lcount != 1 ||
+        query_result.Lrcount != 1 || query_result.Expried < 59 || query_result.Expried > 61 || query_result.WaitCount != 2 || query_result.Token != token {
+        t.Errorf("LockDB Query Owner Error %v", query_result)
+        return
+    }
+
+    query_result = db.Query(&protocol.LockCommand{CommandType: protocol.COMMAND_QUERY, DbId: 0, LockId: other_lock_id, LockKey: lock_key})
+    if query_result.Result != protocol.RESULT_SUCCED || query_result.Flag != 0 || query_result.LockId != lock_id || query_result.Lcount != 1 ||
+        query_result.WaitCount != 2 || query_result.Token != token {
+        t.Errorf("LockDB Query Other Error %v", query_result)
+        return
+    }
+
+    query_result = db.Query(&protocol.LockCommand{CommandType: protocol.COMMAND_QUERY, DbId: 0, LockId: lock_id, LockKey: unlimited_key})
+    if query_result.Result != protocol.RESULT_SUCCED || query_result.Flag != 0x01 || query_result.Expried != 0xffffffff || query_result.WaitCount != 0 {
+        t.Errorf("LockDB Query Unlimited Error %v", query_result)
+        return
+    }
+
+    if *db.GetState() != state {
+        t.Errorf("LockDB Query State Changed Error %v %v", *db.GetState(), state)
+        return
+    }
+
+    for i := 0; i < 2; i++ {
+        select {
+        case result = <- waiter:
+            if result == nil || result.Result != protocol.RESULT_TIMEOUT {
+                t.Errorf("LockDB Query Wait Result Error %v", result)
+                return
+            }
+        case <- time.After(5 * time.Second):
+            t.Errorf("LockDB Query Wait Result Timeout")
+            return
+        }
+    }
+
+    query_result = db.Query(&protocol.LockCommand{CommandType: protocol.COMMAND_QUERY, DbId: 0, LockId: lock_id, LockKey: lock_key})
+    if query_result.Flag != 0x01 || query_result.Lcount != 1 || query_result.WaitCount != 0 {
+        t.Errorf("LockDB Query Timeouted Error %v", query_result)
+        return
+    }
+
+    result = doTestDBLockCommand(slock, protocol.COMMAND_UNLOCK, lock_key, lock_id, 0, 0)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("LockDB Query Unlock Error %v", result)
+        return
+    }
+
+    query_result = db.Query(&protocol.LockCommand{CommandType: protocol.COMMAND_QUERY, DbId: 0, LockId: lock_id, LockKey: lock_key})
+    if query_result.Flag != 0 || query_result.LockId != [16]byte{} || query_result.Lcount != 0 || query_result.Expried != 0 {
+        t.Errorf("LockDB Query Unlocked Error %v", query_result)
+    }
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+    "fmt"
     "sync"
     "github.com/snower/slock/protocol"
 )
@@ -8,10 +9,12 @@ import (
 type LockManager struct {
     lock_db        *LockDB
     lock_key       [16]byte
+    lock_name      string
     current_lock   *Lock
     locks          *LockQueue
     lock_maps      map[[16]byte]*Lock
     wait_locks     *LockQueue
+    priority_wait_locks map[uint8]*LockQueue
     glock          *sync.Mutex
     free_locks     *LockQueue
     fast_key_value *FastKeyValue
@@ -19,14 +22,15 @@ type LockManager struct {
     locked         uint32
     db_id          uint8
     waited         bool
+    priority_waited bool
     freed          bool
     glock_index    int8
 }
 
 func NewLockManager(lock_db *LockDB, command *protocol.LockCommand, glock *sync.Mutex, glock_index int8, free_locks *LockQueue) *LockManager {
-    return &LockManager{lock_db, command.LockKey,
-        nil, nil, nil, nil, glock, free_locks, nil, 0, 0,
-        command.DbId, false, true, glock_index}
+    return &LockManager{lock_db, command.LockKey, command.LockName,
+        nil, nil, nil, nil, nil, glock, free_locks, nil, 0, 0,
+        command.DbId, false, false, true, glock_index}
 }
 
 func (self *LockManager) GetDB() *LockDB{
@@ -35,7 +39,7 @@ func (self *LockManager) GetDB() *LockDB{
 
 func (self *LockManager) AddLock(lock *Lock) *Lock {
     if lock.command.ExpriedFlag & 0x0400 == 0 {
-        lock.expried_time = self.lock_db.current_time + int64(lock.command.Expried) + 1
+        lock.expried_time = self.lock_db.current_time + int64(lock.command.GetExpried()) + 1
     } else if lock.command.ExpriedFlag & 0x4000 != 0 {
         lock.expried_time = 0x7fffffffffffffff
     }
@@ -54,6 +58,9 @@ func (self *LockManager) AddLock(lock *Lock) *Lock {
     }
     lock.locked = 1
     lock.ref_count++
+    if lock.fencing_token == 0 {
+        lock.fencing_token = self.lock_db.GetFencingToken()
+    }
 
     if self.current_lock == nil {
         self.current_lock = lock
@@ -135,13 +142,13 @@ func (self *LockManager) UpdateLockedLock(lock *Lock, timeout uint16, timeout_fl
     lock.command.Rcount = rcount
 
     if timeout_flag & 0x0400 == 0 {
-        lock.timeout_time = self.lock_db.current_time + int64(timeout) + 1
+        lock.timeout_time = self.lock_db.current_time + int64(lock.command.GetTimeout()) + 1
     } else {
         lock.timeout_time = 0
     }
 
     if expried_flag & 0x0400 == 0 {
-        lock.expried_time = self.lock_db.current_time + int64(expried) + 1
+        lock.expried_time = self.lock_db.current_time + int64(lock.command.GetExpried()) + 1
     } else if lock.command.ExpriedFlag & 0x4000 != 0 {
         lock.expried_time = 0x7fffffffffffffff
     } else {
@@ -164,47 +171,135 @@ func (self *LockManager) UpdateLockedLock(lock *Lock, timeout uint16, timeout_fl
         lock.aof_time = self.lock_db.aof_time
     }
 
-    if lock.is_aof {
+    if lock.is_aof && lock.command.ExpriedFlag & 0x1000 == 0 {
         self.PushLockAof(lock)
     }
 }
 
 func (self *LockManager) AddWaitLock(lock *Lock) *Lock {
-    self.wait_locks.Push(lock)
+    lock.priority = uint8(lock.command.TimeoutFlag & 0x00ff)
+    if lock.priority > 0 {
+        if self.priority_wait_locks == nil {
+            self.priority_wait_locks = make(map[uint8]*LockQueue, 4)
+        }
+
+        wait_locks, ok := self.priority_wait_locks[lock.priority]
+        if !ok {
+            wait_locks = NewLockQueue(2, 16, 4)
+            self.priority_wait_locks[lock.priority] = wait_locks
+        }
+        wait_locks.Push(lock)
+        self.priority_waited = true
+    } else {
+        self.wait_locks.Push(lock)
+    }
+
     lock.ref_count++
     self.waited = true
     return lock
 }
 
 func (self *LockManager) GetWaitLock() *Lock {
-    lock := self.wait_locks.Head()
-    for ; lock != nil; {
-        if lock.timeouted {
-            self.wait_locks.Pop()
-            lock.ref_count--
-            if lock.ref_count == 0 {
-                self.FreeLock(lock)
-            }
-            lock = self.wait_locks.Head()
+    lock := self.GetQueueWaitLock(self.wait_locks)
+    if self.priority_waited {
+        return self.GetPriorityWaitLock(lock)
+    }
+    return lock
+}
+
+func (self *LockManager) GetQueueWaitLock(wait_locks *LockQueue) *Lock {
+    lock := wait_locks.Head()
+    for ; lock != nil && lock.timeouted; {
+        wait_locks.Pop()
+        lock.ref_count--
+        if lock.ref_count == 0 {
+            self.FreeLock(lock)
+        }
+        lock = wait_locks.Head()
+    }
+
+    if wait_locks.head_node_index >= 6 {
+        wait_locks.Resize()
+    }
+    return lock
+}
+
+func (self *LockManager) GetPriorityWaitLock(head_lock *Lock) *Lock {
+    // every priority has its own fifo queue, only the head of each queue can have the highest aged priority
+    now, priority_aging_time := self.lock_db.current_time, self.lock_db.priority_aging_time
+    priority_lock, priority := head_lock, int64(0)
+    if head_lock != nil && priority_aging_time > 0 {
+        priority += (now - head_lock.start_time) / priority_aging_time
+    }
+
+    for lock_priority, wait_locks := range self.priority_wait_locks {
+        lock := self.GetQueueWaitLock(wait_locks)
+        if lock == nil {
+            delete(self.priority_wait_locks, lock_priority)
             continue
         }
 
-        if self.wait_locks.head_node_index >= 6 {
-            self.wait_locks.Resize()
+        aged_priority := int64(lock.priority)
+        if priority_aging_time > 0 {
+            aged_priority += (now - lock.start_time) / priority_aging_time
         }
-        return lock
+
+        if priority_lock == nil || aged_priority > priority || (aged_priority == priority && (lock.start_time < priority_lock.start_time ||
+            (lock.start_time == priority_lock.start_time && lock.priority > priority_lock.priority))) {
+            priority_lock, priority = lock, aged_priority
+        }
+    }
+
+    if len(self.priority_wait_locks) == 0 {
+        self.priority_waited = false
+    }
+    return priority_lock
+}
+
+func (self *LockManager) GetWaitLockQueues() []*LockQueue {
+    if self.wait_locks == nil {
+        return nil
     }
 
-    if self.wait_locks.head_node_index >= 6 {
-        self.wait_locks.Resize()
+    wait_lock_queues := make([]*LockQueue, 0, len(self.priority_wait_locks) + 1)
+    wait_lock_queues = append(wait_lock_queues, self.wait_locks)
+    for _, wait_locks := range self.priority_wait_locks {
+        wait_lock_queues = append(wait_lock_queues, wait_locks)
+    }
+    return wait_lock_queues
+}
+
+func (self *LockManager) GetWaitLockByRequestId(request_id [16]byte) *Lock {
+    for _, wait_locks := range self.GetWaitLockQueues() {
+        for node_index := wait_locks.head_node_index; node_index <= wait_locks.tail_node_index; node_index++ {
+            for _, lock := range wait_locks.IterNodeQueues(node_index) {
+                if lock != nil && !lock.timeouted && lock.command != nil && lock.command.RequestId == request_id {
+                    return lock
+                }
+            }
+        }
     }
     return nil
 }
 
+func (self *LockManager) GetWaitLockCount() uint32 {
+    wait_count := uint32(0)
+    for _, wait_locks := range self.GetWaitLockQueues() {
+        for node_index := wait_locks.head_node_index; node_index <= wait_locks.tail_node_index; node_index++ {
+            for _, lock := range wait_locks.IterNodeQueues(node_index) {
+                if lock != nil && !lock.timeouted {
+                    wait_count++
+                }
+            }
+        }
+    }
+    return wait_count
+}
+
 func (self *LockManager) PushLockAof(lock *Lock)  {
     if self.lock_db.aof_channels[self.glock_index].Push(lock, protocol.COMMAND_LOCK) != nil {
-        self.lock_db.slock.Log().Errorf("Lock Push Aof Lock Error DbId:%d LockKey:%x LockId:%x",
-            lock.command.DbId, lock.command.LockKey, lock.command.LockId)
+        self.lock_db.slock.Log().Errorf("Lock Push Aof Lock Error DbId:%d LockKey:%x LockName:%s LockId:%x",
+            lock.command.DbId, lock.command.LockKey, self.lock_name, lock.command.LockId)
         return
     }
     lock.is_aof = true
@@ -212,12 +307,63 @@ func (self *LockManager) PushLockAof(lock *Lock)  {
 
 func (self *LockManager) PushUnLockAof(lock *Lock)  {
     if self.lock_db.aof_channels[self.glock_index].Push(lock, protocol.COMMAND_UNLOCK) != nil {
-        self.lock_db.slock.Log().Errorf("Lock Push Aof Unlock Error DbId:%d LockKey:%x LockId:%x",
-            lock.command.DbId, lock.command.LockKey, lock.command.LockId)
+        self.lock_db.slock.Log().Errorf("Lock Push Aof Unlock Error DbId:%d LockKey:%x LockName:%s LockId:%x",
+            lock.command.DbId, lock.command.LockKey, self.lock_name, lock.command.LockId)
     }
     lock.is_aof = false
 }
 
+func (self *LockManager) DumpAofLock(lock *Lock, aof_index uint32, aof_id uint32, now int64) *AofLock {
+    if lock.locked == 0 || lock.expried || lock.command == nil {
+        return nil
+    }
+
+    expried_time := uint32(0)
+    if lock.command.ExpriedFlag & 0x4000 == 0 {
+        if lock.expried_time <= now {
+            return nil
+        }
+
+        if lock.expried_time - now > protocol.MAX_EXPRIED_TIME {
+            expried_time = protocol.MAX_EXPRIED_TIME
+        } else {
+            expried_time = uint32(lock.expried_time - now)
+        }
+    }
+
+    start_time := uint16(0)
+    if now - lock.start_time <= 0xffff {
+        start_time = uint16(now - lock.start_time)
+    }
+
+    aof_lock := &AofLock{protocol.COMMAND_LOCK, aof_index, aof_id, uint64(now), lock.command.Flag, self.db_id, lock.command.LockId,
+        lock.command.LockKey, 0, start_time, lock.command.ExpriedFlag & 0x4800 | uint16(expried_time >> 16), uint16(expried_time), lock.command.Count, lock.command.Rcount, 0, lock.fencing_token, self.lock_name, make([]byte, 64), nil}
+    err := aof_lock.Encode()
+    if err != nil {
+        return nil
+    }
+
+    buf := aof_lock.GetBuf()
+    buf[0], buf[1] = 62, 0
+    return aof_lock
+}
+
+func (self *LockManager) GetLockInfos(now int64) []*LockInfo {
+    lock_infos := make([]*LockInfo, 0)
+    if self.current_lock != nil && self.current_lock.command != nil {
+        lock_infos = append(lock_infos, NewLockInfo(self.current_lock, self.db_id, now))
+    }
+
+    if self.lock_maps != nil {
+        for _, lock := range self.lock_maps {
+            if lock.command != nil {
+                lock_infos = append(lock_infos, NewLockInfo(lock, self.db_id, now))
+            }
+        }
+    }
+    return lock_infos
+}
+
 func (self *LockManager) FreeLock(lock *Lock) *Lock {
     self.ref_count--
     lock.manager = nil
@@ -246,13 +392,16 @@ func (self *LockManager) GetOrNewLock(protocol ServerProtocol, command *protocol
     lock.start_time = now
     lock.expried_time = 0
     if lock.command.TimeoutFlag & 0x0400 == 0 {
-        lock.timeout_time = now + int64(command.Timeout) + 1
+        lock.timeout_time = now + int64(command.GetTimeout()) + 1
     } else {
         lock.timeout_time = 0
     }
     lock.timeout_checked_count = 1
     lock.expried_checked_count = 1
     lock.long_wait_index = 0
+    lock.fencing_token = 0
+    lock.multi_waited = false
+    lock.aof_waiter = nil
     self.ref_count++
     return lock
 }
@@ -265,6 +414,7 @@ type Lock struct {
     expried_time            int64
     timeout_time            int64
     long_wait_index         uint64
+    fencing_token           uint64
     timeout_checked_count   uint8
     expried_checked_count   uint8
     ref_count               uint8
@@ -272,13 +422,16 @@ type Lock struct {
     timeouted               bool
     expried                 bool
     aof_time                uint8
+    priority                uint8
     is_aof                  bool
+    multi_waited            bool
+    aof_waiter              chan bool
 }
 
 func NewLock(manager *LockManager, protocol ServerProtocol, command *protocol.LockCommand) *Lock {
     now := manager.lock_db.current_time
-    return &Lock{manager, command, protocol,now, 0, now + int64(command.Timeout),
-        0, 0, 0,0, 0, false, false, 0, false}
+    return &Lock{manager, command, protocol,now, 0, now + int64(command.GetTimeout()),
+        0, 0, 0, 0,0, 0, false, false, 0, 0, false, false, nil}
 }
 
 func (self *Lock) GetDB() *LockDB {
@@ -286,4 +439,63 @@ func (self *Lock) GetDB() *LockDB {
         return nil
     }
     return self.manager.GetDB()
-}
\ No newline at end of file
+}
+
+type LockInfo struct {
+    DbId            uint8       `json:"db_id"`
+    LockKey         string      `json:"lock_key"`
+    LockName        string      `json:"lock_name,omitempty"`
+    LockId          string      `json:"lock_id"`
+    StartTime       int64       `json:"start_time"`
+    TimeoutTime     int64       `json:"timeout_time"`
+    ExpriedTime     int64       `json:"expried_time"`
+    Locked          uint8       `json:"locked"`
+    AofTime         uint8       `json:"aof_time"`
+    State           uint8       `json:"state"`
+    Expried         uint32      `json:"expried"`
+    ExpriedFlag     uint16      `json:"expried_flag"`
+    Count           uint16      `json:"count"`
+    Rcount          uint8       `json:"rcount"`
+    FencingToken    uint64      `json:"fencing_token,omitempty"`
+}
+
+func NewLockInfo(lock *Lock, db_id uint8, now int64) *LockInfo {
+    state := uint8(0)
+    if lock.timeouted {
+        state |= 0x01
+    }
+
+    if lock.expried {
+        state |= 0x02
+    }
+
+    if lock.long_wait_index > 0 {
+        state |= 0x04
+    }
+
+    if lock.is_aof {
+        state |= 0x08
+    }
+
+    expried := uint32(0)
+    if lock.command.ExpriedFlag & 0x4000 == 0 {
+        if lock.command.ExpriedFlag & 0x0400 != 0 {
+            expried = lock.command.GetExpried()
+        } else if lock.expried_time > now {
+            if lock.expried_time - now > protocol.MAX_EXPRIED_TIME {
+                expried = protocol.MAX_EXPRIED_TIME
+            } else {
+                expried = uint32(lock.expried_time - now)
+            }
+        }
+    }
+
+    lock_name := ""
+    if lock.manager != nil {
+        lock_name = lock.manager.lock_name
+    }
+
+    return &LockInfo{db_id, fmt.Sprintf("%x", lock.command.LockKey), lock_name, fmt.Sprintf("%x", lock.command.LockId),
+        lock.start_time, lock.timeout_time, lock.expried_time, lock.locked, lock.aof_time, state,
+        expried, lock.command.ExpriedFlag & 0x4f00, lock.command.Count, lock.command.Rcount, lock.fencing_token}
+}
@@ -1 +1,82 @@
 package server
+
+import (
+    "github.com/snower/slock/protocol"
+    "os"
+    "testing"
+    "time"
+)
+
+func TestLockManager_PriorityWaitLock(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "none")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_key := [16]byte{}
+    copy(lock_key[:], "priority_wait")
+    result := doTestAofLockCommand(slock, protocol.COMMAND_LOCK, lock_key, [16]byte{0})
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("LockManager Priority Lock Error %v", result)
+        return
+    }
+
+    server_protocol := slock.multi_lock_protocol
+    priorities := []uint16{0, 2, 1, 2, 0}
+    waiters := make([]chan *protocol.LockResultCommand, len(priorities))
+    for i, priority := range priorities {
+        server_protocol.Lock()
+        lock_command := server_protocol.GetLockCommand()
+        server_protocol.Unlock()
+
+        lock_command.Magic = protocol.MAGIC
+        lock_command.Version = protocol.VERSION
+        lock_command.CommandType = protocol.COMMAND_LOCK
+        lock_command.RequestId = slock.GetAof().GetRequestId()
+        lock_command.Flag = 0
+        lock_command.DbId = 0
+        lock_command.LockId = [16]byte{byte(i + 1)}
+        lock_command.LockKey = lock_key
+        lock_command.LockName = ""
+        lock_command.TimeoutFlag = priority
+        lock_command.Timeout = 5
+        lock_command.ExpriedFlag = 0
+        lock_command.Expried = 60
+        lock_command.Count = 0
+        lock_command.Rcount = 0
+
+        waiters[i] = make(chan *protocol.LockResultCommand, 1)
+        server_protocol.AddWaiter(lock_command, waiters[i])
+        server_protocol.ProcessLockCommand(lock_command)
+    }
+
+    lock_manager := slock.GetOrNewDB(0).GetLockManager(&protocol.LockCommand{LockKey: lock_key})
+    if lock_manager.GetWaitLockCount() != 5 {
+        t.Errorf("LockManager Priority Wait Count Error %d", lock_manager.GetWaitLockCount())
+        return
+    }
+
+    lock_id := [16]byte{0}
+    for _, i := range []int{1, 3, 2, 0, 4} {
+        result = doTestAofLockCommand(slock, protocol.COMMAND_UNLOCK, lock_key, lock_id)
+        if result == nil || result.Result != protocol.RESULT_SUCCED {
+            t.Errorf("LockManager Priority Unlock Error %v", result)
+            return
+        }
+
+        select {
+        case result = <- waiters[i]:
+            if result.Result != protocol.RESULT_SUCCED {
+                t.Errorf("LockManager Priority Wait Result Error %d %d", i, result.Result)
+                return
+            }
+        case <- time.After(time.Second):
+            t.Errorf("LockManager Priority Wait Order Error %d", i)
+            return
+        }
+        lock_id = [16]byte{byte(i + 1)}
+    }
+
+    if len(lock_manager.priority_wait_locks) != 0 || lock_manager.GetWaitLockCount() != 0 {
+        t.Errorf("LockManager Priority Wait Queue Error %d %d", len(lock_manager.priority_wait_locks), lock_manager.GetWaitLockCount())
+    }
+}
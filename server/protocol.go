@@ -1,8 +1,6 @@
 package server
 
 import (
-    "crypto/md5"
-    "encoding/hex"
     "errors"
     "fmt"
     "github.com/snower/slock/protocol"
@@ -27,8 +25,8 @@ type ServerProtocol interface {
     ProcessBuild(command protocol.ICommand) error
     ProcessCommad(command protocol.ICommand) error
     ProcessLockCommand(command *protocol.LockCommand) error
-    ProcessLockResultCommand(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8) error
-    ProcessLockResultCommandLocked(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8) error
+    ProcessLockResultCommand(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8, token uint64) error
+    ProcessLockResultCommandLocked(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8, token uint64) error
     Close() (error)
     GetStream() *Stream
     RemoteAddr() net.Addr
@@ -98,23 +96,31 @@ func (self *MemWaiterServerProtocol) ProcessLockCommand(lock_command *protocol.L
     }
 
     if db == nil {
-        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+    }
+
+    if lock_command.CommandType == protocol.COMMAND_RENEW {
+        return db.Renew(self, lock_command)
+    }
+
+    if lock_command.CommandType == protocol.COMMAND_CANCEL {
+        return db.Cancel(self, lock_command)
     }
     return db.UnLock(self, lock_command)
 }
 
-func (self *MemWaiterServerProtocol)ProcessLockResultCommand(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8) error {
+func (self *MemWaiterServerProtocol)ProcessLockResultCommand(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8, token uint64) error {
     self.glock.Lock()
     if waiter, ok := self.waiters[command.RequestId]; ok {
-        waiter <- protocol.NewLockResultCommand(command, result, 0, lcount, command.Count, lrcount, command.Rcount)
+        waiter <- protocol.NewTokenLockResultCommand(command, result, 0, lcount, command.Count, lrcount, command.Rcount, token)
         delete(self.waiters, command.RequestId)
     }
     self.glock.Unlock()
     return nil
 }
 
-func (self *MemWaiterServerProtocol) ProcessLockResultCommandLocked(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8) error {
-    return self.ProcessLockResultCommand(command, result, lcount, lrcount)
+func (self *MemWaiterServerProtocol) ProcessLockResultCommandLocked(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8, token uint64) error {
+    return self.ProcessLockResultCommand(command, result, lcount, lrcount, token)
 }
 
 func (self *MemWaiterServerProtocol) Close() (error) {
@@ -227,7 +233,7 @@ type BinaryServerProtocol struct {
 }
 
 func NewBinaryServerProtocol(slock *SLock, stream *Stream) *BinaryServerProtocol {
-    wbuf := make([]byte, 64)
+    wbuf := make([]byte, 72)
     wbuf[0] = byte(protocol.MAGIC)
     wbuf[1] = byte(protocol.VERSION)
 
@@ -317,7 +323,7 @@ func (self *BinaryServerProtocol) Read() (protocol.CommandDecode, error) {
             return nil, errors.New("unknown magic")
         }
 
-        if (mv>>8) & 0xff != uint16(protocol.VERSION) {
+        if (mv>>8) & 0xff != uint16(protocol.VERSION) && (mv>>8) & 0xff != uint16(protocol.VERSION2) {
             return nil, errors.New("unknown version")
         }
     }
@@ -330,6 +336,13 @@ func (self *BinaryServerProtocol) Read() (protocol.CommandDecode, error) {
         if err != nil {
             return nil, err
         }
+
+        if lock_command.Version == protocol.VERSION2 {
+            err = self.ReadLockName(lock_command)
+            if err != nil {
+                return nil, err
+            }
+        }
         return lock_command, nil
 
     case protocol.COMMAND_UNLOCK:
@@ -338,6 +351,13 @@ func (self *BinaryServerProtocol) Read() (protocol.CommandDecode, error) {
         if err != nil {
             return nil, err
         }
+
+        if lock_command.Version == protocol.VERSION2 {
+            err = self.ReadLockName(lock_command)
+            if err != nil {
+                return nil, err
+            }
+        }
         return lock_command, nil
     default:
         switch command_type {
@@ -363,6 +383,11 @@ func (self *BinaryServerProtocol) Read() (protocol.CommandDecode, error) {
             if err != nil {
                 return nil, err
             }
+
+            err = self.ReadAdminArgs(admin_command)
+            if err != nil {
+                return nil, err
+            }
             return admin_command, nil
         case protocol.COMMAND_PING:
             ping_command := &protocol.PingCommand{}
@@ -378,22 +403,142 @@ func (self *BinaryServerProtocol) Read() (protocol.CommandDecode, error) {
                 return nil, err
             }
             return quit_command, nil
+        case protocol.COMMAND_SYNC:
+            sync_command := &protocol.SyncCommand{}
+            err := sync_command.Decode(buf)
+            if err != nil {
+                return nil, err
+            }
+            return sync_command, nil
+        case protocol.COMMAND_RAFT_VOTE:
+            raft_vote_command := &protocol.RaftVoteCommand{}
+            err := raft_vote_command.Decode(buf)
+            if err != nil {
+                return nil, err
+            }
+            return raft_vote_command, nil
+        case protocol.COMMAND_RAFT_APPEND:
+            raft_append_command := &protocol.RaftAppendCommand{}
+            err := raft_append_command.Decode(buf)
+            if err != nil {
+                return nil, err
+            }
+            return raft_append_command, nil
+        case protocol.COMMAND_SNAPSHOT:
+            snapshot_command := &protocol.SnapshotCommand{}
+            err := snapshot_command.Decode(buf)
+            if err != nil {
+                return nil, err
+            }
+            return snapshot_command, nil
+        case protocol.COMMAND_MULTI_LOCK, protocol.COMMAND_MULTI_UNLOCK:
+            multi_lock_command := &protocol.MultiLockCommand{}
+            err := multi_lock_command.Decode(buf)
+            if err != nil {
+                return nil, err
+            }
+
+            err = self.ReadMultiLockKeys(multi_lock_command)
+            if err != nil {
+                return nil, err
+            }
+            return multi_lock_command, nil
+        case protocol.COMMAND_RENEW, protocol.COMMAND_CANCEL, protocol.COMMAND_QUERY:
+            lock_command := self.GetLockCommand()
+            err := lock_command.Decode(buf)
+            if err != nil {
+                return nil, err
+            }
+
+            if lock_command.Version == protocol.VERSION2 {
+                err = self.ReadLockName(lock_command)
+                if err != nil {
+                    return nil, err
+                }
+            }
+            return lock_command, nil
         }
     }
     return nil, errors.New("Unknown Command")
 }
 
+func (self *BinaryServerProtocol) ReadMultiLockKeys(multi_lock_command *protocol.MultiLockCommand) error {
+    if multi_lock_command.KeyCount == 0 {
+        return multi_lock_command.DecodeLockKeys(nil)
+    }
+
+    buf := make([]byte, int(multi_lock_command.KeyCount) * 16)
+    _, err := self.stream.ReadBytes(buf)
+    if err != nil {
+        return err
+    }
+    return multi_lock_command.DecodeLockKeys(buf)
+}
+
+func (self *BinaryServerProtocol) ReadAdminArgs(admin_command *protocol.AdminCommand) error {
+    if admin_command.ArgCount == 0 {
+        return admin_command.DecodeArgs(nil)
+    }
+
+    buf := make([]byte, 0, 64)
+    for i := 0; i < int(admin_command.ArgCount); i++ {
+        _, err := self.stream.ReadBytes(self.rbuf[:2])
+        if err != nil {
+            return err
+        }
+
+        arg_len := int(uint16(self.rbuf[0]) | uint16(self.rbuf[1])<<8)
+        arg_buf := make([]byte, 2 + arg_len)
+        arg_buf[0], arg_buf[1] = self.rbuf[0], self.rbuf[1]
+        if arg_len > 0 {
+            _, err = self.stream.ReadBytes(arg_buf[2:])
+            if err != nil {
+                return err
+            }
+        }
+        buf = append(buf, arg_buf...)
+    }
+    return admin_command.DecodeArgs(buf)
+}
+
+func (self *BinaryServerProtocol) ReadLockName(lock_command *protocol.LockCommand) error {
+    _, err := self.stream.ReadBytes(self.rbuf[:2])
+    if err != nil {
+        return err
+    }
+
+    name_len := int(uint16(self.rbuf[0]) | uint16(self.rbuf[1])<<8)
+    buf := make([]byte, 2 + name_len)
+    buf[0], buf[1] = self.rbuf[0], self.rbuf[1]
+    if name_len > 0 {
+        _, err = self.stream.ReadBytes(buf[2:])
+        if err != nil {
+            return err
+        }
+    }
+    return lock_command.DecodeLockName(buf)
+}
+
 func (self *BinaryServerProtocol) Write(result protocol.CommandEncode) error {
     if self.closed {
         return errors.New("Protocol Closed")
     }
 
-    err := result.Encode(self.wbuf)
+    wbuf := self.wbuf[:64]
+    if command, ok := result.(protocol.CommandEncodeLength); ok {
+        if command.GetEncodeLength() > len(self.wbuf) {
+            wbuf = make([]byte, command.GetEncodeLength())
+        } else {
+            wbuf = self.wbuf[:command.GetEncodeLength()]
+        }
+    }
+
+    err := result.Encode(wbuf)
     if err != nil {
         return err
     }
 
-    return self.stream.WriteBytes(self.wbuf)
+    return self.stream.WriteBytes(wbuf)
 }
 
 func (self *BinaryServerProtocol) Process() error {
@@ -435,7 +580,7 @@ func (self *BinaryServerProtocol) ProcessParse(buf []byte) error {
             return errors.New("Unknown Magic")
         }
 
-        if (mv>>8)&0xff != uint16(protocol.VERSION) {
+        if (mv>>8)&0xff != uint16(protocol.VERSION) && (mv>>8)&0xff != uint16(protocol.VERSION2) {
             command := protocol.NewCommand(buf)
             self.Write(protocol.NewResultCommand(command, protocol.RESULT_UNKNOWN_VERSION))
             return errors.New("Unknown Version")
@@ -451,7 +596,7 @@ func (self *BinaryServerProtocol) ProcessParse(buf []byte) error {
             lock_command = self.GetLockCommandLocked()
         }
 
-        lock_command.CommandType = command_type
+        lock_command.Version, lock_command.CommandType = buf[1], command_type
 
         lock_command.RequestId[0], lock_command.RequestId[1], lock_command.RequestId[2], lock_command.RequestId[3], lock_command.RequestId[4], lock_command.RequestId[5], lock_command.RequestId[6], lock_command.RequestId[7],
             lock_command.RequestId[8], lock_command.RequestId[9], lock_command.RequestId[10], lock_command.RequestId[11], lock_command.RequestId[12], lock_command.RequestId[13], lock_command.RequestId[14], lock_command.RequestId[15] =
@@ -473,19 +618,28 @@ func (self *BinaryServerProtocol) ProcessParse(buf []byte) error {
         lock_command.Timeout, lock_command.TimeoutFlag, lock_command.Expried, lock_command.ExpriedFlag = uint16(buf[53])|uint16(buf[54])<<8, uint16(buf[55])|uint16(buf[56])<<8, uint16(buf[57])|uint16(buf[58])<<8, uint16(buf[59])|uint16(buf[60])<<8
         lock_command.Count, lock_command.Rcount = uint16(buf[61])|uint16(buf[62])<<8, uint8(buf[63])
 
+        if buf[1] == protocol.VERSION2 {
+            err := self.ReadLockName(lock_command)
+            if err != nil {
+                return err
+            }
+        } else {
+            lock_command.LockName = ""
+        }
+
         if self.slock.state != STATE_LEADER {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
         }
 
         if lock_command.DbId == 0xff {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
 
         db := self.slock.dbs[lock_command.DbId]
         if db == nil {
             db = self.slock.GetOrNewDB(lock_command.DbId)
         }
-        err := db.Lock(self, lock_command)
+        err := self.slock.DoLockComamnd(db, self, lock_command)
         if err != nil {
             return err
         }
@@ -496,7 +650,7 @@ func (self *BinaryServerProtocol) ProcessParse(buf []byte) error {
             lock_command = self.GetLockCommandLocked()
         }
 
-        lock_command.CommandType = command_type
+        lock_command.Version, lock_command.CommandType = buf[1], command_type
 
         lock_command.RequestId[0], lock_command.RequestId[1], lock_command.RequestId[2], lock_command.RequestId[3], lock_command.RequestId[4], lock_command.RequestId[5], lock_command.RequestId[6], lock_command.RequestId[7],
             lock_command.RequestId[8], lock_command.RequestId[9], lock_command.RequestId[10], lock_command.RequestId[11], lock_command.RequestId[12], lock_command.RequestId[13], lock_command.RequestId[14], lock_command.RequestId[15] =
@@ -518,19 +672,28 @@ func (self *BinaryServerProtocol) ProcessParse(buf []byte) error {
         lock_command.Timeout, lock_command.TimeoutFlag, lock_command.Expried, lock_command.ExpriedFlag = uint16(buf[53])|uint16(buf[54])<<8, uint16(buf[55])|uint16(buf[56])<<8, uint16(buf[57])|uint16(buf[58])<<8, uint16(buf[59])|uint16(buf[60])<<8
         lock_command.Count, lock_command.Rcount = uint16(buf[61])|uint16(buf[62])<<8, uint8(buf[63])
 
+        if buf[1] == protocol.VERSION2 {
+            err := self.ReadLockName(lock_command)
+            if err != nil {
+                return err
+            }
+        } else {
+            lock_command.LockName = ""
+        }
+
         if self.slock.state != STATE_LEADER {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
         }
 
         if lock_command.DbId == 0xff {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
 
         db := self.slock.dbs[lock_command.DbId]
         if db == nil {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
-        err := db.UnLock(self, lock_command)
+        err := self.slock.DoUnLockComamnd(db, self, lock_command)
         if err != nil {
             return err
         }
@@ -548,6 +711,18 @@ func (self *BinaryServerProtocol) ProcessParse(buf []byte) error {
             command = &protocol.PingCommand{}
         case protocol.COMMAND_QUIT:
             command = &protocol.QuitCommand{}
+        case protocol.COMMAND_SYNC:
+            command = &protocol.SyncCommand{}
+        case protocol.COMMAND_RAFT_VOTE:
+            command = &protocol.RaftVoteCommand{}
+        case protocol.COMMAND_RAFT_APPEND:
+            command = &protocol.RaftAppendCommand{}
+        case protocol.COMMAND_SNAPSHOT:
+            command = &protocol.SnapshotCommand{}
+        case protocol.COMMAND_MULTI_LOCK, protocol.COMMAND_MULTI_UNLOCK:
+            command = &protocol.MultiLockCommand{}
+        case protocol.COMMAND_RENEW, protocol.COMMAND_CANCEL, protocol.COMMAND_QUERY:
+            command = self.GetLockCommand()
         default:
             command = &protocol.Command{}
         }
@@ -555,6 +730,31 @@ func (self *BinaryServerProtocol) ProcessParse(buf []byte) error {
         if err != nil {
             return err
         }
+
+        if multi_lock_command, ok := command.(*protocol.MultiLockCommand); ok {
+            err = self.ReadMultiLockKeys(multi_lock_command)
+            if err != nil {
+                return err
+            }
+        }
+
+        if admin_command, ok := command.(*protocol.AdminCommand); ok {
+            err = self.ReadAdminArgs(admin_command)
+            if err != nil {
+                return err
+            }
+        }
+
+        if lock_command, ok := command.(*protocol.LockCommand); ok {
+            if lock_command.Version == protocol.VERSION2 {
+                err = self.ReadLockName(lock_command)
+                if err != nil {
+                    return err
+                }
+            } else {
+                lock_command.LockName = ""
+            }
+        }
         err = self.ProcessCommad(command)
         if err != nil {
             return err
@@ -573,42 +773,42 @@ func (self *BinaryServerProtocol) ProcessCommad(command protocol.ICommand) error
         lock_command := command.(*protocol.LockCommand)
 
         if self.slock.state != STATE_LEADER {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
         }
 
         if lock_command.DbId == 0xff {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
 
         db := self.slock.dbs[lock_command.DbId]
         if db == nil {
             db = self.slock.GetOrNewDB(lock_command.DbId)
         }
-        return db.Lock(self, lock_command)
+        return self.slock.DoLockComamnd(db, self, lock_command)
 
     case protocol.COMMAND_UNLOCK:
         lock_command := command.(*protocol.LockCommand)
 
         if self.slock.state != STATE_LEADER {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
         }
 
         if lock_command.DbId == 0xff {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
 
         db := self.slock.dbs[lock_command.DbId]
         if db == nil {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
-        return db.UnLock(self, lock_command)
+        return self.slock.DoUnLockComamnd(db, self, lock_command)
 
     default:
         switch command.GetCommandType() {
         case protocol.COMMAND_INIT:
             init_command := command.(*protocol.InitCommand)
             if self.Init(init_command.ClientId) != nil {
-                return self.Write(protocol.NewInitResultCommand(init_command, protocol.RESULT_ERROR, 0))
+                return self.Write(protocol.NewInitResultCommand(init_command, protocol.RESULT_ERROR, 0, self.slock.GetCapabilities(), VERSION))
             }
             self.slock.glock.Lock()
             init_type := uint8(0)
@@ -617,14 +817,18 @@ func (self *BinaryServerProtocol) ProcessCommad(command protocol.ICommand) error
             }
             self.slock.streams[init_command.ClientId] = self
             self.slock.glock.Unlock()
-            return self.Write(protocol.NewInitResultCommand(init_command, protocol.RESULT_SUCCED, init_type))
+            return self.Write(protocol.NewInitResultCommand(init_command, protocol.RESULT_SUCCED, init_type, self.slock.GetCapabilities(), VERSION))
 
         case protocol.COMMAND_STATE:
             return self.slock.GetState(self, command.(*protocol.StateCommand))
 
         case protocol.COMMAND_ADMIN:
             admin_command := command.(*protocol.AdminCommand)
-            err := self.Write(protocol.NewAdminResultCommand(admin_command, protocol.RESULT_SUCCED))
+            if admin_command.AdminType != protocol.ADMIN_COMMAND_TEXT {
+                return self.slock.GetAdmin().ProcessBinaryCommand(self, admin_command)
+            }
+
+            err := self.Write(protocol.NewAdminResultCommand(admin_command, protocol.RESULT_SUCCED, nil))
             if err != nil {
                 return err
             }
@@ -657,6 +861,110 @@ func (self *BinaryServerProtocol) ProcessCommad(command protocol.ICommand) error
             }
             return err
 
+        case protocol.COMMAND_SYNC:
+            sync_command := command.(*protocol.SyncCommand)
+            if self.slock.state != STATE_LEADER {
+                return self.Write(protocol.NewSyncResultCommand(sync_command, protocol.RESULT_STATE_ERROR, 0, 0, 0))
+            }
+
+            replication_server := NewReplicationServer(self.slock, self)
+            return replication_server.Handle(sync_command)
+
+        case protocol.COMMAND_RAFT_VOTE:
+            raft_vote_command := command.(*protocol.RaftVoteCommand)
+            if self.slock.raft == nil {
+                return self.Write(protocol.NewRaftVoteResultCommand(raft_vote_command, protocol.RESULT_STATE_ERROR, 0, 0))
+            }
+            return self.slock.raft.HandleVote(self, raft_vote_command)
+
+        case protocol.COMMAND_RAFT_APPEND:
+            raft_append_command := command.(*protocol.RaftAppendCommand)
+            if self.slock.raft == nil {
+                return self.Write(protocol.NewRaftAppendResultCommand(raft_append_command, protocol.RESULT_STATE_ERROR, 0, 0, 0))
+            }
+            return self.slock.raft.HandleAppend(self, raft_append_command)
+
+        case protocol.COMMAND_SNAPSHOT:
+            snapshot_command := command.(*protocol.SnapshotCommand)
+            if self.slock.state != STATE_LEADER {
+                return self.Write(protocol.NewSnapshotResultCommand(snapshot_command, protocol.RESULT_STATE_ERROR, 0, 0, 0))
+            }
+
+            replication_server := NewReplicationServer(self.slock, self)
+            return replication_server.HandleSnapshot(snapshot_command)
+
+        case protocol.COMMAND_MULTI_LOCK, protocol.COMMAND_MULTI_UNLOCK:
+            multi_lock_command := command.(*protocol.MultiLockCommand)
+            if self.slock.state != STATE_LEADER {
+                return self.Write(protocol.NewMultiLockResultCommand(multi_lock_command, protocol.RESULT_STATE_ERROR, [16]byte{}, 0, nil))
+            }
+
+            if multi_lock_command.DbId == 0xff {
+                return self.Write(protocol.NewMultiLockResultCommand(multi_lock_command, protocol.RESULT_UNKNOWN_DB, [16]byte{}, 0, nil))
+            }
+
+            db := self.slock.dbs[multi_lock_command.DbId]
+            if db == nil {
+                if multi_lock_command.CommandType == protocol.COMMAND_MULTI_UNLOCK {
+                    return self.Write(protocol.NewMultiLockResultCommand(multi_lock_command, protocol.RESULT_UNKNOWN_DB, [16]byte{}, 0, nil))
+                }
+                db = self.slock.GetOrNewDB(multi_lock_command.DbId)
+            }
+
+            go func() {
+                result, lock_key, tokens := self.slock.DoMultiLockComamnd(db, multi_lock_command)
+                lcount := uint16(0)
+                if result == protocol.RESULT_SUCCED {
+                    lcount = multi_lock_command.KeyCount
+                }
+
+                self.Lock()
+                err := self.Write(protocol.NewMultiLockResultCommand(multi_lock_command, result, lock_key, lcount, tokens))
+                self.Unlock()
+                if err != nil {
+                    self.slock.Log().Errorf("Protocol Write MultiLock Result Error: %s %v", self.RemoteAddr().String(), err)
+                }
+            }()
+            return nil
+
+        case protocol.COMMAND_RENEW:
+            lock_command := command.(*protocol.LockCommand)
+            if self.slock.state != STATE_LEADER {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
+            }
+
+            if lock_command.DbId == 0xff {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            }
+
+            db := self.slock.dbs[lock_command.DbId]
+            if db == nil {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            }
+            return self.slock.DoRenewComamnd(db, self, lock_command)
+
+        case protocol.COMMAND_CANCEL:
+            lock_command := command.(*protocol.LockCommand)
+            if self.slock.state != STATE_LEADER {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
+            }
+
+            if lock_command.DbId == 0xff {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            }
+
+            db := self.slock.dbs[lock_command.DbId]
+            if db == nil {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            }
+            return self.slock.DoCancelComamnd(db, self, lock_command)
+
+        case protocol.COMMAND_QUERY:
+            lock_command := command.(*protocol.LockCommand)
+            err := self.slock.GetQuery(self, lock_command)
+            self.FreeLockCommand(lock_command)
+            return err
+
         default:
             return self.Write(protocol.NewResultCommand(command, protocol.RESULT_UNKNOWN_COMMAND))
         }
@@ -665,11 +973,11 @@ func (self *BinaryServerProtocol) ProcessCommad(command protocol.ICommand) error
 
 func (self *BinaryServerProtocol) ProcessLockCommand(lock_command *protocol.LockCommand) error {
     if self.slock.state != STATE_LEADER {
-        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0)
+        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
     }
 
     if lock_command.DbId == 0xff {
-        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
     }
 
     db := self.slock.dbs[lock_command.DbId]
@@ -677,16 +985,20 @@ func (self *BinaryServerProtocol) ProcessLockCommand(lock_command *protocol.Lock
         if db == nil {
             db = self.slock.GetOrNewDB(lock_command.DbId)
         }
-        return db.Lock(self, lock_command)
+        return self.slock.DoLockComamnd(db, self, lock_command)
     }
 
     if db == nil {
-        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
     }
-    return db.UnLock(self, lock_command)
+
+    if lock_command.CommandType == protocol.COMMAND_RENEW {
+        return self.slock.DoRenewComamnd(db, self, lock_command)
+    }
+    return self.slock.DoUnLockComamnd(db, self, lock_command)
 }
 
-func (self *BinaryServerProtocol) ProcessLockResultCommand(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8) error {
+func (self *BinaryServerProtocol) ProcessLockResultCommand(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8, token uint64) error {
     if self.closed {
         if !self.inited {
             return errors.New("Protocol Closed")
@@ -695,7 +1007,7 @@ func (self *BinaryServerProtocol) ProcessLockResultCommand(command *protocol.Loc
         self.slock.glock.Lock()
         if server_protocol, ok := self.slock.streams[self.client_id]; ok {
             self.slock.glock.Unlock()
-            return server_protocol.ProcessLockResultCommandLocked(command, result, lcount, lrcount)
+            return server_protocol.ProcessLockResultCommandLocked(command, result, lcount, lrcount, token)
         } else {
             self.slock.glock.Unlock()
             return errors.New("Protocol Closed")
@@ -703,13 +1015,19 @@ func (self *BinaryServerProtocol) ProcessLockResultCommand(command *protocol.Loc
     }
 
     self.glock.Lock()
-    buf := self.wbuf
+    buf := self.wbuf[:64]
+    if command.Version == protocol.VERSION2 {
+        buf = self.wbuf[:72]
+    }
     if len(buf) < 64 {
         self.glock.Unlock()
         return errors.New("buf too short")
     }
 
-    buf[2] = byte(command.CommandType)
+    buf[1], buf[2] = byte(protocol.VERSION), byte(command.CommandType)
+    if command.Version == protocol.VERSION2 {
+        buf[1] = byte(protocol.VERSION2)
+    }
 
     buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10],
         buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] =
@@ -731,14 +1049,25 @@ func (self *BinaryServerProtocol) ProcessLockResultCommand(command *protocol.Loc
     buf[54], buf[55], buf[56], buf[57], buf[58], buf[59], buf[60], buf[61] = byte(lcount), byte(lcount >> 8), byte(command.Count), byte(command.Count >> 8), byte(lrcount), byte(command.Rcount), 0x00, 0x00
     buf[62], buf[63] = 0x00, 0x00
 
+    if result == protocol.RESULT_STATE_ERROR && self.slock.raft != nil {
+        leader_ip, leader_port := self.slock.raft.GetLeaderHint()
+        buf[54], buf[55] = byte(leader_port), byte(leader_port >> 8)
+        buf[60], buf[61], buf[62], buf[63] = leader_ip[0], leader_ip[1], leader_ip[2], leader_ip[3]
+    }
+
+    if command.Version == protocol.VERSION2 {
+        buf[64], buf[65], buf[66], buf[67], buf[68], buf[69], buf[70], buf[71] = byte(token), byte(token >> 8), byte(token >> 16), byte(token >> 24),
+            byte(token >> 32), byte(token >> 40), byte(token >> 48), byte(token >> 56)
+    }
+
     n, err := self.stream.conn.Write(buf)
     if err != nil {
         self.glock.Unlock()
         return err
     }
 
-    if n < 64 {
-        for ; n < 64; {
+    if n < len(buf) {
+        for ; n < len(buf); {
             nn, nerr := self.stream.conn.Write(buf[n:])
             if nerr != nil {
                 self.glock.Unlock()
@@ -751,8 +1080,8 @@ func (self *BinaryServerProtocol) ProcessLockResultCommand(command *protocol.Loc
     return nil
 }
 
-func (self *BinaryServerProtocol) ProcessLockResultCommandLocked(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8) error {
-    return self.ProcessLockResultCommand(command, result, lcount, lrcount)
+func (self *BinaryServerProtocol) ProcessLockResultCommandLocked(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8, token uint64) error {
+    return self.ProcessLockResultCommand(command, result, lcount, lrcount, token)
 }
 
 func (self *BinaryServerProtocol) GetStream() *Stream {
@@ -864,11 +1193,14 @@ func (self *BinaryServerProtocol) FreeLockCommandLocked(command *protocol.LockCo
     return nil
 }
 
+const MAX_TEXT_INLINE_COMMAND_LENGTH = 0x10000
+
 type TextServerProtocolParser struct {
     buf         []byte
     wbuf        []byte
     args        []string
     carg        []byte
+    inline_buf  []byte
     buf_index   int
     buf_len     int
     stage       int
@@ -882,7 +1214,8 @@ func (self *TextServerProtocolParser) Parse() error {
         switch self.stage {
         case 0:
             if self.buf[self.buf_index] != '*' {
-                return errors.New("Command first byte must by *")
+                self.stage = 5
+                continue
             }
             self.buf_index++
             self.stage = 1
@@ -993,6 +1326,27 @@ func (self *TextServerProtocolParser) Parse() error {
             if self.stage == 4 {
                 return nil
             }
+        case 5:
+            start_index := self.buf_index
+            for ; self.buf_index < self.buf_len && self.buf[self.buf_index] != '\n'; self.buf_index++ {
+            }
+
+            if len(self.inline_buf) + self.buf_index - start_index > MAX_TEXT_INLINE_COMMAND_LENGTH {
+                return errors.New("Command parse inline length error")
+            }
+            self.inline_buf = append(self.inline_buf, self.buf[start_index:self.buf_index]...)
+            if self.buf_index == self.buf_len {
+                return nil
+            }
+
+            self.buf_index++
+            self.args = append(self.args, strings.Fields(string(self.inline_buf))...)
+            self.args_count = len(self.args)
+            self.inline_buf = self.inline_buf[:0]
+            self.stage = 0
+            if self.args_count > 0 {
+                return nil
+            }
         }
     }
     return nil
@@ -1022,16 +1376,21 @@ func (self *TextServerProtocolParser) Build(is_success bool, err_msg string, res
 
 type TextServerProtocolCommandHandler func(*TextServerProtocol, []string) error
 
+type TextServerProtocolLockReply struct {
+    request_id                  [16]byte
+    result                      *protocol.LockResultCommand
+    buf                         []byte
+}
+
 type TextServerProtocol struct {
     slock                       *SLock
     glock                       *sync.Mutex
     stream                      *Stream
     free_commands               *LockCommandQueue
-    free_command_result         *protocol.LockResultCommand
     parser                      *TextServerProtocolParser
     handlers                    map[string]TextServerProtocolCommandHandler
-    lock_waiter                 chan *protocol.LockResultCommand
-    lock_request_id             [16]byte
+    lock_replys                 []*TextServerProtocolLockReply
+    lock_waiter                 chan bool
     lock_id                     [16]byte
     total_command_count         uint64
     db_id                       uint8
@@ -1040,15 +1399,18 @@ type TextServerProtocol struct {
 
 func NewTextServerProtocol(slock *SLock, stream *Stream) *TextServerProtocol {
     parser := &TextServerProtocolParser{make([]byte, 1024), make([]byte, 1024), make([]string, 0), make([]byte, 64),
-        0, 0, 0, 0, 0, 0}
+        make([]byte, 0), 0, 0, 0, 0, 0, 0}
     server_protocol := &TextServerProtocol{slock, &sync.Mutex{}, stream, NewLockCommandQueue(4, 16, FREE_COMMAND_QUEUE_INIT_SIZE),
-        nil, parser, make(map[string]TextServerProtocolCommandHandler, 64), make(chan *protocol.LockResultCommand, 4),
-        [16]byte{}, [16]byte{}, 0, 0, false}
+        parser, make(map[string]TextServerProtocolCommandHandler, 64), make([]*TextServerProtocolLockReply, 0), make(chan bool, 1),
+        [16]byte{}, 0, 0, false}
     server_protocol.InitLockCommand()
 
     server_protocol.handlers["SELECT"] = server_protocol.CommandHandlerSelectDB
     server_protocol.handlers["LOCK"] = server_protocol.CommandHandlerLock
     server_protocol.handlers["UNLOCK"] = server_protocol.CommandHandlerUnlock
+    server_protocol.handlers["RENEW"] = server_protocol.CommandHandlerRenew
+    server_protocol.handlers["MLOCK"] = server_protocol.CommandHandlerMultiLock
+    server_protocol.handlers["MUNLOCK"] = server_protocol.CommandHandlerMultiUnlock
     for name, handler := range slock.GetAdmin().GetHandlers() {
         server_protocol.handlers[name] = handler
     }
@@ -1090,6 +1452,11 @@ func (self *TextServerProtocol) Close() error {
 
     self.UnInitLockCommand()
     self.closed = true
+    self.lock_replys = self.lock_replys[:0]
+    select {
+    case self.lock_waiter <- true:
+    default:
+    }
     return nil
 }
 
@@ -1110,7 +1477,7 @@ func (self *TextServerProtocol) Read() (protocol.CommandDecode, error) {
             return nil, err
         }
 
-        if self.parser.stage == 0 {
+        if self.parser.stage == 0 && len(self.parser.args) > 0 {
             command_name := strings.ToUpper(self.parser.args[0])
             if command_name == "LOCK" || command_name == "UNLOCK" {
                 if len(self.parser.args) < 5 {
@@ -1173,19 +1540,10 @@ func (self *TextServerProtocol) Process() error {
             return err
         }
 
-        if self.parser.stage == 0 {
-            self.total_command_count++
-            command_name := strings.ToUpper(self.parser.args[0])
-            if command_handler, ok := self.handlers[command_name]; ok {
-                err := command_handler(self, self.parser.args)
-                if err != nil {
-                    return err
-                }
-            } else {
-                err := self.CommandHandlerUnknownCommand(self, self.parser.args)
-                if err != nil {
-                    return err
-                }
+        if self.parser.stage == 0 && len(self.parser.args) > 0 {
+            err := self.ProcessArgs(self.parser.args)
+            if err != nil {
+                return err
             }
 
             self.parser.args = self.parser.args[:0]
@@ -1203,19 +1561,10 @@ func (self *TextServerProtocol) ProcessParse(buf []byte) error {
         return err
     }
 
-    if self.parser.stage == 0 {
-        self.total_command_count++
-        command_name := strings.ToUpper(self.parser.args[0])
-        if command_handler, ok := self.handlers[command_name]; ok {
-            err := command_handler(self, self.parser.args)
-            if err != nil {
-                return err
-            }
-        } else {
-            err := self.CommandHandlerUnknownCommand(self, self.parser.args)
-            if err != nil {
-                return err
-            }
+    if self.parser.stage == 0 && len(self.parser.args) > 0 {
+        err := self.ProcessArgs(self.parser.args)
+        if err != nil {
+            return err
         }
 
         self.parser.args = self.parser.args[:0]
@@ -1224,6 +1573,129 @@ func (self *TextServerProtocol) ProcessParse(buf []byte) error {
     return nil
 }
 
+func (self *TextServerProtocol) ProcessArgs(args []string) error {
+    self.total_command_count++
+    command_name := strings.ToUpper(args[0])
+    switch command_name {
+    case "UNLOCK", "RENEW":
+        err := self.WaitLockArgs(args)
+        if err != nil {
+            return err
+        }
+    case "MLOCK", "MUNLOCK", "QUIT", "SHUTDOWN":
+        err := self.WaitLockReplys()
+        if err != nil {
+            return err
+        }
+    }
+
+    if command_handler, ok := self.handlers[command_name]; ok {
+        return command_handler(self, args)
+    }
+    return self.CommandHandlerUnknownCommand(self, args)
+}
+
+func (self *TextServerProtocol) WaitLockArgs(args []string) error {
+    for i := 2; i < len(args); i+= 2 {
+        if strings.ToUpper(args[i]) == "LOCK_ID" {
+            return nil
+        }
+    }
+    return self.WaitLockReplys()
+}
+
+func (self *TextServerProtocol) WaitLockReplys() error {
+    for ; !self.closed; {
+        self.glock.Lock()
+        waited := len(self.lock_replys) > 0
+        self.glock.Unlock()
+
+        if !waited {
+            return nil
+        }
+        <- self.lock_waiter
+    }
+    return errors.New("Protocol Closed")
+}
+
+func (self *TextServerProtocol) AddLockReply(lock_command *protocol.LockCommand) {
+    self.glock.Lock()
+    self.lock_replys = append(self.lock_replys, &TextServerProtocolLockReply{lock_command.RequestId, nil, nil})
+    self.glock.Unlock()
+}
+
+func (self *TextServerProtocol) WriteReply(request_id [16]byte, buf []byte) error {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+
+    if self.closed {
+        return errors.New("Protocol Closed")
+    }
+
+    for _, lock_reply := range self.lock_replys {
+        if lock_reply.request_id == request_id && lock_reply.result == nil && lock_reply.buf == nil {
+            lock_reply.buf = buf
+            return self.FlushLockReplys()
+        }
+    }
+
+    if len(self.lock_replys) == 0 {
+        return self.stream.WriteBytes(buf)
+    }
+    self.lock_replys = append(self.lock_replys, &TextServerProtocolLockReply{request_id, nil, buf})
+    return self.FlushLockReplys()
+}
+
+func (self *TextServerProtocol) WriteBytes(buf []byte) error {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+
+    if self.closed {
+        return errors.New("Protocol Closed")
+    }
+
+    if len(self.lock_replys) == 0 {
+        return self.stream.WriteBytes(buf)
+    }
+    self.lock_replys = append(self.lock_replys, &TextServerProtocolLockReply{[16]byte{}, nil, buf})
+    return self.FlushLockReplys()
+}
+
+func (self *TextServerProtocol) FlushLockReplys() error {
+    buf := make([]byte, 0, 256)
+    flushed_count := 0
+    for _, lock_reply := range self.lock_replys {
+        if lock_reply.buf != nil {
+            buf = append(buf, lock_reply.buf...)
+        } else if lock_reply.result != nil {
+            lock_command_result := lock_reply.result
+            if lock_command_result.Result == protocol.RESULT_SUCCED {
+                switch lock_command_result.CommandType {
+                case protocol.COMMAND_LOCK:
+                    self.lock_id = lock_command_result.LockId
+                case protocol.COMMAND_UNLOCK:
+                    self.lock_id = [16]byte{}
+                }
+            }
+            buf = append(buf, self.BuildLockResult(lock_command_result)...)
+        } else {
+            break
+        }
+        flushed_count++
+    }
+
+    if flushed_count == 0 {
+        return nil
+    }
+
+    self.lock_replys = append(self.lock_replys[:0], self.lock_replys[flushed_count:]...)
+    select {
+    case self.lock_waiter <- true:
+    default:
+    }
+    return self.stream.WriteBytes(buf)
+}
+
 func (self *TextServerProtocol) ProcessBuild(command protocol.ICommand) error {
     switch command.GetCommandType() {
     case protocol.COMMAND_LOCK:
@@ -1270,42 +1742,42 @@ func (self *TextServerProtocol) ProcessCommad(command protocol.ICommand) error {
         lock_command := command.(*protocol.LockCommand)
 
         if self.slock.state != STATE_LEADER {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
         }
 
         if lock_command.DbId == 0xff {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
 
         db := self.slock.dbs[lock_command.DbId]
         if db == nil {
             db = self.slock.GetOrNewDB(lock_command.DbId)
         }
-        return db.Lock(self, lock_command)
+        return self.slock.DoLockComamnd(db, self, lock_command)
 
     case protocol.COMMAND_UNLOCK:
         lock_command := command.(*protocol.LockCommand)
 
         if self.slock.state != STATE_LEADER {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
         }
 
         if lock_command.DbId == 0xff {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
 
         db := self.slock.dbs[lock_command.DbId]
         if db == nil {
-            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+            return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
         }
-        return db.UnLock(self, lock_command)
+        return self.slock.DoUnLockComamnd(db, self, lock_command)
 
     default:
         switch command.GetCommandType() {
         case protocol.COMMAND_INIT:
             init_command := command.(*protocol.InitCommand)
             if self.Init(init_command.ClientId) != nil {
-                return self.Write(protocol.NewInitResultCommand(init_command, protocol.RESULT_ERROR, 0))
+                return self.Write(protocol.NewInitResultCommand(init_command, protocol.RESULT_ERROR, 0, self.slock.GetCapabilities(), VERSION))
             }
             self.slock.glock.Lock()
             init_type := uint8(0)
@@ -1314,14 +1786,14 @@ func (self *TextServerProtocol) ProcessCommad(command protocol.ICommand) error {
             }
             self.slock.streams[init_command.ClientId] = self
             self.slock.glock.Unlock()
-            return self.Write(protocol.NewInitResultCommand(init_command, protocol.RESULT_SUCCED, init_type))
+            return self.Write(protocol.NewInitResultCommand(init_command, protocol.RESULT_SUCCED, init_type, self.slock.GetCapabilities(), VERSION))
 
         case protocol.COMMAND_STATE:
             return self.slock.GetState(self, command.(*protocol.StateCommand))
 
         case protocol.COMMAND_ADMIN:
             admin_command := command.(*protocol.AdminCommand)
-            err := self.Write(protocol.NewAdminResultCommand(admin_command, protocol.RESULT_SUCCED))
+            err := self.Write(protocol.NewAdminResultCommand(admin_command, protocol.RESULT_SUCCED, nil))
             if err != nil {
                 return err
             }
@@ -1354,6 +1826,44 @@ func (self *TextServerProtocol) ProcessCommad(command protocol.ICommand) error {
             }
             return err
 
+        case protocol.COMMAND_RENEW:
+            lock_command := command.(*protocol.LockCommand)
+            if self.slock.state != STATE_LEADER {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
+            }
+
+            if lock_command.DbId == 0xff {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            }
+
+            db := self.slock.dbs[lock_command.DbId]
+            if db == nil {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            }
+            return self.slock.DoRenewComamnd(db, self, lock_command)
+
+        case protocol.COMMAND_CANCEL:
+            lock_command := command.(*protocol.LockCommand)
+            if self.slock.state != STATE_LEADER {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
+            }
+
+            if lock_command.DbId == 0xff {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            }
+
+            db := self.slock.dbs[lock_command.DbId]
+            if db == nil {
+                return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            }
+            return self.slock.DoCancelComamnd(db, self, lock_command)
+
+        case protocol.COMMAND_QUERY:
+            lock_command := command.(*protocol.LockCommand)
+            err := self.slock.GetQuery(self, lock_command)
+            self.FreeLockCommand(lock_command)
+            return err
+
         default:
             return self.Write(protocol.NewResultCommand(command, protocol.RESULT_UNKNOWN_COMMAND))
         }
@@ -1362,11 +1872,11 @@ func (self *TextServerProtocol) ProcessCommad(command protocol.ICommand) error {
 
 func (self *TextServerProtocol) ProcessLockCommand(lock_command *protocol.LockCommand) error {
     if self.slock.state != STATE_LEADER {
-        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0)
+        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
     }
 
     if lock_command.DbId == 0xff {
-        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
     }
 
     db := self.slock.dbs[lock_command.DbId]
@@ -1374,54 +1884,38 @@ func (self *TextServerProtocol) ProcessLockCommand(lock_command *protocol.LockCo
         if db == nil {
             db = self.slock.GetOrNewDB(lock_command.DbId)
         }
-        return db.Lock(self, lock_command)
+        return self.slock.DoLockComamnd(db, self, lock_command)
     }
 
     if db == nil {
-        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0)
+        return self.ProcessLockResultCommand(lock_command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
     }
-    return db.UnLock(self, lock_command)
+
+    if lock_command.CommandType == protocol.COMMAND_RENEW {
+        return self.slock.DoRenewComamnd(db, self, lock_command)
+    }
+    return self.slock.DoUnLockComamnd(db, self, lock_command)
 }
 
-func (self *TextServerProtocol) ProcessLockResultCommand(lock_command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8) error {
-    self.lock_request_id[0], self.lock_request_id[1], self.lock_request_id[2], self.lock_request_id[3], self.lock_request_id[4], self.lock_request_id[5], self.lock_request_id[6], self.lock_request_id[7],
-        self.lock_request_id[8], self.lock_request_id[9], self.lock_request_id[10], self.lock_request_id[11], self.lock_request_id[12], self.lock_request_id[13], self.lock_request_id[14], self.lock_request_id[15] =
-        0, 0, 0, 0, 0, 0, 0, 0,
-        0, 0, 0, 0, 0, 0, 0, 0
+func (self *TextServerProtocol) ProcessLockResultCommand(lock_command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8, token uint64) error {
+    self.glock.Lock()
+    defer self.glock.Unlock()
 
-    if self.free_command_result == nil {
-        lock_result_commad := protocol.NewLockResultCommand(lock_command, result, 0, lcount, lock_command.Count, lrcount, lock_command.Rcount)
-        self.lock_waiter <- lock_result_commad
-        return nil
+    if self.closed {
+        return errors.New("Protocol Closed")
     }
 
-    lock_result_commad := self.free_command_result
-    lock_result_commad.CommandType = lock_command.CommandType
-    lock_result_commad.RequestId = lock_command.RequestId
-    lock_result_commad.Result = result
-    lock_result_commad.Flag = 0
-    lock_result_commad.DbId = lock_command.DbId
-    lock_result_commad.LockId = lock_command.LockId
-    lock_result_commad.LockKey = lock_command.LockKey
-    lock_result_commad.Lcount = lcount
-    lock_result_commad.Count = lock_command.Count
-    lock_result_commad.Lrcount = lrcount
-    lock_result_commad.Rcount = lock_command.Rcount
-    self.free_command_result = nil
-    self.lock_waiter <- lock_result_commad
+    for _, lock_reply := range self.lock_replys {
+        if lock_reply.request_id == lock_command.RequestId && lock_reply.result == nil && lock_reply.buf == nil {
+            lock_reply.result = protocol.NewTokenLockResultCommand(lock_command, result, 0, lcount, lock_command.Count, lrcount, lock_command.Rcount, token)
+            return self.FlushLockReplys()
+        }
+    }
     return nil
 }
 
-func (self *TextServerProtocol) ProcessLockResultCommandLocked(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8) error {
-    self.glock.Lock()
-    if command.RequestId != self.lock_request_id {
-        self.glock.Unlock()
-        return nil
-    }
-
-    err := self.ProcessLockResultCommand(command, result, lcount, lrcount)
-    self.glock.Unlock()
-    return err
+func (self *TextServerProtocol) ProcessLockResultCommandLocked(command *protocol.LockCommand, result uint8, lcount uint16, lrcount uint8, token uint64) error {
+    return self.ProcessLockResultCommand(command, result, lcount, lrcount, token)
 }
 
 func (self *TextServerProtocol) GetStream() *Stream {
@@ -1498,44 +1992,7 @@ func (self *TextServerProtocol) FreeLockCommandLocked(command *protocol.LockComm
 }
 
 func (self *TextServerProtocol) ArgsToLockComandParseId(arg_id string, lock_id *[16]byte) {
-    arg_len := len(arg_id)
-    if arg_len == 16 {
-        lock_id[0], lock_id[1], lock_id[2], lock_id[3], lock_id[4], lock_id[5], lock_id[6], lock_id[7], 
-            lock_id[8], lock_id[9], lock_id[10], lock_id[11], lock_id[12], lock_id[13], lock_id[14], lock_id[15] = 
-            byte(arg_id[0]), byte(arg_id[1]), byte(arg_id[2]), byte(arg_id[3]), byte(arg_id[4]), byte(arg_id[5]), byte(arg_id[6]), 
-            byte(arg_id[7]), byte(arg_id[8]), byte(arg_id[9]), byte(arg_id[10]), byte(arg_id[11]), byte(arg_id[12]), byte(arg_id[13]), byte(arg_id[14]), byte(arg_id[15])
-    } else if arg_len > 16 {
-        if arg_len == 32 {
-            v, err := hex.DecodeString(arg_id)
-            if err == nil {
-                lock_id[0], lock_id[1], lock_id[2], lock_id[3], lock_id[4], lock_id[5], lock_id[6], lock_id[7],
-                    lock_id[8], lock_id[9], lock_id[10], lock_id[11], lock_id[12], lock_id[13], lock_id[14], lock_id[15] =
-                    v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7],
-                    v[8], v[9], v[10], v[11], v[12], v[13], v[14], v[15]
-            } else {
-                v := md5.Sum([]byte(arg_id))
-                lock_id[0], lock_id[1], lock_id[2], lock_id[3], lock_id[4], lock_id[5], lock_id[6], lock_id[7],
-                    lock_id[8], lock_id[9], lock_id[10], lock_id[11], lock_id[12], lock_id[13], lock_id[14], lock_id[15] =
-                    v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7],
-                    v[8], v[9], v[10], v[11], v[12], v[13], v[14], v[15]
-            }
-        } else {
-            v := md5.Sum([]byte(arg_id))
-            lock_id[0], lock_id[1], lock_id[2], lock_id[3], lock_id[4], lock_id[5], lock_id[6], lock_id[7],
-                lock_id[8], lock_id[9], lock_id[10], lock_id[11], lock_id[12], lock_id[13], lock_id[14], lock_id[15] =
-                v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7],
-                v[8], v[9], v[10], v[11], v[12], v[13], v[14], v[15]
-        }
-    } else {
-        arg_index := 16 - arg_len
-        for i := 0; i < 16; i++ {
-            if i < arg_index {
-                lock_id[i] = 0
-            } else {
-                lock_id[i] = arg_id[i - arg_index]
-            }
-        }
-    }
+    protocol.LockNameToKey(arg_id, lock_id)
 }
 
 func (self *TextServerProtocol) ArgsToLockComand(args []string) (*protocol.LockCommand, error) {
@@ -1547,9 +2004,12 @@ func (self *TextServerProtocol) ArgsToLockComand(args []string) (*protocol.LockC
     command := self.GetLockCommand()
     command.Magic = protocol.MAGIC
     command.Version = protocol.VERSION
-    if command_name == "LOCK" {
+    switch command_name {
+    case "LOCK":
         command.CommandType = protocol.COMMAND_LOCK
-    } else {
+    case "RENEW":
+        command.CommandType = protocol.COMMAND_RENEW
+    default:
         command.CommandType = protocol.COMMAND_UNLOCK
     }
     command.RequestId = self.GetRequestId()
@@ -1558,12 +2018,16 @@ func (self *TextServerProtocol) ArgsToLockComand(args []string) (*protocol.LockC
     command.Timeout = 3
     command.TimeoutFlag = 0
     command.Expried = 60
+    if command.CommandType == protocol.COMMAND_RENEW {
+        command.Expried = 0
+    }
     command.ExpriedFlag = 0
     command.Count = 0
     command.Rcount = 0
+    command.LockName = args[1]
     self.ArgsToLockComandParseId(args[1], &command.LockKey)
 
-    has_lock_id := false
+    has_lock_id, priority := false, -1
     for i := 2; i < len(args); i+= 2 {
         switch strings.ToUpper(args[i]) {
         case "LOCK_ID":
@@ -1589,6 +2053,13 @@ func (self *TextServerProtocol) ArgsToLockComand(args []string) (*protocol.LockC
             }
             command.Expried = uint16(expried & 0xffff)
             command.ExpriedFlag = uint16(expried >> 16 & 0xffff)
+        case "EXPRIEDAT":
+            deadline, err := strconv.ParseInt(args[i + 1], 10, 64)
+            if err != nil || deadline - time.Now().Unix() > protocol.MAX_EXPRIED_DEADLINE_TIME {
+                return nil, errors.New("Command Parse EXPRIEDAT Error")
+            }
+            command.Expried = uint16(deadline & 0xffff)
+            command.ExpriedFlag = command.ExpriedFlag & 0x7b00 | 0x8000 | uint16(deadline >> 16 & 0xff)
         case "COUNT":
             count, err := strconv.Atoi(args[i + 1])
             if err != nil {
@@ -1601,9 +2072,19 @@ func (self *TextServerProtocol) ArgsToLockComand(args []string) (*protocol.LockC
                 return nil, errors.New("Command Parse RCOUNT Error")
             }
             command.Rcount = uint8(rcount)
+        case "PRIORITY":
+            wait_priority, err := strconv.Atoi(args[i + 1])
+            if err != nil || wait_priority < 0 || wait_priority > 0xff {
+                return nil, errors.New("Command Parse PRIORITY Error")
+            }
+            priority = wait_priority
         }
     }
 
+    if priority >= 0 {
+        command.TimeoutFlag = command.TimeoutFlag & 0xff00 | uint16(priority)
+    }
+
     if !has_lock_id {
         if command_name == "LOCK" {
             command.LockId = command.RequestId
@@ -1614,55 +2095,203 @@ func (self *TextServerProtocol) ArgsToLockComand(args []string) (*protocol.LockC
     return command, nil
 }
 
+func (self *TextServerProtocol) ArgsToMultiLockComand(args []string) (*protocol.MultiLockCommand, error) {
+    if len(args) < 3 {
+        return nil, errors.New("Command Parse Len Error")
+    }
+
+    key_count, err := strconv.Atoi(args[1])
+    if err != nil || key_count <= 0 || key_count > protocol.MAX_MULTI_LOCK_KEYS {
+        return nil, errors.New("Command Parse NUMKEYS Error")
+    }
+
+    if len(args) < key_count + 2 || (len(args) - key_count) % 2 != 0 {
+        return nil, errors.New("Command Parse Len Error")
+    }
+
+    command_name := strings.ToUpper(args[0])
+    command := &protocol.MultiLockCommand{}
+    command.Magic = protocol.MAGIC
+    command.Version = protocol.VERSION
+    if command_name == "MLOCK" {
+        command.CommandType = protocol.COMMAND_MULTI_LOCK
+    } else {
+        command.CommandType = protocol.COMMAND_MULTI_UNLOCK
+    }
+    command.RequestId = self.GetRequestId()
+    command.DbId = self.db_id
+    command.Flag = 0
+    command.Timeout = 3
+    command.TimeoutFlag = 0
+    command.Expried = 60
+    command.ExpriedFlag = 0
+    command.Count = 0
+    command.Rcount = 0
+    command.KeyCount = uint16(key_count)
+    command.LockKeys = make([][16]byte, key_count)
+    for i := 0; i < key_count; i++ {
+        self.ArgsToLockComandParseId(args[i + 2], &command.LockKeys[i])
+    }
+
+    has_lock_id := false
+    for i := key_count + 2; i < len(args); i+= 2 {
+        switch strings.ToUpper(args[i]) {
+        case "LOCK_ID":
+            self.ArgsToLockComandParseId(args[i + 1], &command.LockId)
+            has_lock_id = true
+        case "TIMEOUT":
+            timeout, err := strconv.Atoi(args[i + 1])
+            if err != nil {
+                return nil, errors.New("Command Parse TIMEOUT Error")
+            }
+            command.Timeout = uint16(timeout & 0xffff)
+            command.TimeoutFlag = uint16(timeout >> 16 & 0xffff)
+        case "EXPRIED":
+            expried, err := strconv.Atoi(args[i + 1])
+            if err != nil {
+                return nil, errors.New("Command Parse EXPRIED Error")
+            }
+            command.Expried = uint16(expried & 0xffff)
+            command.ExpriedFlag = uint16(expried >> 16 & 0xffff)
+        case "COUNT":
+            count, err := strconv.Atoi(args[i + 1])
+            if err != nil {
+                return nil, errors.New("Command Parse COUNT Error")
+            }
+            command.Count = uint16(count)
+        case "RCOUNT":
+            rcount, err := strconv.Atoi(args[i + 1])
+            if err != nil {
+                return nil, errors.New("Command Parse RCOUNT Error")
+            }
+            command.Rcount = uint8(rcount)
+        }
+    }
+
+    if !has_lock_id {
+        if command_name == "MLOCK" {
+            command.LockId = command.RequestId
+        } else {
+            command.LockId = self.lock_id
+        }
+    }
+    return command, nil
+}
+
 func (self *TextServerProtocol) CommandHandlerUnknownCommand(server_protocol *TextServerProtocol, args []string) error {
-    return self.stream.WriteBytes(self.parser.Build(false, "Unknown Command", nil))
+    return self.WriteBytes(self.parser.Build(false, "Unknown Command", nil))
 }
 
 func (self *TextServerProtocol) CommandHandlerSelectDB(server_protocol *TextServerProtocol, args []string) error {
     if len(args) < 2 {
-        return self.stream.WriteBytes(self.parser.Build(false, "Command Parse Len Error", nil))
+        return self.WriteBytes(self.parser.Build(false, "Command Parse Len Error", nil))
     }
 
     db_id, err := strconv.Atoi(args[1])
     if err != nil {
-        return self.stream.WriteBytes(self.parser.Build(false, "Command Parse DB_ID Error", nil))
+        return self.WriteBytes(self.parser.Build(false, "Command Parse DB_ID Error", nil))
     }
     self.db_id = uint8(db_id)
-    return self.stream.WriteBytes(self.parser.Build(true, "OK", nil))
+    return self.WriteBytes(self.parser.Build(true, "OK", nil))
 }
 
 func (self *TextServerProtocol) CommandHandlerLock(server_protocol *TextServerProtocol, args []string) error {
     lock_command, err := self.ArgsToLockComand(args)
     if err != nil {
-        return self.stream.WriteBytes(self.parser.Build(false, err.Error(), nil))
+        return self.WriteReply([16]byte{}, self.parser.Build(false, err.Error(), nil))
     }
 
     if self.slock.state != STATE_LEADER {
-        return self.stream.WriteBytes(self.parser.Build(false, "State Error", nil))
+        return self.WriteReply(lock_command.RequestId, self.parser.Build(false, "State Error", nil))
     }
 
     if lock_command.DbId == 0xff {
-        return self.stream.WriteBytes(self.parser.Build(false, "Uknown DB Error", nil))
+        return self.WriteReply(lock_command.RequestId, self.parser.Build(false, "Uknown DB Error", nil))
     }
 
     db := self.slock.dbs[lock_command.DbId]
     if db == nil {
         db = self.slock.GetOrNewDB(lock_command.DbId)
     }
-    self.lock_request_id = lock_command.RequestId
-    err = db.Lock(self, lock_command)
+    request_id := lock_command.RequestId
+    self.AddLockReply(lock_command)
+    err = self.slock.DoLockComamnd(db, self, lock_command)
+    if err != nil {
+        return self.WriteReply(request_id, self.parser.Build(false, "Lock Error", nil))
+    }
+    return nil
+}
+
+func (self *TextServerProtocol) CommandHandlerUnlock(server_protocol *TextServerProtocol, args []string) error {
+    lock_command, err := self.ArgsToLockComand(args)
+    if err != nil {
+        return self.WriteReply([16]byte{}, self.parser.Build(false, err.Error(), nil))
+    }
+
+    if self.slock.state != STATE_LEADER {
+        return self.WriteReply(lock_command.RequestId, self.parser.Build(false, "State Error", nil))
+    }
+
+    if lock_command.DbId == 0xff {
+        return self.WriteReply(lock_command.RequestId, self.parser.Build(false, "Uknown DB Error", nil))
+    }
+
+    db := self.slock.dbs[lock_command.DbId]
+    if db == nil {
+        return self.WriteReply(lock_command.RequestId, self.parser.Build(false, "Uknown DB Error", nil))
+    }
+    request_id := lock_command.RequestId
+    self.AddLockReply(lock_command)
+    err = self.slock.DoUnLockComamnd(db, self, lock_command)
+    if err != nil {
+        return self.WriteReply(request_id, self.parser.Build(false, "UnLock Error", nil))
+    }
+    return nil
+}
+
+func (self *TextServerProtocol) CommandHandlerRenew(server_protocol *TextServerProtocol, args []string) error {
+    lock_command, err := self.ArgsToLockComand(args)
+    if err != nil {
+        return self.WriteReply([16]byte{}, self.parser.Build(false, err.Error(), nil))
+    }
+
+    if self.slock.state != STATE_LEADER {
+        return self.WriteReply(lock_command.RequestId, self.parser.Build(false, "State Error", nil))
+    }
+
+    if lock_command.DbId == 0xff {
+        return self.WriteReply(lock_command.RequestId, self.parser.Build(false, "Uknown DB Error", nil))
+    }
+
+    db := self.slock.dbs[lock_command.DbId]
+    if db == nil {
+        return self.WriteReply(lock_command.RequestId, self.parser.Build(false, "Uknown DB Error", nil))
+    }
+    request_id := lock_command.RequestId
+    self.AddLockReply(lock_command)
+    err = self.slock.DoRenewComamnd(db, self, lock_command)
     if err != nil {
-        return self.stream.WriteBytes(self.parser.Build(false, "Lock Error", nil))
+        return self.WriteReply(request_id, self.parser.Build(false, "Renew Error", nil))
     }
-    lock_command_result := <- self.lock_waiter
-    if lock_command_result.Result == 0 {
-        self.lock_id = lock_command.LockId
+    return nil
+}
+
+func (self *TextServerProtocol) BuildLockResult(lock_command_result *protocol.LockResultCommand) []byte {
+    if lock_command_result.CommandType == protocol.COMMAND_RENEW {
+        results := []string{fmt.Sprintf("%d", lock_command_result.Result), protocol.ERROR_MSG[lock_command_result.Result],
+            "LOCK_ID", fmt.Sprintf("%x", lock_command_result.LockId), "LCOUNT", fmt.Sprintf("%d", lock_command_result.Lcount),
+            "LRCOUNT", fmt.Sprintf("%d", lock_command_result.Lrcount), "TOKEN", fmt.Sprintf("%d", lock_command_result.Token)}
+        return self.parser.Build(true, "", results)
     }
 
     buf_index := 0
     tr := ""
 
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte("*12\r\n"))
+    if lock_command_result.CommandType == protocol.COMMAND_LOCK {
+        buf_index += copy(self.parser.wbuf[buf_index:], []byte("*14\r\n"))
+    } else {
+        buf_index += copy(self.parser.wbuf[buf_index:], []byte("*12\r\n"))
+    }
 
     tr = fmt.Sprintf("%d", lock_command_result.Result)
     buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("$%d\r\n", len(tr))))
@@ -1698,13 +2327,20 @@ func (self *TextServerProtocol) CommandHandlerLock(server_protocol *TextServerPr
     buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("\r\n$%d\r\n", len(tr))))
     buf_index += copy(self.parser.wbuf[buf_index:], []byte(tr))
 
+    if lock_command_result.CommandType == protocol.COMMAND_LOCK {
+        buf_index += copy(self.parser.wbuf[buf_index:], []byte("\r\n$5\r\nTOKEN"))
+
+        tr = fmt.Sprintf("%d", lock_command_result.Token)
+        buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("\r\n$%d\r\n", len(tr))))
+        buf_index += copy(self.parser.wbuf[buf_index:], []byte(tr))
+    }
+
     buf_index += copy(self.parser.wbuf[buf_index:], []byte("\r\n"))
-    self.free_command_result = lock_command_result
-    return self.stream.WriteBytes(self.parser.wbuf[:buf_index])
+    return self.parser.wbuf[:buf_index]
 }
 
-func (self *TextServerProtocol) CommandHandlerUnlock(server_protocol *TextServerProtocol, args []string) error {
-    lock_command, err := self.ArgsToLockComand(args)
+func (self *TextServerProtocol) CommandHandlerMultiLock(server_protocol *TextServerProtocol, args []string) error {
+    multi_lock_command, err := self.ArgsToMultiLockComand(args)
     if err != nil {
         return self.stream.WriteBytes(self.parser.Build(false, err.Error(), nil))
     }
@@ -1713,70 +2349,66 @@ func (self *TextServerProtocol) CommandHandlerUnlock(server_protocol *TextServer
         return self.stream.WriteBytes(self.parser.Build(false, "State Error", nil))
     }
 
-    if lock_command.DbId == 0xff {
+    if multi_lock_command.DbId == 0xff {
         return self.stream.WriteBytes(self.parser.Build(false, "Uknown DB Error", nil))
     }
 
-    db := self.slock.dbs[lock_command.DbId]
+    db := self.slock.dbs[multi_lock_command.DbId]
     if db == nil {
-        return self.stream.WriteBytes(self.parser.Build(false, "Uknown DB Error", nil))
-    }
-    self.lock_request_id = lock_command.RequestId
-    err = db.UnLock(self, lock_command)
-    if err != nil {
-        return self.stream.WriteBytes(self.parser.Build(false, "UnLock Error", nil))
+        db = self.slock.GetOrNewDB(multi_lock_command.DbId)
     }
-    lock_command_result := <- self.lock_waiter
-    if lock_command_result.Result == 0 {
-        self.lock_id[0], self.lock_id[1], self.lock_id[2], self.lock_id[3], self.lock_id[4], self.lock_id[5], self.lock_id[6], self.lock_id[7],
-            self.lock_id[8], self.lock_id[9], self.lock_id[10], self.lock_id[11], self.lock_id[12], self.lock_id[13], self.lock_id[14], self.lock_id[15] = 
-                0, 0, 0, 0, 0, 0, 0, 0,
-                0, 0, 0, 0, 0, 0, 0, 0
-    }
-
-    buf_index := 0
-    tr := ""
-
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte("*12\r\n"))
-
-    tr = fmt.Sprintf("%d", lock_command_result.Result)
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("$%d\r\n", len(tr))))
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(tr))
-
-    tr = protocol.ERROR_MSG[lock_command_result.Result]
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("\r\n$%d\r\n", len(tr))))
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(tr))
 
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte("\r\n$7\r\nLOCK_ID\r\n$32\r\n"))
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("%x", lock_command_result.LockId)))
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte("\r\n$6\r\nLCOUNT"))
-
-    tr = fmt.Sprintf("%d", lock_command_result.Lcount)
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("\r\n$%d\r\n", len(tr))))
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(tr))
-
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte("\r\n$5\r\nCOUNT"))
+    result, lock_key, tokens := self.slock.DoMultiLockComamnd(db, multi_lock_command)
+    if result == protocol.RESULT_SUCCED {
+        self.lock_id = multi_lock_command.LockId
+    }
+    return self.stream.WriteBytes(self.parser.Build(true, "", self.BuildMultiLockResult(multi_lock_command, result, lock_key, tokens)))
+}
 
-    tr = fmt.Sprintf("%d", lock_command_result.Count)
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("\r\n$%d\r\n", len(tr))))
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(tr))
+func (self *TextServerProtocol) CommandHandlerMultiUnlock(server_protocol *TextServerProtocol, args []string) error {
+    multi_lock_command, err := self.ArgsToMultiLockComand(args)
+    if err != nil {
+        return self.stream.WriteBytes(self.parser.Build(false, err.Error(), nil))
+    }
 
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte("\r\n$7\r\nLRCOUNT"))
+    if self.slock.state != STATE_LEADER {
+        return self.stream.WriteBytes(self.parser.Build(false, "State Error", nil))
+    }
 
-    tr = fmt.Sprintf("%d", lock_command_result.Lrcount)
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("\r\n$%d\r\n", len(tr))))
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(tr))
+    if multi_lock_command.DbId == 0xff {
+        return self.stream.WriteBytes(self.parser.Build(false, "Uknown DB Error", nil))
+    }
 
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte("\r\n$6\r\nRCOUNT"))
+    db := self.slock.dbs[multi_lock_command.DbId]
+    if db == nil {
+        return self.stream.WriteBytes(self.parser.Build(false, "Uknown DB Error", nil))
+    }
 
-    tr = fmt.Sprintf("%d", lock_command_result.Rcount)
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(fmt.Sprintf("\r\n$%d\r\n", len(tr))))
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte(tr))
+    result, lock_key, _ := self.slock.DoMultiLockComamnd(db, multi_lock_command)
+    if result == protocol.RESULT_SUCCED {
+        self.lock_id = [16]byte{}
+    }
+    return self.stream.WriteBytes(self.parser.Build(true, "", self.BuildMultiLockResult(multi_lock_command, result, lock_key, nil)))
+}
 
-    buf_index += copy(self.parser.wbuf[buf_index:], []byte("\r\n"))
+func (self *TextServerProtocol) BuildMultiLockResult(multi_lock_command *protocol.MultiLockCommand, result uint8, lock_key [16]byte, tokens []uint64) []string {
+    lcount := uint16(0)
+    if result == protocol.RESULT_SUCCED {
+        lcount = multi_lock_command.KeyCount
+    }
 
-    self.free_command_result = lock_command_result
-    return self.stream.WriteBytes(self.parser.wbuf[:buf_index])
+    results := []string{fmt.Sprintf("%d", result), protocol.ERROR_MSG[result], "LOCK_ID", fmt.Sprintf("%x", multi_lock_command.LockId),
+        "LCOUNT", fmt.Sprintf("%d", lcount)}
+    if result != protocol.RESULT_SUCCED {
+        results = append(results, "LOCK_KEY", fmt.Sprintf("%x", lock_key))
+    } else if tokens != nil {
+        str_tokens := make([]string, len(tokens))
+        for i, token := range tokens {
+            str_tokens[i] = fmt.Sprintf("%d", token)
+        }
+        results = append(results, "TOKENS", strings.Join(str_tokens, ","))
+    }
+    return results
 }
 
 func (self *TextServerProtocol) GetRequestId() [16]byte {
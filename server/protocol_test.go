@@ -1,10 +1,21 @@
 package server
 
-import "testing"
+import (
+    "bufio"
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
 
 func TestTextServerProtocolParser_Parse(t *testing.T) {
     admin_parse := &TextServerProtocolParser{make([]byte, 1024), make([]byte, 1024), make([]string, 0), make([]byte, 64),
-        0, 0, 0, 0, 0, 0}
+        make([]byte, 0), 0, 0, 0, 0, 0, 0}
 
     data := []byte("*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n")
 
@@ -37,7 +48,7 @@ func TestTextServerProtocolParser_Parse(t *testing.T) {
 
 func TestTextServerProtocolParser_MultiParse(t *testing.T) {
     admin_parse := &TextServerProtocolParser{make([]byte, 1024), make([]byte, 1024), make([]string, 0), make([]byte, 64),
-        0, 0, 0, 0, 0, 0}
+        make([]byte, 0), 0, 0, 0, 0, 0, 0}
 
     datas := [][]byte{
         []byte("*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n*3\r\n$3\r\nSET\r"),
@@ -86,9 +97,60 @@ func TestTextServerProtocolParser_MultiParse(t *testing.T) {
     }
 }
 
+func TestTextServerProtocolParser_InlineParse(t *testing.T) {
+    admin_parse := &TextServerProtocolParser{make([]byte, 1024), make([]byte, 1024), make([]string, 0), make([]byte, 64),
+        make([]byte, 0), 0, 0, 0, 0, 0, 0}
+
+    datas := [][]byte{
+        []byte("SET mykey  myvalue\r\n\r\n*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\nSET my"),
+        []byte("key\tmyvalue\nSET mykey myvalue\r"),
+        []byte("\n"),
+    }
+
+    cmd_count := 0
+    for _, data := range datas {
+        copy(admin_parse.buf, data)
+        admin_parse.buf_len = len(data)
+        admin_parse.buf_index = 0
+
+        for ; admin_parse.buf_index < admin_parse.buf_len; {
+            err := admin_parse.Parse()
+            if err != nil {
+                t.Errorf("Admin Inline Parse Fail %v %v", err, admin_parse.args)
+                return
+            }
+
+            if admin_parse.stage != 0 || len(admin_parse.args) == 0 {
+                continue
+            }
+            cmd_count++
+
+            if len(admin_parse.args) != 3 {
+                t.Errorf("Admin Inline Parse Fail %v", admin_parse.args)
+                return
+            }
+
+            for i, arg := range []string{"SET", "mykey", "myvalue"} {
+                if admin_parse.args[i] != arg {
+                    t.Errorf("Admin Inline Parse Arg Fail %v %s", admin_parse.args, arg)
+                    return
+                }
+            }
+
+            admin_parse.args = admin_parse.args[:0]
+            admin_parse.args_count = 0
+        }
+    }
+
+    if cmd_count != 4 {
+        t.Errorf("Admin Inline Parse Count Fail %d", cmd_count)
+        return
+    }
+}
+
 func TestTextServerProtocolParser_Build(t *testing.T) {
     admin_parse := &TextServerProtocolParser{make([]byte, 1024), make([]byte, 1024), make([]string, 0), make([]byte, 64),
-        0, 0, 0, 0, 0, 0}
+        make([]byte, 0), 0, 0, 0, 0, 0, 0}
     r := admin_parse.Build(true, "OK", nil)
     if string(r) != "+OK\r\n" {
         t.Errorf("Admin Build Success Result Fail %s", string(r))
@@ -112,4 +174,92 @@ func TestTextServerProtocolParser_Build(t *testing.T) {
         t.Errorf("Admin Build Multi Result Fail %s", string(r))
         return
     }
-}
\ No newline at end of file
+}
+
+func readTestTextReply(reader *bufio.Reader) ([]string, error) {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+
+    line = strings.TrimRight(line, "\r\n")
+    switch line[0] {
+    case '*':
+        count, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+
+        results := make([]string, 0, count)
+        for i := 0; i < count; i++ {
+            result, err := readTestTextReply(reader)
+            if err != nil {
+                return nil, err
+            }
+            results = append(results, result...)
+        }
+        return results, nil
+    case '$':
+        size, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+
+        buf := make([]byte, size + 2)
+        _, err = io.ReadFull(reader, buf)
+        if err != nil {
+            return nil, err
+        }
+        return []string{string(buf[:size])}, nil
+    }
+    return []string{line}, nil
+}
+
+func TestTextServerProtocol_PipelineLock(t *testing.T) {
+    slock, data_dir := newTestAofSLock(t, "none")
+    defer os.RemoveAll(data_dir)
+    defer slock.Close()
+
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    protocol.LockNameToKey("pipeline_b", &lock_key)
+    protocol.LockNameToKey("pipeline_hold", &lock_id)
+    result := doTestAofLockCommand(slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("TextServerProtocol Pipeline Lock Error %v", result)
+        return
+    }
+
+    server_conn, client_conn := net.Pipe()
+    defer client_conn.Close()
+    server_protocol := NewTextServerProtocol(slock, NewStream(nil, server_conn))
+    defer server_protocol.Close()
+    go server_protocol.Process()
+
+    go client_conn.Write([]byte("LOCK pipeline_b LOCK_ID pipeline_wait TIMEOUT 5\r\nLOCK pipeline_a LOCK_ID pipeline_a\r\n" +
+        "PING\r\nUNLOCK pipeline_b LOCK_ID pipeline_hold\r\n"))
+    client_conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    reader := bufio.NewReader(client_conn)
+    lock_ids := []string{"pipeline_wait", "pipeline_a", "", "pipeline_hold"}
+    for i, lock_name := range lock_ids {
+        results, err := readTestTextReply(reader)
+        if err != nil {
+            t.Errorf("TextServerProtocol Pipeline Read Reply Error %d %v", i, err)
+            return
+        }
+
+        if lock_name == "" {
+            if results[0] != "+PONG" {
+                t.Errorf("TextServerProtocol Pipeline Ping Reply Error %d %v", i, results)
+                return
+            }
+            continue
+        }
+
+        reply_lock_id := [16]byte{}
+        protocol.LockNameToKey(lock_name, &reply_lock_id)
+        if len(results) < 4 || results[0] != "0" || results[3] != fmt.Sprintf("%x", reply_lock_id) {
+            t.Errorf("TextServerProtocol Pipeline Lock Reply Error %d %v", i, results)
+            return
+        }
+    }
+}
@@ -0,0 +1,1590 @@
+package server
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type RaftEntry struct {
+    Term        uint64
+    CommandTime uint64
+    CommandType uint8
+    Flag        uint8
+    DbId        uint8
+    RequestId   [16]byte
+    LockId      [16]byte
+    LockKey     [16]byte
+    Timeout     uint16
+    TimeoutFlag uint16
+    Expried     uint16
+    ExpriedFlag uint16
+    Count       uint16
+    Rcount      uint8
+    Token       uint64
+    LockName    string
+    buf         []byte
+}
+
+func NewRaftEntry(term uint64, command *protocol.LockCommand) *RaftEntry {
+    entry := &RaftEntry{term, uint64(time.Now().Unix()), protocol.COMMAND_INIT, 0, 0, [16]byte{}, [16]byte{}, [16]byte{},
+        0, 0, 0, 0, 0, 0, 0, "", nil}
+    if command != nil {
+        entry.CommandType = command.CommandType
+        entry.Flag, entry.DbId, entry.RequestId, entry.LockId, entry.LockKey = command.Flag, command.DbId, command.RequestId, command.LockId, command.LockKey
+        entry.Timeout, entry.TimeoutFlag, entry.Expried, entry.ExpriedFlag = command.Timeout, command.TimeoutFlag, command.Expried, command.ExpriedFlag
+        entry.Count, entry.Rcount, entry.LockName = command.Count, command.Rcount, command.LockName
+    }
+    entry.Encode()
+    return entry
+}
+
+func ReadRaftEntry(reader io.Reader) (*RaftEntry, error) {
+    entry := &RaftEntry{buf: make([]byte, 64)}
+    _, err := io.ReadFull(reader, entry.buf)
+    if err != nil {
+        return nil, err
+    }
+
+    size := (int(entry.buf[0]) | int(entry.buf[1])<<8) + 2
+    if size < 64 {
+        return nil, errors.New("Entry Len error")
+    }
+
+    if size > 64 {
+        buf := make([]byte, size)
+        copy(buf, entry.buf)
+        _, err = io.ReadFull(reader, buf[64:])
+        if err != nil {
+            if err == io.EOF {
+                err = io.ErrUnexpectedEOF
+            }
+            return nil, err
+        }
+        entry.buf = buf
+    }
+    return entry, entry.Decode()
+}
+
+func (self *RaftEntry) GetBuf() []byte {
+    return self.buf
+}
+
+func (self *RaftEntry) Decode() error {
+    buf := self.buf
+    if len(buf) < 64 {
+        return errors.New("Buffer Len error")
+    }
+
+    self.CommandType = buf[2]
+    self.Term = uint64(buf[3]) | uint64(buf[4])<<8 | uint64(buf[5])<<16 | uint64(buf[6])<<24 | uint64(buf[7])<<32 | uint64(buf[8])<<40 | uint64(buf[9])<<48 | uint64(buf[10])<<56
+    self.CommandTime = uint64(buf[11]) | uint64(buf[12])<<8 | uint64(buf[13])<<16 | uint64(buf[14])<<24 | uint64(buf[15])<<32 | uint64(buf[16])<<40 | uint64(buf[17])<<48 | uint64(buf[18])<<56
+
+    self.Flag, self.DbId = buf[19], buf[20]
+
+    self.LockId[0], self.LockId[1], self.LockId[2], self.LockId[3], self.LockId[4], self.LockId[5], self.LockId[6], self.LockId[7],
+        self.LockId[8], self.LockId[9], self.LockId[10], self.LockId[11], self.LockId[12], self.LockId[13], self.LockId[14], self.LockId[15] =
+        buf[21], buf[22], buf[23], buf[24], buf[25], buf[26], buf[27], buf[28],
+        buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35], buf[36]
+
+    self.LockKey[0], self.LockKey[1], self.LockKey[2], self.LockKey[3], self.LockKey[4], self.LockKey[5], self.LockKey[6], self.LockKey[7],
+        self.LockKey[8], self.LockKey[9], self.LockKey[10], self.LockKey[11], self.LockKey[12], self.LockKey[13], self.LockKey[14], self.LockKey[15] =
+        buf[37], buf[38], buf[39], buf[40], buf[41], buf[42], buf[43], buf[44],
+        buf[45], buf[46], buf[47], buf[48], buf[49], buf[50], buf[51], buf[52]
+
+    self.Timeout, self.TimeoutFlag, self.Expried, self.ExpriedFlag = uint16(buf[53])|uint16(buf[54])<<8, uint16(buf[55])|uint16(buf[56])<<8, uint16(buf[57])|uint16(buf[58])<<8, uint16(buf[59])|uint16(buf[60])<<8
+    self.Count, self.Rcount = uint16(buf[61])|uint16(buf[62])<<8, buf[63]
+
+    self.RequestId, self.Token, self.LockName = [16]byte{}, 0, ""
+    if len(buf) < 90 {
+        return nil
+    }
+
+    copy(self.RequestId[:], buf[64:80])
+    self.Token = uint64(buf[80]) | uint64(buf[81])<<8 | uint64(buf[82])<<16 | uint64(buf[83])<<24 | uint64(buf[84])<<32 | uint64(buf[85])<<40 | uint64(buf[86])<<48 | uint64(buf[87])<<56
+    name_len := int(buf[88]) | int(buf[89])<<8
+    if 90 + name_len > len(buf) {
+        return errors.New("Buffer Len error")
+    }
+    self.LockName = string(buf[90:90 + name_len])
+    return nil
+}
+
+func (self *RaftEntry) Encode() error {
+    name_len := len(self.LockName)
+    if name_len > 0xffff - 88 {
+        name_len = 0xffff - 88
+    }
+    if len(self.buf) != 90 + name_len {
+        self.buf = make([]byte, 90 + name_len)
+    }
+
+    buf := self.buf
+    buf[0], buf[1], buf[2] = byte(88 + name_len), byte((88 + name_len) >> 8), self.CommandType
+    buf[3], buf[4], buf[5], buf[6], buf[7], buf[8], buf[9], buf[10] = byte(self.Term), byte(self.Term >> 8), byte(self.Term >> 16), byte(self.Term >> 24), byte(self.Term >> 32), byte(self.Term >> 40), byte(self.Term >> 48), byte(self.Term >> 56)
+    buf[11], buf[12], buf[13], buf[14], buf[15], buf[16], buf[17], buf[18] = byte(self.CommandTime), byte(self.CommandTime >> 8), byte(self.CommandTime >> 16), byte(self.CommandTime >> 24), byte(self.CommandTime >> 32), byte(self.CommandTime >> 40), byte(self.CommandTime >> 48), byte(self.CommandTime >> 56)
+
+    buf[19], buf[20] = self.Flag, self.DbId
+
+    buf[21], buf[22], buf[23], buf[24], buf[25], buf[26], buf[27], buf[28],
+        buf[29], buf[30], buf[31], buf[32], buf[33], buf[34], buf[35], buf[36] =
+        self.LockId[0], self.LockId[1], self.LockId[2], self.LockId[3], self.LockId[4], self.LockId[5], self.LockId[6], self.LockId[7],
+        self.LockId[8], self.LockId[9], self.LockId[10], self.LockId[11], self.LockId[12], self.LockId[13], self.LockId[14], self.LockId[15]
+
+    buf[37], buf[38], buf[39], buf[40], buf[41], buf[42], buf[43], buf[44],
+        buf[45], buf[46], buf[47], buf[48], buf[49], buf[50], buf[51], buf[52] =
+        self.LockKey[0], self.LockKey[1], self.LockKey[2], self.LockKey[3], self.LockKey[4], self.LockKey[5], self.LockKey[6], self.LockKey[7],
+        self.LockKey[8], self.LockKey[9], self.LockKey[10], self.LockKey[11], self.LockKey[12], self.LockKey[13], self.LockKey[14], self.LockKey[15]
+
+    buf[53], buf[54], buf[55], buf[56], buf[57], buf[58], buf[59], buf[60] = byte(self.Timeout), byte(self.Timeout >> 8), byte(self.TimeoutFlag), byte(self.TimeoutFlag >> 8), byte(self.Expried), byte(self.Expried >> 8), byte(self.ExpriedFlag), byte(self.ExpriedFlag >> 8)
+    buf[61], buf[62], buf[63] = byte(self.Count), byte(self.Count >> 8), self.Rcount
+
+    copy(buf[64:80], self.RequestId[:])
+    buf[80], buf[81], buf[82], buf[83], buf[84], buf[85], buf[86], buf[87] = byte(self.Token), byte(self.Token >> 8), byte(self.Token >> 16), byte(self.Token >> 24), byte(self.Token >> 32), byte(self.Token >> 40), byte(self.Token >> 48), byte(self.Token >> 56)
+    buf[88], buf[89] = byte(name_len), byte(name_len >> 8)
+    copy(buf[90:], self.LockName[:name_len])
+    return nil
+}
+
+func (self *RaftEntry) GetExpried(now int64) uint32 {
+    expried := uint32(self.Expried) | uint32(self.ExpriedFlag & 0x00ff) << 16
+    if expried == 0 || self.ExpriedFlag & 0x4000 != 0 {
+        return expried
+    }
+
+    elapsed := now - int64(self.CommandTime)
+    if self.ExpriedFlag & 0x0400 != 0 {
+        elapsed = elapsed * 1000
+    }
+    if elapsed <= 0 {
+        return expried
+    }
+    if int64(expried) <= elapsed {
+        return 1
+    }
+    return uint32(int64(expried) - elapsed)
+}
+
+type RaftProposal struct {
+    server_protocol ServerProtocol
+    command         *protocol.LockCommand
+}
+
+type RaftNode struct {
+    raft            *Raft
+    glock           *sync.Mutex
+    node_id         uint8
+    address         string
+    stream          *Stream
+    rbuf            []byte
+    wbuf            []byte
+    next_index      uint64
+    match_index     uint64
+    snapshot_index  uint64
+    snapshot_offset int
+    append_waiter   chan bool
+}
+
+func NewRaftNode(raft *Raft, node_id uint8, address string) *RaftNode {
+    return &RaftNode{raft, &sync.Mutex{}, node_id, address, nil, make([]byte, 64), make([]byte, 64),
+        0, 0, 0, 0, make(chan bool, 1)}
+}
+
+func (self *RaftNode) Open() error {
+    conn, err := net.DialTimeout("tcp", self.address, RAFT_RPC_TIMEOUT)
+    if err != nil {
+        return err
+    }
+
+    stream := NewStream(nil, conn)
+    if stream == nil {
+        conn.Close()
+        return errors.New("Stream Init Error")
+    }
+    self.stream = stream
+    return nil
+}
+
+func (self *RaftNode) Close() error {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+
+    if self.stream != nil {
+        self.stream.Close()
+        self.stream = nil
+    }
+    return nil
+}
+
+func (self *RaftNode) Call(command protocol.CommandEncode, entries []*RaftEntry, result protocol.CommandDecode) error {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+
+    if self.stream == nil {
+        err := self.Open()
+        if err != nil {
+            return err
+        }
+    }
+
+    wlen := 64
+    for _, entry := range entries {
+        wlen += len(entry.GetBuf())
+    }
+    if len(self.wbuf) < wlen {
+        self.wbuf = make([]byte, wlen)
+    }
+
+    err := command.Encode(self.wbuf)
+    if err == nil {
+        offset := 64
+        for _, entry := range entries {
+            offset += copy(self.wbuf[offset:], entry.GetBuf())
+        }
+
+        self.stream.SetDeadline(time.Now().Add(RAFT_RPC_TIMEOUT))
+        err = self.stream.WriteBytes(self.wbuf[:wlen])
+        if err == nil {
+            _, err = self.stream.ReadBytes(self.rbuf)
+            if err == nil {
+                err = result.Decode(self.rbuf)
+            }
+        }
+    }
+
+    if err != nil {
+        self.stream.Close()
+        self.stream = nil
+    }
+    return err
+}
+
+func (self *RaftNode) RequestVote(term uint64, last_index uint64, last_term uint64) bool {
+    command := &protocol.RaftVoteCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION, CommandType: protocol.COMMAND_RAFT_VOTE, RequestId: self.raft.slock.GetAof().GetRequestId()},
+        Term: term, NodeId: self.raft.node_id, LastLogIndex: last_index, LastLogTerm: last_term}
+    result := &protocol.RaftVoteResultCommand{}
+    err := self.Call(command, nil, result)
+    if err != nil {
+        self.raft.slock.Log().Debugf("Raft Request Vote Error %s %v", self.address, err)
+        return false
+    }
+
+    if result.Result != protocol.RESULT_SUCCED {
+        return false
+    }
+
+    self.raft.glock.Lock()
+    if result.Term > self.raft.current_term {
+        self.raft.StepDown(result.Term)
+    }
+    self.raft.glock.Unlock()
+    return result.VoteGranted == 1
+}
+
+func (self *RaftNode) Append() {
+    raft := self.raft
+    raft.glock.Lock()
+    if raft.slock.state != STATE_LEADER {
+        raft.glock.Unlock()
+        return
+    }
+
+    flag, snapshot_offset := uint8(0), 0
+    term, prev_index := raft.current_term, self.next_index - 1
+    var entries []*RaftEntry = nil
+    if self.next_index <= raft.base_index {
+        if self.snapshot_index != raft.base_index {
+            self.snapshot_index, self.snapshot_offset = raft.base_index, 0
+        }
+
+        flag, prev_index = 0x01, raft.base_index
+        if self.snapshot_offset == 0 {
+            flag |= 0x02
+        }
+        snapshot_offset = self.snapshot_offset + RAFT_APPEND_MAX_ENTRIES
+        if snapshot_offset >= len(raft.snapshot_entries) {
+            snapshot_offset = len(raft.snapshot_entries)
+            flag |= 0x04
+        }
+        entries = make([]*RaftEntry, snapshot_offset - self.snapshot_offset)
+        copy(entries, raft.snapshot_entries[self.snapshot_offset:snapshot_offset])
+    } else {
+        entries = raft.GetEntries(self.next_index, RAFT_APPEND_MAX_ENTRIES)
+    }
+    prev_term := raft.GetTerm(prev_index)
+    commit_index := raft.commit_index
+    raft.glock.Unlock()
+
+    command := &protocol.RaftAppendCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION, CommandType: protocol.COMMAND_RAFT_APPEND, RequestId: raft.slock.GetAof().GetRequestId()},
+        Term: term, NodeId: raft.node_id, PrevLogIndex: prev_index, PrevLogTerm: prev_term, LeaderCommit: commit_index, EntryCount: uint16(len(entries)), Flag: flag}
+    result := &protocol.RaftAppendResultCommand{}
+    err := self.Call(command, entries, result)
+    if err != nil {
+        raft.slock.Log().Debugf("Raft Append Error %s %v", self.address, err)
+        return
+    }
+
+    if result.Result != protocol.RESULT_SUCCED {
+        return
+    }
+
+    raft.glock.Lock()
+    defer raft.glock.Unlock()
+
+    if result.Term > raft.current_term {
+        raft.StepDown(result.Term)
+        return
+    }
+
+    if raft.current_term != term || raft.slock.state != STATE_LEADER {
+        return
+    }
+
+    if flag & 0x01 != 0 {
+        if result.Success != 1 || self.snapshot_index != prev_index || raft.base_index != prev_index {
+            self.snapshot_offset = 0
+        } else if flag & 0x04 != 0 {
+            if prev_index > self.match_index {
+                self.match_index = prev_index
+            }
+            self.next_index, self.snapshot_offset = prev_index + 1, 0
+            raft.UpdateCommitIndex()
+        } else {
+            self.snapshot_offset = snapshot_offset
+        }
+        self.Active()
+        return
+    }
+
+    if result.Success == 1 {
+        if prev_index + uint64(len(entries)) > self.match_index {
+            self.match_index = prev_index + uint64(len(entries))
+        }
+        self.next_index = self.match_index + 1
+        raft.UpdateCommitIndex()
+    } else {
+        next_index := result.MatchIndex + 1
+        if next_index >= self.next_index {
+            next_index = self.next_index - 1
+        }
+        if next_index < 1 {
+            next_index = 1
+        }
+        self.next_index = next_index
+    }
+
+    if self.next_index <= raft.LastLogIndex() {
+        self.Active()
+    }
+}
+
+func (self *RaftNode) Active() {
+    select {
+    case self.append_waiter <- true:
+    default:
+    }
+}
+
+func (self *RaftNode) Run() {
+    for ; !self.raft.is_stop; {
+        select {
+        case <- self.append_waiter:
+        case <- time.After(RAFT_HEARTBEAT_TIME):
+        }
+
+        if self.raft.is_stop {
+            break
+        }
+
+        if self.raft.slock.state == STATE_LEADER {
+            self.Append()
+        }
+    }
+    self.Close()
+}
+
+type Raft struct {
+    slock               *SLock
+    glock               *sync.Mutex
+    nodes               []*RaftNode
+    node_id             uint8
+    leader_id           uint8
+    leader_ip           [4]byte
+    leader_port         uint16
+    current_term        uint64
+    voted_for           uint8
+    entries             []*RaftEntry
+    snapshot_entries    []*RaftEntry
+    receive_entries     []*RaftEntry
+    install_entries     []*RaftEntry
+    base_index          uint64
+    base_term           uint64
+    commit_index        uint64
+    last_applied        uint64
+    proposals           map[uint64]*RaftProposal
+    data_dir            string
+    log_file            *os.File
+    log_wbuf            *bufio.Writer
+    log_dirty           bool
+    heartbeat_time      time.Time
+    election_timeout    time.Duration
+    apply_waiter        chan bool
+    server_protocol     *MemWaiterServerProtocol
+    is_stop             bool
+}
+
+func NewRaft(slock *SLock) (*Raft, error) {
+    raft := &Raft{slock, &sync.Mutex{}, make([]*RaftNode, 0), 0xff, 0xff, [4]byte{}, 0, 0, 0xff,
+        make([]*RaftEntry, 0), make([]*RaftEntry, 0), nil, nil, 0, 0, 0, 0, make(map[uint64]*RaftProposal, 4096), "", nil,
+        nil, false, time.Now(), RAFT_ELECTION_TIMEOUT, make(chan bool, 1), nil, false}
+
+    address := Config.ClusterAddress
+    if address == "" {
+        address = net.JoinHostPort(Config.Bind, fmt.Sprintf("%d", Config.Port))
+    }
+
+    for _, node_address := range strings.Split(Config.Cluster, ",") {
+        node_address = strings.TrimSpace(node_address)
+        if node_address == "" {
+            continue
+        }
+
+        node := NewRaftNode(raft, uint8(len(raft.nodes)), node_address)
+        if node_address == address {
+            raft.node_id = node.node_id
+        }
+        raft.nodes = append(raft.nodes, node)
+    }
+
+    if len(raft.nodes) == 0 || len(raft.nodes) > 0xfe {
+        return nil, errors.New("Cluster Node Count Error")
+    }
+
+    if raft.node_id == 0xff {
+        return nil, errors.New("Cluster Address Not In Cluster Nodes")
+    }
+    return raft, nil
+}
+
+func (self *Raft) Init() error {
+    data_dir, err := filepath.Abs(Config.DataDir)
+    if err != nil {
+        return err
+    }
+    self.data_dir = data_dir
+
+    err = self.LoadState()
+    if err != nil {
+        return err
+    }
+
+    err = self.OpenLog()
+    if err != nil {
+        return err
+    }
+
+    snapshot_index, snapshot_term, err := self.LoadSnapshot()
+    if err != nil {
+        return err
+    }
+
+    if snapshot_index > self.base_index {
+        if snapshot_index < self.LastLogIndex() && self.GetTerm(snapshot_index) == snapshot_term {
+            entries := make([]*RaftEntry, self.LastLogIndex() - snapshot_index)
+            copy(entries, self.entries[snapshot_index - self.base_index:])
+            self.entries = entries
+        } else {
+            self.entries = make([]*RaftEntry, 0)
+        }
+        self.base_index, self.base_term = snapshot_index, snapshot_term
+        self.commit_index, self.last_applied = snapshot_index, snapshot_index
+        err = self.WriteLog()
+        if err != nil {
+            return err
+        }
+    }
+
+    self.server_protocol = NewMemWaiterServerProtocol(self.slock)
+    self.RestoreSnapshot(self.snapshot_entries)
+    self.ResetElectionTimeout()
+    self.slock.UpdateState(STATE_FOLLOWER)
+    self.slock.Log().Infof("Raft Init Node %d %s Term %d LastIndex %d", self.node_id, self.nodes[self.node_id].address, self.current_term, self.LastLogIndex())
+
+    for _, node := range self.nodes {
+        if node.node_id != self.node_id {
+            go node.Run()
+        }
+    }
+    go self.Run()
+    go self.ApplyRun()
+    return nil
+}
+
+func (self *Raft) Close() {
+    self.glock.Lock()
+    if self.is_stop {
+        self.glock.Unlock()
+        return
+    }
+
+    self.is_stop = true
+    self.slock.UpdateState(STATE_INIT)
+    self.FailProposals()
+    self.FlushLog()
+    if self.log_file != nil {
+        self.log_file.Close()
+        self.log_file = nil
+    }
+    self.glock.Unlock()
+
+    for _, node := range self.nodes {
+        node.Active()
+        node.Close()
+    }
+
+    select {
+    case self.apply_waiter <- true:
+    default:
+    }
+}
+
+func (self *Raft) LoadState() error {
+    buf, err := ioutil.ReadFile(filepath.Join(self.data_dir, "raft.state"))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return err
+    }
+
+    if len(buf) < 9 {
+        return errors.New("Raft State File Error")
+    }
+
+    self.current_term = uint64(buf[0]) | uint64(buf[1])<<8 | uint64(buf[2])<<16 | uint64(buf[3])<<24 | uint64(buf[4])<<32 | uint64(buf[5])<<40 | uint64(buf[6])<<48 | uint64(buf[7])<<56
+    self.voted_for = buf[8]
+    return nil
+}
+
+func (self *Raft) SaveState() error {
+    buf := make([]byte, 9)
+    buf[0], buf[1], buf[2], buf[3], buf[4], buf[5], buf[6], buf[7] = byte(self.current_term), byte(self.current_term >> 8), byte(self.current_term >> 16), byte(self.current_term >> 24), byte(self.current_term >> 32), byte(self.current_term >> 40), byte(self.current_term >> 48), byte(self.current_term >> 56)
+    buf[8] = self.voted_for
+
+    filename := filepath.Join(self.data_dir, "raft.state")
+    file, err := os.OpenFile(filename + ".tmp", os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        self.slock.Log().Errorf("Raft State Save Error %v", err)
+        return err
+    }
+
+    _, err = file.Write(buf)
+    if err == nil {
+        err = file.Sync()
+    }
+    file.Close()
+    if err == nil {
+        err = os.Rename(filename + ".tmp", filename)
+    }
+
+    if err != nil {
+        self.slock.Log().Errorf("Raft State Save Error %v", err)
+    }
+    return err
+}
+
+func (self *Raft) OpenLog() error {
+    filename := filepath.Join(self.data_dir, "raft.log")
+    if _, err := os.Stat(filename); os.IsNotExist(err) {
+        return self.WriteLog()
+    }
+
+    file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+    if err != nil {
+        return err
+    }
+
+    rbuf := bufio.NewReaderSize(file, int(Config.AofFileBufferSize))
+    header := make([]byte, 28)
+    _, err = io.ReadFull(rbuf, header)
+    if err != nil || string(header[:8]) != "SLOCKRFT" {
+        file.Close()
+        return errors.New("File is not Raft Log File")
+    }
+
+    self.base_index = uint64(header[12]) | uint64(header[13])<<8 | uint64(header[14])<<16 | uint64(header[15])<<24 | uint64(header[16])<<32 | uint64(header[17])<<40 | uint64(header[18])<<48 | uint64(header[19])<<56
+    self.base_term = uint64(header[20]) | uint64(header[21])<<8 | uint64(header[22])<<16 | uint64(header[23])<<24 | uint64(header[24])<<32 | uint64(header[25])<<40 | uint64(header[26])<<48 | uint64(header[27])<<56
+    self.entries = make([]*RaftEntry, 0)
+    for {
+        entry, err := ReadRaftEntry(rbuf)
+        if err != nil {
+            if err == io.ErrUnexpectedEOF {
+                self.slock.Log().Errorf("Raft Log Truncate Tail %d", len(self.entries))
+            } else if err != io.EOF {
+                self.slock.Log().Errorf("Raft Log Entry Len Error %d", len(self.entries))
+            }
+            break
+        }
+        self.entries = append(self.entries, entry)
+    }
+
+    size := self.LogSize()
+    err = file.Truncate(size)
+    if err == nil {
+        _, err = file.Seek(size, 0)
+    }
+    if err != nil {
+        file.Close()
+        return err
+    }
+
+    self.commit_index, self.last_applied = self.base_index, self.base_index
+    self.log_file = file
+    self.log_wbuf = bufio.NewWriterSize(file, int(Config.AofFileBufferSize))
+    return nil
+}
+
+func (self *Raft) WriteLog() error {
+    if self.log_file != nil {
+        self.FlushLog()
+        self.log_file.Close()
+        self.log_file = nil
+    }
+
+    filename := filepath.Join(self.data_dir, "raft.log")
+    file, err := os.OpenFile(filename + ".tmp", os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+
+    wbuf := bufio.NewWriterSize(file, int(Config.AofFileBufferSize))
+    header := make([]byte, 28)
+    copy(header, "SLOCKRFT")
+    header[8], header[9], header[10], header[11] = 0x02, 0x00, 16, 0x00
+    header[12], header[13], header[14], header[15], header[16], header[17], header[18], header[19] = byte(self.base_index), byte(self.base_index >> 8), byte(self.base_index >> 16), byte(self.base_index >> 24), byte(self.base_index >> 32), byte(self.base_index >> 40), byte(self.base_index >> 48), byte(self.base_index >> 56)
+    header[20], header[21], header[22], header[23], header[24], header[25], header[26], header[27] = byte(self.base_term), byte(self.base_term >> 8), byte(self.base_term >> 16), byte(self.base_term >> 24), byte(self.base_term >> 32), byte(self.base_term >> 40), byte(self.base_term >> 48), byte(self.base_term >> 56)
+    _, err = wbuf.Write(header)
+    for _, entry := range self.entries {
+        if err != nil {
+            break
+        }
+        _, err = wbuf.Write(entry.GetBuf())
+    }
+
+    if err == nil {
+        err = wbuf.Flush()
+    }
+    if err == nil {
+        err = file.Sync()
+    }
+    file.Close()
+    if err == nil {
+        err = os.Rename(filename + ".tmp", filename)
+    }
+    if err != nil {
+        return err
+    }
+
+    file, err = os.OpenFile(filename, os.O_WRONLY | os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    self.log_file = file
+    self.log_wbuf = bufio.NewWriterSize(file, int(Config.AofFileBufferSize))
+    self.log_dirty = false
+    return nil
+}
+
+func (self *Raft) AppendLog(entry *RaftEntry) {
+    self.entries = append(self.entries, entry)
+    _, err := self.log_wbuf.Write(entry.GetBuf())
+    if err != nil {
+        self.slock.Log().Errorf("Raft Log Write Error %v", err)
+    }
+    self.log_dirty = true
+}
+
+func (self *Raft) FlushLog() error {
+    if !self.log_dirty || self.log_file == nil {
+        return nil
+    }
+
+    err := self.log_wbuf.Flush()
+    if err == nil {
+        err = self.log_file.Sync()
+    }
+    if err != nil {
+        self.slock.Log().Errorf("Raft Log Flush Error %v", err)
+        return err
+    }
+    self.log_dirty = false
+    return nil
+}
+
+func (self *Raft) TruncateLog(index uint64) error {
+    if index >= self.LastLogIndex() {
+        return nil
+    }
+
+    for i := index + 1; i <= self.LastLogIndex(); i++ {
+        if proposal, ok := self.proposals[i]; ok {
+            delete(self.proposals, i)
+            go self.FailProposal(proposal)
+        }
+    }
+
+    self.entries = self.entries[:index - self.base_index]
+    self.log_wbuf.Flush()
+    size := self.LogSize()
+    err := self.log_file.Truncate(size)
+    if err != nil {
+        self.slock.Log().Errorf("Raft Log Truncate Error %v", err)
+        return err
+    }
+    self.log_wbuf.Reset(self.log_file)
+    self.log_dirty = true
+    return nil
+}
+
+func (self *Raft) LogSize() int64 {
+    size := int64(28)
+    for _, entry := range self.entries {
+        size += int64(len(entry.GetBuf()))
+    }
+    return size
+}
+
+func (self *Raft) CompactLog() {
+    self.glock.Lock()
+    if self.is_stop || self.install_entries != nil || self.last_applied < self.base_index + RAFT_LOG_COMPACT_COUNT {
+        self.glock.Unlock()
+        return
+    }
+    index, term := self.last_applied, self.GetTerm(self.last_applied)
+    self.glock.Unlock()
+
+    entries := self.DumpSnapshot()
+    err := self.WriteSnapshot(index, term, entries)
+    if err != nil {
+        self.slock.Log().Errorf("Raft Snapshot Write Error %v", err)
+        return
+    }
+
+    self.glock.Lock()
+    defer self.glock.Unlock()
+    if index <= self.base_index || index > self.LastLogIndex() {
+        return
+    }
+
+    count := index - self.base_index
+    self.snapshot_entries = entries
+    self.base_index, self.base_term = index, term
+    log_entries := make([]*RaftEntry, uint64(len(self.entries)) - count)
+    copy(log_entries, self.entries[count:])
+    self.entries = log_entries
+    err = self.WriteLog()
+    if err != nil {
+        self.slock.Log().Errorf("Raft Log Compact Error %v", err)
+        return
+    }
+    self.slock.Log().Infof("Raft Log Compact %d BaseIndex %d Snapshot %d", count, self.base_index, len(entries))
+}
+
+func (self *Raft) LoadSnapshot() (uint64, uint64, error) {
+    file, err := os.Open(filepath.Join(self.data_dir, "raft.snapshot"))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return 0, 0, nil
+        }
+        return 0, 0, err
+    }
+    defer file.Close()
+
+    rbuf := bufio.NewReaderSize(file, int(Config.AofFileBufferSize))
+    header := make([]byte, 28)
+    _, err = io.ReadFull(rbuf, header)
+    if err != nil || string(header[:8]) != "SLOCKRSN" {
+        return 0, 0, errors.New("File is not Raft Snapshot File")
+    }
+
+    index := uint64(header[12]) | uint64(header[13])<<8 | uint64(header[14])<<16 | uint64(header[15])<<24 | uint64(header[16])<<32 | uint64(header[17])<<40 | uint64(header[18])<<48 | uint64(header[19])<<56
+    term := uint64(header[20]) | uint64(header[21])<<8 | uint64(header[22])<<16 | uint64(header[23])<<24 | uint64(header[24])<<32 | uint64(header[25])<<40 | uint64(header[26])<<48 | uint64(header[27])<<56
+    entries := make([]*RaftEntry, 0)
+    for {
+        entry, err := ReadRaftEntry(rbuf)
+        if err != nil {
+            if err == io.EOF {
+                break
+            }
+            return 0, 0, err
+        }
+        entries = append(entries, entry)
+    }
+    self.snapshot_entries = entries
+    return index, term, nil
+}
+
+func (self *Raft) WriteSnapshot(index uint64, term uint64, entries []*RaftEntry) error {
+    filename := filepath.Join(self.data_dir, "raft.snapshot")
+    file, err := os.OpenFile(filename + ".tmp", os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+    if err != nil {
+        return err
+    }
+
+    wbuf := bufio.NewWriterSize(file, int(Config.AofFileBufferSize))
+    header := make([]byte, 28)
+    copy(header, "SLOCKRSN")
+    header[8], header[9], header[10], header[11] = 0x01, 0x00, 16, 0x00
+    header[12], header[13], header[14], header[15], header[16], header[17], header[18], header[19] = byte(index), byte(index >> 8), byte(index >> 16), byte(index >> 24), byte(index >> 32), byte(index >> 40), byte(index >> 48), byte(index >> 56)
+    header[20], header[21], header[22], header[23], header[24], header[25], header[26], header[27] = byte(term), byte(term >> 8), byte(term >> 16), byte(term >> 24), byte(term >> 32), byte(term >> 40), byte(term >> 48), byte(term >> 56)
+    _, err = wbuf.Write(header)
+    for _, entry := range entries {
+        if err != nil {
+            break
+        }
+        _, err = wbuf.Write(entry.GetBuf())
+    }
+
+    if err == nil {
+        err = wbuf.Flush()
+    }
+    if err == nil {
+        err = file.Sync()
+    }
+    file.Close()
+    if err == nil {
+        err = os.Rename(filename + ".tmp", filename)
+    }
+    return err
+}
+
+func (self *Raft) DumpSnapshot() []*RaftEntry {
+    now := time.Now().Unix()
+    entries := make([]*RaftEntry, 0)
+    for _, db := range self.slock.dbs {
+        if db == nil {
+            continue
+        }
+
+        entry := NewRaftEntry(0, nil)
+        entry.CommandType, entry.DbId, entry.Token = RAFT_ENTRY_SNAPSHOT_DB, db.db_id, atomic.LoadUint64(&db.fencing_token)
+        entry.Encode()
+        entries = append(entries, entry)
+
+        for _, lock_manager := range db.GetActiveLockManagers() {
+            lock_manager.glock.Lock()
+            if lock_manager.locked > 0 && lock_manager.locks != nil {
+                if lock_manager.current_lock != nil {
+                    entries = self.DumpSnapshotLock(entries, lock_manager, lock_manager.current_lock, now)
+                }
+
+                for node_index := lock_manager.locks.head_node_index; node_index <= lock_manager.locks.tail_node_index; node_index++ {
+                    for _, lock := range lock_manager.locks.IterNodeQueues(node_index) {
+                        if lock != nil && lock.locked > 0 {
+                            entries = self.DumpSnapshotLock(entries, lock_manager, lock, now)
+                        }
+                    }
+                }
+            }
+
+            if lock_manager.waited {
+                for _, wait_locks := range lock_manager.GetWaitLockQueues() {
+                    for node_index := wait_locks.head_node_index; node_index <= wait_locks.tail_node_index; node_index++ {
+                        for _, lock := range wait_locks.IterNodeQueues(node_index) {
+                            if lock == nil || lock.timeouted || lock.command == nil {
+                                continue
+                            }
+
+                            timeout, timeout_flag := int64(0), lock.command.TimeoutFlag & 0x28ff
+                            if lock.timeout_time > now {
+                                timeout = lock.timeout_time - now
+                            }
+                            if timeout > 0xffff {
+                                timeout, timeout_flag = timeout / 60, timeout_flag | 0x8000
+                            }
+
+                            entry := NewRaftEntry(0, lock.command)
+                            entry.CommandType, entry.CommandTime, entry.LockName = RAFT_ENTRY_SNAPSHOT_WAIT, uint64(now), lock_manager.lock_name
+                            entry.Timeout, entry.TimeoutFlag = uint16(timeout), timeout_flag
+                            entry.Encode()
+                            entries = append(entries, entry)
+                        }
+                    }
+                }
+            }
+            lock_manager.glock.Unlock()
+        }
+    }
+    return entries
+}
+
+func (self *Raft) DumpSnapshotLock(entries []*RaftEntry, lock_manager *LockManager, lock *Lock, now int64) []*RaftEntry {
+    if lock.expried || lock.command == nil {
+        return entries
+    }
+
+    expried := uint32(0)
+    if lock.command.ExpriedFlag & 0x4000 == 0 {
+        expried = 1
+        if lock.command.ExpriedFlag & 0x0400 != 0 && lock.expried_time == 0 {
+            expried = lock.command.GetExpried() / 1000 + 1
+        } else if lock.expried_time - now > protocol.MAX_EXPRIED_TIME {
+            expried = protocol.MAX_EXPRIED_TIME
+        } else if lock.expried_time > now {
+            expried = uint32(lock.expried_time - now)
+        }
+    }
+
+    entry := NewRaftEntry(0, lock.command)
+    entry.CommandType, entry.CommandTime, entry.Token, entry.LockName = protocol.COMMAND_LOCK, uint64(now), lock.fencing_token, lock_manager.lock_name
+    entry.Expried, entry.ExpriedFlag = uint16(expried), lock.command.ExpriedFlag & 0x7b00 | uint16(expried >> 16)
+    entry.Encode()
+    for i := uint8(0); i < lock.locked; i++ {
+        entries = append(entries, entry)
+    }
+    return entries
+}
+
+func (self *Raft) RestoreSnapshot(entries []*RaftEntry) {
+    now := time.Now().Unix()
+    for _, entry := range entries {
+        db := self.slock.GetDB(entry.DbId)
+        switch entry.CommandType {
+        case RAFT_ENTRY_SNAPSHOT_DB:
+            db.UpdateFencingToken(entry.Token)
+        case protocol.COMMAND_LOCK:
+            lock_command := self.GetLockCommand(entry, now)
+            err := db.RestoreLock(self.server_protocol, lock_command, entry.Token)
+            if err != nil {
+                self.slock.Log().Errorf("Raft Snapshot Restore Lock Error %v", err)
+            }
+        case RAFT_ENTRY_SNAPSHOT_WAIT:
+            lock_command := self.GetLockCommand(entry, now)
+            lock_command.CommandType = protocol.COMMAND_LOCK
+            if entry.TimeoutFlag & 0x8000 == 0 && int64(entry.CommandTime) < now {
+                elapsed := now - int64(entry.CommandTime)
+                if int64(entry.Timeout) > elapsed {
+                    lock_command.Timeout = uint16(int64(entry.Timeout) - elapsed)
+                } else {
+                    lock_command.Timeout = 0
+                }
+            }
+            err := db.RestoreWaitLock(self.server_protocol, lock_command)
+            if err != nil {
+                self.slock.Log().Errorf("Raft Snapshot Restore Wait Lock Error %v", err)
+            }
+        }
+    }
+}
+
+func (self *Raft) InstallSnapshot(entries []*RaftEntry) {
+    self.slock.glock.Lock()
+    dbs := make([]*LockDB, 0)
+    for db_id, db := range self.slock.dbs {
+        if db != nil {
+            dbs = append(dbs, db)
+            self.slock.dbs[db_id] = nil
+        }
+    }
+    self.slock.glock.Unlock()
+
+    for _, db := range dbs {
+        db.Close()
+    }
+    self.RestoreSnapshot(entries)
+    self.slock.Log().Infof("Raft Snapshot Install %d", len(entries))
+}
+
+func (self *Raft) LastLogIndex() uint64 {
+    return self.base_index + uint64(len(self.entries))
+}
+
+func (self *Raft) LastLogTerm() uint64 {
+    if len(self.entries) == 0 {
+        return self.base_term
+    }
+    return self.entries[len(self.entries) - 1].Term
+}
+
+func (self *Raft) GetTerm(index uint64) uint64 {
+    if index <= self.base_index {
+        if index == self.base_index {
+            return self.base_term
+        }
+        return 0
+    }
+
+    if index > self.LastLogIndex() {
+        return 0
+    }
+    return self.entries[index - self.base_index - 1].Term
+}
+
+func (self *Raft) GetEntry(index uint64) *RaftEntry {
+    if index <= self.base_index || index > self.LastLogIndex() {
+        return nil
+    }
+    return self.entries[index - self.base_index - 1]
+}
+
+func (self *Raft) GetEntries(index uint64, count int) []*RaftEntry {
+    if index <= self.base_index || index > self.LastLogIndex() {
+        return nil
+    }
+
+    start := index - self.base_index - 1
+    end := start + uint64(count)
+    if end > uint64(len(self.entries)) {
+        end = uint64(len(self.entries))
+    }
+    entries := make([]*RaftEntry, end - start)
+    copy(entries, self.entries[start:end])
+    return entries
+}
+
+func (self *Raft) GetLeaderHint() ([4]byte, uint16) {
+    return self.leader_ip, self.leader_port
+}
+
+func (self *Raft) UpdateLeader(leader_id uint8) {
+    if leader_id == self.leader_id {
+        return
+    }
+
+    self.leader_id = leader_id
+    self.leader_ip, self.leader_port = [4]byte{}, 0
+    if leader_id >= uint8(len(self.nodes)) {
+        return
+    }
+
+    // resolved once per leader change, the hint is read on every not leader error
+    addr, err := net.ResolveTCPAddr("tcp", self.nodes[leader_id].address)
+    if err != nil {
+        return
+    }
+
+    ip := addr.IP.To4()
+    if ip == nil {
+        return
+    }
+    copy(self.leader_ip[:], ip)
+    self.leader_port = uint16(addr.Port)
+}
+
+func (self *Raft) GetLeaderAddress() string {
+    if self.leader_id >= uint8(len(self.nodes)) {
+        return ""
+    }
+    return self.nodes[self.leader_id].address
+}
+
+func (self *Raft) ResetElectionTimeout() {
+    self.heartbeat_time = time.Now()
+    self.election_timeout = RAFT_ELECTION_TIMEOUT + time.Duration(rand.Int63n(int64(RAFT_ELECTION_TIMEOUT)))
+}
+
+func (self *Raft) Run() {
+    for ; !self.is_stop; {
+        time.Sleep(RAFT_HEARTBEAT_TIME / 2)
+
+        self.glock.Lock()
+        if self.is_stop {
+            self.glock.Unlock()
+            break
+        }
+
+        if self.slock.state != STATE_LEADER && time.Since(self.heartbeat_time) > self.election_timeout {
+            self.ResetElectionTimeout()
+            self.glock.Unlock()
+            go self.StartElection()
+            continue
+        }
+        self.glock.Unlock()
+    }
+}
+
+func (self *Raft) StartElection() {
+    self.glock.Lock()
+    if self.is_stop || self.slock.state == STATE_LEADER {
+        self.glock.Unlock()
+        return
+    }
+
+    self.current_term++
+    self.voted_for = self.node_id
+    self.UpdateLeader(0xff)
+    self.SaveState()
+    self.slock.UpdateState(STATE_CANDIDATE)
+    term, last_index, last_term := self.current_term, self.LastLogIndex(), self.LastLogTerm()
+    self.slock.Log().Infof("Raft Start Election Term %d", term)
+    self.glock.Unlock()
+
+    votes := 1
+    if votes * 2 > len(self.nodes) {
+        self.glock.Lock()
+        if self.current_term == term && self.slock.state == STATE_CANDIDATE {
+            self.BecomeLeader()
+        }
+        self.glock.Unlock()
+        return
+    }
+
+    results := make(chan bool, len(self.nodes))
+    for _, node := range self.nodes {
+        if node.node_id == self.node_id {
+            continue
+        }
+
+        go func(node *RaftNode) {
+            results <- node.RequestVote(term, last_index, last_term)
+        }(node)
+    }
+
+    for i := 1; i < len(self.nodes); i++ {
+        if <- results {
+            votes++
+        }
+
+        if votes * 2 > len(self.nodes) {
+            self.glock.Lock()
+            if self.current_term == term && self.slock.state == STATE_CANDIDATE {
+                self.BecomeLeader()
+            }
+            self.glock.Unlock()
+            return
+        }
+    }
+}
+
+func (self *Raft) BecomeLeader() {
+    self.UpdateLeader(self.node_id)
+    last_index := self.LastLogIndex()
+    for _, node := range self.nodes {
+        node.next_index = last_index + 1
+        node.match_index = 0
+    }
+
+    self.AppendLog(NewRaftEntry(self.current_term, nil))
+    self.slock.UpdateState(STATE_LEADER)
+    self.slock.Log().Infof("Raft Become Leader Term %d LastIndex %d", self.current_term, last_index)
+    self.UpdateCommitIndex()
+
+    for _, node := range self.nodes {
+        if node.node_id != self.node_id {
+            node.Active()
+        }
+    }
+}
+
+func (self *Raft) StepDown(term uint64) {
+    if term > self.current_term {
+        self.current_term = term
+        self.voted_for = 0xff
+        self.SaveState()
+    }
+
+    if self.slock.state != STATE_FOLLOWER {
+        if self.slock.state == STATE_LEADER {
+            self.UpdateLeader(0xff)
+            self.slock.Log().Infof("Raft Step Down Term %d", self.current_term)
+        }
+        self.slock.UpdateState(STATE_FOLLOWER)
+        self.FailProposals()
+    }
+    self.ResetElectionTimeout()
+}
+
+func (self *Raft) UpdateCommitIndex() {
+    self.FlushLog()
+
+    last_index := self.LastLogIndex()
+    self.nodes[self.node_id].match_index = last_index
+    for index := last_index; index > self.commit_index; index-- {
+        if self.GetTerm(index) != self.current_term {
+            break
+        }
+
+        count := 0
+        for _, node := range self.nodes {
+            if node.match_index >= index {
+                count++
+            }
+        }
+
+        if count * 2 > len(self.nodes) {
+            self.commit_index = index
+            select {
+            case self.apply_waiter <- true:
+            default:
+            }
+            break
+        }
+    }
+}
+
+func (self *Raft) Propose(server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    self.glock.Lock()
+    if self.is_stop || self.slock.state != STATE_LEADER {
+        self.glock.Unlock()
+        server_protocol.ProcessLockResultCommand(command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
+        return server_protocol.FreeLockCommand(command)
+    }
+
+    self.AppendLog(NewRaftEntry(self.current_term, command))
+    self.proposals[self.LastLogIndex()] = &RaftProposal{server_protocol, command}
+    if len(self.nodes) == 1 {
+        self.UpdateCommitIndex()
+    }
+    self.glock.Unlock()
+
+    for _, node := range self.nodes {
+        if node.node_id != self.node_id {
+            node.Active()
+        }
+    }
+    return nil
+}
+
+func (self *Raft) ProposeEntry(entry *RaftEntry) {
+    self.glock.Lock()
+    if self.is_stop || self.slock.state != STATE_LEADER {
+        self.glock.Unlock()
+        return
+    }
+
+    entry.Term = self.current_term
+    entry.Encode()
+    self.AppendLog(entry)
+    if len(self.nodes) == 1 {
+        self.UpdateCommitIndex()
+    }
+    self.glock.Unlock()
+
+    for _, node := range self.nodes {
+        if node.node_id != self.node_id {
+            node.Active()
+        }
+    }
+}
+
+func (self *Raft) FailProposal(proposal *RaftProposal) {
+    proposal.server_protocol.ProcessLockResultCommand(proposal.command, protocol.RESULT_STATE_ERROR, 0, 0, 0)
+    proposal.server_protocol.FreeLockCommand(proposal.command)
+}
+
+func (self *Raft) FailProposals() {
+    if len(self.proposals) == 0 {
+        return
+    }
+
+    proposals := self.proposals
+    self.proposals = make(map[uint64]*RaftProposal, 4096)
+    go func() {
+        for _, proposal := range proposals {
+            self.FailProposal(proposal)
+        }
+    }()
+}
+
+func (self *Raft) HandleVote(server_protocol *BinaryServerProtocol, command *protocol.RaftVoteCommand) error {
+    self.glock.Lock()
+    if command.Term > self.current_term {
+        self.StepDown(command.Term)
+    }
+
+    vote_granted := uint8(0)
+    if command.Term == self.current_term && (self.voted_for == 0xff || self.voted_for == command.NodeId) {
+        last_term := self.LastLogTerm()
+        if command.LastLogTerm > last_term || (command.LastLogTerm == last_term && command.LastLogIndex >= self.LastLogIndex()) {
+            self.voted_for = command.NodeId
+            self.SaveState()
+            self.ResetElectionTimeout()
+            vote_granted = 1
+        }
+    }
+    term := self.current_term
+    self.glock.Unlock()
+
+    return server_protocol.Write(protocol.NewRaftVoteResultCommand(command, protocol.RESULT_SUCCED, term, vote_granted))
+}
+
+func (self *Raft) HandleAppend(server_protocol *BinaryServerProtocol, command *protocol.RaftAppendCommand) error {
+    entries := make([]*RaftEntry, command.EntryCount)
+    for i := range entries {
+        entry, err := ReadRaftEntry(server_protocol.stream)
+        if err != nil {
+            return err
+        }
+        entries[i] = entry
+    }
+
+    self.glock.Lock()
+    if command.Term < self.current_term {
+        term := self.current_term
+        self.glock.Unlock()
+        return server_protocol.Write(protocol.NewRaftAppendResultCommand(command, protocol.RESULT_SUCCED, term, 0, 0))
+    }
+
+    if command.Term > self.current_term || self.slock.state != STATE_FOLLOWER {
+        self.StepDown(command.Term)
+    }
+    self.UpdateLeader(command.NodeId)
+    self.ResetElectionTimeout()
+
+    prev_index := command.PrevLogIndex
+    if command.Flag & 0x01 != 0 {
+        if command.Flag & 0x02 != 0 {
+            self.receive_entries = make([]*RaftEntry, 0)
+        }
+        if self.receive_entries == nil {
+            term := self.current_term
+            self.glock.Unlock()
+            return server_protocol.Write(protocol.NewRaftAppendResultCommand(command, protocol.RESULT_SUCCED, term, 0, self.base_index))
+        }
+
+        self.receive_entries = append(self.receive_entries, entries...)
+        if command.Flag & 0x04 != 0 {
+            snapshot_entries := self.receive_entries
+            self.receive_entries = nil
+            err := self.WriteSnapshot(prev_index, command.PrevLogTerm, snapshot_entries)
+            if err != nil {
+                self.slock.Log().Errorf("Raft Snapshot Write Error %v", err)
+                term := self.current_term
+                self.glock.Unlock()
+                return server_protocol.Write(protocol.NewRaftAppendResultCommand(command, protocol.RESULT_SUCCED, term, 0, self.base_index))
+            }
+
+            for i := self.base_index + 1; i <= self.LastLogIndex(); i++ {
+                if proposal, ok := self.proposals[i]; ok {
+                    delete(self.proposals, i)
+                    go self.FailProposal(proposal)
+                }
+            }
+            self.snapshot_entries, self.install_entries = snapshot_entries, snapshot_entries
+            self.entries = make([]*RaftEntry, 0)
+            self.base_index, self.base_term = prev_index, command.PrevLogTerm
+            self.commit_index, self.last_applied = prev_index, prev_index
+            err = self.WriteLog()
+            if err != nil {
+                self.slock.Log().Errorf("Raft Log Reset Error %v", err)
+            }
+            self.slock.Log().Infof("Raft Log Reset BaseIndex %d", prev_index)
+            select {
+            case self.apply_waiter <- true:
+            default:
+            }
+        }
+        term := self.current_term
+        self.glock.Unlock()
+        return server_protocol.Write(protocol.NewRaftAppendResultCommand(command, protocol.RESULT_SUCCED, term, 1, prev_index))
+    }
+
+    if prev_index < self.base_index {
+        skip := self.base_index - prev_index
+        if skip > uint64(len(entries)) {
+            skip = uint64(len(entries))
+        }
+        entries = entries[skip:]
+        prev_index += skip
+    }
+
+    if prev_index > self.LastLogIndex() || self.GetTerm(prev_index) != command.PrevLogTerm {
+        match_index := self.LastLogIndex()
+        if prev_index <= match_index {
+            match_index = prev_index - 1
+        }
+        if match_index < self.base_index {
+            match_index = self.base_index
+        }
+        term := self.current_term
+        self.glock.Unlock()
+        return server_protocol.Write(protocol.NewRaftAppendResultCommand(command, protocol.RESULT_SUCCED, term, 0, match_index))
+    }
+
+    for i, entry := range entries {
+        index := prev_index + uint64(i) + 1
+        if index <= self.LastLogIndex() {
+            if self.GetTerm(index) == entry.Term {
+                continue
+            }
+            self.TruncateLog(index - 1)
+        }
+        self.AppendLog(entry)
+    }
+    self.FlushLog()
+
+    match_index := prev_index + uint64(len(entries))
+    if command.LeaderCommit > self.commit_index {
+        commit_index := command.LeaderCommit
+        if commit_index > match_index {
+            commit_index = match_index
+        }
+
+        if commit_index > self.commit_index {
+            self.commit_index = commit_index
+            select {
+            case self.apply_waiter <- true:
+            default:
+            }
+        }
+    }
+    term := self.current_term
+    self.glock.Unlock()
+    return server_protocol.Write(protocol.NewRaftAppendResultCommand(command, protocol.RESULT_SUCCED, term, 1, match_index))
+}
+
+func (self *Raft) ApplyRun() {
+    for ; !self.is_stop; {
+        <- self.apply_waiter
+
+        for ; !self.is_stop; {
+            self.glock.Lock()
+            if self.install_entries != nil {
+                install_entries := self.install_entries
+                self.install_entries = nil
+                self.glock.Unlock()
+
+                self.InstallSnapshot(install_entries)
+                continue
+            }
+
+            if self.last_applied >= self.commit_index {
+                self.glock.Unlock()
+                break
+            }
+
+            self.last_applied++
+            entry := self.GetEntry(self.last_applied)
+            proposal, ok := self.proposals[self.last_applied]
+            if ok {
+                delete(self.proposals, self.last_applied)
+            }
+            self.glock.Unlock()
+
+            if entry != nil {
+                self.Apply(entry, proposal)
+            }
+        }
+        self.CompactLog()
+    }
+}
+
+func (self *Raft) Apply(entry *RaftEntry, proposal *RaftProposal) {
+    switch entry.CommandType {
+    case protocol.COMMAND_INIT:
+        self.glock.Lock()
+        is_leader := self.slock.state == STATE_LEADER && entry.Term == self.current_term
+        self.glock.Unlock()
+        if is_leader {
+            self.WakeUpWaitLocks()
+        }
+        return
+    case RAFT_ENTRY_TIMEOUT, RAFT_ENTRY_EXPRIED, RAFT_ENTRY_WAKEUP:
+        db := self.slock.dbs[entry.DbId]
+        if db == nil {
+            return
+        }
+
+        lock_command := self.GetLockCommand(entry, int64(entry.CommandTime))
+        switch entry.CommandType {
+        case RAFT_ENTRY_TIMEOUT:
+            db.DoRaftTimeOut(lock_command)
+        case RAFT_ENTRY_EXPRIED:
+            db.DoRaftExpried(lock_command, entry.Token)
+        default:
+            db.DoRaftWakeUp(lock_command)
+        }
+        self.server_protocol.FreeLockCommand(lock_command)
+        return
+    case protocol.COMMAND_LOCK, protocol.COMMAND_UNLOCK, protocol.COMMAND_RENEW, protocol.COMMAND_CANCEL:
+    default:
+        return
+    }
+
+    if proposal != nil {
+        db := self.slock.dbs[proposal.command.DbId]
+        if proposal.command.CommandType == protocol.COMMAND_LOCK {
+            if db == nil {
+                db = self.slock.GetOrNewDB(proposal.command.DbId)
+            }
+            err := db.Lock(proposal.server_protocol, proposal.command)
+            if err != nil {
+                self.slock.Log().Errorf("Raft Apply Lock Error %v", err)
+            }
+            return
+        }
+
+        if db == nil {
+            proposal.server_protocol.ProcessLockResultCommand(proposal.command, protocol.RESULT_UNKNOWN_DB, 0, 0, 0)
+            proposal.server_protocol.FreeLockCommand(proposal.command)
+            return
+        }
+
+        if proposal.command.CommandType == protocol.COMMAND_RENEW {
+            err := db.Renew(proposal.server_protocol, proposal.command)
+            if err != nil {
+                self.slock.Log().Errorf("Raft Apply Renew Error %v", err)
+            }
+            return
+        }
+
+        if proposal.command.CommandType == protocol.COMMAND_CANCEL {
+            err := db.Cancel(proposal.server_protocol, proposal.command)
+            if err != nil {
+                self.slock.Log().Errorf("Raft Apply Cancel Error %v", err)
+            }
+            return
+        }
+        err := db.UnLock(proposal.server_protocol, proposal.command)
+        if err != nil {
+            self.slock.Log().Errorf("Raft Apply UnLock Error %v", err)
+        }
+        return
+    }
+
+    err := self.server_protocol.ProcessLockCommand(self.GetLockCommand(entry, time.Now().Unix()))
+    if err != nil {
+        self.slock.Log().Errorf("Raft Apply ProcessLockCommand Error %v", err)
+    }
+}
+
+func (self *Raft) GetLockCommand(entry *RaftEntry, now int64) *protocol.LockCommand {
+    lock_command := self.server_protocol.GetLockCommand()
+    lock_command.CommandType = entry.CommandType
+    lock_command.RequestId = entry.RequestId
+    lock_command.Flag = entry.Flag
+    lock_command.DbId = entry.DbId
+    lock_command.LockId = entry.LockId
+    lock_command.LockKey = entry.LockKey
+    lock_command.LockName = entry.LockName
+    lock_command.TimeoutFlag = entry.TimeoutFlag
+    lock_command.Timeout = entry.Timeout
+    lock_command.ExpriedFlag = entry.ExpriedFlag
+    lock_command.SetExpried(entry.GetExpried(now))
+    lock_command.Count = entry.Count
+    lock_command.Rcount = entry.Rcount
+    return lock_command
+}
+
+func (self *Raft) WakeUpWaitLocks() {
+    for _, db := range self.slock.dbs {
+        if db == nil {
+            continue
+        }
+
+        for _, lock_manager := range db.GetActiveLockManagers() {
+            db.WakeUpWaitLocks(lock_manager, nil)
+        }
+    }
+}
@@ -0,0 +1,419 @@
+package server
+
+import (
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "io/ioutil"
+    "net"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+type testRaftNode struct {
+    slock       *SLock
+    server      *Server
+    address     string
+    data_dir    string
+}
+
+func startTestRaftNode(t *testing.T, cluster string, address string, data_dir string) *testRaftNode {
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        t.Fatalf("Raft Test Listen Error %s %v", address, err)
+    }
+
+    config := &ServerConfig{Bind: "127.0.0.1", Port: 5658, Log: "-", LogLevel: "ERROR", DataDir: data_dir,
+        DBFastKeyCount: 4096, DBConcurrentLock: 8, DBLockAofTime: 0, AofQueueSize: 4096, AofFsync: "no",
+        AofPersistence: "memory", AofFileRewriteSize: 67174400, AofFileBufferSize: 4096, Cluster: cluster, ClusterAddress: address}
+    slock := NewSLock(config)
+    server := NewServer(slock)
+    server.server = listener
+    err = slock.Init()
+    if err != nil {
+        listener.Close()
+        t.Fatalf("Raft Test SLock Init Error %s %v", address, err)
+    }
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            stream := NewStream(server, conn)
+            server.AddStream(stream)
+            go server.Handle(stream)
+        }
+    }()
+    return &testRaftNode{slock, server, address, data_dir}
+}
+
+func newTestRaftCluster(t *testing.T, count int) []*testRaftNode {
+    addresses := make([]string, count)
+    for i := range addresses {
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatalf("Raft Test Listen Error %v", err)
+        }
+        addresses[i] = listener.Addr().String()
+        listener.Close()
+    }
+
+    nodes := make([]*testRaftNode, count)
+    for i, address := range addresses {
+        data_dir, err := ioutil.TempDir("", "slock_raft_test")
+        if err != nil {
+            t.Fatalf("Raft Test Create Data Dir Error %v", err)
+        }
+        nodes[i] = startTestRaftNode(t, strings.Join(addresses, ","), address, data_dir)
+    }
+    return nodes
+}
+
+func closeTestRaftCluster(nodes []*testRaftNode) {
+    for _, node := range nodes {
+        if node.server != nil {
+            node.server.Close()
+        }
+        os.RemoveAll(node.data_dir)
+    }
+}
+
+func stopTestRaftNode(node *testRaftNode) {
+    node.server.Close()
+    node.slock, node.server = nil, nil
+}
+
+func waitTestRaftLeader(nodes []*testRaftNode) *testRaftNode {
+    for i := 0; i < 1000; i++ {
+        var leader *testRaftNode = nil
+        leader_count, follower_count := 0, 0
+        for _, node := range nodes {
+            if node.slock == nil {
+                continue
+            }
+
+            switch node.slock.state {
+            case STATE_LEADER:
+                leader, leader_count = node, leader_count + 1
+            case STATE_FOLLOWER:
+                follower_count++
+            }
+        }
+
+        if leader_count == 1 && follower_count > 0 {
+            return leader
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return nil
+}
+
+func waitTestRaftCommit(nodes []*testRaftNode, leader *testRaftNode) bool {
+    leader.slock.raft.glock.Lock()
+    commit_index := leader.slock.raft.commit_index
+    leader.slock.raft.glock.Unlock()
+
+    for i := 0; i < 1000; i++ {
+        applied := true
+        for _, node := range nodes {
+            if node.slock == nil {
+                continue
+            }
+
+            node.slock.raft.glock.Lock()
+            if node.slock.raft.last_applied < commit_index {
+                applied = false
+            }
+            node.slock.raft.glock.Unlock()
+        }
+
+        if applied {
+            return true
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return false
+}
+
+func doTestRaftLockCommand(slock *SLock, command_type uint8, lock_key [16]byte, lock_id [16]byte) *protocol.LockResultCommand {
+    server_protocol := slock.multi_lock_protocol
+    server_protocol.Lock()
+    lock_command := server_protocol.GetLockCommand()
+    server_protocol.Unlock()
+
+    lock_command.Magic = protocol.MAGIC
+    lock_command.Version = protocol.VERSION
+    lock_command.CommandType = command_type
+    lock_command.RequestId = slock.GetAof().GetRequestId()
+    lock_command.Flag = 0
+    lock_command.DbId = 0
+    lock_command.LockId = lock_id
+    lock_command.LockKey = lock_key
+    lock_command.LockName = ""
+    lock_command.TimeoutFlag = 0
+    lock_command.Timeout = 0
+    lock_command.ExpriedFlag = 0
+    lock_command.Expried = 60
+    lock_command.Count = 0
+    lock_command.Rcount = 0
+
+    waiter := make(chan *protocol.LockResultCommand, 1)
+    server_protocol.AddWaiter(lock_command, waiter)
+    db := slock.GetDB(0)
+    var err error
+    if command_type == protocol.COMMAND_LOCK {
+        err = slock.DoLockComamnd(db, server_protocol, lock_command)
+    } else {
+        err = slock.DoUnLockComamnd(db, server_protocol, lock_command)
+    }
+    if err != nil {
+        server_protocol.RemoveWaiter(lock_command)
+        return nil
+    }
+
+    select {
+    case result := <- waiter:
+        return result
+    case <- time.After(5 * time.Second):
+        server_protocol.RemoveWaiter(lock_command)
+        return nil
+    }
+}
+
+func TestRaft_Election(t *testing.T) {
+    nodes := newTestRaftCluster(t, 3)
+    defer closeTestRaftCluster(nodes)
+
+    leader := waitTestRaftLeader(nodes)
+    if leader == nil {
+        t.Errorf("Raft Election Leader Error")
+        return
+    }
+
+    for _, node := range nodes {
+        for i := 0; i < 500 && node != leader && node.slock.raft.leader_id != leader.slock.raft.node_id; i++ {
+            time.Sleep(10 * time.Millisecond)
+        }
+
+        if node.slock.raft.leader_id != leader.slock.raft.node_id || node.slock.raft.current_term != leader.slock.raft.current_term {
+            t.Errorf("Raft Election Follower Error %s %d %d", node.address, node.slock.raft.leader_id, node.slock.raft.current_term)
+        }
+    }
+
+    leader_ip, leader_port := nodes[0].slock.raft.GetLeaderHint()
+    if fmt.Sprintf("%d.%d.%d.%d:%d", leader_ip[0], leader_ip[1], leader_ip[2], leader_ip[3], leader_port) != leader.address {
+        t.Errorf("Raft Election Leader Hint Error %v %d", leader_ip, leader_port)
+    }
+
+    stopTestRaftNode(leader)
+    new_leader := waitTestRaftLeader(nodes)
+    if new_leader == nil || new_leader == leader {
+        t.Errorf("Raft Election Failover Leader Error")
+    }
+}
+
+func TestRaft_ReplicationCommit(t *testing.T) {
+    nodes := newTestRaftCluster(t, 3)
+    defer closeTestRaftCluster(nodes)
+
+    leader := waitTestRaftLeader(nodes)
+    if leader == nil {
+        t.Errorf("Raft Replication Leader Error")
+        return
+    }
+
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    copy(lock_key[:], "raft_replication")
+    copy(lock_id[:], "raft_lock_id")
+    result := doTestRaftLockCommand(leader.slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Raft Replication Lock Error %v", result)
+        return
+    }
+
+    for _, node := range nodes {
+        if node == leader {
+            continue
+        }
+
+        result = doTestRaftLockCommand(node.slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+        if result == nil || result.Result != protocol.RESULT_STATE_ERROR {
+            t.Errorf("Raft Replication Follower Lock Error %v", result)
+            return
+        }
+    }
+
+    if !waitTestRaftCommit(nodes, leader) {
+        t.Errorf("Raft Replication Commit Timeout")
+        return
+    }
+
+    for _, node := range nodes {
+        if !waitTestLockedCount(node.slock, lock_key, 1) {
+            t.Errorf("Raft Replication Lock State Error %s %d", node.address, getTestLockedCount(node.slock, lock_key))
+        }
+    }
+
+    result = doTestRaftLockCommand(leader.slock, protocol.COMMAND_UNLOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Raft Replication Unlock Error %v", result)
+        return
+    }
+
+    if !waitTestRaftCommit(nodes, leader) {
+        t.Errorf("Raft Replication Unlock Commit Timeout")
+        return
+    }
+
+    for _, node := range nodes {
+        if !waitTestLockedCount(node.slock, lock_key, 0) {
+            t.Errorf("Raft Replication Unlock State Error %s %d", node.address, getTestLockedCount(node.slock, lock_key))
+        }
+    }
+}
+
+func TestRaft_Restart(t *testing.T) {
+    nodes := newTestRaftCluster(t, 3)
+    defer closeTestRaftCluster(nodes)
+
+    leader := waitTestRaftLeader(nodes)
+    if leader == nil {
+        t.Errorf("Raft Restart Leader Error")
+        return
+    }
+
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    copy(lock_key[:], "raft_restart")
+    copy(lock_id[:], "raft_lock_id")
+    result := doTestRaftLockCommand(leader.slock, protocol.COMMAND_LOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Raft Restart Lock Error %v", result)
+        return
+    }
+
+    if !waitTestRaftCommit(nodes, leader) {
+        t.Errorf("Raft Restart Commit Timeout")
+        return
+    }
+
+    var follower *testRaftNode = nil
+    for _, node := range nodes {
+        if node != leader {
+            follower = node
+            break
+        }
+    }
+
+    cluster := strings.Join([]string{nodes[0].address, nodes[1].address, nodes[2].address}, ",")
+    follower.slock.raft.glock.Lock()
+    term, last_index := follower.slock.raft.current_term, follower.slock.raft.LastLogIndex()
+    follower.slock.raft.glock.Unlock()
+    stopTestRaftNode(follower)
+
+    restart_lock_key := [16]byte{}
+    copy(restart_lock_key[:], "raft_restart_new")
+    result = doTestRaftLockCommand(leader.slock, protocol.COMMAND_LOCK, restart_lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Raft Restart Majority Lock Error %v", result)
+        return
+    }
+
+    restarted := startTestRaftNode(t, cluster, follower.address, follower.data_dir)
+    follower.slock, follower.server = restarted.slock, restarted.server
+    follower.slock.raft.glock.Lock()
+    restart_term, restart_last_index := follower.slock.raft.current_term, follower.slock.raft.LastLogIndex()
+    follower.slock.raft.glock.Unlock()
+    if restart_term < term || restart_last_index < last_index {
+        t.Errorf("Raft Restart Load State Error %d %d %d %d", term, restart_term, last_index, restart_last_index)
+        return
+    }
+
+    if !waitTestRaftCommit(nodes, leader) {
+        t.Errorf("Raft Restart Catch Up Timeout")
+        return
+    }
+
+    if !waitTestLockedCount(follower.slock, lock_key, 1) || !waitTestLockedCount(follower.slock, restart_lock_key, 1) {
+        t.Errorf("Raft Restart Lock State Error %d %d", getTestLockedCount(follower.slock, lock_key), getTestLockedCount(follower.slock, restart_lock_key))
+    }
+}
+
+func TestRaft_InstallSnapshot(t *testing.T) {
+    nodes := newTestRaftCluster(t, 3)
+    defer closeTestRaftCluster(nodes)
+
+    leader := waitTestRaftLeader(nodes)
+    if leader == nil {
+        t.Errorf("Raft Snapshot Leader Error")
+        return
+    }
+
+    var follower *testRaftNode = nil
+    for _, node := range nodes {
+        if node != leader {
+            follower = node
+            break
+        }
+    }
+    cluster := strings.Join([]string{nodes[0].address, nodes[1].address, nodes[2].address}, ",")
+    stopTestRaftNode(follower)
+    os.RemoveAll(follower.data_dir)
+    os.MkdirAll(follower.data_dir, 0755)
+
+    lock_id := [16]byte{}
+    copy(lock_id[:], "raft_lock_id")
+    lock_keys := make([][16]byte, RAFT_LOG_COMPACT_COUNT)
+    for i := range lock_keys {
+        copy(lock_keys[i][:], fmt.Sprintf("raft_snap_%d", i))
+        result := doTestRaftLockCommand(leader.slock, protocol.COMMAND_LOCK, lock_keys[i], lock_id)
+        if result == nil || result.Result != protocol.RESULT_SUCCED {
+            t.Errorf("Raft Snapshot Lock Error %d %v", i, result)
+            return
+        }
+
+        if i % 2 == 1 {
+            result = doTestRaftLockCommand(leader.slock, protocol.COMMAND_UNLOCK, lock_keys[i], lock_id)
+            if result == nil || result.Result != protocol.RESULT_SUCCED {
+                t.Errorf("Raft Snapshot Unlock Error %d %v", i, result)
+                return
+            }
+        }
+    }
+
+    base_index := uint64(0)
+    for i := 0; i < 500 && base_index == 0; i++ {
+        leader.slock.raft.glock.Lock()
+        base_index = leader.slock.raft.base_index
+        leader.slock.raft.glock.Unlock()
+        time.Sleep(10 * time.Millisecond)
+    }
+    if base_index == 0 {
+        t.Errorf("Raft Snapshot Compact Log Error")
+        return
+    }
+
+    restarted := startTestRaftNode(t, cluster, follower.address, follower.data_dir)
+    follower.slock, follower.server = restarted.slock, restarted.server
+    if !waitTestRaftCommit(nodes, leader) {
+        t.Errorf("Raft Snapshot Install Timeout")
+        return
+    }
+
+    follower.slock.raft.glock.Lock()
+    follower_base_index := follower.slock.raft.base_index
+    follower.slock.raft.glock.Unlock()
+    if follower_base_index == 0 {
+        t.Errorf("Raft Snapshot Install Base Index Error %d", follower_base_index)
+    }
+
+    for i, lock_key := range lock_keys {
+        locked_count := uint32(1 - i % 2)
+        if !waitTestLockedCount(follower.slock, lock_key, locked_count) {
+            t.Errorf("Raft Snapshot Install Lock State Error %d %d", i, getTestLockedCount(follower.slock, lock_key))
+            return
+        }
+    }
+}
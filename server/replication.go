@@ -0,0 +1,441 @@
+package server
+
+import (
+    "errors"
+    "github.com/snower/slock/protocol"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type ReplicationServer struct {
+    slock           *SLock
+    glock           *sync.Mutex
+    aof             *Aof
+    server_protocol *BinaryServerProtocol
+    stream          *Stream
+    channel         chan []byte
+    closed_waiter   chan bool
+    aof_index       uint32
+    aof_id          uint32
+    extend          bool
+    closed          bool
+}
+
+func NewReplicationServer(slock *SLock, server_protocol *BinaryServerProtocol) *ReplicationServer {
+    return &ReplicationServer{slock, &sync.Mutex{}, slock.GetAof(), server_protocol, server_protocol.stream,
+        make(chan []byte, REPLICATION_QUEUE_SIZE), make(chan bool), 0, 0, false, false}
+}
+
+func (self *ReplicationServer) Close() error {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+
+    if self.closed {
+        return nil
+    }
+
+    self.closed = true
+    close(self.closed_waiter)
+    return nil
+}
+
+func (self *ReplicationServer) PushLock(lock *AofLock) {
+    buf := lock.EncodeReplication(self.extend)
+    select {
+    case self.channel <- buf:
+    case <- self.closed_waiter:
+    default:
+        // never block the aof on one follower, a follower that falls a whole queue behind is dropped and syncs again
+        self.slock.Log().Errorf("Replication Follower Queue Full Resync %s", self.server_protocol.RemoteAddr().String())
+        self.Close()
+        self.stream.SetWriteDeadline(time.Now())
+    }
+}
+
+func (self *ReplicationServer) WriteLock(buf []byte) error {
+    return self.stream.WriteBytes(buf)
+}
+
+func (self *ReplicationServer) Handle(command *protocol.SyncCommand) error {
+    self.aof.LockRewriting()
+    aof_filenames, lock_counts, err := self.aof.AddReplication(self)
+    if err != nil {
+        self.aof.UnLockRewriting()
+        self.slock.Log().Errorf("Replication Follower Sync Error %s %v", self.server_protocol.RemoteAddr().String(), err)
+        return self.server_protocol.Write(protocol.NewSyncResultCommand(command, protocol.RESULT_ERROR, 0, 0, 0))
+    }
+    defer self.aof.RemoveReplication(self)
+    defer self.Close()
+
+    lock_count := uint64(0)
+    for _, count := range lock_counts {
+        lock_count += count
+    }
+
+    self.slock.Log().Infof("Replication Follower Sync Start %s %v %d", self.server_protocol.RemoteAddr().String(), aof_filenames, lock_count)
+    err = self.server_protocol.Write(protocol.NewSyncResultCommand(command, protocol.RESULT_SUCCED, self.aof_index, self.aof_id, lock_count))
+    if err != nil {
+        self.aof.UnLockRewriting()
+        return err
+    }
+
+    err = self.SendAofFiles(aof_filenames, lock_counts)
+    self.aof.UnLockRewriting()
+    if err != nil {
+        return err
+    }
+    self.slock.Log().Infof("Replication Follower Synced %s", self.server_protocol.RemoteAddr().String())
+    return self.SendChannelLocks()
+}
+
+func (self *ReplicationServer) HandleSnapshot(command *protocol.SnapshotCommand) error {
+    self.extend = command.Flag & 0x01 != 0
+    lock_bufs, err := self.aof.AddSnapshotReplication(self)
+    if err != nil {
+        self.slock.Log().Errorf("Replication Follower Snapshot Error %s %v", self.server_protocol.RemoteAddr().String(), err)
+        return self.server_protocol.Write(protocol.NewSnapshotResultCommand(command, protocol.RESULT_ERROR, 0, 0, 0))
+    }
+    defer self.aof.RemoveReplication(self)
+    defer self.Close()
+
+    self.slock.Log().Infof("Replication Follower Snapshot Start %s %d %d %d", self.server_protocol.RemoteAddr().String(), self.aof_index, self.aof_id, len(lock_bufs))
+    err = self.server_protocol.Write(protocol.NewSnapshotResultCommand(command, protocol.RESULT_SUCCED, self.aof_index, self.aof_id, uint64(len(lock_bufs))))
+    if err != nil {
+        return err
+    }
+
+    for _, buf := range lock_bufs {
+        err := self.WriteLock(buf)
+        if err != nil {
+            return err
+        }
+    }
+    self.slock.Log().Infof("Replication Follower Snapshot Synced %s", self.server_protocol.RemoteAddr().String())
+    return self.SendChannelLocks()
+}
+
+func (self *ReplicationServer) DumpLocks(dbs []*LockDB) [][]byte {
+    lock_bufs := make([][]byte, 0)
+    now := time.Now().Unix()
+    for _, db := range dbs {
+        if self.extend {
+            // an already expried lock record only carries the fencing token counter of the db to the follower
+            aof_lock := NewAofLock()
+            aof_lock.CommandType, aof_lock.AofIndex, aof_lock.AofId, aof_lock.DbId = protocol.COMMAND_LOCK, self.aof_index, self.aof_id, db.db_id
+            aof_lock.Token = atomic.LoadUint64(&db.fencing_token)
+            aof_lock.Encode()
+            lock_bufs = append(lock_bufs, aof_lock.EncodeReplication(self.extend))
+        }
+
+        // locks not written to the aof yet reach the follower with their own aof record later
+        for _, lock_manager := range db.GetLockManagers() {
+            if lock_manager.locked == 0 {
+                continue
+            }
+
+            if lock_manager.current_lock != nil && lock_manager.current_lock.is_aof {
+                lock_bufs = self.DumpLock(lock_bufs, lock_manager, lock_manager.current_lock, now)
+            }
+
+            for _, lock := range lock_manager.lock_maps {
+                if lock.is_aof {
+                    lock_bufs = self.DumpLock(lock_bufs, lock_manager, lock, now)
+                }
+            }
+        }
+    }
+    return lock_bufs
+}
+
+func (self *ReplicationServer) DumpLock(lock_bufs [][]byte, lock_manager *LockManager, lock *Lock, now int64) [][]byte {
+    aof_lock := lock_manager.DumpAofLock(lock, self.aof_index, self.aof_id, now)
+    if aof_lock == nil {
+        return lock_bufs
+    }
+
+    buf := aof_lock.EncodeReplication(self.extend)
+    for i := uint8(0); i < lock.locked; i++ {
+        lock_bufs = append(lock_bufs, buf)
+    }
+    return lock_bufs
+}
+
+func (self *ReplicationServer) SendChannelLocks() error {
+    for {
+        select {
+        case buf := <- self.channel:
+            err := self.WriteLock(buf)
+            if err != nil {
+                return err
+            }
+        case <- self.closed_waiter:
+            return io.EOF
+        }
+    }
+}
+
+func (self *ReplicationServer) SendAofFiles(aof_filenames []string, lock_counts []uint64) error {
+    lock := NewAofLock()
+
+    for i, aof_filename := range aof_filenames {
+        if lock_counts[i] == 0 {
+            continue
+        }
+
+        aof_file := NewAofFile(self.aof, filepath.Join(self.aof.data_dir, aof_filename), os.O_RDONLY, int(Config.AofFileBufferSize))
+        err := aof_file.Open()
+        if err != nil {
+            return err
+        }
+
+        for j := uint64(0); j < lock_counts[i]; j++ {
+            err := aof_file.ReadLock(lock)
+            if err == nil {
+                err = self.WriteLock(lock.EncodeReplication(self.extend))
+            }
+
+            if err != nil {
+                aof_file.Close()
+                return err
+            }
+        }
+
+        err = aof_file.Close()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+type ReplicationClient struct {
+    slock           *SLock
+    glock           *sync.Mutex
+    aof             *Aof
+    address         string
+    stream          *Stream
+    aof_lock        *AofLock
+    rbuf            []byte
+    wbuf            []byte
+    closed          bool
+    closed_waiter   chan bool
+}
+
+func NewReplicationClient(slock *SLock, address string) *ReplicationClient {
+    aof_lock := NewAofLock()
+    return &ReplicationClient{slock, &sync.Mutex{}, slock.GetAof(), address, nil, aof_lock,
+        make([]byte, 64), make([]byte, 64), false, nil}
+}
+
+func (self *ReplicationClient) Open() error {
+    conn, err := net.Dial("tcp", self.address)
+    if err != nil {
+        return err
+    }
+
+    stream := NewStream(nil, conn)
+    if stream == nil {
+        conn.Close()
+        return errors.New("Stream Init Error")
+    }
+
+    self.glock.Lock()
+    if self.closed {
+        self.glock.Unlock()
+        stream.Close()
+        return io.EOF
+    }
+    self.stream = stream
+    self.glock.Unlock()
+    return nil
+}
+
+func (self *ReplicationClient) Close() error {
+    self.glock.Lock()
+    if self.closed {
+        self.glock.Unlock()
+        return nil
+    }
+
+    self.closed = true
+    if self.stream != nil {
+        self.stream.Close()
+    }
+    self.closed_waiter = make(chan bool, 1)
+    self.glock.Unlock()
+
+    <- self.closed_waiter
+    return nil
+}
+
+func (self *ReplicationClient) IsClosed() bool {
+    self.glock.Lock()
+    defer self.glock.Unlock()
+    return self.closed
+}
+
+func (self *ReplicationClient) Run() {
+    for ; !self.IsClosed(); {
+        err := self.Open()
+        if err == nil {
+            err = self.Sync()
+            self.glock.Lock()
+            self.stream.Close()
+            self.stream = nil
+            self.glock.Unlock()
+        }
+
+        if self.IsClosed() {
+            break
+        }
+
+        if err != nil && err != io.EOF {
+            self.slock.Log().Errorf("Replication Sync Error %s %v", self.address, err)
+        }
+        self.slock.UpdateState(STATE_SYNC)
+        time.Sleep(1e9)
+    }
+
+    self.glock.Lock()
+    if self.closed_waiter != nil {
+        self.closed_waiter <- true
+        self.closed_waiter = nil
+    }
+    self.glock.Unlock()
+}
+
+func (self *ReplicationClient) Sync() error {
+    command := &protocol.SnapshotCommand{Command: protocol.Command{Magic: protocol.MAGIC, Version: protocol.VERSION, CommandType: protocol.COMMAND_SNAPSHOT, RequestId: self.aof.GetRequestId()},
+        Flag: 0x01, Blank: [44]byte{}}
+    err := command.Encode(self.wbuf)
+    if err != nil {
+        return err
+    }
+
+    err = self.stream.WriteBytes(self.wbuf)
+    if err != nil {
+        return err
+    }
+
+    n, err := self.stream.ReadBytes(self.rbuf)
+    if err != nil {
+        return err
+    }
+
+    if n != 64 {
+        return errors.New("Snapshot Result Len Error")
+    }
+
+    result_command := &protocol.SnapshotResultCommand{}
+    err = result_command.Decode(self.rbuf)
+    if err != nil {
+        return err
+    }
+
+    if result_command.CommandType != protocol.COMMAND_SNAPSHOT || result_command.Result != protocol.RESULT_SUCCED {
+        return errors.New("Snapshot Result Error")
+    }
+
+    err = self.Reset()
+    if err != nil {
+        return err
+    }
+    self.slock.UpdateState(STATE_SYNC)
+    self.slock.Log().Infof("Replication Sync Start %s %d %d %d", self.address, result_command.AofIndex, result_command.AofId, result_command.LockCount)
+
+    for i := uint64(0); i < result_command.LockCount; i++ {
+        err := self.ReadLock()
+        if err != nil {
+            return err
+        }
+
+        err = self.LoadLock()
+        if err != nil {
+            return err
+        }
+    }
+
+    self.slock.UpdateState(STATE_FOLLOWER)
+    self.slock.Log().Infof("Replication Synced %s", self.address)
+
+    for ; !self.IsClosed(); {
+        err := self.ReadLock()
+        if err != nil {
+            return err
+        }
+
+        err = self.LoadLock()
+        if err != nil {
+            return err
+        }
+    }
+    return io.EOF
+}
+
+func (self *ReplicationClient) Reset() error {
+    for _, db := range self.slock.dbs {
+        if db != nil {
+            db.FlushDB()
+        }
+    }
+
+    if self.aof.aof_lock_count == 0 {
+        return nil
+    }
+    return self.aof.Reset()
+}
+
+func (self *ReplicationClient) ReadLock() error {
+    buf := self.aof_lock.GetBuf()
+    n, err := self.stream.ReadBytes(buf)
+    if err != nil {
+        return err
+    }
+
+    lock_len := uint16(buf[0]) | uint16(buf[1])<<8
+    if lock_len < 62 {
+        return errors.New("Lock Len error")
+    }
+
+    if n != 64 {
+        return errors.New("Lock Len error")
+    }
+
+    var extend_buf []byte
+    if lock_len > 62 {
+        extend_buf = make([]byte, lock_len - 62)
+        n, err = self.stream.ReadBytes(extend_buf)
+        if err != nil {
+            return err
+        }
+
+        if n != len(extend_buf) {
+            return errors.New("Lock Len error")
+        }
+    }
+
+    err = self.aof_lock.Decode()
+    if err != nil {
+        return err
+    }
+    return self.aof_lock.DecodeReplication(extend_buf)
+}
+
+func (self *ReplicationClient) LoadLock() error {
+    self.aof.AppendLock(self.aof_lock)
+
+    if self.aof_lock.ExpriedFlag & 0x4000 == 0 {
+        if int64(self.aof_lock.CommandTime + uint64(self.aof_lock.GetExpriedTime())) <= time.Now().Unix() {
+            if self.aof_lock.CommandType == protocol.COMMAND_LOCK {
+                self.slock.GetOrNewDB(self.aof_lock.DbId).UpdateFencingToken(self.aof_lock.Token)
+            }
+            return nil
+        }
+    }
+    return self.aof.LoadLock(self.aof_lock)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+    "fmt"
+    "github.com/snower/slock/protocol"
+    "io/ioutil"
+    "net"
+    "os"
+    "sync"
+    "testing"
+    "time"
+)
+
+func newTestReplicationLeader(t *testing.T) (*SLock, *Server, string, string) {
+    slock, data_dir := newTestAofSLock(t, "memory")
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        slock.Close()
+        os.RemoveAll(data_dir)
+        t.Fatalf("Replication Test Listen Error %v", err)
+    }
+
+    server := NewServer(slock)
+    server.server = listener
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            stream := NewStream(server, conn)
+            server.AddStream(stream)
+            go server.Handle(stream)
+        }
+    }()
+    return slock, server, listener.Addr().String(), data_dir
+}
+
+func newTestReplicationFollower(t *testing.T, leader_address string) (*SLock, string) {
+    data_dir, err := ioutil.TempDir("", "slock_replication_test")
+    if err != nil {
+        t.Fatalf("Replication Test Create Data Dir Error %v", err)
+    }
+
+    config := *Config
+    config.DataDir = data_dir
+    config.SlaveOf = leader_address
+    slock := NewSLock(&config)
+    err = slock.Init()
+    if err != nil {
+        os.RemoveAll(data_dir)
+        t.Fatalf("Replication Test Follower Init Error %v", err)
+    }
+
+    for i := 0; i < 500 && slock.state != STATE_FOLLOWER; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if slock.state != STATE_FOLLOWER {
+        slock.Close()
+        os.RemoveAll(data_dir)
+        t.Fatalf("Replication Test Follower Sync Timeout")
+    }
+    return slock, data_dir
+}
+
+func getTestLockedCount(slock *SLock, lock_key [16]byte) uint32 {
+    db := slock.dbs[0]
+    if db == nil {
+        return 0
+    }
+
+    lock_manager := db.GetLockManager(&protocol.LockCommand{LockKey: lock_key})
+    if lock_manager == nil {
+        return 0
+    }
+
+    lock_manager.glock.Lock()
+    defer lock_manager.glock.Unlock()
+    if lock_manager.lock_key != lock_key {
+        return 0
+    }
+    return lock_manager.locked
+}
+
+func waitTestLockedCount(follower *SLock, lock_key [16]byte, locked_count uint32) bool {
+    for i := 0; i < 500; i++ {
+        if getTestLockedCount(follower, lock_key) == locked_count {
+            return true
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return false
+}
+
+func TestReplication_Sync(t *testing.T) {
+    leader, server, leader_address, leader_data_dir := newTestReplicationLeader(t)
+    defer os.RemoveAll(leader_data_dir)
+    defer server.Close()
+
+    lock_key, lock_id := [16]byte{}, [16]byte{}
+    copy(lock_key[:], "replication_sync")
+    copy(lock_id[:], "replication_id")
+    result := doTestAofRcountLockCommand(leader, protocol.COMMAND_LOCK, lock_key, lock_id, 3)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Replication Sync Lock Error %v", result)
+        return
+    }
+    result = doTestAofRcountLockCommand(leader, protocol.COMMAND_LOCK, lock_key, lock_id, 3)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Replication Sync Relock Error %v", result)
+        return
+    }
+
+    follower, follower_data_dir := newTestReplicationFollower(t, leader_address)
+    defer os.RemoveAll(follower_data_dir)
+    defer follower.Close()
+
+    if !waitTestLockedCount(follower, lock_key, 2) {
+        t.Errorf("Replication Sync Snapshot Lock Error %d", getTestLockedCount(follower, lock_key))
+        return
+    }
+
+    stream_lock_key := [16]byte{}
+    copy(stream_lock_key[:], "replication_strm")
+    result = doTestAofLockCommand(leader, protocol.COMMAND_LOCK, stream_lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Replication Stream Lock Error %v", result)
+        return
+    }
+    result = doTestAofLockCommand(leader, protocol.COMMAND_UNLOCK, lock_key, lock_id)
+    if result == nil || result.Result != protocol.RESULT_SUCCED {
+        t.Errorf("Replication Stream Unlock Error %v", result)
+        return
+    }
+
+    if !waitTestLockedCount(follower, stream_lock_key, 1) || !waitTestLockedCount(follower, lock_key, 0) {
+        t.Errorf("Replication Stream Lock State Error %d %d", getTestLockedCount(follower, stream_lock_key), getTestLockedCount(follower, lock_key))
+        return
+    }
+
+    leader_token := leader.dbs[0].GetLockManager(&protocol.LockCommand{LockKey: stream_lock_key}).current_lock.fencing_token
+    follower_token := follower.dbs[0].GetLockManager(&protocol.LockCommand{LockKey: stream_lock_key}).current_lock.fencing_token
+    if leader_token != follower_token {
+        t.Errorf("Replication Stream Fencing Token Error %d %d", leader_token, follower_token)
+    }
+}
+
+func TestReplication_SnapshotConcurrentLocks(t *testing.T) {
+    leader, server, leader_address, leader_data_dir := newTestReplicationLeader(t)
+    defer os.RemoveAll(leader_data_dir)
+    defer server.Close()
+
+    lock_keys := make([][16]byte, 16)
+    for i := range lock_keys {
+        copy(lock_keys[i][:], fmt.Sprintf("replication_%d", i))
+    }
+
+    lock_id := [16]byte{}
+    copy(lock_id[:], "replication_id")
+    stoped := make(chan bool)
+    var wait_group sync.WaitGroup
+    for i := range lock_keys {
+        wait_group.Add(1)
+        go func(lock_key [16]byte) {
+            defer wait_group.Done()
+            for j := 0; ; j++ {
+                select {
+                case <- stoped:
+                    return
+                default:
+                }
+
+                if j % 4 == 3 {
+                    doTestAofLockCommand(leader, protocol.COMMAND_UNLOCK, lock_key, lock_id)
+                } else {
+                    doTestAofRcountLockCommand(leader, protocol.COMMAND_LOCK, lock_key, lock_id, 0xff)
+                }
+            }
+        }(lock_keys[i])
+    }
+
+    time.Sleep(50 * time.Millisecond)
+    follower, follower_data_dir := newTestReplicationFollower(t, leader_address)
+    defer os.RemoveAll(follower_data_dir)
+    defer follower.Close()
+    time.Sleep(50 * time.Millisecond)
+    close(stoped)
+    wait_group.Wait()
+
+    for i, lock_key := range lock_keys {
+        locked_count := getTestLockedCount(leader, lock_key)
+        if !waitTestLockedCount(follower, lock_key, locked_count) {
+            t.Errorf("Replication Snapshot Concurrent Lock State Error %d %d %d", i, locked_count, getTestLockedCount(follower, lock_key))
+            return
+        }
+    }
+}
@@ -12,6 +12,7 @@ const (
     STATE_LEADER
     STATE_FOLLOWER
     STATE_SYNC
+    STATE_CANDIDATE
 )
 
 type SLock struct {
@@ -19,6 +20,8 @@ type SLock struct {
     glock                       *sync.Mutex
     aof                         *Aof
     admin                       *Admin
+    replication_client          *ReplicationClient
+    raft                        *Raft
     logger                      logging.Logger
     streams                     map[[16]byte]ServerProtocol
     uptime                      *time.Time
@@ -26,6 +29,7 @@ type SLock struct {
     free_lock_command_lock      *sync.Mutex
     free_lock_command_count     int32
     stats_total_command_count   uint64
+    multi_lock_protocol         *MemWaiterServerProtocol
     state                       uint8
 }
 
@@ -36,15 +40,24 @@ func NewSLock(config *ServerConfig) *SLock {
     admin := NewAdmin()
     now := time.Now()
     logger := InitLogger(Config.Log, Config.LogLevel)
-    slock := &SLock{make([]*LockDB, 256), &sync.Mutex{}, aof,admin, logger, make(map[[16]byte]ServerProtocol, STREAMS_INIT_COUNT),
+    slock := &SLock{make([]*LockDB, 256), &sync.Mutex{}, aof,admin, nil, nil, logger, make(map[[16]byte]ServerProtocol, STREAMS_INIT_COUNT),
         &now,NewLockCommandQueue(16, 64, FREE_COMMAND_QUEUE_INIT_SIZE * 16), &sync.Mutex{}, 0,
-        0, STATE_INIT}
+        0, nil, STATE_INIT}
     aof.slock = slock
     admin.slock = slock
+    slock.multi_lock_protocol = NewMemWaiterServerProtocol(slock)
     return slock
 }
 
 func (self *SLock) Init() error {
+    if Config.Cluster != "" {
+        return self.InitCluster()
+    }
+
+    if Config.SlaveOf != "" {
+        return self.InitFollower(Config.SlaveOf)
+    }
+
     err := self.aof.LoadAndInit()
     if err != nil {
         self.logger.Errorf("Aof LoadOrInit Error: %v", err)
@@ -54,7 +67,52 @@ func (self *SLock) Init() error {
     return nil
 }
 
+func (self *SLock) InitFollower(leader_address string) error {
+    err := self.aof.Init()
+    if err != nil {
+        self.logger.Errorf("Aof Init Error: %v", err)
+        return err
+    }
+
+    self.UpdateState(STATE_SYNC)
+    self.replication_client = NewReplicationClient(self, leader_address)
+    go self.replication_client.Run()
+    self.logger.Infof("Replication Follower Of %s", leader_address)
+    return nil
+}
+
+func (self *SLock) InitCluster() error {
+    err := self.aof.Init()
+    if err != nil {
+        self.logger.Errorf("Aof Init Error: %v", err)
+        return err
+    }
+
+    raft, err := NewRaft(self)
+    if err != nil {
+        self.logger.Errorf("Raft Init Error: %v", err)
+        return err
+    }
+
+    self.raft = raft
+    err = raft.Init()
+    if err != nil {
+        self.raft = nil
+        self.logger.Errorf("Raft Init Error: %v", err)
+        return err
+    }
+    return nil
+}
+
 func (self *SLock) Close()  {
+    if self.raft != nil {
+        self.raft.Close()
+    }
+
+    if self.replication_client != nil {
+        self.replication_client.Close()
+    }
+
     defer self.glock.Unlock()
     self.glock.Lock()
 
@@ -98,13 +156,65 @@ func (self *SLock) GetDB(db_id uint8) *LockDB {
 }
 
 func (self *SLock) DoLockComamnd(db *LockDB, server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    command.Expried, command.ExpriedFlag = protocol.ResolveExpriedDeadline(command.Expried, command.ExpriedFlag, db.current_time)
+    if self.raft != nil {
+        return self.raft.Propose(server_protocol, command)
+    }
     return db.Lock(server_protocol, command)
 }
 
 func (self *SLock) DoUnLockComamnd(db *LockDB, server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    if self.raft != nil {
+        return self.raft.Propose(server_protocol, command)
+    }
     return db.UnLock(server_protocol, command)
 }
 
+func (self *SLock) DoRenewComamnd(db *LockDB, server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    command.Expried, command.ExpriedFlag = protocol.ResolveExpriedDeadline(command.Expried, command.ExpriedFlag, db.current_time)
+    if self.raft != nil {
+        return self.raft.Propose(server_protocol, command)
+    }
+    return db.Renew(server_protocol, command)
+}
+
+func (self *SLock) DoCancelComamnd(db *LockDB, server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    if self.raft != nil {
+        // followers apply cancels with their raft protocol, so the session is checked here before it reaches the log
+        if !db.HasWaitLock(server_protocol, command) {
+            server_protocol.ProcessLockResultCommand(command, protocol.RESULT_UNOWN_ERROR, 0, 0, 0)
+            return server_protocol.FreeLockCommand(command)
+        }
+        return self.raft.Propose(server_protocol, command)
+    }
+    return db.Cancel(server_protocol, command)
+}
+
+func (self *SLock) DoMultiLockComamnd(db *LockDB, command *protocol.MultiLockCommand) (uint8, [16]byte, []uint64) {
+    // the raft log carries single key commands only, cluster nodes leave CAPABILITY_MULTI_LOCK out so clients never send it
+    if self.raft != nil {
+        return protocol.RESULT_UNKNOWN_COMMAND, [16]byte{}, nil
+    }
+
+    if command.CommandType == protocol.COMMAND_MULTI_UNLOCK {
+        result, lock_key := db.MultiUnLock(self.multi_lock_protocol, command)
+        return result, lock_key, nil
+    }
+
+    command.Expried, command.ExpriedFlag = protocol.ResolveExpriedDeadline(command.Expried, command.ExpriedFlag, db.current_time)
+    return db.MultiLock(self.multi_lock_protocol, command)
+}
+
+func (self *SLock) GetCapabilities() uint32 {
+    capabilities := protocol.CAPABILITY_MILLISECOND_TIME | protocol.CAPABILITY_UNLIMITED_EXPRIED | protocol.CAPABILITY_LOCK_NAME | protocol.CAPABILITY_FENCING_TOKEN |
+        protocol.CAPABILITY_RENEW | protocol.CAPABILITY_PRIORITY | protocol.CAPABILITY_EXTENDED_TIME | protocol.CAPABILITY_QUERY |
+        protocol.CAPABILITY_ADMIN | protocol.CAPABILITY_CANCEL
+    if self.raft == nil {
+        capabilities |= protocol.CAPABILITY_MULTI_LOCK
+    }
+    return capabilities
+}
+
 func (self *SLock) GetState(server_protocol ServerProtocol, command *protocol.StateCommand) error {
     db_state := uint8(0)
 
@@ -119,6 +229,14 @@ func (self *SLock) GetState(server_protocol ServerProtocol, command *protocol.St
     return server_protocol.Write(protocol.NewStateResultCommand(command, protocol.RESULT_SUCCED, 0, db_state, db.GetState()))
 }
 
+func (self *SLock) GetQuery(server_protocol ServerProtocol, command *protocol.LockCommand) error {
+    db := self.dbs[command.DbId]
+    if db == nil {
+        return server_protocol.Write(protocol.NewQueryResultCommand(command, protocol.RESULT_SUCCED, 0, [16]byte{}, 0, 0, 0, 0, 0, 0, 0))
+    }
+    return server_protocol.Write(db.Query(command))
+}
+
 func (self *SLock) Log() logging.Logger {
     return self.logger
 }